@@ -2,16 +2,20 @@ package downloader
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/zyxar/argo/rpc"
 )
 
 type Aria2Client struct {
-	client rpc.Client
-	secret string
+	client   rpc.Client
+	secret   string
+	notifier *Aria2Notifier
 }
 
 func NewAria2Client(rpcURL, secret string) (*Aria2Client, error) {
@@ -20,12 +24,31 @@ func NewAria2Client(rpcURL, secret string) (*Aria2Client, error) {
 		return nil, fmt.Errorf("failed to create aria2 client: %w", err)
 	}
 
+	notifier, err := NewAria2Notifier(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aria2 notifier: %w", err)
+	}
+
 	return &Aria2Client{
-		client: client,
-		secret: secret,
+		client:   client,
+		secret:   secret,
+		notifier: notifier,
 	}, nil
 }
 
+// StartNotifications 在后台订阅 aria2 WebSocket 通知
+func (a *Aria2Client) StartNotifications(ctx context.Context) {
+	go a.notifier.Run(ctx)
+}
+
+func (a *Aria2Client) Events() <-chan Event {
+	return a.notifier.Events()
+}
+
+func (a *Aria2Client) Connected() bool {
+	return a.notifier.Connected()
+}
+
 func (a *Aria2Client) AddURI(ctx context.Context, uris []string, options map[string]interface{}) (string, error) {
 	fmt.Printf("[Aria2] AddURI called with URIs: %v, Options: %+v\n", uris, options)
 	gid, err := a.client.AddURI(uris, options)
@@ -37,6 +60,38 @@ func (a *Aria2Client) AddURI(ctx context.Context, uris []string, options map[str
 	return gid, nil
 }
 
+// AddTorrent 提交种子文件内容，argo 只接受文件路径，因此先写入临时文件
+func (a *Aria2Client) AddTorrent(ctx context.Context, data []byte, options map[string]interface{}) (string, error) {
+	path, err := writeTempFile("mynest-*.torrent", data)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path)
+
+	gid, err := a.client.AddTorrent(path, options)
+	if err != nil {
+		return "", fmt.Errorf("failed to add torrent: %w", err)
+	}
+	log.Printf("[Aria2] Successfully added torrent, GID: %s", gid)
+	return gid, nil
+}
+
+// AddMetalink 提交 metalink 文件内容，metalink 中的每个文件对应一个 GID
+func (a *Aria2Client) AddMetalink(ctx context.Context, data []byte, options map[string]interface{}) ([]string, error) {
+	path, err := writeTempFile("mynest-*.metalink", data)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	gids, err := a.client.AddMetalink(path, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add metalink: %w", err)
+	}
+	log.Printf("[Aria2] Successfully added metalink, GIDs: %v", gids)
+	return gids, nil
+}
+
 func (a *Aria2Client) TellStatus(ctx context.Context, gid string) (*Status, error) {
 	info, err := a.client.TellStatus(gid)
 	if err != nil {
@@ -44,39 +99,87 @@ func (a *Aria2Client) TellStatus(ctx context.Context, gid string) (*Status, erro
 		return nil, fmt.Errorf("failed to get status: %w", err)
 	}
 
-	totalLen, _ := strconv.ParseInt(info.TotalLength, 10, 64)
-	completedLen, _ := strconv.ParseInt(info.CompletedLength, 10, 64)
-	downloadSpeed, _ := strconv.ParseInt(info.DownloadSpeed, 10, 64)
-
-	status := &Status{
-		GID:             info.Gid,
-		Status:          info.Status,
-		TotalLength:     totalLen,
-		CompletedLength: completedLen,
-		DownloadSpeed:   downloadSpeed,
-		ErrorMessage:    info.ErrorMessage,
-		Files:           make([]File, len(info.Files)),
-		FollowedBy:      info.FollowedBy,
-	}
+	status := toStatus(info)
 
 	// 详细状态日志
 	if info.Status == "error" || info.Status == "removed" {
 		log.Printf("[Aria2] ❌ 任务失败 - GID: %s, Status: %s, ErrorMessage: %s, TotalLength: %d",
-			gid, info.Status, info.ErrorMessage, totalLen)
+			gid, info.Status, info.ErrorMessage, status.TotalLength)
 	} else {
 		log.Printf("[Aria2] 📊 任务状态 - GID: %s, Status: %s, Progress: %d/%d bytes, Speed: %d B/s",
-			gid, info.Status, completedLen, totalLen, downloadSpeed)
+			gid, info.Status, status.CompletedLength, status.TotalLength, status.DownloadSpeed)
 	}
 
-	for i, f := range info.Files {
-		length, _ := strconv.ParseInt(f.Length, 10, 64)
-		status.Files[i] = File{
-			Path:   f.Path,
-			Length: length,
+	return status, nil
+}
+
+// statusKeys 批量查询时只请求同步需要的字段，减少响应体积
+var statusKeys = []string{
+	"gid", "status", "totalLength", "completedLength", "downloadSpeed",
+	"errorCode", "errorMessage", "files", "followedBy",
+}
+
+func (a *Aria2Client) TellActive(ctx context.Context) ([]*Status, error) {
+	infos, err := a.client.TellActive(statusKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tell active: %w", err)
+	}
+	return toStatuses(infos), nil
+}
+
+func (a *Aria2Client) TellWaiting(ctx context.Context, offset, num int) ([]*Status, error) {
+	infos, err := a.client.TellWaiting(offset, num, statusKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tell waiting: %w", err)
+	}
+	return toStatuses(infos), nil
+}
+
+func (a *Aria2Client) TellStopped(ctx context.Context, offset, num int) ([]*Status, error) {
+	infos, err := a.client.TellStopped(offset, num, statusKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tell stopped: %w", err)
+	}
+	return toStatuses(infos), nil
+}
+
+// TellStatusBatch 通过 system.multicall 在一次请求中查询多个任务的状态
+// aria2 中不存在的 GID 不会出现在返回结果中
+func (a *Aria2Client) TellStatusBatch(ctx context.Context, gids []string) (map[string]*Status, error) {
+	result := make(map[string]*Status, len(gids))
+	if len(gids) == 0 {
+		return result, nil
+	}
+
+	methods := make([]rpc.Method, 0, len(gids))
+	for _, gid := range gids {
+		params := make([]interface{}, 0, 3)
+		if a.secret != "" {
+			params = append(params, "token:"+a.secret)
 		}
+		params = append(params, gid, statusKeys)
+		methods = append(methods, rpc.Method{Name: "aria2.tellStatus", Params: params})
 	}
 
-	return status, nil
+	replies, err := a.client.Multicall(methods)
+	if err != nil {
+		return nil, fmt.Errorf("failed to multicall tell status: %w", err)
+	}
+
+	for _, reply := range replies {
+		// 成功的调用返回单元素数组，失败的调用返回 fault 结构体
+		raw, err := json.Marshal(reply)
+		if err != nil {
+			continue
+		}
+		var infos []rpc.StatusInfo
+		if err := json.Unmarshal(raw, &infos); err != nil || len(infos) == 0 {
+			continue
+		}
+		result[infos[0].Gid] = toStatus(infos[0])
+	}
+
+	return result, nil
 }
 
 func (a *Aria2Client) Remove(ctx context.Context, gid string) error {
@@ -87,6 +190,14 @@ func (a *Aria2Client) Remove(ctx context.Context, gid string) error {
 	return nil
 }
 
+func (a *Aria2Client) RemoveDownloadResult(ctx context.Context, gid string) error {
+	_, err := a.client.RemoveDownloadResult(gid)
+	if err != nil {
+		return fmt.Errorf("failed to remove download result: %w", err)
+	}
+	return nil
+}
+
 func (a *Aria2Client) Pause(ctx context.Context, gid string) error {
 	_, err := a.client.Pause(gid)
 	if err != nil {
@@ -103,6 +214,21 @@ func (a *Aria2Client) Unpause(ctx context.Context, gid string) error {
 	return nil
 }
 
+func (a *Aria2Client) SelectFiles(ctx context.Context, gid string, indexes []int) error {
+	selected := make([]string, len(indexes))
+	for i, index := range indexes {
+		selected[i] = strconv.Itoa(index)
+	}
+
+	if _, err := a.client.ChangeOption(gid, rpc.Option{"select-file": strings.Join(selected, ",")}); err != nil {
+		return fmt.Errorf("failed to select files: %w", err)
+	}
+	if _, err := a.client.Unpause(gid); err != nil {
+		return fmt.Errorf("failed to unpause download: %w", err)
+	}
+	return nil
+}
+
 func (a *Aria2Client) GetVersion(ctx context.Context) (map[string]interface{}, error) {
 	version, err := a.client.GetVersion()
 	if err != nil {
@@ -123,6 +249,66 @@ func (a *Aria2Client) GetGlobalOption(ctx context.Context) (map[string]interface
 	return options, nil
 }
 
+func (a *Aria2Client) ChangeGlobalOption(ctx context.Context, options map[string]interface{}) error {
+	if _, err := a.client.ChangeGlobalOption(rpc.Option(options)); err != nil {
+		return fmt.Errorf("failed to change global option: %w", err)
+	}
+	return nil
+}
+
 func (a *Aria2Client) Close() error {
 	return a.client.Close()
-}
\ No newline at end of file
+}
+
+func writeTempFile(pattern string, data []byte) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temp file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+func toStatus(info rpc.StatusInfo) *Status {
+	totalLen, _ := strconv.ParseInt(info.TotalLength, 10, 64)
+	completedLen, _ := strconv.ParseInt(info.CompletedLength, 10, 64)
+	downloadSpeed, _ := strconv.ParseInt(info.DownloadSpeed, 10, 64)
+
+	status := &Status{
+		GID:             info.Gid,
+		Status:          info.Status,
+		TotalLength:     totalLen,
+		CompletedLength: completedLen,
+		DownloadSpeed:   downloadSpeed,
+		ErrorCode:       info.ErrorCode,
+		ErrorMessage:    info.ErrorMessage,
+		Files:           make([]File, len(info.Files)),
+		FollowedBy:      info.FollowedBy,
+	}
+
+	for i, f := range info.Files {
+		index, _ := strconv.Atoi(f.Index)
+		length, _ := strconv.ParseInt(f.Length, 10, 64)
+		status.Files[i] = File{
+			Index:    index,
+			Path:     f.Path,
+			Length:   length,
+			Selected: f.Selected != "false",
+		}
+	}
+
+	return status
+}
+
+func toStatuses(infos []rpc.StatusInfo) []*Status {
+	statuses := make([]*Status, 0, len(infos))
+	for _, info := range infos {
+		statuses = append(statuses, toStatus(info))
+	}
+	return statuses
+}
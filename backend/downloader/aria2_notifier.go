@@ -0,0 +1,150 @@
+package downloader
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// aria2 通知方法名到事件类型的映射
+var aria2NotificationEvents = map[string]EventType{
+	"aria2.onDownloadStart":      EventStart,
+	"aria2.onDownloadPause":      EventPause,
+	"aria2.onDownloadStop":       EventStop,
+	"aria2.onDownloadComplete":   EventComplete,
+	"aria2.onDownloadError":      EventError,
+	"aria2.onBtDownloadComplete": EventBtComplete,
+}
+
+// Aria2Notifier 通过 WebSocket 订阅 aria2 的下载事件通知
+// 连接断开后会自动重连，断开期间 Connected() 返回 false
+type Aria2Notifier struct {
+	wsURL     string
+	events    chan Event
+	connected atomic.Bool
+}
+
+// NewAria2Notifier 根据 RPC 地址创建通知订阅器
+// http(s)://host:6800/jsonrpc 会被转换为 ws(s)://host:6800/jsonrpc
+func NewAria2Notifier(rpcURL string) (*Aria2Notifier, error) {
+	u, err := url.Parse(rpcURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	}
+
+	return &Aria2Notifier{
+		wsURL:  u.String(),
+		events: make(chan Event, 256),
+	}, nil
+}
+
+// Events 返回事件通道
+func (n *Aria2Notifier) Events() <-chan Event {
+	return n.events
+}
+
+// Connected 返回通知通道当前是否可用
+func (n *Aria2Notifier) Connected() bool {
+	return n.connected.Load()
+}
+
+// Run 持续订阅通知，直到 ctx 被取消
+func (n *Aria2Notifier) Run(ctx context.Context) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		connected, err := n.listen(ctx, attempt > 0)
+		n.connected.Store(false)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		// 连接成功过说明 aria2 可用，断开后从最短的间隔重新开始
+		if connected {
+			backoff = time.Second
+		}
+		log.Printf("[Aria2] ⚠️  通知通道断开: %v，%s 后重连", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// listen 订阅一次通知直到连接断开，返回是否连接成功过；reconnect 为 true 时连接后推送 EventReconnect
+func (n *Aria2Notifier) listen(ctx context.Context, reconnect bool) (bool, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.DialContext(ctx, n.wsURL, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// ctx 取消时关闭连接，使 ReadJSON 立即返回
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	n.connected.Store(true)
+	log.Printf("[Aria2] ✅ 已订阅通知: %s", n.wsURL)
+	if reconnect {
+		// 断开期间的通知已丢失，让订阅方立即对账
+		n.emit(Event{Type: EventReconnect})
+	}
+
+	for {
+		var msg struct {
+			Method string `json:"method"`
+			Params []struct {
+				GID string `json:"gid"`
+			} `json:"params"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return true, err
+		}
+
+		eventType, ok := aria2NotificationEvents[msg.Method]
+		if !ok {
+			continue
+		}
+
+		for _, p := range msg.Params {
+			n.emit(Event{GID: p.GID, Type: eventType})
+		}
+	}
+}
+
+// emit 推送事件，通道已满时丢弃事件，由定时对账兜底
+func (n *Aria2Notifier) emit(ev Event) {
+	select {
+	case n.events <- ev:
+	default:
+		log.Printf("[Aria2] ⚠️  事件通道已满，丢弃事件: %s %s", ev.Type, ev.GID)
+	}
+}
@@ -0,0 +1,61 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAria2NotifierReconnect(t *testing.T) {
+	var connections atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if connections.Add(1) == 1 {
+			// 第一个连接推送一条通知后断开
+			conn.WriteJSON(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"method":  "aria2.onDownloadStart",
+				"params":  []map[string]string{{"gid": "2089b05ecca3d829"}},
+			})
+			return
+		}
+		conn.ReadMessage() // 保持连接直到客户端关闭
+	}))
+	defer server.Close()
+
+	notifier, err := NewAria2Notifier(server.URL + "/jsonrpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+
+	want := []Event{
+		{GID: "2089b05ecca3d829", Type: EventStart},
+		{Type: EventReconnect}, // 重新连接后通知订阅方对账
+	}
+	for _, w := range want {
+		select {
+		case ev := <-notifier.Events():
+			if ev != w {
+				t.Fatalf("event = %+v, want %+v", ev, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %+v", w)
+		}
+	}
+	if !notifier.Connected() {
+		t.Error("notifier not connected after reconnect")
+	}
+}
@@ -1,6 +1,9 @@
 package downloader
 
-import "context"
+import (
+	"context"
+	"errors"
+)
 
 type Status struct {
 	GID             string
@@ -8,22 +11,69 @@ type Status struct {
 	TotalLength     int64
 	CompletedLength int64
 	DownloadSpeed   int64
+	ErrorCode       string // aria2 退出状态码，见 error_code.go
 	ErrorMessage    string
 	Files           []File
 	FollowedBy      []string // 后续任务的 GID（magnet 链接元数据下载完成后的实际下载任务）
 }
 
 type File struct {
-	Path   string
-	Length int64
+	Index    int // 从 1 开始，与 aria2 select-file 一致
+	Path     string
+	Length   int64
+	Selected bool
 }
 
 type Downloader interface {
 	AddURI(ctx context.Context, uris []string, options map[string]interface{}) (gid string, err error)
+	// AddTorrent/AddMetalink 以文件内容提交种子或 metalink，不支持的引擎返回 ErrUnsupported
+	AddTorrent(ctx context.Context, data []byte, options map[string]interface{}) (gid string, err error)
+	AddMetalink(ctx context.Context, data []byte, options map[string]interface{}) (gids []string, err error)
 	TellStatus(ctx context.Context, gid string) (*Status, error)
+	// TellActive/TellWaiting/TellStopped 批量列出各队列中的任务，用于对账
+	TellActive(ctx context.Context) ([]*Status, error)
+	TellWaiting(ctx context.Context, offset, num int) ([]*Status, error)
+	TellStopped(ctx context.Context, offset, num int) ([]*Status, error)
+	// TellStatusBatch 一次性查询多个 GID 的状态，不存在的 GID 不出现在结果中
+	TellStatusBatch(ctx context.Context, gids []string) (map[string]*Status, error)
 	Remove(ctx context.Context, gid string) error
+	// RemoveDownloadResult 从已结束的任务列表中清除任务，任务未结束时返回错误
+	RemoveDownloadResult(ctx context.Context, gid string) error
 	Pause(ctx context.Context, gid string) error
 	Unpause(ctx context.Context, gid string) error
+	// SelectFiles 只下载指定序号（从 1 开始）的文件并恢复暂停的任务
+	SelectFiles(ctx context.Context, gid string, indexes []int) error
 	GetVersion(ctx context.Context) (map[string]interface{}, error)
 	GetGlobalOption(ctx context.Context) (map[string]interface{}, error)
-}
\ No newline at end of file
+	// ChangeGlobalOption 动态修改全局选项（如 max-overall-download-limit）
+	ChangeGlobalOption(ctx context.Context, options map[string]interface{}) error
+}
+
+// ErrUnsupported 引擎不支持该操作
+var ErrUnsupported = errors.New("下载引擎不支持该操作")
+
+// EventType 下载事件类型
+type EventType string
+
+const (
+	EventStart      EventType = "start"
+	EventPause      EventType = "pause"
+	EventStop       EventType = "stop"
+	EventComplete   EventType = "complete"
+	EventError      EventType = "error"
+	EventBtComplete EventType = "bt_complete" // BT 下载完成但仍在做种
+	EventReconnect  EventType = "reconnect"   // 推送通道断开后重新连接，断开期间的事件已丢失，GID 为空
+)
+
+// Event 下载器推送的任务状态变化事件
+type Event struct {
+	GID  string
+	Type EventType
+}
+
+// Notifier 由支持事件推送的下载器实现
+type Notifier interface {
+	Events() <-chan Event
+	// Connected 返回推送通道当前是否可用，不可用时调用方应回退到轮询
+	Connected() bool
+}
@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// aria2 退出状态码（errorCode），内置引擎也按同样的含义上报
+// 参见 https://aria2.github.io/manual/en/html/aria2c.html#exit-status
+const (
+	ErrCodeUnknown            = "1"
+	ErrCodeTimeout            = "2"
+	ErrCodeNotFound           = "3"
+	ErrCodeTooManyNotFound    = "4"
+	ErrCodeTooSlow            = "5"
+	ErrCodeNetwork            = "6"
+	ErrCodeUnfinished         = "7"
+	ErrCodeDiskFull           = "9"
+	ErrCodeFileExists         = "13"
+	ErrCodeOpenFile           = "15"
+	ErrCodeCreateFile         = "16"
+	ErrCodeFileIO             = "17"
+	ErrCodeCreateDir          = "18"
+	ErrCodeNameResolution     = "19"
+	ErrCodeBadResponse        = "22"
+	ErrCodeTooManyRedirects   = "23"
+	ErrCodeAuthFailed         = "24"
+	ErrCodeServerOverloaded   = "29"
+	ErrCodeChecksumMismatched = "32"
+)
+
+// transientErrorCodes 网络波动、服务端 5xx、超时等稍后重试可能成功的错误
+// 校验失败说明下载的内容与期望不符，重新下载同一地址通常得到同样的结果，不在其中
+var transientErrorCodes = map[string]bool{
+	ErrCodeTimeout:          true,
+	ErrCodeTooSlow:          true,
+	ErrCodeNetwork:          true,
+	ErrCodeUnfinished:       true,
+	ErrCodeNameResolution:   true,
+	ErrCodeBadResponse:      true,
+	ErrCodeServerOverloaded: true,
+}
+
+// IsTransientError 判断错误码是否为临时性错误；404、磁盘已满、认证失败、文件读写、校验失败等为永久性错误
+// 未知错误（错误码 1 或未上报错误码）无法判断，不视为临时性错误，由调用方决定是否重试
+func IsTransientError(code string) bool {
+	return transientErrorCodes[code]
+}
+
+// IsUnknownError 判断错误码是否为未知错误
+func IsUnknownError(code string) bool {
+	return code == "" || code == ErrCodeUnknown
+}
+
+// httpStatusError 服务器返回非 2xx 状态码
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e httpStatusError) Error() string { return "unexpected HTTP status: " + e.status }
+
+// errorCodeOf 将内置引擎的错误映射为 aria2 错误码
+func errorCodeOf(err error) string {
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.code == http.StatusNotFound || statusErr.code == http.StatusGone:
+			return ErrCodeNotFound
+		case statusErr.code == http.StatusUnauthorized || statusErr.code == http.StatusForbidden ||
+			statusErr.code == http.StatusProxyAuthRequired:
+			return ErrCodeAuthFailed
+		case statusErr.code == http.StatusRequestTimeout:
+			return ErrCodeTimeout
+		case statusErr.code == http.StatusTooManyRequests || statusErr.code == http.StatusServiceUnavailable:
+			return ErrCodeServerOverloaded
+		case statusErr.code >= 500:
+			return ErrCodeBadResponse
+		}
+		// 其他 4xx 说明请求本身不被接受，重试同一请求不会成功，按资源不可用处理
+		return ErrCodeNotFound
+	}
+
+	if errors.Is(err, syscall.ENOSPC) {
+		return ErrCodeDiskFull
+	}
+	if errors.Is(err, errFileExists) {
+		return ErrCodeFileExists
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		switch pathErr.Op {
+		case "mkdir":
+			return ErrCodeCreateDir
+		case "open":
+			return ErrCodeCreateFile
+		case "truncate":
+			return ErrCodeCreateFile
+		}
+		return ErrCodeFileIO
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrCodeNameResolution
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return ErrCodeTimeout
+	}
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrCodeNetwork
+	}
+	return ErrCodeUnknown
+}
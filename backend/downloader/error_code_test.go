@@ -0,0 +1,90 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func statusError(code int) error {
+	return httpStatusError{code: code, status: fmt.Sprintf("%d %s", code, http.StatusText(code))}
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		want      string
+		transient bool
+	}{
+		{"404", statusError(http.StatusNotFound), ErrCodeNotFound, false},
+		{"410", statusError(http.StatusGone), ErrCodeNotFound, false},
+		{"400", statusError(http.StatusBadRequest), ErrCodeNotFound, false},
+		{"405", statusError(http.StatusMethodNotAllowed), ErrCodeNotFound, false},
+		{"416", statusError(http.StatusRequestedRangeNotSatisfiable), ErrCodeNotFound, false},
+		{"401", statusError(http.StatusUnauthorized), ErrCodeAuthFailed, false},
+		{"403", statusError(http.StatusForbidden), ErrCodeAuthFailed, false},
+		{"407", statusError(http.StatusProxyAuthRequired), ErrCodeAuthFailed, false},
+		{"408", statusError(http.StatusRequestTimeout), ErrCodeTimeout, true},
+		{"429", statusError(http.StatusTooManyRequests), ErrCodeServerOverloaded, true},
+		{"503", statusError(http.StatusServiceUnavailable), ErrCodeServerOverloaded, true},
+		{"500", statusError(http.StatusInternalServerError), ErrCodeBadResponse, true},
+		{"502", statusError(http.StatusBadGateway), ErrCodeBadResponse, true},
+		{"permanent 404", permanentError{statusError(http.StatusNotFound)}, ErrCodeNotFound, false},
+		{"wrapped 500", fmt.Errorf("segment 3: %w", statusError(http.StatusInternalServerError)), ErrCodeBadResponse, true},
+		{"disk full", &os.PathError{Op: "write", Path: "/tmp/a", Err: syscall.ENOSPC}, ErrCodeDiskFull, false},
+		{"file exists", fmt.Errorf("out: %w", errFileExists), ErrCodeFileExists, false},
+		{"mkdir", &os.PathError{Op: "mkdir", Path: "/tmp/a", Err: syscall.EACCES}, ErrCodeCreateDir, false},
+		{"open", &os.PathError{Op: "open", Path: "/tmp/a", Err: syscall.EACCES}, ErrCodeCreateFile, false},
+		{"write", &os.PathError{Op: "write", Path: "/tmp/a", Err: syscall.EIO}, ErrCodeFileIO, false},
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid"}, ErrCodeNameResolution, true},
+		{"deadline", context.DeadlineExceeded, ErrCodeTimeout, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, ErrCodeNetwork, true},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ErrCodeNetwork, true},
+		{"unknown", errors.New("something went wrong"), ErrCodeUnknown, false},
+	}
+	for _, tt := range tests {
+		got := errorCodeOf(tt.err)
+		if got != tt.want {
+			t.Errorf("%s: errorCodeOf = %s, want %s", tt.name, got, tt.want)
+		}
+		if transient := IsTransientError(got); transient != tt.transient {
+			t.Errorf("%s: IsTransientError(%s) = %v, want %v", tt.name, got, transient, tt.transient)
+		}
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{ErrCodeTimeout, true},
+		{ErrCodeTooSlow, true},
+		{ErrCodeNetwork, true},
+		{ErrCodeUnfinished, true},
+		{ErrCodeNameResolution, true},
+		{ErrCodeBadResponse, true},
+		{ErrCodeServerOverloaded, true},
+		{ErrCodeNotFound, false},
+		{ErrCodeTooManyNotFound, false},
+		{ErrCodeDiskFull, false},
+		{ErrCodeFileExists, false},
+		{ErrCodeAuthFailed, false},
+		{ErrCodeFileIO, false},
+		{ErrCodeChecksumMismatched, false},
+		{ErrCodeUnknown, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsTransientError(tt.code); got != tt.want {
+			t.Errorf("IsTransientError(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
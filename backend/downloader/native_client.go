@@ -0,0 +1,1067 @@
+package downloader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	nativeVersion       = "mynest-native/1.0"
+	nativeDefaultSplit  = 5
+	nativeDefaultTries  = 5
+	nativeMinSplitSize  = 1 << 20 // 1M，与 aria2 的 min-split-size 默认值一致
+	nativeMaxRedirects  = 10
+	nativeControlSuffix = ".mynest" // 分段进度控制文件后缀，作用类似 aria2 的 .aria2 文件
+	nativeSaveInterval  = time.Second
+	nativeMaxRename     = 9999 // 与 aria2 一致，文件名冲突时最多尝试 name.1.ext ~ name.9999.ext
+)
+
+// errFileExists 目标文件已存在，且不允许覆盖或自动改名
+var errFileExists = errors.New("file already exists")
+
+// NativeClient 内置的 HTTP(S) 下载引擎，同时支持 HLS/DASH 流媒体（见 stream.go）
+// 实现与 Aria2Client 相同的 Downloader 接口，任务状态字符串沿用 aria2 的语义
+// （waiting/active/paused/complete/error/removed），以便 TaskSyncService 无需区分引擎
+type NativeClient struct {
+	dir        string
+	stateDir   string // 任务状态目录，为空时不保存
+	httpClient *http.Client
+	slots      chan struct{} // 同时下载的任务数限制
+	events     chan Event
+
+	mu    sync.RWMutex
+	tasks map[string]*nativeTask
+	order []string // 按添加顺序保存 GID，用于列表接口
+}
+
+type nativeTask struct {
+	gid            string
+	uris           []string
+	dir            string
+	out            string
+	split          int
+	maxTries       int
+	header         http.Header
+	proxy          string
+	allowOverwrite bool // allow-overwrite=true：目标文件已存在时覆盖
+	autoRename     bool // auto-file-renaming（默认开启）：目标文件已存在时改名
+	client         *http.Client
+	addedAt        time.Time
+
+	completed atomic.Int64
+	saveMu    sync.Mutex // 串行写入任务状态文件
+
+	mu           sync.Mutex
+	status       string
+	totalLength  int64
+	errorMessage string
+	errorCode    string
+	filePath     string
+	claimed      bool // 已确定保存路径，重试和续传时沿用
+	cancel       context.CancelFunc
+	done         chan struct{}
+	sampleAt     time.Time
+	sampleBytes  int64
+	speed        int64
+}
+
+// permanentError 重试无意义的错误（如 4xx）
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// NewNativeClient 创建内置下载引擎，并恢复上次运行时保存的任务（见 native_state.go）
+// dir 为默认下载目录，stateDir 为任务状态目录（状态中有请求头等敏感信息，不应放在下载目录下），maxConcurrent 为同时下载的任务数
+func NewNativeClient(dir, stateDir string, maxConcurrent int) *NativeClient {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 5
+	}
+
+	n := &NativeClient{
+		dir:      dir,
+		stateDir: stateDir,
+		httpClient: &http.Client{
+			Transport:     http.DefaultTransport, // 自动从环境变量读取 HTTP_PROXY/HTTPS_PROXY
+			CheckRedirect: checkRedirect,
+		},
+		slots:  make(chan struct{}, maxConcurrent),
+		events: make(chan Event, 256),
+		tasks:  make(map[string]*nativeTask),
+	}
+	n.restore()
+	return n
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= nativeMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", nativeMaxRedirects)
+	}
+	return nil
+}
+
+// clientFor 任务指定了 all-proxy 时使用独立的代理连接，否则共用默认客户端
+func (n *NativeClient) clientFor(options map[string]interface{}) (*http.Client, error) {
+	proxy := optionString(options, "all-proxy", "")
+	if proxy == "" {
+		return n.httpClient, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy: %s", proxy)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}, nil
+}
+
+func (n *NativeClient) AddURI(ctx context.Context, uris []string, options map[string]interface{}) (string, error) {
+	if len(uris) == 0 {
+		return "", fmt.Errorf("failed to add URI: no URI given")
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return "", fmt.Errorf("failed to add URI: native engine only supports http(s): %s", u)
+		}
+	}
+
+	gid, err := newGID()
+	if err != nil {
+		return "", fmt.Errorf("failed to add URI: %w", err)
+	}
+	client, err := n.clientFor(options)
+	if err != nil {
+		return "", fmt.Errorf("failed to add URI: %w", err)
+	}
+	out := optionString(options, "out", "")
+	if out != "" {
+		if out, err = cleanOutName(out); err != nil {
+			return "", fmt.Errorf("failed to add URI: %w", err)
+		}
+	}
+
+	task := &nativeTask{
+		gid:            gid,
+		uris:           uris,
+		dir:            optionString(options, "dir", n.dir),
+		out:            out,
+		split:          optionInt(options, "split", nativeDefaultSplit),
+		maxTries:       optionInt(options, "max-tries", nativeDefaultTries),
+		header:         optionHeader(options),
+		proxy:          optionString(options, "all-proxy", ""),
+		allowOverwrite: optionString(options, "allow-overwrite", "false") == "true",
+		autoRename:     optionString(options, "auto-file-renaming", "true") != "false",
+		client:         client,
+		addedAt:        time.Now(),
+	}
+	if task.split < 1 {
+		task.split = 1
+	}
+	if task.maxTries < 1 {
+		task.maxTries = 1
+	}
+
+	n.mu.Lock()
+	n.tasks[gid] = task
+	n.order = append(n.order, gid)
+	n.mu.Unlock()
+
+	log.Printf("[Native] AddURI: %v, GID: %s, dir=%s, out=%s, split=%d", uris, gid, task.dir, task.out, task.split)
+	n.persist(task)
+	n.start(task)
+	return gid, nil
+}
+
+// AddTorrent 内置引擎不支持 BT
+func (n *NativeClient) AddTorrent(ctx context.Context, data []byte, options map[string]interface{}) (string, error) {
+	return "", fmt.Errorf("failed to add torrent: %w", ErrUnsupported)
+}
+
+// AddMetalink 内置引擎不支持 metalink
+func (n *NativeClient) AddMetalink(ctx context.Context, data []byte, options map[string]interface{}) ([]string, error) {
+	return nil, fmt.Errorf("failed to add metalink: %w", ErrUnsupported)
+}
+
+func (n *NativeClient) TellStatus(ctx context.Context, gid string) (*Status, error) {
+	task, err := n.getTask(gid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status: %w", err)
+	}
+	return task.snapshot(), nil
+}
+
+func (n *NativeClient) TellActive(ctx context.Context) ([]*Status, error) {
+	return n.list(func(status string) bool { return status == "active" }, 0, -1), nil
+}
+
+func (n *NativeClient) TellWaiting(ctx context.Context, offset, num int) ([]*Status, error) {
+	// 与 aria2 一致，tellWaiting 同时返回等待中和已暂停的任务
+	return n.list(func(status string) bool { return status == "waiting" || status == "paused" }, offset, num), nil
+}
+
+func (n *NativeClient) TellStopped(ctx context.Context, offset, num int) ([]*Status, error) {
+	return n.list(isStoppedStatus, offset, num), nil
+}
+
+func (n *NativeClient) TellStatusBatch(ctx context.Context, gids []string) (map[string]*Status, error) {
+	result := make(map[string]*Status, len(gids))
+	for _, gid := range gids {
+		if task, err := n.getTask(gid); err == nil {
+			result[gid] = task.snapshot()
+		}
+	}
+	return result, nil
+}
+
+func (n *NativeClient) Remove(ctx context.Context, gid string) error {
+	task, err := n.getTask(gid)
+	if err != nil {
+		return fmt.Errorf("failed to remove download: %w", err)
+	}
+
+	task.mu.Lock()
+	status := task.status
+	if status == "complete" || status == "removed" {
+		task.mu.Unlock()
+		return nil
+	}
+	task.status = "removed"
+	cancel, done := task.cancel, task.done
+	task.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	n.persist(task)
+	n.evict()
+	n.emit(gid, EventStop)
+	return nil
+}
+
+func (n *NativeClient) RemoveDownloadResult(ctx context.Context, gid string) error {
+	n.mu.Lock()
+	task, ok := n.tasks[gid]
+	if !ok {
+		n.mu.Unlock()
+		return fmt.Errorf("failed to remove download result: GID %s is not found", gid)
+	}
+	task.mu.Lock()
+	stopped := isStoppedStatus(task.status)
+	task.mu.Unlock()
+	if !stopped {
+		n.mu.Unlock()
+		return fmt.Errorf("failed to remove download result: GID %s is not stopped", gid)
+	}
+	delete(n.tasks, gid)
+	order := n.order[:0]
+	for _, id := range n.order {
+		if id != gid {
+			order = append(order, id)
+		}
+	}
+	n.order = order
+	n.mu.Unlock()
+
+	n.forget(gid)
+	return nil
+}
+
+func (n *NativeClient) Pause(ctx context.Context, gid string) error {
+	task, err := n.getTask(gid)
+	if err != nil {
+		return fmt.Errorf("failed to pause download: %w", err)
+	}
+
+	task.mu.Lock()
+	if task.status != "active" && task.status != "waiting" {
+		status := task.status
+		task.mu.Unlock()
+		return fmt.Errorf("failed to pause download: task is %s", status)
+	}
+	task.status = "paused"
+	cancel, done := task.cancel, task.done
+	task.mu.Unlock()
+
+	cancel()
+	<-done
+	n.persist(task)
+	n.emit(gid, EventPause)
+	return nil
+}
+
+func (n *NativeClient) Unpause(ctx context.Context, gid string) error {
+	task, err := n.getTask(gid)
+	if err != nil {
+		return fmt.Errorf("failed to unpause download: %w", err)
+	}
+
+	task.mu.Lock()
+	status := task.status
+	task.mu.Unlock()
+	if status != "paused" {
+		return fmt.Errorf("failed to unpause download: task is %s", status)
+	}
+
+	n.start(task)
+	return nil
+}
+
+// SelectFiles 内置引擎每个任务只有一个文件，不支持选择
+func (n *NativeClient) SelectFiles(ctx context.Context, gid string, indexes []int) error {
+	return fmt.Errorf("failed to select files: %w", ErrUnsupported)
+}
+
+func (n *NativeClient) GetVersion(ctx context.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"version": nativeVersion,
+	}, nil
+}
+
+func (n *NativeClient) GetGlobalOption(ctx context.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"dir":                      n.dir,
+		"max-concurrent-downloads": strconv.Itoa(cap(n.slots)),
+	}, nil
+}
+
+// ChangeGlobalOption 内置引擎不支持动态修改全局选项
+func (n *NativeClient) ChangeGlobalOption(ctx context.Context, options map[string]interface{}) error {
+	return fmt.Errorf("failed to change global option: %w", ErrUnsupported)
+}
+
+func (n *NativeClient) Events() <-chan Event {
+	return n.events
+}
+
+// Connected 内置引擎的事件在进程内产生，始终可用
+func (n *NativeClient) Connected() bool {
+	return true
+}
+
+func (n *NativeClient) getTask(gid string) (*nativeTask, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	task, ok := n.tasks[gid]
+	if !ok {
+		return nil, fmt.Errorf("GID %s is not found", gid)
+	}
+	return task, nil
+}
+
+func (n *NativeClient) list(match func(status string) bool, offset, num int) []*Status {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var result []*Status
+	for _, gid := range n.order {
+		status := n.tasks[gid].snapshot()
+		if match(status.Status) {
+			result = append(result, status)
+		}
+	}
+
+	if offset >= len(result) {
+		return []*Status{}
+	}
+	result = result[offset:]
+	if num >= 0 && num < len(result) {
+		result = result[:num]
+	}
+	return result
+}
+
+func (n *NativeClient) emit(gid string, eventType EventType) {
+	select {
+	case n.events <- Event{GID: gid, Type: eventType}:
+	default:
+		// 通道已满时丢弃事件，由定时对账兜底
+	}
+}
+
+// start 在后台运行任务，占用一个并发槽位
+func (n *NativeClient) start(task *nativeTask) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	task.mu.Lock()
+	task.status = "waiting"
+	task.errorMessage = ""
+	task.errorCode = ""
+	task.cancel = cancel
+	task.done = done
+	task.mu.Unlock()
+	n.persist(task)
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		// 在释放 task.mu 之后保存最终状态
+		defer func() {
+			n.persist(task)
+			n.evict()
+		}()
+
+		select {
+		case n.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-n.slots }()
+
+		task.mu.Lock()
+		if task.status != "waiting" {
+			task.mu.Unlock()
+			return
+		}
+		task.status = "active"
+		task.mu.Unlock()
+		n.persist(task)
+		n.emit(task.gid, EventStart)
+
+		err := n.download(ctx, task)
+
+		task.mu.Lock()
+		defer task.mu.Unlock()
+		if ctx.Err() != nil && task.status != "active" {
+			// 已被 Pause/Remove 改变状态
+			return
+		}
+		if err != nil {
+			task.status = "error"
+			task.errorMessage = err.Error()
+			task.errorCode = errorCodeOf(err)
+			log.Printf("[Native] ❌ 任务失败 - GID: %s, 错误: %v", task.gid, err)
+			n.emit(task.gid, EventError)
+			return
+		}
+		task.status = "complete"
+		log.Printf("[Native] ✅ 任务完成 - GID: %s, 文件: %s", task.gid, task.filePath)
+		n.emit(task.gid, EventComplete)
+	}()
+}
+
+// download 按 max-tries 重试，永久性错误立即返回
+func (n *NativeClient) download(ctx context.Context, task *nativeTask) error {
+	var lastErr error
+	for attempt := 0; attempt < task.maxTries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+			log.Printf("[Native] 🔄 重试任务 - GID: %s, 第 %d 次, 上次错误: %v", task.gid, attempt+1, lastErr)
+		}
+
+		uri := task.uris[attempt%len(task.uris)]
+		lastErr = n.downloadOnce(ctx, task, uri)
+		if lastErr == nil || ctx.Err() != nil {
+			return lastErr
+		}
+
+		var perm permanentError
+		if errors.As(lastErr, &perm) {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+type probeResult struct {
+	finalURL  string
+	length    int64
+	rangeable bool
+	filename  string
+}
+
+// probe 用 Range: bytes=0-0 请求探测文件大小和是否支持分段
+// 相比 HEAD，部分服务器（如 CDN 签名链接）只接受 GET
+func (n *NativeClient) probe(ctx context.Context, task *nativeTask, uri string) (*probeResult, error) {
+	req, err := n.newRequest(ctx, task, uri)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := task.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	result := &probeResult{
+		finalURL: resp.Request.URL.String(),
+		filename: filenameFromResponse(resp),
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-0/12345
+		if idx := strings.LastIndex(resp.Header.Get("Content-Range"), "/"); idx != -1 {
+			if total, err := strconv.ParseInt(resp.Header.Get("Content-Range")[idx+1:], 10, 64); err == nil {
+				result.length = total
+				result.rangeable = true
+			}
+		}
+	} else {
+		result.length = resp.ContentLength
+	}
+
+	return result, nil
+}
+
+func (n *NativeClient) downloadOnce(ctx context.Context, task *nativeTask, uri string) error {
+	if kind := StreamKind(uri); kind != "" {
+		return n.downloadStream(ctx, task, uri, kind)
+	}
+
+	info, err := n.probe(ctx, task, uri)
+	if err != nil {
+		return err
+	}
+
+	filePath, err := n.claimPath(task, info.filename)
+	if err != nil {
+		return err
+	}
+	if info.length > 0 {
+		task.mu.Lock()
+		task.totalLength = info.length
+		task.mu.Unlock()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return permanentError{fmt.Errorf("failed to create directory: %w", err)}
+	}
+
+	if info.rangeable && info.length > 0 {
+		return n.downloadRanged(ctx, task, info, filePath)
+	}
+	return n.downloadSingle(ctx, task, info, filePath)
+}
+
+// downloadSingle 不支持分段的服务器只能从头单连接下载
+func (n *NativeClient) downloadSingle(ctx context.Context, task *nativeTask, info *probeResult, filePath string) error {
+	req, err := n.newRequest(ctx, task, info.finalURL)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	resp, err := task.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return permanentError{fmt.Errorf("failed to create file: %w", err)}
+	}
+	defer f.Close()
+
+	task.completed.Store(0)
+	if _, err := io.Copy(f, &countingReader{r: resp.Body, n: &task.completed}); err != nil {
+		return err
+	}
+
+	if info.length <= 0 {
+		task.mu.Lock()
+		task.totalLength = task.completed.Load()
+		task.mu.Unlock()
+	}
+	return nil
+}
+
+// nativeControl 分段下载的进度控制文件，用于断点续传
+type nativeControl struct {
+	URL      string          `json:"url"`
+	Length   int64           `json:"length"`
+	Segments []nativeSegment `json:"segments"`
+}
+
+type nativeSegment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // 包含
+	Done  int64 `json:"done"`
+}
+
+func (n *NativeClient) downloadRanged(ctx context.Context, task *nativeTask, info *probeResult, filePath string) error {
+	controlPath := filePath + nativeControlSuffix
+	control := loadControl(controlPath, filePath, info.length)
+	if control == nil {
+		// claimPath 已确认该路径属于本任务（新文件、本任务未完成的下载或允许覆盖），可以清空
+		control = newControl(info.finalURL, info.length, task.split)
+		if err := os.Truncate(filePath, 0); err != nil && !os.IsNotExist(err) {
+			return permanentError{fmt.Errorf("failed to reset file: %w", err)}
+		}
+	} else {
+		log.Printf("[Native] ⏯️  断点续传 - GID: %s, 文件: %s", task.gid, filePath)
+	}
+
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return permanentError{fmt.Errorf("failed to open file: %w", err)}
+	}
+	defer f.Close()
+
+	if err := f.Truncate(info.length); err != nil {
+		return permanentError{fmt.Errorf("failed to allocate file: %w", err)}
+	}
+
+	done := make([]atomic.Int64, len(control.Segments))
+	var total int64
+	for i, seg := range control.Segments {
+		done[i].Store(seg.Done)
+		total += seg.Done
+	}
+	task.completed.Store(total)
+
+	saveControl := func() {
+		snapshot := nativeControl{URL: control.URL, Length: control.Length, Segments: make([]nativeSegment, len(control.Segments))}
+		for i, seg := range control.Segments {
+			seg.Done = done[i].Load()
+			snapshot.Segments[i] = seg
+		}
+		data, err := json.Marshal(snapshot)
+		if err == nil {
+			err = os.WriteFile(controlPath, data, 0644)
+		}
+		if err != nil {
+			log.Printf("[Native] ⚠️  保存进度失败: %v", err)
+		}
+	}
+
+	// 定期保存进度，进程退出或暂停后可以续传
+	stopSaving := make(chan struct{})
+	savingDone := make(chan struct{})
+	go func() {
+		defer close(savingDone)
+		ticker := time.NewTicker(nativeSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				saveControl()
+			case <-stopSaving:
+				return
+			}
+		}
+	}()
+
+	segCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(control.Segments))
+	for i := range control.Segments {
+		seg := control.Segments[i]
+		if seg.Start+done[i].Load() > seg.End {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, seg nativeSegment) {
+			defer wg.Done()
+			if err := n.downloadSegment(segCtx, task, info.finalURL, f, seg, &done[i]); err != nil {
+				errs <- err
+				cancel() // 一个分段失败，其余分段一起停止，交给外层重试
+			}
+		}(i, seg)
+	}
+	wg.Wait()
+	close(stopSaving)
+	<-savingDone
+	close(errs)
+
+	if err := <-errs; err != nil {
+		saveControl()
+		return err
+	}
+	if ctx.Err() != nil {
+		saveControl()
+		return ctx.Err()
+	}
+
+	os.Remove(controlPath)
+	return nil
+}
+
+func (n *NativeClient) downloadSegment(ctx context.Context, task *nativeTask, uri string, f *os.File, seg nativeSegment, done *atomic.Int64) error {
+	offset := seg.Start + done.Load()
+
+	req, err := n.newRequest(ctx, task, uri)
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, seg.End))
+
+	resp, err := task.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("server ignored range request: %s", resp.Status)
+	}
+
+	buf := make([]byte, 32*1024)
+	for offset <= seg.End {
+		nr, readErr := resp.Body.Read(buf)
+		if nr > 0 {
+			if remaining := seg.End - offset + 1; int64(nr) > remaining {
+				nr = int(remaining)
+			}
+			if _, err := f.WriteAt(buf[:nr], offset); err != nil {
+				return permanentError{fmt.Errorf("failed to write file: %w", err)}
+			}
+			offset += int64(nr)
+			done.Add(int64(nr))
+			task.completed.Add(int64(nr))
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	if offset <= seg.End {
+		return fmt.Errorf("segment %d-%d ended early at %d", seg.Start, seg.End, offset)
+	}
+	return nil
+}
+
+// claimPath 确定任务的保存路径，重试、暂停后恢复和重启后续传时沿用同一路径
+// 目标文件已存在且不是未完成的下载时：allow-overwrite=true 直接覆盖，
+// auto-file-renaming（默认开启）按 aria2 的规则改名为 name.1.ext，否则任务失败（错误码 13）；
+// 其他未结束的任务正在使用的路径即使允许覆盖也不会覆盖
+func (n *NativeClient) claimPath(task *nativeTask, name string) (string, error) {
+	task.mu.Lock()
+	if task.claimed {
+		filePath := task.filePath
+		task.mu.Unlock()
+		return filePath, nil
+	}
+	out := task.out
+	task.mu.Unlock()
+
+	if out == "" {
+		out = name
+	}
+	out, err := cleanOutName(out)
+	if err != nil {
+		return "", permanentError{err}
+	}
+
+	busy := n.claimedPaths(task.gid)
+	filePath := filepath.Join(task.dir, out)
+	if busy[filePath] || pathTaken(filePath, busy) && !task.allowOverwrite {
+		if !task.autoRename {
+			return "", permanentError{fmt.Errorf("%w: %s", errFileExists, filePath)}
+		}
+		ext := filepath.Ext(out)
+		base := strings.TrimSuffix(out, ext)
+		renamed := ""
+		for i := 1; i <= nativeMaxRename; i++ {
+			candidate := fmt.Sprintf("%s.%d%s", base, i, ext)
+			if !pathTaken(filepath.Join(task.dir, candidate), busy) {
+				renamed = candidate
+				break
+			}
+		}
+		if renamed == "" {
+			return "", permanentError{fmt.Errorf("%w: %s", errFileExists, filePath)}
+		}
+		log.Printf("[Native] 🔀 文件已存在，重命名为: %s (GID: %s)", renamed, task.gid)
+		out = renamed
+		filePath = filepath.Join(task.dir, out)
+	}
+
+	task.mu.Lock()
+	task.out = out
+	task.filePath = filePath
+	task.claimed = true
+	task.mu.Unlock()
+	n.persist(task)
+	return filePath, nil
+}
+
+// claimedPaths 其他未结束的任务已确定的保存路径
+func (n *NativeClient) claimedPaths(exceptGID string) map[string]bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	busy := make(map[string]bool)
+	for gid, task := range n.tasks {
+		if gid == exceptGID {
+			continue
+		}
+		task.mu.Lock()
+		if task.claimed && !isStoppedStatus(task.status) {
+			busy[task.filePath] = true
+		}
+		task.mu.Unlock()
+	}
+	return busy
+}
+
+// pathTaken 路径被其他任务占用，或文件已存在且不是未完成的下载（没有控制文件或分片目录）
+func pathTaken(filePath string, busy map[string]bool) bool {
+	if busy[filePath] {
+		return true
+	}
+	if _, err := os.Lstat(filePath); err != nil {
+		return false
+	}
+	return !hasControlFile(filePath, nativeControlSuffix, streamPartsSuffix)
+}
+
+// IsPartialDownload 判断 filePath 是否为未完成的下载：存在 aria2 的 .aria2 控制文件、
+// 内置引擎的 .mynest 控制文件或流媒体的分片目录，下载引擎会在原文件上续传
+func IsPartialDownload(filePath string) bool {
+	return hasControlFile(filePath, ".aria2", nativeControlSuffix, streamPartsSuffix)
+}
+
+func hasControlFile(filePath string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if _, err := os.Stat(filePath + suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanOutName 校验 out 选项，可以包含子目录，但不能是绝对路径或用 .. 跳出下载目录
+func cleanOutName(out string) (string, error) {
+	clean := filepath.Clean(out)
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid output filename: %s", out)
+	}
+	return clean, nil
+}
+
+func isStoppedStatus(status string) bool {
+	return status == "complete" || status == "error" || status == "removed"
+}
+
+func (n *NativeClient) newRequest(ctx context.Context, task *nativeTask, uri string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range task.header {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", nativeVersion)
+	}
+	return req, nil
+}
+
+func (t *nativeTask) snapshot() *Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	completed := t.completed.Load()
+	now := time.Now()
+	if t.status == "active" {
+		// 每秒采样一次计算速度
+		if elapsed := now.Sub(t.sampleAt); elapsed >= time.Second {
+			if !t.sampleAt.IsZero() {
+				t.speed = int64(float64(completed-t.sampleBytes) / elapsed.Seconds())
+			}
+			t.sampleAt = now
+			t.sampleBytes = completed
+		}
+	} else {
+		t.speed = 0
+		t.sampleAt = time.Time{}
+	}
+
+	status := &Status{
+		GID:             t.gid,
+		Status:          t.status,
+		TotalLength:     t.totalLength,
+		CompletedLength: completed,
+		DownloadSpeed:   t.speed,
+		ErrorCode:       t.errorCode,
+		ErrorMessage:    t.errorMessage,
+	}
+	if t.filePath != "" {
+		status.Files = []File{{Index: 1, Path: t.filePath, Length: t.totalLength, Selected: true}}
+	}
+	return status
+}
+
+func newControl(uri string, length int64, split int) *nativeControl {
+	// 分段不小于 nativeMinSplitSize
+	if maxSplit := int(length / nativeMinSplitSize); split > maxSplit {
+		split = maxSplit
+	}
+	if split < 1 {
+		split = 1
+	}
+
+	control := &nativeControl{URL: uri, Length: length}
+	size := length / int64(split)
+	for i := 0; i < split; i++ {
+		start := int64(i) * size
+		end := start + size - 1
+		if i == split-1 {
+			end = length - 1
+		}
+		control.Segments = append(control.Segments, nativeSegment{Start: start, End: end})
+	}
+	return control
+}
+
+// loadControl 读取已有的进度文件，文件大小不一致或数据文件丢失时返回 nil
+func loadControl(controlPath, filePath string, length int64) *nativeControl {
+	data, err := os.ReadFile(controlPath)
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return nil
+	}
+
+	var control nativeControl
+	if err := json.Unmarshal(data, &control); err != nil || control.Length != length || len(control.Segments) == 0 {
+		return nil
+	}
+	return &control
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := httpStatusError{code: resp.StatusCode, status: resp.Status}
+	// 4xx（除 408/429）重试无意义
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// filenameFromResponse 依次从 Content-Disposition 和最终 URL 路径中获取文件名
+func filenameFromResponse(resp *http.Response) string {
+	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+		if _, params, err := mime.ParseMediaType(cd); err == nil && params["filename"] != "" {
+			if name := filepath.Base(params["filename"]); name != "." && name != ".." && name != string(filepath.Separator) {
+				return name
+			}
+		}
+	}
+
+	name := path.Base(resp.Request.URL.Path)
+	if decoded, err := url.PathUnescape(name); err == nil {
+		name = filepath.Base(decoded)
+	}
+	if name == "" || name == "/" || name == "." || name == ".." {
+		return "index.html"
+	}
+	return name
+}
+
+func newGID() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func optionString(options map[string]interface{}, key, def string) string {
+	if v, ok := options[key]; ok {
+		if s := fmt.Sprint(v); s != "" {
+			return s
+		}
+	}
+	return def
+}
+
+func optionInt(options map[string]interface{}, key string, def int) int {
+	if v, ok := options[key]; ok {
+		if i, err := strconv.Atoi(fmt.Sprint(v)); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// optionHeader 将 aria2 风格的 header/user-agent/referer 选项转换为 http.Header
+func optionHeader(options map[string]interface{}) http.Header {
+	header := http.Header{}
+
+	var lines []string
+	switch v := options["header"].(type) {
+	case string:
+		lines = []string{v}
+	case []string:
+		lines = v
+	case []interface{}:
+		for _, item := range v {
+			lines = append(lines, fmt.Sprint(item))
+		}
+	}
+	for _, line := range lines {
+		if idx := strings.Index(line, ":"); idx > 0 {
+			header.Add(strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:]))
+		}
+	}
+
+	if ua := optionString(options, "user-agent", ""); ua != "" {
+		header.Set("User-Agent", ua)
+	}
+	if referer := optionString(options, "referer", ""); referer != "" {
+		header.Set("Referer", referer)
+	}
+	return header
+}
@@ -0,0 +1,227 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitStatus 等待任务进入指定状态
+func waitStatus(t *testing.T, n *NativeClient, gid, want string) *Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := n.TellStatus(context.Background(), gid)
+		if err != nil {
+			t.Fatalf("TellStatus: %v", err)
+		}
+		if status.Status == want {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s: status %s (%s), want %s", gid, status.Status, status.ErrorMessage, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newFileServer(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestNativeDoesNotOverwriteExistingFile(t *testing.T) {
+	content := bytes.Repeat([]byte("mynest"), 1000)
+	server := newFileServer(content)
+	defer server.Close()
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(existing, []byte("user data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNativeClient(dir, "", 2)
+	gid, err := n.AddURI(context.Background(), []string{server.URL + "/file.bin"}, map[string]interface{}{"out": "file.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitStatus(t, n, gid, "complete")
+
+	if data, _ := os.ReadFile(existing); string(data) != "user data" {
+		t.Fatalf("existing file was modified: %q", data)
+	}
+	renamed := filepath.Join(dir, "file.1.bin")
+	if status.Files[0].Path != renamed {
+		t.Fatalf("path = %s, want %s", status.Files[0].Path, renamed)
+	}
+	if data, _ := os.ReadFile(renamed); !bytes.Equal(data, content) {
+		t.Fatal("renamed file content mismatch")
+	}
+}
+
+func TestNativeExistingFileWithoutRenaming(t *testing.T) {
+	server := newFileServer([]byte("new content"))
+	defer server.Close()
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "file.bin")
+	if err := os.WriteFile(existing, []byte("user data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNativeClient(dir, "", 2)
+	gid, err := n.AddURI(context.Background(), []string{server.URL + "/file.bin"}, map[string]interface{}{
+		"out":                "file.bin",
+		"auto-file-renaming": "false",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitStatus(t, n, gid, "error")
+	if status.ErrorCode != ErrCodeFileExists {
+		t.Fatalf("error code = %s, want %s", status.ErrorCode, ErrCodeFileExists)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "user data" {
+		t.Fatalf("existing file was modified: %q", data)
+	}
+
+	// allow-overwrite 时覆盖
+	gid, err = n.AddURI(context.Background(), []string{server.URL + "/file.bin"}, map[string]interface{}{
+		"out":                "file.bin",
+		"allow-overwrite":    "true",
+		"auto-file-renaming": "false",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, n, gid, "complete")
+	if data, _ := os.ReadFile(existing); string(data) != "new content" {
+		t.Fatalf("file not overwritten: %q", data)
+	}
+}
+
+func TestNativeRejectsOutTraversal(t *testing.T) {
+	n := NewNativeClient(t.TempDir(), "", 1)
+	for _, out := range []string{"../escape.bin", "a/../../escape.bin", "/etc/passwd", ".."} {
+		if _, err := n.AddURI(context.Background(), []string{"http://example.com/f"}, map[string]interface{}{"out": out}); err == nil {
+			t.Errorf("out %q accepted", out)
+		}
+	}
+	if got, err := cleanOutName("sub/../file.bin"); err != nil || got != "file.bin" {
+		t.Errorf("cleanOutName = %q, %v", got, err)
+	}
+}
+
+func TestNativeRestoresTasksAfterRestart(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, stateDir := t.TempDir(), t.TempDir()
+	n := NewNativeClient(dir, stateDir, 1)
+	done, err := n.AddURI(context.Background(), []string{server.URL + "/done.bin"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	waitStatus(t, n, done, "complete")
+
+	paused, err := n.AddURI(context.Background(), []string{server.URL + "/paused.bin"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Pause(context.Background(), paused); err != nil {
+		t.Fatal(err)
+	}
+
+	// 状态文件只有当前用户可以读写
+	if info, err := os.Stat(filepath.Join(stateDir, paused+".json")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("state file: %v, %v", info, err)
+	}
+
+	// 模拟进程重启
+	restarted := NewNativeClient(dir, stateDir, 1)
+	if status := waitStatus(t, restarted, done, "complete"); status.Files[0].Path != filepath.Join(dir, "done.bin") {
+		t.Fatalf("restored path = %s", status.Files[0].Path)
+	}
+	waitStatus(t, restarted, paused, "paused")
+	if err := restarted.Unpause(context.Background(), paused); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, restarted, paused, "complete")
+	if data, _ := os.ReadFile(filepath.Join(dir, "paused.bin")); !bytes.Equal(data, content) {
+		t.Fatal("resumed file content mismatch")
+	}
+}
+
+func TestNativeEvictsOldStoppedTasks(t *testing.T) {
+	n := NewNativeClient("", "", 1)
+	for i := 0; i < nativeMaxStopped+5; i++ {
+		gid := string(rune('a'+i%26)) + time.Now().Format("150405.000000000") + string(rune(i))
+		n.tasks[gid] = &nativeTask{gid: gid, status: "complete"}
+		n.order = append(n.order, gid)
+	}
+	first := n.order[0]
+	n.evict()
+	if len(n.tasks) != nativeMaxStopped || len(n.order) != nativeMaxStopped {
+		t.Fatalf("tasks = %d, order = %d", len(n.tasks), len(n.order))
+	}
+	if _, ok := n.tasks[first]; ok {
+		t.Fatal("oldest task not evicted")
+	}
+}
+
+func TestNativeDoesNotOverwriteActiveDownload(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write(make([]byte, 10))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dir := t.TempDir()
+	n := NewNativeClient(dir, "", 2)
+	first, err := n.AddURI(context.Background(), []string{server.URL + "/file.bin"}, map[string]interface{}{"out": "file.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(n.claimedPaths("")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first task did not claim its path")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 允许覆盖也不能覆盖其他任务正在下载的文件
+	second, err := n.AddURI(context.Background(), []string{server.URL + "/file.bin"}, map[string]interface{}{
+		"out":                "file.bin",
+		"allow-overwrite":    "true",
+		"auto-file-renaming": "false",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitStatus(t, n, second, "error")
+	if status.ErrorCode != ErrCodeFileExists {
+		t.Fatalf("error code = %s, want %s", status.ErrorCode, ErrCodeFileExists)
+	}
+	n.Remove(context.Background(), first)
+}
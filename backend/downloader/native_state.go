@@ -0,0 +1,222 @@
+package downloader
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	nativeMaxStopped = 1000 // 保留的已结束任务数，与 aria2 的 max-download-result 默认值一致
+)
+
+// nativeState 持久化的任务状态，进程重启后用于恢复任务
+type nativeState struct {
+	GID            string      `json:"gid"`
+	URIs           []string    `json:"uris"`
+	Dir            string      `json:"dir"`
+	Out            string      `json:"out,omitempty"`
+	Split          int         `json:"split"`
+	MaxTries       int         `json:"max_tries"`
+	Header         http.Header `json:"header,omitempty"`
+	Proxy          string      `json:"proxy,omitempty"`
+	AllowOverwrite bool        `json:"allow_overwrite,omitempty"`
+	AutoRename     bool        `json:"auto_rename"`
+	Claimed        bool        `json:"claimed,omitempty"`
+	FilePath       string      `json:"file_path,omitempty"`
+	Status         string      `json:"status"`
+	TotalLength    int64       `json:"total_length"`
+	Completed      int64       `json:"completed"`
+	ErrorCode      string      `json:"error_code,omitempty"`
+	ErrorMessage   string      `json:"error_message,omitempty"`
+	AddedAt        time.Time   `json:"added_at"`
+}
+
+// persist 保存任务状态，未配置状态目录时不保存
+// 状态中有 Cookie、Authorization 等请求头，目录和文件只有当前用户可以读写
+func (n *NativeClient) persist(task *nativeTask) {
+	dir := n.stateDir
+	if dir == "" {
+		return
+	}
+
+	task.saveMu.Lock()
+	defer task.saveMu.Unlock()
+
+	task.mu.Lock()
+	state := nativeState{
+		GID:            task.gid,
+		URIs:           task.uris,
+		Dir:            task.dir,
+		Out:            task.out,
+		Split:          task.split,
+		MaxTries:       task.maxTries,
+		Header:         task.header,
+		Proxy:          task.proxy,
+		AllowOverwrite: task.allowOverwrite,
+		AutoRename:     task.autoRename,
+		Claimed:        task.claimed,
+		FilePath:       task.filePath,
+		Status:         task.status,
+		TotalLength:    task.totalLength,
+		Completed:      task.completed.Load(),
+		ErrorCode:      task.errorCode,
+		ErrorMessage:   task.errorMessage,
+		AddedAt:        task.addedAt,
+	}
+	task.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		// 先写临时文件再重命名，避免中断留下不完整的状态
+		path := filepath.Join(dir, task.gid+".json")
+		if err = os.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Printf("[Native] ⚠️  保存任务状态失败 - GID: %s, 错误: %v", task.gid, err)
+	}
+}
+
+// forget 删除任务的状态文件
+func (n *NativeClient) forget(gid string) {
+	if n.stateDir != "" {
+		os.Remove(filepath.Join(n.stateDir, gid+".json"))
+	}
+}
+
+// restore 恢复上次运行时保存的任务：下载中和等待中的任务重新开始（分段下载和流媒体从断点续传），
+// 暂停的任务保持暂停，已结束的任务保留状态供 TaskSyncService 查询
+func (n *NativeClient) restore() {
+	dir := n.stateDir
+	if dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[Native] ⚠️  读取任务状态失败: %v", err)
+		}
+		return
+	}
+
+	var tasks []*nativeTask
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var state nativeState
+		if err := json.Unmarshal(data, &state); err != nil || state.GID == "" || len(state.URIs) == 0 {
+			log.Printf("[Native] ⚠️  忽略无效的任务状态文件: %s", entry.Name())
+			continue
+		}
+		tasks = append(tasks, n.taskFromState(&state))
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].addedAt.Before(tasks[j].addedAt) })
+
+	n.mu.Lock()
+	for _, task := range tasks {
+		n.tasks[task.gid] = task
+		n.order = append(n.order, task.gid)
+	}
+	n.mu.Unlock()
+
+	resumed := 0
+	for _, task := range tasks {
+		if task.status == "active" || task.status == "waiting" {
+			n.start(task)
+			resumed++
+		}
+	}
+	if len(tasks) > 0 {
+		log.Printf("[Native] 恢复了 %d 个任务，其中 %d 个继续下载", len(tasks), resumed)
+	}
+}
+
+func (n *NativeClient) taskFromState(state *nativeState) *nativeTask {
+	client, err := n.clientFor(map[string]interface{}{"all-proxy": state.Proxy})
+	if err != nil {
+		client = n.httpClient
+	}
+	if state.Split < 1 {
+		state.Split = 1
+	}
+	if state.MaxTries < 1 {
+		state.MaxTries = 1
+	}
+
+	task := &nativeTask{
+		gid:            state.GID,
+		uris:           state.URIs,
+		dir:            state.Dir,
+		out:            state.Out,
+		split:          state.Split,
+		maxTries:       state.MaxTries,
+		header:         state.Header,
+		proxy:          state.Proxy,
+		allowOverwrite: state.AllowOverwrite,
+		autoRename:     state.AutoRename,
+		client:         client,
+		addedAt:        state.AddedAt,
+		status:         state.Status,
+		totalLength:    state.TotalLength,
+		errorCode:      state.ErrorCode,
+		errorMessage:   state.ErrorMessage,
+		filePath:       state.FilePath,
+		claimed:        state.Claimed,
+	}
+	if task.header == nil {
+		task.header = http.Header{}
+	}
+	task.completed.Store(state.Completed)
+	return task
+}
+
+// evict 已结束的任务超过 nativeMaxStopped 个时，移除最早的任务及其状态文件
+func (n *NativeClient) evict() {
+	n.mu.Lock()
+	var stopped []string
+	for _, gid := range n.order {
+		task := n.tasks[gid]
+		task.mu.Lock()
+		if isStoppedStatus(task.status) {
+			stopped = append(stopped, gid)
+		}
+		task.mu.Unlock()
+	}
+	if len(stopped) <= nativeMaxStopped {
+		n.mu.Unlock()
+		return
+	}
+
+	evicted := make(map[string]bool)
+	for _, gid := range stopped[:len(stopped)-nativeMaxStopped] {
+		evicted[gid] = true
+		delete(n.tasks, gid)
+	}
+	order := n.order[:0]
+	for _, gid := range n.order {
+		if !evicted[gid] {
+			order = append(order, gid)
+		}
+	}
+	n.order = order
+	n.mu.Unlock()
+
+	for gid := range evicted {
+		n.forget(gid)
+	}
+}
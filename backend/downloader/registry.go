@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// 内置引擎名称
+const (
+	EngineAria2  = "aria2"
+	EngineNative = "native"
+)
+
+// Rule 引擎路由规则，Schemes/Domains/Extensions 中任一非空条件都需满足
+type Rule struct {
+	Schemes    []string `json:"schemes,omitempty"`    // 如 magnet、ftp、https
+	Domains    []string `json:"domains,omitempty"`    // 域名后缀匹配，如 example.com 同时匹配 cdn.example.com
+	Extensions []string `json:"extensions,omitempty"` // URL 路径扩展名，如 .torrent
+	Engine     string   `json:"engine"`
+}
+
+// Match 判断 URL 是否符合规则
+func (r Rule) Match(u *url.URL) bool {
+	if len(r.Schemes) == 0 && len(r.Domains) == 0 && len(r.Extensions) == 0 {
+		return false
+	}
+
+	if len(r.Schemes) > 0 && !containsFold(r.Schemes, u.Scheme) {
+		return false
+	}
+
+	if len(r.Domains) > 0 {
+		host := strings.ToLower(u.Hostname())
+		matched := false
+		for _, domain := range r.Domains {
+			domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Extensions) > 0 && !containsFold(r.Extensions, path.Ext(u.Path)) {
+		return false
+	}
+
+	return true
+}
+
+// DefaultRules 默认路由：BT/磁力/FTP 只有 aria2 支持，HLS/DASH 播放列表只有内置引擎支持，其余走默认引擎
+func DefaultRules() []Rule {
+	return []Rule{
+		{Schemes: []string{"magnet", "ftp", "sftp"}, Engine: EngineAria2},
+		{Extensions: []string{".torrent", ".metalink", ".meta4"}, Engine: EngineAria2},
+		{Extensions: []string{".m3u8", ".mpd"}, Engine: EngineNative},
+	}
+}
+
+// Registry 管理多个命名的下载引擎，按 URL 规则为任务选择引擎
+type Registry struct {
+	engines       map[string]Downloader
+	defaultEngine string
+}
+
+func NewRegistry(defaultEngine string) *Registry {
+	return &Registry{
+		engines:       make(map[string]Downloader),
+		defaultEngine: defaultEngine,
+	}
+}
+
+// Register 注册引擎，同名引擎会被覆盖
+func (r *Registry) Register(name string, dl Downloader) {
+	r.engines[name] = dl
+}
+
+// Get 按名称获取引擎，名称为空时返回默认引擎
+func (r *Registry) Get(name string) (Downloader, error) {
+	if name == "" {
+		name = r.defaultEngine
+	}
+	dl, ok := r.engines[name]
+	if !ok {
+		return nil, fmt.Errorf("下载引擎 %s 未启用", name)
+	}
+	return dl, nil
+}
+
+// Default 返回默认引擎名称
+func (r *Registry) Default() string {
+	return r.defaultEngine
+}
+
+// Names 返回所有已注册引擎的名称（按字母排序）
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.engines))
+	for name := range r.engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Route 按规则顺序为 URL 选择引擎，自定义规则优先，之后匹配 DefaultRules
+// 命中规则但引擎未注册时继续匹配下一条，全部未命中则返回默认引擎
+func (r *Registry) Route(rawURL string, rules []Rule) string {
+	rules = append(rules[:len(rules):len(rules)], DefaultRules()...)
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return r.defaultEngine
+	}
+
+	for _, rule := range rules {
+		if _, ok := r.engines[rule.Engine]; !ok {
+			continue
+		}
+		if rule.Match(u) {
+			return rule.Engine
+		}
+	}
+
+	return r.defaultEngine
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,944 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 流媒体类型
+const (
+	StreamHLS  = "hls"
+	StreamDASH = "dash"
+)
+
+// StreamKind 根据 URL 扩展名判断是否为 HLS/DASH 播放列表，不是则返回空字符串
+func StreamKind(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".m3u8":
+		return StreamHLS
+	case ".mpd":
+		return StreamDASH
+	}
+	return ""
+}
+
+// StreamOutputExt 返回流媒体合并后的文件扩展名
+func StreamOutputExt(kind string) string {
+	switch kind {
+	case StreamHLS:
+		return ".ts"
+	case StreamDASH:
+		return ".mp4"
+	}
+	return ""
+}
+
+// streamPartsSuffix 已下载分片的保存目录后缀
+const streamPartsSuffix = ".parts"
+
+// streamSegment 单个媒体分片
+type streamSegment struct {
+	URL       string
+	ByteRange string // "start-end"，为空表示整个资源
+	Key       *hlsKey
+}
+
+// hlsKey HLS AES-128 加密信息
+type hlsKey struct {
+	URI string
+	IV  []byte
+}
+
+// streamPlan 解析播放列表后得到的下载计划
+type streamPlan struct {
+	Segments []streamSegment // 按顺序合并的分片，初始化分片插在所属的媒体分片之前
+	Audio    *streamPlan     // DASH 音视频分离时的音轨，下载后用 ffmpeg 与视频轨合并
+	lastInit *streamSegment
+}
+
+// add 追加媒体分片，初始化分片（fMP4 的 moov）变化时先插入新的初始化分片，
+// 多 Period 的 DASH 和多个 EXT-X-MAP 的 HLS 在每段开头都会带上各自的初始化分片
+func (p *streamPlan) add(init *streamSegment, seg streamSegment) {
+	if init != nil && (p.lastInit == nil || init.URL != p.lastInit.URL || init.ByteRange != p.lastInit.ByteRange) {
+		p.Segments = append(p.Segments, *init)
+		p.lastInit = init
+	}
+	p.Segments = append(p.Segments, seg)
+}
+
+// downloadStream 并发下载所有分片后按顺序合并为单个文件
+// 已完成的分片保存在 <文件>.parts 目录中，暂停或重试后可以续传
+func (n *NativeClient) downloadStream(ctx context.Context, task *nativeTask, uri, kind string) error {
+	var plan *streamPlan
+	var err error
+	switch kind {
+	case StreamHLS:
+		plan, err = n.buildHLSPlan(ctx, task, uri)
+	case StreamDASH:
+		plan, err = n.buildDASHPlan(ctx, task, uri)
+	}
+	if err != nil {
+		return err
+	}
+	if len(plan.Segments) == 0 {
+		return permanentError{errors.New("playlist contains no segments")}
+	}
+
+	base := path.Base(mustParseURL(uri).Path)
+	filePath, err := n.claimPath(task, strings.TrimSuffix(base, path.Ext(base))+StreamOutputExt(kind))
+	if err != nil {
+		return err
+	}
+
+	// 视频轨和音轨的分片一起并发下载，音轨分片保存为 a000000 等
+	segments := plan.Segments
+	videoCount := len(segments)
+	if plan.Audio != nil {
+		segments = append(segments[:videoCount:videoCount], plan.Audio.Segments...)
+	}
+
+	partsDir := filePath + streamPartsSuffix
+	if err := preparePartsDir(partsDir, streamFingerprint(uri, segments, videoCount)); err != nil {
+		return permanentError{err}
+	}
+	partPath := func(i int) string {
+		if i >= videoCount {
+			return filepath.Join(partsDir, fmt.Sprintf("a%06d", i-videoCount))
+		}
+		return filepath.Join(partsDir, fmt.Sprintf("%06d", i))
+	}
+
+	// 统计已完成的分片，用于续传和进度估算；音轨分片通常比视频小得多，两条轨道分别估算
+	video := &trackProgress{total: int64(videoCount)}
+	audio := &trackProgress{total: int64(len(segments) - videoCount)}
+	track := func(i int) *trackProgress {
+		if i >= videoCount {
+			return audio
+		}
+		return video
+	}
+	var pending []int
+	task.completed.Store(0)
+	for i := range segments {
+		if fi, err := os.Stat(partPath(i)); err == nil {
+			task.completed.Add(fi.Size())
+			track(i).add(fi.Size())
+		} else {
+			pending = append(pending, i)
+		}
+	}
+	updateEstimate := func() {
+		// 总大小未知，按各轨道已完成分片的平均大小估算
+		estimate := video.estimate() + audio.estimate()
+		if estimate == 0 {
+			return
+		}
+		task.mu.Lock()
+		task.totalLength = estimate
+		task.mu.Unlock()
+	}
+	updateEstimate()
+
+	log.Printf("[Native] 🎞️  %s 流媒体 - GID: %s, 分片: %d, 待下载: %d", kind, task.gid, len(segments), len(pending))
+
+	keys := newKeyCache()
+	jobs := make(chan int)
+	segCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+	for w := 0; w < task.split; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				size, err := n.fetchSegment(segCtx, task, segments[i], keys, partPath(i))
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+				task.completed.Add(size)
+				track(i).add(size)
+				updateEstimate()
+			}
+		}()
+	}
+
+feed:
+	for _, i := range pending {
+		select {
+		case jobs <- i:
+		case <-segCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if plan.Audio == nil {
+		if err := concatParts(filePath, 0, len(segments), partPath); err != nil {
+			return permanentError{err}
+		}
+	} else {
+		videoPath := filepath.Join(partsDir, "video.mp4")
+		audioPath := filepath.Join(partsDir, "audio.mp4")
+		if err := concatParts(videoPath, 0, videoCount, partPath); err != nil {
+			return permanentError{err}
+		}
+		if err := concatParts(audioPath, videoCount, len(segments), partPath); err != nil {
+			return permanentError{err}
+		}
+		if err := muxAudio(ctx, videoPath, audioPath, filePath); err != nil {
+			return permanentError{err}
+		}
+	}
+	os.RemoveAll(partsDir)
+
+	task.mu.Lock()
+	task.totalLength = task.completed.Load()
+	task.mu.Unlock()
+	return nil
+}
+
+// trackProgress 单条轨道已完成的分片数和字节数
+type trackProgress struct {
+	total int64 // 分片总数
+	done  atomic.Int64
+	bytes atomic.Int64
+}
+
+func (p *trackProgress) add(size int64) {
+	p.bytes.Add(size)
+	p.done.Add(1)
+}
+
+// estimate 按已完成分片的平均大小估算整条轨道的大小，还没有完成的分片时返回 0
+func (p *trackProgress) estimate() int64 {
+	done := p.done.Load()
+	if done == 0 {
+		return 0
+	}
+	return p.bytes.Load() * p.total / done
+}
+
+// streamManifestFile 分片目录中记录分片来源的文件
+const streamManifestFile = "manifest"
+
+// streamFingerprint 根据播放列表地址和分片列表计算指纹，用于判断已下载的分片是否属于同一个下载计划
+func streamFingerprint(uri string, segments []streamSegment, videoCount int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n", uri, videoCount)
+	for _, seg := range segments {
+		fmt.Fprintf(h, "%s %s", seg.URL, seg.ByteRange)
+		if seg.Key != nil {
+			fmt.Fprintf(h, " %s %x", seg.Key.URI, seg.Key.IV)
+		}
+		h.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// preparePartsDir 创建分片目录，目录中的清单与 fingerprint 不一致（同名文件的其他任务或播放列表已变化）
+// 或没有清单时清空已有的分片，避免把不相关的分片合并进来
+func preparePartsDir(partsDir, fingerprint string) error {
+	manifest := filepath.Join(partsDir, streamManifestFile)
+	if data, err := os.ReadFile(manifest); err == nil && string(data) == fingerprint {
+		return nil
+	}
+	if err := os.RemoveAll(partsDir); err != nil {
+		return fmt.Errorf("failed to clear segments: %w", err)
+	}
+	if err := os.MkdirAll(partsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.WriteFile(manifest, []byte(fingerprint), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// fetchSegment 下载单个分片（必要时解密）并写入 dst，返回写入的字节数
+func (n *NativeClient) fetchSegment(ctx context.Context, task *nativeTask, seg streamSegment, keys *keyCache, dst string) (int64, error) {
+	data, err := n.fetchBytes(ctx, task, seg.URL, seg.ByteRange)
+	if err != nil {
+		return 0, err
+	}
+
+	if seg.Key != nil {
+		key, err := keys.get(seg.Key.URI, func() ([]byte, error) {
+			return n.fetchBytes(ctx, task, seg.Key.URI, "")
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch key: %w", err)
+		}
+		if data, err = decryptAES128(data, key, seg.Key.IV); err != nil {
+			return 0, permanentError{fmt.Errorf("failed to decrypt segment %s: %w", seg.URL, err)}
+		}
+	}
+
+	// 先写临时文件再重命名，避免中断留下不完整的分片
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return 0, permanentError{fmt.Errorf("failed to write segment: %w", err)}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return 0, permanentError{fmt.Errorf("failed to write segment: %w", err)}
+	}
+	return int64(len(data)), nil
+}
+
+func (n *NativeClient) fetchBytes(ctx context.Context, task *nativeTask, uri, byteRange string) ([]byte, error) {
+	req, err := n.newRequest(ctx, task, uri)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", "bytes="+byteRange)
+	}
+
+	resp, err := task.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// concatParts 按顺序合并 [from, to) 范围的分片，先写临时文件再重命名
+func concatParts(filePath string, from, to int, partPath func(int) string) error {
+	tmp := filePath + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	for i := from; i < to; i++ {
+		part, err := os.Open(partPath(i))
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to open segment %d: %w", i, err)
+		}
+		_, err = io.Copy(out, part)
+		part.Close()
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to merge segment %d: %w", i, err)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filePath)
+}
+
+// muxAudio 用 ffmpeg 把视频轨和音轨无转码合并为一个 mp4，先写临时文件再重命名
+func muxAudio(ctx context.Context, video, audio, filePath string) error {
+	bin, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return errFFmpegRequired
+	}
+
+	tmp := filePath + ".tmp.mp4"
+	cmd := exec.CommandContext(ctx, bin, "-y", "-loglevel", "error",
+		"-i", video, "-i", audio, "-map", "0:v", "-map", "1:a", "-c", "copy", tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to mux audio: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, filePath)
+}
+
+// buildHLSPlan 解析 m3u8，主播放列表会选择带宽最高的变体
+func (n *NativeClient) buildHLSPlan(ctx context.Context, task *nativeTask, uri string) (*streamPlan, error) {
+	for depth := 0; depth < 3; depth++ {
+		data, err := n.fetchBytes(ctx, task, uri, "")
+		if err != nil {
+			return nil, err
+		}
+
+		variant, plan, err := parseHLSPlaylist(data, uri)
+		if err != nil {
+			return nil, permanentError{err}
+		}
+		if variant == "" {
+			return plan, nil
+		}
+		log.Printf("[Native] 🎞️  选择 HLS 变体: %s", variant)
+		uri = variant
+	}
+	return nil, permanentError{errors.New("too many nested HLS playlists")}
+}
+
+var hlsAttrPattern = regexp.MustCompile(`([A-Z0-9-]+)=("[^"]*"|[^,]*)`)
+
+func parseHLSAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range hlsAttrPattern.FindAllStringSubmatch(s, -1) {
+		attrs[m[1]] = strings.Trim(m[2], `"`)
+	}
+	return attrs
+}
+
+// parseHLSPlaylist 解析 m3u8 内容
+// 主播放列表返回带宽最高的变体地址；媒体播放列表返回下载计划
+func parseHLSPlaylist(data []byte, playlistURL string) (string, *streamPlan, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return "", nil, err
+	}
+	resolve := func(ref string) string {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return u.String()
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !scanner.Scan() || !strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff")), "#EXTM3U") {
+		return "", nil, errors.New("invalid m3u8: missing #EXTM3U")
+	}
+
+	plan := &streamPlan{}
+	var (
+		bestVariant   string
+		bestBandwidth = -1
+		pendingStream = false
+		streamBW      int
+		key           *hlsKey
+		keyIVExplicit bool
+		init          *streamSegment
+		mediaCount    int64
+		mediaSequence int64
+		byteRange     string
+		nextOffset    int64
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := parseHLSAttrs(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			streamBW, _ = strconv.Atoi(attrs["BANDWIDTH"])
+			pendingStream = true
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			mediaSequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attrs := parseHLSAttrs(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			switch attrs["METHOD"] {
+			case "NONE", "":
+				key = nil
+			case "AES-128":
+				key = &hlsKey{URI: resolve(attrs["URI"])}
+				keyIVExplicit = false
+				if iv := attrs["IV"]; iv != "" {
+					decoded, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(decoded) != aes.BlockSize {
+						return "", nil, fmt.Errorf("invalid IV: %s", iv)
+					}
+					key.IV = decoded
+					keyIVExplicit = true
+				}
+			default:
+				return "", nil, fmt.Errorf("unsupported encryption method: %s", attrs["METHOD"])
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attrs := parseHLSAttrs(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			init = &streamSegment{URL: resolve(attrs["URI"]), ByteRange: hlsByteRange(attrs["BYTERANGE"], new(int64))}
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			byteRange = hlsByteRange(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"), &nextOffset)
+		case strings.HasPrefix(line, "#"):
+			// 其他标签（#EXTINF 等）不影响下载
+		default:
+			if pendingStream {
+				if streamBW > bestBandwidth {
+					bestBandwidth = streamBW
+					bestVariant = resolve(line)
+				}
+				pendingStream = false
+				continue
+			}
+
+			seg := streamSegment{URL: resolve(line), ByteRange: byteRange}
+			if key != nil {
+				segKey := *key
+				if !keyIVExplicit {
+					// 未指定 IV 时使用分片序号（大端 128 位）
+					segKey.IV = make([]byte, aes.BlockSize)
+					binary.BigEndian.PutUint64(segKey.IV[8:], uint64(mediaSequence+mediaCount))
+				}
+				seg.Key = &segKey
+			}
+			plan.add(init, seg)
+			mediaCount++
+			byteRange = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+
+	if bestVariant != "" {
+		return bestVariant, nil, nil
+	}
+	return "", plan, nil
+}
+
+// hlsByteRange 将 "length[@offset]" 转换为 "start-end"，offset 缺省时接着上一个分片
+func hlsByteRange(s string, nextOffset *int64) string {
+	if s == "" {
+		return ""
+	}
+	parts := strings.SplitN(s, "@", 2)
+	length, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return ""
+	}
+	start := *nextOffset
+	if len(parts) == 2 {
+		if start, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return ""
+		}
+	}
+	*nextOffset = start + length
+	return fmt.Sprintf("%d-%d", start, start+length-1)
+}
+
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("ciphertext is not a multiple of the block size")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	// 去除 PKCS#7 填充
+	if len(out) == 0 {
+		return out, nil
+	}
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(out) {
+		return nil, errors.New("invalid padding")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// keyCache 同一个密钥只下载一次，下载时不持有锁，不同密钥可以并发下载
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[string]*keyEntry
+}
+
+// keyEntry 密钥下载结果，done 关闭后 key/err 可读
+type keyEntry struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{keys: make(map[string]*keyEntry)}
+}
+
+func (c *keyCache) get(uri string, fetch func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	entry, ok := c.keys[uri]
+	if !ok {
+		entry = &keyEntry{done: make(chan struct{})}
+		c.keys[uri] = entry
+	}
+	c.mu.Unlock()
+
+	if ok {
+		// 其他分片正在下载同一个密钥，等待其结果
+		<-entry.done
+		return entry.key, entry.err
+	}
+
+	entry.key, entry.err = fetch()
+	if entry.err != nil {
+		// 下载失败不缓存，之后的分片重新下载
+		c.mu.Lock()
+		delete(c.keys, uri)
+		c.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.key, entry.err
+}
+
+// DASH MPD 结构（只解析下载需要的字段）
+type mpdDocument struct {
+	XMLName                   xml.Name    `xml:"MPD"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string      `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int                 `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+}
+
+type mpdSegmentTemplate struct {
+	Media          string `xml:"media,attr"`
+	Initialization string `xml:"initialization,attr"`
+	StartNumber    *int64 `xml:"startNumber,attr"`
+	Timescale      int64  `xml:"timescale,attr"`
+	Duration       int64  `xml:"duration,attr"`
+	Timeline       []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"SegmentTimeline>S"`
+}
+
+type mpdSegmentList struct {
+	Initialization *struct {
+		SourceURL string `xml:"sourceURL,attr"`
+		Range     string `xml:"range,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// errFFmpegRequired 音视频分离的 DASH 清单需要 ffmpeg 合并音轨
+var errFFmpegRequired = errors.New("mpd has a separate audio track, muxing it requires ffmpeg in PATH")
+
+// buildDASHPlan 解析 mpd，选择带宽最高的视频 Representation
+// 音视频分离的清单同时选择带宽最高的音轨，下载后用 ffmpeg 合并；没有 ffmpeg 时在下载前直接失败，不会只下载视频
+func (n *NativeClient) buildDASHPlan(ctx context.Context, task *nativeTask, uri string) (*streamPlan, error) {
+	data, err := n.fetchBytes(ctx, task, uri, "")
+	if err != nil {
+		return nil, err
+	}
+	plan, err := parseDASHManifest(data, uri)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	if plan.Audio != nil {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return nil, permanentError{errFFmpegRequired}
+		}
+	}
+	return plan, nil
+}
+
+func parseDASHManifest(data []byte, manifestURL string) (*streamPlan, error) {
+	var mpd mpdDocument
+	if err := xml.Unmarshal(data, &mpd); err != nil {
+		return nil, fmt.Errorf("invalid mpd: %w", err)
+	}
+	if len(mpd.Periods) == 0 {
+		return nil, errors.New("invalid mpd: no period")
+	}
+
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	// BaseURL 逐级相对解析：MPD -> Period -> AdaptationSet -> Representation
+	join := func(b *url.URL, ref string) *url.URL {
+		if ref == "" {
+			return b
+		}
+		u, err := b.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return b
+		}
+		return u
+	}
+
+	plan := &streamPlan{}
+	audio := &streamPlan{}
+	for _, period := range mpd.Periods {
+		periodBase := join(join(base, mpd.BaseURL), period.BaseURL)
+
+		duration := parseISODuration(period.Duration)
+		if duration == 0 {
+			duration = parseISODuration(mpd.MediaPresentationDuration)
+		}
+
+		set, rep := pickRepresentation(period.AdaptationSets, "")
+		if rep == nil {
+			continue
+		}
+		if err := addRepresentation(plan, set, rep, join(join(periodBase, set.BaseURL), rep.BaseURL), duration); err != nil {
+			return nil, err
+		}
+
+		// 选中的是视频轨且另有独立的音轨时，同时下载音轨
+		if mediaType(set, rep) != "video" {
+			continue
+		}
+		if set, rep := pickRepresentation(period.AdaptationSets, "audio"); rep != nil {
+			if err := addRepresentation(audio, set, rep, join(join(periodBase, set.BaseURL), rep.BaseURL), duration); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(audio.Segments) > 0 {
+		plan.Audio = audio
+	}
+	return plan, nil
+}
+
+// addRepresentation 把一个 Period 中选中的 Representation 的分片追加到下载计划
+func addRepresentation(plan *streamPlan, set *mpdAdaptationSet, rep *mpdRepresentation, base *url.URL, duration float64) error {
+	segments, init, err := representationSegments(set, rep, base, duration)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		plan.add(init, seg)
+	}
+	return nil
+}
+
+// mediaType 返回 Representation 的媒体类型（video/audio/...），无法判断时返回空字符串
+func mediaType(set *mpdAdaptationSet, rep *mpdRepresentation) string {
+	if set.ContentType != "" {
+		return set.ContentType
+	}
+	for _, mime := range []string{rep.MimeType, set.MimeType} {
+		if i := strings.Index(mime, "/"); i > 0 {
+			return mime[:i]
+		}
+	}
+	return ""
+}
+
+// pickRepresentation 选择带宽最高的 Representation
+// kind 为空时视频优先，否则只在指定媒体类型中选择
+func pickRepresentation(sets []mpdAdaptationSet, kind string) (*mpdAdaptationSet, *mpdRepresentation) {
+	type candidate struct {
+		set   *mpdAdaptationSet
+		rep   *mpdRepresentation
+		video bool
+	}
+	var candidates []candidate
+	for i := range sets {
+		for j := range sets[i].Representations {
+			rep := &sets[i].Representations[j]
+			typ := mediaType(&sets[i], rep)
+			if kind != "" && typ != kind {
+				continue
+			}
+			candidates = append(candidates, candidate{&sets[i], rep, typ == "video"})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	// 视频优先，其次带宽最高
+	sort.SliceStable(candidates, func(a, b int) bool {
+		if candidates[a].video != candidates[b].video {
+			return candidates[a].video
+		}
+		return candidates[a].rep.Bandwidth > candidates[b].rep.Bandwidth
+	})
+	return candidates[0].set, candidates[0].rep
+}
+
+func representationSegments(set *mpdAdaptationSet, rep *mpdRepresentation, base *url.URL, duration float64) ([]streamSegment, *streamSegment, error) {
+	resolve := func(ref string) string {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return u.String()
+	}
+
+	if list := rep.SegmentList; list != nil {
+		var init *streamSegment
+		if list.Initialization != nil {
+			init = &streamSegment{URL: resolve(list.Initialization.SourceURL), ByteRange: list.Initialization.Range}
+			if list.Initialization.SourceURL == "" {
+				init.URL = base.String()
+			}
+		}
+		var segments []streamSegment
+		for _, s := range list.SegmentURLs {
+			ref := s.Media
+			if ref == "" {
+				ref = base.String()
+			}
+			segments = append(segments, streamSegment{URL: resolve(ref), ByteRange: s.MediaRange})
+		}
+		return segments, init, nil
+	}
+
+	tmpl := rep.SegmentTemplate
+	if tmpl == nil {
+		tmpl = set.SegmentTemplate
+	}
+	if tmpl == nil {
+		// 只有 BaseURL 的单文件 Representation
+		return []streamSegment{{URL: base.String()}}, nil, nil
+	}
+
+	fill := func(s string, number, t int64) string {
+		return expandDASHTemplate(s, map[string]int64{"Number": number, "Time": t, "Bandwidth": int64(rep.Bandwidth)}, rep.ID)
+	}
+
+	var init *streamSegment
+	if tmpl.Initialization != "" {
+		init = &streamSegment{URL: resolve(fill(tmpl.Initialization, 0, 0))}
+	}
+
+	number := int64(1)
+	if tmpl.StartNumber != nil {
+		number = *tmpl.StartNumber
+	}
+
+	var segments []streamSegment
+	if len(tmpl.Timeline) > 0 {
+		var t int64
+		for _, s := range tmpl.Timeline {
+			if s.T != nil {
+				t = *s.T
+			}
+			for i := int64(0); i <= s.R; i++ {
+				segments = append(segments, streamSegment{URL: resolve(fill(tmpl.Media, number, t))})
+				number++
+				t += s.D
+			}
+		}
+		return segments, init, nil
+	}
+
+	if tmpl.Duration <= 0 || duration <= 0 {
+		return nil, nil, errors.New("invalid mpd: cannot determine segment count")
+	}
+	timescale := tmpl.Timescale
+	if timescale <= 0 {
+		timescale = 1
+	}
+	count := int64(math.Ceil(duration * float64(timescale) / float64(tmpl.Duration)))
+	for i := int64(0); i < count; i++ {
+		segments = append(segments, streamSegment{URL: resolve(fill(tmpl.Media, number+i, i*tmpl.Duration))})
+	}
+	return segments, init, nil
+}
+
+var dashTemplatePattern = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)(%0?\d*d)?\$`)
+
+// expandDASHTemplate 替换 $RepresentationID$、$Number%05d$ 等模板变量
+func expandDASHTemplate(s string, values map[string]int64, representationID string) string {
+	s = dashTemplatePattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := dashTemplatePattern.FindStringSubmatch(m)
+		if sub[1] == "RepresentationID" {
+			return representationID
+		}
+		format := sub[2]
+		if format == "" {
+			format = "%d"
+		}
+		return fmt.Sprintf(format, values[sub[1]])
+	})
+	return strings.ReplaceAll(s, "$$", "$")
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration 解析 ISO 8601 时长（如 PT1H2M3.5S），返回秒数
+func parseISODuration(s string) float64 {
+	m := isoDurationPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0
+	}
+	var total float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if m[i+1] != "" {
+			v, _ := strconv.ParseFloat(m[i+1], 64)
+			total += v * unit
+		}
+	}
+	return total
+}
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		return &url.URL{}
+	}
+	return u
+}
@@ -0,0 +1,403 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// encryptAES128 按 HLS 的 AES-128 方式加密（CBC + PKCS#7 填充）
+func encryptAES128(t *testing.T, data, key, iv []byte) []byte {
+	t.Helper()
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+	return out
+}
+
+// newStreamServer 按路径返回固定内容，并统计每个路径的请求次数
+func newStreamServer(files map[string][]byte) (*httptest.Server, *sync.Map) {
+	hits := &sync.Map{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		count, _ := hits.LoadOrStore(r.URL.Path, new(atomic.Int64))
+		count.(*atomic.Int64).Add(1)
+		http.ServeContent(w, r, filepath.Base(r.URL.Path), time.Time{}, bytes.NewReader(data))
+	}))
+	return server, hits
+}
+
+func hitCount(hits *sync.Map, path string) int64 {
+	count, ok := hits.Load(path)
+	if !ok {
+		return 0
+	}
+	return count.(*atomic.Int64).Load()
+}
+
+func TestNativeDownloadsEncryptedHLS(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	explicitIV := bytes.Repeat([]byte{0x42}, aes.BlockSize)
+	sequenceIV := func(seq byte) []byte {
+		iv := make([]byte, aes.BlockSize)
+		iv[aes.BlockSize-1] = seq
+		return iv
+	}
+
+	plain := [][]byte{
+		bytes.Repeat([]byte("segment-0 "), 100),
+		bytes.Repeat([]byte("segment-1 "), 120),
+		bytes.Repeat([]byte("segment-2 "), 90),
+	}
+	files := map[string][]byte{
+		"/master.m3u8": []byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=100000\nlow/index.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=900000\nhigh/index.m3u8\n"),
+		"/high/index.m3u8": []byte("#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:7\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/k1\"\n" +
+			"#EXTINF:4,\nseg0.ts\n#EXTINF:4,\nseg1.ts\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/k1\",IV=0x42424242424242424242424242424242\n" +
+			"#EXTINF:4,\nseg2.ts\n#EXT-X-ENDLIST\n"),
+		"/keys/k1":        key,
+		"/high/seg0.ts":   encryptAES128(t, plain[0], key, sequenceIV(7)),
+		"/high/seg1.ts":   encryptAES128(t, plain[1], key, sequenceIV(8)),
+		"/high/seg2.ts":   encryptAES128(t, plain[2], key, explicitIV),
+		"/low/index.m3u8": []byte("#EXTM3U\n#EXTINF:4,\nlow.ts\n"),
+		"/low/low.ts":     []byte("wrong variant"),
+	}
+	server, hits := newStreamServer(files)
+	defer server.Close()
+
+	dir := t.TempDir()
+	n := NewNativeClient(dir, "", 3)
+	gid, err := n.AddURI(context.Background(), []string{server.URL + "/master.m3u8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitStatus(t, n, gid, "complete")
+
+	want := bytes.Join(plain, nil)
+	output := filepath.Join(dir, "master.ts")
+	if status.Files[0].Path != output {
+		t.Fatalf("path = %s, want %s", status.Files[0].Path, output)
+	}
+	if got, _ := os.ReadFile(output); !bytes.Equal(got, want) {
+		t.Fatalf("decrypted output mismatch: got %d bytes, want %d", len(got), len(want))
+	}
+	if status.TotalLength != int64(len(want)) {
+		t.Fatalf("total length = %d, want %d", status.TotalLength, len(want))
+	}
+	if hits := hitCount(hits, "/keys/k1"); hits != 1 {
+		t.Fatalf("key fetched %d times, want 1", hits)
+	}
+	if hitCount(hits, "/low/low.ts") != 0 {
+		t.Fatal("low bandwidth variant downloaded")
+	}
+	if _, err := os.Stat(output + streamPartsSuffix); !os.IsNotExist(err) {
+		t.Fatal("parts directory not removed")
+	}
+}
+
+func TestParseHLSInsertsEachInitSegment(t *testing.T) {
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n#EXTINF:4,\na.m4s\n#EXTINF:4,\nb.m4s\n" +
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init2.mp4\"\n#EXTINF:4,\nc.m4s\n"
+	_, plan, err := parseHLSPlaylist([]byte(playlist), "http://example.com/v/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSegmentURLs(t, plan.Segments, "init1.mp4", "a.m4s", "b.m4s", "init2.mp4", "c.m4s")
+}
+
+func assertSegmentURLs(t *testing.T, segments []streamSegment, want ...string) {
+	t.Helper()
+	var got []string
+	for _, seg := range segments {
+		got = append(got, seg.URL[strings.LastIndex(seg.URL, "/")+1:])
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("segments = %v, want %v", got, want)
+	}
+}
+
+const dashVideoOnly = `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" mediaPresentationDuration="PT6S">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/seg-$Number%03d$.m4s" startNumber="1" timescale="1" duration="2"/>
+      <Representation id="v480" bandwidth="500000"/>
+      <Representation id="v1080" bandwidth="3000000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+func TestNativeDownloadsDASH(t *testing.T) {
+	files := map[string][]byte{
+		"/dash/manifest.mpd":      []byte(dashVideoOnly),
+		"/dash/v1080/init.mp4":    []byte("INIT|"),
+		"/dash/v1080/seg-001.m4s": []byte("one|"),
+		"/dash/v1080/seg-002.m4s": []byte("two|"),
+		"/dash/v1080/seg-003.m4s": []byte("three"),
+		"/dash/v480/init.mp4":     []byte("wrong"),
+		"/dash/v480/seg-001.m4s":  []byte("wrong"),
+	}
+	server, hits := newStreamServer(files)
+	defer server.Close()
+
+	dir := t.TempDir()
+	n := NewNativeClient(dir, "", 2)
+	gid, err := n.AddURI(context.Background(), []string{server.URL + "/dash/manifest.mpd"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, n, gid, "complete")
+
+	if got, _ := os.ReadFile(filepath.Join(dir, "manifest.mp4")); string(got) != "INIT|one|two|three" {
+		t.Fatalf("output = %q", got)
+	}
+	if hitCount(hits, "/dash/v480/init.mp4") != 0 {
+		t.Fatal("low bandwidth representation downloaded")
+	}
+}
+
+func TestParseDASHMultiPeriodKeepsEachInit(t *testing.T) {
+	manifest := `<MPD>
+  <Period duration="PT4S">
+    <AdaptationSet contentType="video">
+      <SegmentTemplate initialization="p1/init.mp4" media="p1/$Number$.m4s" timescale="1" duration="2"/>
+      <Representation id="v" bandwidth="1"/>
+    </AdaptationSet>
+  </Period>
+  <Period duration="PT2S">
+    <AdaptationSet contentType="video">
+      <SegmentTemplate initialization="p2/init.mp4" media="p2/$Number$.m4s" timescale="1" duration="2"/>
+      <Representation id="v" bandwidth="1"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	plan, err := parseDASHManifest([]byte(manifest), "http://example.com/m.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, seg := range plan.Segments {
+		got = append(got, strings.TrimPrefix(seg.URL, "http://example.com/"))
+	}
+	want := "p1/init.mp4,p1/1.m4s,p1/2.m4s,p2/init.mp4,p2/1.m4s"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("segments = %v, want %s", got, want)
+	}
+	if plan.Audio != nil {
+		t.Fatal("unexpected audio track")
+	}
+}
+
+const dashSeparateAudio = `<MPD mediaPresentationDuration="PT4S">
+  <Period>
+    <AdaptationSet contentType="video">
+      <SegmentTemplate initialization="v/init.mp4" media="v/$Number$.m4s" timescale="1" duration="2"/>
+      <Representation id="v" bandwidth="2000000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4" lang="en">
+      <SegmentTemplate initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number$.m4s" timescale="1" duration="2"/>
+      <Representation id="a64" bandwidth="64000"/>
+      <Representation id="a128" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+func TestParseDASHSeparateAudio(t *testing.T) {
+	plan, err := parseDASHManifest([]byte(dashSeparateAudio), "http://example.com/m.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSegmentURLs(t, plan.Segments, "init.mp4", "1.m4s", "2.m4s")
+	if plan.Audio == nil {
+		t.Fatal("audio track not selected")
+	}
+	if !strings.HasSuffix(plan.Audio.Segments[0].URL, "/a128/init.mp4") {
+		t.Fatalf("audio init = %s, want highest bandwidth a128", plan.Audio.Segments[0].URL)
+	}
+	assertSegmentURLs(t, plan.Audio.Segments, "init.mp4", "1.m4s", "2.m4s")
+}
+
+func TestNativeRejectsDASHAudioWithoutFFmpeg(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		t.Skip("ffmpeg is installed, audio is muxed instead of rejected")
+	}
+
+	server, hits := newStreamServer(map[string][]byte{"/m.mpd": []byte(dashSeparateAudio)})
+	defer server.Close()
+
+	n := NewNativeClient(t.TempDir(), "", 2)
+	gid, err := n.AddURI(context.Background(), []string{server.URL + "/m.mpd"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := waitStatus(t, n, gid, "error")
+	if !strings.Contains(status.ErrorMessage, errFFmpegRequired.Error()) {
+		t.Fatalf("error = %q", status.ErrorMessage)
+	}
+	if hitCount(hits, "/v/init.mp4") != 0 {
+		t.Fatal("segments downloaded before rejecting the stream")
+	}
+}
+
+func TestKeyCacheFetchesOutsideLock(t *testing.T) {
+	cache := newKeyCache()
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var slowFetches atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := cache.get("slow", func() ([]byte, error) {
+				if slowFetches.Add(1) == 1 {
+					close(started)
+				}
+				<-release
+				return []byte("slow-key"), nil
+			})
+			if err != nil || string(key) != "slow-key" {
+				t.Errorf("slow key = %q, %v", key, err)
+			}
+		}()
+	}
+	<-started
+
+	// 慢密钥下载期间，其他密钥不应被阻塞
+	done := make(chan struct{})
+	go func() {
+		cache.get("fast", func() ([]byte, error) { return []byte("fast-key"), nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fetching another key blocked on the slow fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := slowFetches.Load(); n != 1 {
+		t.Fatalf("slow key fetched %d times, want 1", n)
+	}
+
+	// 失败的结果不缓存
+	fail := errors.New("boom")
+	if _, err := cache.get("flaky", func() ([]byte, error) { return nil, fail }); !errors.Is(err, fail) {
+		t.Fatalf("err = %v", err)
+	}
+	if key, err := cache.get("flaky", func() ([]byte, error) { return []byte("ok"), nil }); err != nil || string(key) != "ok" {
+		t.Fatalf("retry = %q, %v", key, err)
+	}
+}
+
+func TestMuxAudioWithFFmpeg(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	dir := t.TempDir()
+	video := filepath.Join(dir, "v.mp4")
+	audio := filepath.Join(dir, "a.mp4")
+	gen := func(out string, args ...string) {
+		cmd := exec.Command("ffmpeg", append(append([]string{"-y", "-loglevel", "error"}, args...), out)...)
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("ffmpeg cannot generate fixtures: %v: %s", err, b)
+		}
+	}
+	gen(video, "-f", "lavfi", "-i", "testsrc=duration=1:size=64x64", "-c:v", "mpeg4")
+	gen(audio, "-f", "lavfi", "-i", "sine=duration=1", "-c:a", "aac")
+
+	out := filepath.Join(dir, "out.mp4")
+	if err := muxAudio(context.Background(), video, audio, out); err != nil {
+		t.Fatal(err)
+	}
+	// ffmpeg -i 不指定输出时以非零状态退出，只检查输出的流信息
+	probe, _ := exec.Command("ffmpeg", "-i", out).CombinedOutput()
+	if !strings.Contains(string(probe), "Video:") || !strings.Contains(string(probe), "Audio:") {
+		t.Fatalf("muxed file missing a track: %s", probe)
+	}
+}
+
+func TestTrackProgressEstimatesEachTrack(t *testing.T) {
+	// 10 个 1000 字节的视频分片和 10 个 100 字节的音轨分片，各完成一部分
+	video := &trackProgress{total: 10}
+	audio := &trackProgress{total: 10}
+	video.add(1000)
+	video.add(1000)
+	audio.add(100)
+	if got := video.estimate() + audio.estimate(); got != 11000 {
+		t.Errorf("estimate = %d, want 11000", got)
+	}
+	if got := (&trackProgress{total: 10}).estimate(); got != 0 {
+		t.Errorf("estimate without finished segments = %d, want 0", got)
+	}
+}
+
+func TestPreparePartsDirDiscardsForeignParts(t *testing.T) {
+	partsDir := filepath.Join(t.TempDir(), "video.ts"+streamPartsSuffix)
+	part := filepath.Join(partsDir, "000000")
+	segments := []streamSegment{{URL: "https://example.com/a/0.ts"}, {URL: "https://example.com/a/1.ts"}}
+	fingerprint := streamFingerprint("https://example.com/a/index.m3u8", segments, len(segments))
+
+	// 没有清单的目录（其他任务或旧版本留下的）不复用
+	if err := os.MkdirAll(partsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(part, []byte("foreign"), 0644)
+	if err := preparePartsDir(partsDir, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("part without manifest kept: %v", err)
+	}
+
+	// 清单一致时保留已下载的分片
+	os.WriteFile(part, []byte("segment"), 0644)
+	if err := preparePartsDir(partsDir, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(part); err != nil {
+		t.Errorf("part with matching manifest removed: %v", err)
+	}
+
+	// 同名文件的另一个播放列表
+	other := streamFingerprint("https://example.com/b/index.m3u8", segments, len(segments))
+	if other == fingerprint {
+		t.Fatal("fingerprints of different playlists are equal")
+	}
+	if err := preparePartsDir(partsDir, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("part from another playlist kept: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(partsDir, streamManifestFile)); string(data) != other {
+		t.Errorf("manifest = %q, want %q", data, other)
+	}
+}
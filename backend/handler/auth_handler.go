@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/matrix/mynest/backend/service"
@@ -30,7 +32,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	token, err := h.service.Login(c.Request.Context(), req.Username, req.Password)
+	result, err := h.service.Login(c.Request.Context(), req.Username, req.Password, clientInfo(c))
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"success": false,
@@ -39,13 +41,320 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	// 开启了两步验证，需要再提交验证码
+	if result.ChallengeToken != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success":             true,
+			"two_factor_required": true,
+			"challenge_token":     result.ChallengeToken,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"message":       "登录成功",
+		"token":         result.AccessToken,
+		"refresh_token": result.RefreshToken,
+		"expires_in":    result.ExpiresIn,
+	})
+}
+
+// LoginTwoFactor 两步验证登录的第二步，提交验证器应用的验证码或恢复码
+func (h *AuthHandler) LoginTwoFactor(c *gin.Context) {
+	var req struct {
+		ChallengeToken string `json:"challenge_token" binding:"required"`
+		Code           string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请提供验证码",
+		})
+		return
+	}
+
+	tokens, err := h.service.LoginTwoFactor(c.Request.Context(), req.ChallengeToken, strings.TrimSpace(req.Code), clientInfo(c))
+	if err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, service.ErrTwoFactorLocked) {
+			status = http.StatusTooManyRequests
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"message":       "登录成功",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Refresh 用刷新令牌换取新的访问令牌和刷新令牌（旧的刷新令牌随即失效）
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请提供刷新令牌",
+		})
+		return
+	}
+
+	tokens, err := h.service.Refresh(c.Request.Context(), req.RefreshToken, clientInfo(c))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Logout 退出当前会话
+func (h *AuthHandler) Logout(c *gin.Context) {
+	err := h.service.RevokeSession(c.Request.Context(), c.GetUint("user_id"), c.GetUint("session_id"))
+	if err != nil && !errors.Is(err, service.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"message": "登录成功",
-		"token":   token,
+		"message": "已退出登录",
 	})
 }
 
+// LogoutAll 退出当前用户的所有会话（包括当前会话）
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	if err := h.service.RevokeSessions(c.Request.Context(), c.GetUint("user_id"), 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "已退出所有设备",
+	})
+}
+
+// ListSessions 列出当前用户的登录会话（设备、IP、最后活动时间）
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	sessions, err := h.service.ListSessions(c.Request.Context(), c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":            true,
+		"sessions":           sessions,
+		"current_session_id": c.GetUint("session_id"),
+	})
+}
+
+// RevokeSession 撤销当前用户的一个会话，该设备需要重新登录
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if err := h.service.RevokeSession(c.Request.Context(), c.GetUint("user_id"), uri.ID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, service.ErrSessionNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "会话已撤销",
+	})
+}
+
+// GetTwoFactor 获取当前用户的两步验证状态
+func (h *AuthHandler) GetTwoFactor(c *gin.Context) {
+	status, err := h.service.GetTwoFactorStatus(c.Request.Context(), c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"two_factor": status,
+	})
+}
+
+// SetupTwoFactor 生成两步验证密钥和 otpauth:// 地址（用于生成二维码），确认验证码后才开启
+func (h *AuthHandler) SetupTwoFactor(c *gin.Context) {
+	setup, err := h.service.SetupTwoFactor(c.Request.Context(), c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"secret":      setup.Secret,
+		"otpauth_url": setup.OTPAuthURL,
+	})
+}
+
+// EnableTwoFactor 提交验证码确认密钥并开启两步验证，返回恢复码
+func (h *AuthHandler) EnableTwoFactor(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请提供验证码",
+		})
+		return
+	}
+
+	codes, err := h.service.EnableTwoFactor(c.Request.Context(), c.GetUint("user_id"), c.GetUint("session_id"), strings.TrimSpace(req.Code))
+	if err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "两步验证已开启，请妥善保存恢复码",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor 关闭两步验证（需要密码和验证码）
+func (h *AuthHandler) DisableTwoFactor(c *gin.Context) {
+	var req struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请提供密码和验证码",
+		})
+		return
+	}
+
+	if err := h.service.DisableTwoFactor(c.Request.Context(), c.GetUint("user_id"), req.Password, strings.TrimSpace(req.Code)); err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "两步验证已关闭",
+	})
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码（需要密码和验证码），之前的恢复码全部失效
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "请提供密码和验证码",
+		})
+		return
+	}
+
+	codes, err := h.service.RegenerateRecoveryCodes(c.Request.Context(), c.GetUint("user_id"), req.Password, strings.TrimSpace(req.Code))
+	if err != nil {
+		c.JSON(twoFactorErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "恢复码已重新生成",
+		"recovery_codes": codes,
+	})
+}
+
+// twoFactorErrorStatus 已登录的接口中验证码错误返回 400（401 会让前端退出登录）
+func twoFactorErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrTwoFactorEnabled), errors.Is(err, service.ErrTwoFactorNotEnabled), errors.Is(err, service.ErrTwoFactorNotSetup):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrTwoFactorLocked):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// clientInfo 会话列表中显示的客户端信息
+func clientInfo(c *gin.Context) service.ClientInfo {
+	return service.ClientInfo{
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+}
+
 // GetCurrentUser 获取当前登录用户信息
 func (h *AuthHandler) GetCurrentUser(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -69,9 +378,11 @@ func (h *AuthHandler) GetCurrentUser(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"user": gin.H{
-			"id":       user.ID,
-			"username": user.Username,
-			"is_admin": user.IsAdmin,
+			"id":           user.ID,
+			"username":     user.Username,
+			"role":         user.Role,
+			"is_admin":     user.IsAdmin(),
+			"totp_enabled": user.TOTPEnabled,
 		},
 	})
 }
@@ -100,7 +411,8 @@ func (h *AuthHandler) ChangePassword(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.ChangePassword(c.Request.Context(), userID.(uint), req.OldPassword, req.NewPassword); err != nil {
+	// 修改密码后其他会话全部失效，当前会话保留
+	if err := h.service.ChangePassword(c.Request.Context(), userID.(uint), c.GetUint("session_id"), req.OldPassword, req.NewPassword); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
 			"error":   err.Error(),
@@ -110,7 +422,7 @@ func (h *AuthHandler) ChangePassword(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"message": "密码修改成功",
+		"message": "密码修改成功，其他设备已退出登录",
 	})
 }
 
@@ -1,10 +1,15 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/matrix/mynest/backend/model"
 	"github.com/matrix/mynest/backend/service"
 	"github.com/matrix/mynest/internal/types"
 )
@@ -40,20 +45,198 @@ func (h *DownloadHandler) SubmitDownload(c *gin.Context) {
 	fmt.Printf("[DEBUG] SubmitDownload - 接收到的请求: URL=%s, PluginName=%s, Category=%s, Filename=%s\n",
 		req.URL, req.PluginName, req.Category, req.Filename)
 
+	req.User = submitter(c)
+	req.OwnerID = c.GetUint("user_id")
+	if !applyTokenLimits(c, &req.Category, &req.PathTemplate) {
+		return
+	}
 	task, err := h.service.SubmitDownload(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		if respondDuplicate(c, err) {
+			return
+		}
+		c.JSON(submitErrorStatus(err), gin.H{
 			"success": false,
 			"error":   err.Error(),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	respondSubmitted(c, task)
+}
+
+// submitter 返回提交任务的用户名，使用 API Token 时返回 Token 名称
+func submitter(c *gin.Context) string {
+	if username := c.GetString("username"); username != "" {
+		return username
+	}
+	if token, ok := c.Get("api_token"); ok {
+		if apiToken, ok := token.(*model.APIToken); ok {
+			return apiToken.Name
+		}
+	}
+	return ""
+}
+
+// applyTokenLimits 使用 API Token 提交时应用 Token 的分类和路径模板限制
+// 未指定分类时使用允许的第一个分类，不允许的分类返回 403
+func applyTokenLimits(c *gin.Context, category, pathTemplate *string) bool {
+	token, ok := c.Get("api_token")
+	if !ok {
+		return true
+	}
+	apiToken, ok := token.(*model.APIToken)
+	if !ok {
+		return true
+	}
+
+	if categories := service.TokenCategories(apiToken); len(categories) > 0 {
+		if *category == "" {
+			*category = categories[0]
+		} else if !slices.Contains(categories, *category) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   fmt.Sprintf("认证令牌不允许提交分类 %s，允许的分类: %s", *category, strings.Join(categories, ", ")),
+			})
+			return false
+		}
+	}
+	*pathTemplate = apiToken.PathTemplate
+	return true
+}
+
+// respondDuplicate 提交的任务与已有任务重复时返回已有任务：link 策略视为成功，reject 策略返回 409
+func respondDuplicate(c *gin.Context, err error) bool {
+	var dup *service.DuplicateError
+	if !errors.As(err, &dup) {
+		return false
+	}
+
+	if dup.Policy == service.DuplicateLink {
+		c.JSON(http.StatusOK, gin.H{
+			"success":          true,
+			"message":          fmt.Sprintf("任务已存在（#%d），未重复添加", dup.Task.ID),
+			"task":             dup.Task,
+			"duplicate_of":     dup.Task.ID,
+			"duplicate_reason": dup.Reason,
+		})
+		return true
+	}
+
+	c.JSON(http.StatusConflict, gin.H{
+		"success":          false,
+		"error":            dup.Error(),
+		"task":             dup.Task,
+		"duplicate_of":     dup.Task.ID,
+		"duplicate_reason": dup.Reason,
+	})
+	return true
+}
+
+// respondSubmitted 返回新建的任务，allow 策略下同时告知重复的已有任务
+func respondSubmitted(c *gin.Context, task *model.DownloadTask) {
+	resp := gin.H{
 		"success": true,
 		"message": "任务已归巢",
 		"task":    task,
-	})
+	}
+	if task.DuplicateOf != nil {
+		resp["duplicate_of"] = *task.DuplicateOf
+	}
+	if task.Status == string(types.TaskStatusWaitingForSpace) {
+		resp["message"] = "任务已归巢，等待磁盘空间: " + task.ErrorMsg
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// submitErrorStatus 提交失败时的状态码：参数无效返回 400，空间或存储配额不足（disk_space_policy 为 reject）时返回 507
+func submitErrorStatus(err error) int {
+	var requestErr *service.RequestError
+	if errors.As(err, &requestErr) {
+		return http.StatusBadRequest
+	}
+	var spaceErr *service.SpaceError
+	if errors.As(err, &spaceErr) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// maxUploadSize 上传种子/metalink 文件的大小上限
+const maxUploadSize = 10 << 20
+
+// SubmitFile 上传 .torrent/.metalink 文件创建下载任务（multipart/form-data，文件字段为 file）
+func (h *DownloadHandler) SubmitFile(c *gin.Context) {
+	var req types.UploadRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "缺少上传文件",
+		})
+		return
+	}
+	if fileHeader.Size > maxUploadSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "文件过大",
+		})
+		return
+	}
+
+	f, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxUploadSize))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if req.Filename == "" {
+		req.Filename = fileHeader.Filename
+	}
+
+	req.User = submitter(c)
+	req.OwnerID = c.GetUint("user_id")
+	if !applyTokenLimits(c, &req.Category, &req.PathTemplate) {
+		return
+	}
+	task, err := h.service.SubmitFile(c.Request.Context(), req, data)
+	if err != nil {
+		if respondDuplicate(c, err) {
+			return
+		}
+		status := submitErrorStatus(err)
+		if errors.Is(err, service.ErrUnsupportedFile) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	respondSubmitted(c, task)
 }
 
 func (h *DownloadHandler) ListTasks(c *gin.Context) {
@@ -104,6 +287,7 @@ func (h *DownloadHandler) ListTasks(c *gin.Context) {
 		PluginName: params.PluginName,
 		Category:   params.Category,
 		Filename:   params.Filename,
+		OwnerID:    ownerScope(c),
 	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -163,6 +347,43 @@ func (h *DownloadHandler) RetryTask(c *gin.Context) {
 	})
 }
 
+// SelectFiles 为等待选择的 BT 任务选择要下载的文件
+// 请求体: {"indexes": [1, 3]} 或 {"rule": {"largest_video_only": true, "exclude": ["*.txt"]}}
+func (h *DownloadHandler) SelectFiles(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req struct {
+		Indexes []int                `json:"indexes"`
+		Rule    *types.FileSelection `json:"rule"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	indexes, err := h.service.SelectTaskFiles(c.Request.Context(), uri.ID, req.Indexes, req.Rule)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, service.ErrNotAwaitingSelection) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "已开始下载所选文件",
+		"indexes": indexes,
+	})
+}
+
 func (h *DownloadHandler) DeleteTask(c *gin.Context) {
 	var uri struct {
 		ID uint `uri:"id" binding:"required"`
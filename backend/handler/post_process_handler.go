@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/matrix/mynest/backend/service"
+	"gorm.io/gorm"
+)
+
+type PostProcessHandler struct {
+	service *service.PostProcessService
+}
+
+func NewPostProcessHandler(service *service.PostProcessService) *PostProcessHandler {
+	return &PostProcessHandler{service: service}
+}
+
+// RetryStep 重试任务后处理流水线中失败的步骤，step 为步骤序号（从 0 开始）
+func (h *PostProcessHandler) RetryStep(c *gin.Context) {
+	var uri struct {
+		ID   uint `uri:"id" binding:"required"`
+		Step *int `uri:"step" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	task, err := h.service.RetryStep(c.Request.Context(), uri.ID, *uri.Step)
+	if err != nil {
+		c.JSON(postProcessErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "步骤已重新加入后处理",
+		"task":    task,
+	})
+}
+
+func postProcessErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrStepNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrStepNotFailed):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
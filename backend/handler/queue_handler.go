@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/matrix/mynest/backend/service"
+	"gorm.io/gorm"
+)
+
+type QueueHandler struct {
+	service *service.QueueService
+}
+
+func NewQueueHandler(service *service.QueueService) *QueueHandler {
+	return &QueueHandler{service: service}
+}
+
+// ListQueues 列出所有队列及排队/运行中的任务数
+func (h *QueueHandler) ListQueues(c *gin.Context) {
+	queues, err := h.service.ListQueues(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"queues":  queues,
+	})
+}
+
+// CreateQueue 创建队列
+func (h *QueueHandler) CreateQueue(c *gin.Context) {
+	var req struct {
+		Name          string `json:"name" binding:"required"`
+		Priority      int    `json:"priority"`
+		MaxConcurrent int    `json:"max_concurrent"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	queue, err := h.service.CreateQueue(c.Request.Context(), req.Name, req.Priority, req.MaxConcurrent)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "队列创建成功",
+		"queue":   queue,
+	})
+}
+
+// UpdateQueue 更新队列优先级和并发上限
+func (h *QueueHandler) UpdateQueue(c *gin.Context) {
+	var req struct {
+		Priority      int `json:"priority"`
+		MaxConcurrent int `json:"max_concurrent"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if err := h.service.UpdateQueue(c.Request.Context(), c.Param("name"), req.Priority, req.MaxConcurrent); err != nil {
+		c.JSON(queueErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "队列更新成功",
+	})
+}
+
+// DeleteQueue 删除队列，其中的任务移入 default 队列
+func (h *QueueHandler) DeleteQueue(c *gin.Context) {
+	if err := h.service.DeleteQueue(c.Request.Context(), c.Param("name")); err != nil {
+		c.JSON(queueErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "队列已删除",
+	})
+}
+
+// MoveTask 调整排队任务的队列、位置和优先级
+// 请求体: {"queue": "urgent", "index": 0, "priority": 10}，index 省略时放到队尾
+func (h *QueueHandler) MoveTask(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req struct {
+		Queue    string `json:"queue"`
+		Index    *int   `json:"index"`
+		Priority *int   `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	index := -1
+	if req.Index != nil {
+		index = *req.Index
+	}
+
+	if err := h.service.MoveTask(c.Request.Context(), uri.ID, req.Queue, index, req.Priority); err != nil {
+		c.JSON(queueErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "任务已移动",
+	})
+}
+
+func queueErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrQueueNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrTaskNotQueued):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
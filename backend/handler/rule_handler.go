@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/matrix/mynest/backend/service"
+	"github.com/matrix/mynest/internal/types"
+)
+
+type RuleHandler struct {
+	service         *service.RuleService
+	downloadService *service.DownloadService
+}
+
+func NewRuleHandler(service *service.RuleService, downloadService *service.DownloadService) *RuleHandler {
+	return &RuleHandler{service: service, downloadService: downloadService}
+}
+
+// ListRules 按评估顺序列出下载规则
+func (h *RuleHandler) ListRules(c *gin.Context) {
+	rules, err := h.service.ListRules(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"rules":   rules,
+	})
+}
+
+// CreateRule 创建下载规则
+func (h *RuleHandler) CreateRule(c *gin.Context) {
+	var req service.RuleInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	rule, err := h.service.CreateRule(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"rule":    rule,
+	})
+}
+
+// UpdateRule 更新下载规则
+func (h *RuleHandler) UpdateRule(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req service.RuleInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule, err := h.service.UpdateRule(c.Request.Context(), uri.ID, req)
+	if err != nil {
+		c.JSON(ruleErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"rule":    rule,
+	})
+}
+
+// DeleteRule 删除下载规则
+func (h *RuleHandler) DeleteRule(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.service.DeleteRule(c.Request.Context(), uri.ID); err != nil {
+		c.JSON(ruleErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "规则已删除",
+	})
+}
+
+// TestRules 试运行：按提交任务的流程评估规则，返回命中的规则和生效的下载路径，不创建任务
+func (h *RuleHandler) TestRules(c *gin.Context) {
+	var req types.DownloadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	req.User = submitter(c)
+	result, pathTemplate, downloadPath, err := h.downloadService.TestRules(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"result":        result,
+		"path_template": pathTemplate,
+		"download_path": downloadPath,
+	})
+}
+
+func ruleErrorStatus(err error) int {
+	if errors.Is(err, service.ErrRuleNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
@@ -39,6 +39,19 @@ func (h *SystemConfigHandler) UpdateConfig(c *gin.Context) {
 		return
 	}
 
+	if service.IsPathTemplateConfig(req.Key) {
+		if err := service.ValidatePathTemplate(req.Value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Key == "speed_limit_schedule" {
+		if _, err := service.ParseSpeedLimitSchedule(req.Value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	if err := h.service.SetConfig(c.Request.Context(), req.Key, req.Value); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -48,4 +61,45 @@ func (h *SystemConfigHandler) UpdateConfig(c *gin.Context) {
 		"success": true,
 		"message": "配置已更新",
 	})
-}
\ No newline at end of file
+}
+
+// PreviewPathTemplate 按示例任务信息渲染路径模板，模板无效时返回 400
+func (h *SystemConfigHandler) PreviewPathTemplate(c *gin.Context) {
+	var req struct {
+		Template   string            `json:"template" binding:"required"`
+		URL        string            `json:"url"`
+		Filename   string            `json:"filename"`
+		PluginName string            `json:"plugin_name"`
+		Category   string            `json:"category"`
+		Tags       []string          `json:"tags"`
+		Metadata   map[string]string `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := service.ValidatePathTemplate(req.Template); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	path, err := service.RenderPathTemplate(req.Template, service.PathTemplateVars{
+		Plugin:   req.PluginName,
+		Category: req.Category,
+		Filename: req.Filename,
+		URL:      req.URL,
+		User:     c.GetString("username"),
+		Tags:     req.Tags,
+		Metadata: req.Metadata,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"path":    path,
+	})
+}
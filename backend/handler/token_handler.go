@@ -1,10 +1,12 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/matrix/mynest/backend/service"
+	"gorm.io/gorm"
 )
 
 type TokenHandler struct {
@@ -17,11 +19,7 @@ func NewTokenHandler(service *service.TokenService) *TokenHandler {
 
 // CreateToken 创建新的API token
 func (h *TokenHandler) CreateToken(c *gin.Context) {
-	var req struct {
-		Name        string `json:"name" binding:"required"`
-		Description string `json:"description"`
-	}
-
+	var req service.TokenInput
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -30,9 +28,9 @@ func (h *TokenHandler) CreateToken(c *gin.Context) {
 		return
 	}
 
-	token, err := h.service.CreateToken(c.Request.Context(), req.Name, req.Description)
+	token, err := h.service.CreateToken(c.Request.Context(), c.GetUint("user_id"), req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
 			"error":   err.Error(),
 		})
@@ -48,7 +46,7 @@ func (h *TokenHandler) CreateToken(c *gin.Context) {
 
 // ListTokens 列出所有tokens
 func (h *TokenHandler) ListTokens(c *gin.Context) {
-	tokens, err := h.service.ListTokens(c.Request.Context())
+	tokens, err := h.service.ListTokens(c.Request.Context(), ownerScope(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -76,7 +74,7 @@ func (h *TokenHandler) GetToken(c *gin.Context) {
 		return
 	}
 
-	token, err := h.service.GetToken(c.Request.Context(), uri.ID)
+	token, err := h.service.GetToken(c.Request.Context(), uri.ID, ownerScope(c))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"success": false,
@@ -104,11 +102,7 @@ func (h *TokenHandler) UpdateToken(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		Name        string `json:"name" binding:"required"`
-		Description string `json:"description"`
-		Enabled     bool   `json:"enabled"`
-	}
+	var req service.TokenInput
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -117,8 +111,8 @@ func (h *TokenHandler) UpdateToken(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.UpdateToken(c.Request.Context(), uri.ID, req.Name, req.Description, req.Enabled); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	if err := h.service.UpdateToken(c.Request.Context(), uri.ID, ownerScope(c), req); err != nil {
+		c.JSON(tokenErrorStatus(err), gin.H{
 			"success": false,
 			"error":   err.Error(),
 		})
@@ -144,8 +138,8 @@ func (h *TokenHandler) DeleteToken(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.DeleteToken(c.Request.Context(), uri.ID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	if err := h.service.DeleteToken(c.Request.Context(), uri.ID, ownerScope(c)); err != nil {
+		c.JSON(tokenErrorStatus(err), gin.H{
 			"success": false,
 			"error":   err.Error(),
 		})
@@ -156,4 +150,11 @@ func (h *TokenHandler) DeleteToken(c *gin.Context) {
 		"success": true,
 		"message": "Token 删除成功",
 	})
-}
\ No newline at end of file
+}
+
+func tokenErrorStatus(err error) int {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
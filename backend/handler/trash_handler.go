@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/matrix/mynest/backend/service"
+)
+
+type TrashHandler struct {
+	service *service.TrashService
+}
+
+func NewTrashHandler(service *service.TrashService) *TrashHandler {
+	return &TrashHandler{service: service}
+}
+
+// ListTrash 列出回收站中的任务及其文件
+func (h *TrashHandler) ListTrash(c *gin.Context) {
+	tasks, err := h.service.List(c.Request.Context(), ownerScope(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"tasks":   tasks,
+	})
+}
+
+// RestoreTask 恢复回收站中的任务，文件移回原位置
+func (h *TrashHandler) RestoreTask(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := h.service.Restore(c.Request.Context(), uri.ID, ownerScope(c))
+	if err != nil {
+		c.JSON(trashErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "任务已恢复",
+		"task":    task,
+	})
+}
+
+// PurgeTask 彻底删除回收站中的任务及其文件
+func (h *TrashHandler) PurgeTask(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.service.Purge(c.Request.Context(), uri.ID, ownerScope(c)); err != nil {
+		c.JSON(trashErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "任务已彻底删除",
+	})
+}
+
+func trashErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrTrashNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrTrashConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/backend/service"
+)
+
+type UserHandler struct {
+	service *service.UserService
+}
+
+func NewUserHandler(service *service.UserService) *UserHandler {
+	return &UserHandler{service: service}
+}
+
+// ownerScope 普通成员只能查看和管理自己的任务和 Token，返回其用户 ID；管理员和只读用户返回 0（不限制）
+func ownerScope(c *gin.Context) uint {
+	if c.GetString("role") == model.RoleMember {
+		return c.GetUint("user_id")
+	}
+	return 0
+}
+
+// ListUsers 列出所有用户
+func (h *UserHandler) ListUsers(c *gin.Context) {
+	users, err := h.service.ListUsers(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"users":   users,
+	})
+}
+
+// CreateUser 创建用户（{"username", "password", "role"}，角色默认为 member）
+func (h *UserHandler) CreateUser(c *gin.Context) {
+	var req service.UserInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	user, err := h.service.CreateUser(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(userErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "用户创建成功",
+		"user":    user,
+	})
+}
+
+// UpdateUser 修改用户名、密码或角色，未提供的字段保持不变
+func (h *UserHandler) UpdateUser(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	var req service.UserInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	user, err := h.service.UpdateUser(c.Request.Context(), uri.ID, req)
+	if err != nil {
+		c.JSON(userErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "用户更新成功",
+		"user":    user,
+	})
+}
+
+// DeleteUser 删除用户及其 API Token
+func (h *UserHandler) DeleteUser(c *gin.Context) {
+	var uri struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if uri.ID == c.GetUint("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "不能删除当前登录的用户",
+		})
+		return
+	}
+
+	if err := h.service.DeleteUser(c.Request.Context(), uri.ID); err != nil {
+		c.JSON(userErrorStatus(err), gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "用户删除成功",
+	})
+}
+
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrUsernameTaken), errors.Is(err, service.ErrLastAdmin):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
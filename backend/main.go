@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"path/filepath"
 
 	"github.com/gin-gonic/gin"
 	"github.com/matrix/mynest/backend/downloader"
@@ -40,14 +41,6 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	aria2Client, err := downloader.NewAria2Client(
-		viper.GetString("aria2.rpc_url"),
-		viper.GetString("aria2.rpc_secret"),
-	)
-	if err != nil {
-		log.Fatalf("Failed to initialize aria2 client: %v", err)
-	}
-
 	// JWT密钥配置
 	jwtSecret := viper.GetString("auth.jwt_secret")
 	if jwtSecret == "" {
@@ -113,10 +106,31 @@ func main() {
 	// 启动插件健康检查器
 	pluginManager.StartHealthChecker()
 
-	taskSyncService := service.NewTaskSyncService(db, aria2Client)
+	// 注册下载引擎，按系统配置选择默认引擎
+	engines, err := initDownloaders(ctx, systemConfigService)
+	if err != nil {
+		log.Fatalf("Failed to initialize downloader: %v", err)
+	}
+
+	taskSyncService := service.NewTaskSyncService(db, engines)
 	taskSyncService.Start()
 	defer taskSyncService.Stop()
 
+	// 计算已完成任务的内容哈希，检测内容重复的下载
+	contentHashService := service.NewContentHashService(db, engines)
+	contentHashService.Start()
+	defer contentHashService.Stop()
+
+	// 下载完成后按分类执行后处理流水线
+	postProcessService := service.NewPostProcessService(db, engines)
+	postProcessService.Start()
+	defer postProcessService.Stop()
+
+	// 回收站：删除的任务和文件保留一段时间，可以恢复，过期后自动彻底删除
+	trashService := service.NewTrashService(db)
+	trashService.Start()
+	defer trashService.Stop()
+
 	if err := pluginRunner.StartEnabledPlugins(); err != nil {
 		log.Printf("Failed to start enabled plugins: %v", err)
 	}
@@ -124,7 +138,19 @@ func main() {
 
 	// 使用项目根目录下的 logs 目录
 	logsService := service.NewLogsService("./logs")
-	downloadService := service.NewDownloadService(db, aria2Client)
+	downloadService := service.NewDownloadService(db, engines)
+
+	// 队列调度：任务先在 MyNest 队列中排队，按优先级和并发上限放行给下载引擎
+	queueService := service.NewQueueService(db)
+	if err := queueService.EnsureDefaultQueue(ctx, viper.GetInt("download.max_concurrent")); err != nil {
+		log.Printf("Failed to create default queue: %v", err)
+	}
+	// 下载规则：按域名、URL、扩展名、MIME 类型、大小和来源插件设置分类、路径模板、队列等
+	ruleService := service.NewRuleService(db)
+
+	queueScheduler := service.NewQueueScheduler(db, downloadService)
+	queueScheduler.Start()
+	defer queueScheduler.Stop()
 
 	// 添加一些测试日志
 	logsService.AddLog(ctx, "INFO", "system", "MyNest 系统启动", "Core service started successfully", "Main")
@@ -162,7 +188,12 @@ func main() {
 	logsHandler := handler.NewLogsHandler(logsService)
 	taskProgressHandler := handler.NewTaskProgressHandler(downloadService)
 	tokenHandler := handler.NewTokenHandler(tokenService)
+	queueHandler := handler.NewQueueHandler(queueService)
+	postProcessHandler := handler.NewPostProcessHandler(postProcessService)
+	ruleHandler := handler.NewRuleHandler(ruleService, downloadService)
+	trashHandler := handler.NewTrashHandler(trashService)
 	authHandler := handler.NewAuthHandler(authService)
+	userHandler := handler.NewUserHandler(service.NewUserService(db, authService))
 
 	// 如果有密码，记录到日志系统
 	if displayPassword != "" {
@@ -174,6 +205,10 @@ func main() {
 	}
 
 	r := gin.Default()
+	// 只信任配置的反向代理发来的 X-Forwarded-For，默认不信任任何代理，客户端 IP 取连接的来源地址
+	if err := r.SetTrustedProxies(viper.GetStringSlice("server.trusted_proxies")); err != nil {
+		log.Fatalf("Invalid server.trusted_proxies: %v", err)
+	}
 
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -190,8 +225,20 @@ func main() {
 	{
 		// 登录接口（不需要认证）
 		api.POST("/auth/login", authHandler.Login)
+		api.POST("/auth/login/2fa", authHandler.LoginTwoFactor)
+		api.POST("/auth/refresh", authHandler.Refresh)
 	}
 
+	// 角色权限：admin 管理全部任务、用户和系统配置，member 提交和管理自己的任务，readonly 只能查看任务
+	requireAdmin := authMiddleware.RequireRole(model.RoleAdmin)
+	requireWriter := authMiddleware.RequireRole(model.RoleAdmin, model.RoleMember)
+	taskOwner := authMiddleware.RequireTaskOwner()
+	// API Token 的权限范围，用户登录不受限制
+	submitScope := authMiddleware.RequireScope(model.ScopeDownloadSubmit)
+	readScope := authMiddleware.RequireScope(model.ScopeTasksRead)
+	writeScope := authMiddleware.RequireScope(model.ScopeTasksWrite)
+	pluginScope := authMiddleware.RequireScope(model.ScopePluginsManage)
+
 	// 需要用户认证的API（管理界面）
 	apiAuth := r.Group("/api/v1")
 	apiAuth.Use(authMiddleware.RequireAuth())
@@ -199,39 +246,58 @@ func main() {
 		// 用户信息
 		apiAuth.GET("/auth/me", authHandler.GetCurrentUser)
 		apiAuth.POST("/auth/change-password", authHandler.ChangePassword)
-
-		// Token 管理 API
-		apiAuth.GET("/tokens", tokenHandler.ListTokens)
-		apiAuth.POST("/tokens", tokenHandler.CreateToken)
-		apiAuth.GET("/tokens/:id", tokenHandler.GetToken)
-		apiAuth.PUT("/tokens/:id", tokenHandler.UpdateToken)
-		apiAuth.DELETE("/tokens/:id", tokenHandler.DeleteToken)
-
-		// 插件管理
-		apiAuth.GET("/plugins", pluginHandler.ListPlugins)
-		apiAuth.POST("/plugins/:name/enable", pluginHandler.EnablePlugin)
-		apiAuth.POST("/plugins/:name/disable", pluginHandler.DisablePlugin)
-		apiAuth.POST("/plugins/:name/start", pluginHandler.StartPlugin)
-		apiAuth.POST("/plugins/:name/stop", pluginHandler.StopPlugin)
-		apiAuth.POST("/plugins/:name/restart", pluginHandler.RestartPlugin)
-		apiAuth.GET("/plugins/:name/logs", pluginHandler.GetPluginLogs)
-
-		// 任务管理（管理操作，只在管理界面使用）
-		apiAuth.GET("/tasks/:id", downloadHandler.GetTask)
-		apiAuth.POST("/tasks/:id/retry", downloadHandler.RetryTask)
-		apiAuth.DELETE("/tasks/:id", downloadHandler.DeleteTask)
-		apiAuth.POST("/tasks/:id/pause", downloadHandler.PauseTask)
-		apiAuth.DELETE("/tasks/failed", downloadHandler.ClearFailedTasks)
+		apiAuth.POST("/auth/logout", authHandler.Logout)
+		apiAuth.POST("/auth/logout-all", authHandler.LogoutAll)
+		apiAuth.GET("/auth/sessions", authHandler.ListSessions)
+		apiAuth.DELETE("/auth/sessions/:id", authHandler.RevokeSession)
+		apiAuth.GET("/auth/2fa", authHandler.GetTwoFactor)
+		apiAuth.POST("/auth/2fa/setup", authHandler.SetupTwoFactor)
+		apiAuth.POST("/auth/2fa/enable", authHandler.EnableTwoFactor)
+		apiAuth.POST("/auth/2fa/disable", authHandler.DisableTwoFactor)
+		apiAuth.POST("/auth/2fa/recovery-codes", authHandler.RegenerateRecoveryCodes)
+
+		// Token 管理 API（普通成员只能管理自己的 Token）
+		apiAuth.GET("/tokens", requireWriter, tokenHandler.ListTokens)
+		apiAuth.POST("/tokens", requireWriter, tokenHandler.CreateToken)
+		apiAuth.GET("/tokens/:id", requireWriter, tokenHandler.GetToken)
+		apiAuth.PUT("/tokens/:id", requireWriter, tokenHandler.UpdateToken)
+		apiAuth.DELETE("/tokens/:id", requireWriter, tokenHandler.DeleteToken)
+
+		// 用户管理
+		apiAuth.GET("/users", requireAdmin, userHandler.ListUsers)
+		apiAuth.POST("/users", requireAdmin, userHandler.CreateUser)
+		apiAuth.PUT("/users/:id", requireAdmin, userHandler.UpdateUser)
+		apiAuth.DELETE("/users/:id", requireAdmin, userHandler.DeleteUser)
+
+		// 回收站（普通成员只能看到和恢复自己的任务）
+		apiAuth.GET("/trash", requireWriter, trashHandler.ListTrash)
+		apiAuth.POST("/trash/:id/restore", requireWriter, trashHandler.RestoreTask)
+		apiAuth.DELETE("/trash/:id", requireWriter, trashHandler.PurgeTask)
+
+		// 下载队列
+		apiAuth.GET("/queues", queueHandler.ListQueues)
+		apiAuth.POST("/queues", requireAdmin, queueHandler.CreateQueue)
+		apiAuth.PUT("/queues/:name", requireAdmin, queueHandler.UpdateQueue)
+		apiAuth.DELETE("/queues/:name", requireAdmin, queueHandler.DeleteQueue)
+		apiAuth.POST("/tasks/:id/move", requireAdmin, queueHandler.MoveTask)
+
+		// 下载规则
+		apiAuth.GET("/rules", requireAdmin, ruleHandler.ListRules)
+		apiAuth.POST("/rules", requireAdmin, ruleHandler.CreateRule)
+		apiAuth.POST("/rules/test", requireAdmin, ruleHandler.TestRules)
+		apiAuth.PUT("/rules/:id", requireAdmin, ruleHandler.UpdateRule)
+		apiAuth.DELETE("/rules/:id", requireAdmin, ruleHandler.DeleteRule)
 
 		apiAuth.GET("/downloader/status", downloadHandler.CheckDownloaderStatus)
 
 		// 系统配置
-		apiAuth.GET("/system/configs", systemConfigHandler.GetAllConfigs)
-		apiAuth.POST("/system/configs", systemConfigHandler.UpdateConfig)
+		apiAuth.GET("/system/configs", requireAdmin, systemConfigHandler.GetAllConfigs)
+		apiAuth.POST("/system/configs", requireAdmin, systemConfigHandler.UpdateConfig)
+		apiAuth.POST("/system/path-template/preview", requireAdmin, systemConfigHandler.PreviewPathTemplate)
 
-		apiAuth.GET("/system/logs", logsHandler.GetLogs)
-		apiAuth.DELETE("/system/logs", logsHandler.ClearLogs)
-		apiAuth.GET("/system/logs/stats", logsHandler.GetLogStats)
+		apiAuth.GET("/system/logs", requireAdmin, logsHandler.GetLogs)
+		apiAuth.DELETE("/system/logs", requireAdmin, logsHandler.ClearLogs)
+		apiAuth.GET("/system/logs/stats", requireAdmin, logsHandler.GetLogStats)
 	}
 
 	// 需要用户认证或API Token认证的接口（支持管理界面和扩展插件）
@@ -241,12 +307,31 @@ func main() {
 		// Token 验证（用于客户端测试连接）
 		apiAuthOrToken.GET("/verify-token", authHandler.VerifyToken)
 
-		// 提交下载任务（支持用户和插件）
-		apiAuthOrToken.POST("/download", downloadHandler.SubmitDownload)
+		// 提交下载任务（支持用户和插件，只读用户不能提交）
+		apiAuthOrToken.POST("/download", submitScope, requireWriter, downloadHandler.SubmitDownload)
+		apiAuthOrToken.POST("/download/file", submitScope, requireWriter, downloadHandler.SubmitFile)
 
-		// 任务查询（支持插件查看任务状态）
-		apiAuthOrToken.GET("/tasks", downloadHandler.ListTasks)
-		apiAuthOrToken.GET("/tasks/:id/progress", taskProgressHandler.GetProgress)
+		// 任务查询（支持插件查看任务状态，普通成员只能看到自己的任务）
+		apiAuthOrToken.GET("/tasks", readScope, downloadHandler.ListTasks)
+		apiAuthOrToken.GET("/tasks/:id", readScope, taskOwner, downloadHandler.GetTask)
+		apiAuthOrToken.GET("/tasks/:id/progress", readScope, taskOwner, taskProgressHandler.GetProgress)
+
+		// 任务管理（普通成员只能操作自己的任务）
+		apiAuthOrToken.POST("/tasks/:id/retry", writeScope, requireWriter, taskOwner, downloadHandler.RetryTask)
+		apiAuthOrToken.DELETE("/tasks/:id", writeScope, requireWriter, taskOwner, downloadHandler.DeleteTask)
+		apiAuthOrToken.POST("/tasks/:id/pause", writeScope, requireWriter, taskOwner, downloadHandler.PauseTask)
+		apiAuthOrToken.POST("/tasks/:id/select-files", writeScope, requireWriter, taskOwner, downloadHandler.SelectFiles)
+		apiAuthOrToken.DELETE("/tasks/failed", writeScope, requireAdmin, downloadHandler.ClearFailedTasks)
+		apiAuthOrToken.POST("/tasks/:id/post-process/steps/:step/retry", writeScope, requireWriter, taskOwner, postProcessHandler.RetryStep)
+
+		// 插件管理
+		apiAuthOrToken.GET("/plugins", pluginScope, requireAdmin, pluginHandler.ListPlugins)
+		apiAuthOrToken.POST("/plugins/:name/enable", pluginScope, requireAdmin, pluginHandler.EnablePlugin)
+		apiAuthOrToken.POST("/plugins/:name/disable", pluginScope, requireAdmin, pluginHandler.DisablePlugin)
+		apiAuthOrToken.POST("/plugins/:name/start", pluginScope, requireAdmin, pluginHandler.StartPlugin)
+		apiAuthOrToken.POST("/plugins/:name/stop", pluginScope, requireAdmin, pluginHandler.StopPlugin)
+		apiAuthOrToken.POST("/plugins/:name/restart", pluginScope, requireAdmin, pluginHandler.RestartPlugin)
+		apiAuthOrToken.GET("/plugins/:name/logs", pluginScope, requireAdmin, pluginHandler.GetPluginLogs)
 	}
 
 	r.GET("/health", func(c *gin.Context) {
@@ -271,12 +356,25 @@ func main() {
 // initializeSystemConfig 初始化系统配置（仅在配置不存在时设置默认值）
 func initializeSystemConfig(ctx context.Context, svc *service.SystemConfigService) {
 	configs := map[string]string{
-		"aria2_rpc_url":           viper.GetString("aria2.rpc_url"),
-		"aria2_rpc_secret":        viper.GetString("aria2.rpc_secret"),
-		"aria2_download_dir":      viper.GetString("aria2.download_dir"),
-		"download_path_template":  "{plugin}/{date}/{filename}",
-		"manual_download_path":    "manual/{filename}",
-		"chrome_extension_path":   "chrome/{filename}",
+		"aria2_rpc_url":             viper.GetString("aria2.rpc_url"),
+		"aria2_rpc_secret":          viper.GetString("aria2.rpc_secret"),
+		"aria2_download_dir":        viper.GetString("aria2.download_dir"),
+		"download_path_template":    "{plugin}/{date}/{filename}",
+		"manual_download_path":      "manual/{filename}",
+		"chrome_extension_path":     "chrome/{filename}",
+		"downloader_engine":         "aria2",
+		"max_active_downloads":      "0",
+		"retry_max_attempts":        "3",
+		"retry_base_delay":          "30",
+		"retry_max_delay":           "3600",
+		"retry_jitter":              "0.2",
+		"duplicate_policy":          "link",
+		"filename_collision_policy": "rename",
+		"disk_space_policy":         "wait",
+		"disk_reserve":              "1G",
+		"disk_reserve_percent":      "0",
+		"trash_retention_days":      "7",
+		"post_process_workers":      "2",
 	}
 
 	for key, defaultValue := range configs {
@@ -295,6 +393,46 @@ func initializeSystemConfig(ctx context.Context, svc *service.SystemConfigServic
 	}
 }
 
+// initDownloaders 注册所有下载引擎，downloader_engine 配置决定默认引擎
+// aria2: 外部 aria2 服务，支持 HTTP/FTP/BT/磁力链接；native: 内置 HTTP(S) 下载引擎，无需 aria2
+// 每个任务按 downloader_routes 规则选择引擎，未命中时使用默认引擎
+func initDownloaders(ctx context.Context, svc *service.SystemConfigService) (*downloader.Registry, error) {
+	defaultEngine, _ := svc.GetConfig(ctx, "downloader_engine")
+	if defaultEngine == "" {
+		defaultEngine = downloader.EngineAria2
+	}
+
+	registry := downloader.NewRegistry(defaultEngine)
+
+	if rpcURL := viper.GetString("aria2.rpc_url"); rpcURL != "" {
+		aria2Client, err := downloader.NewAria2Client(rpcURL, viper.GetString("aria2.rpc_secret"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize aria2 client: %w", err)
+		}
+		// 订阅 aria2 事件通知，任务状态由推送驱动，轮询仅作兜底
+		aria2Client.StartNotifications(ctx)
+		registry.Register(downloader.EngineAria2, aria2Client)
+	}
+
+	dir, _ := svc.GetConfig(ctx, "aria2_download_dir")
+	if dir == "" {
+		dir = viper.GetString("download.save_path")
+	}
+	// 任务状态中有请求头（Cookie 等），保存在下载目录以外
+	stateDir := viper.GetString("download.state_dir")
+	if stateDir == "" {
+		stateDir = filepath.Join("data", "native-tasks")
+	}
+	registry.Register(downloader.EngineNative, downloader.NewNativeClient(dir, stateDir, viper.GetInt("download.max_concurrent")))
+
+	if _, err := registry.Get(defaultEngine); err != nil {
+		return nil, fmt.Errorf("unknown downloader engine: %s", defaultEngine)
+	}
+
+	log.Printf("Downloader engines: %v, default: %s", registry.Names(), defaultEngine)
+	return registry, nil
+}
+
 // migrateOldConfigs 迁移旧的配置值到新的默认值
 func migrateOldConfigs(ctx context.Context, svc *service.SystemConfigService) {
 	// 迁移 manual_download_path: {filename} -> manual/{filename}
@@ -6,20 +6,23 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/matrix/mynest/backend/model"
 	"github.com/matrix/mynest/backend/service"
 	"gorm.io/gorm"
 )
 
 type AuthMiddleware struct {
-	db          *gorm.DB
-	authService *service.AuthService
+	db           *gorm.DB
+	authService  *service.AuthService
+	tokenService *service.TokenService
 }
 
 func NewAuthMiddleware(db *gorm.DB, authService *service.AuthService) *AuthMiddleware {
 	return &AuthMiddleware{
-		db:          db,
-		authService: authService,
+		db:           db,
+		authService:  authService,
+		tokenService: service.NewTokenService(db),
 	}
 }
 
@@ -44,9 +47,8 @@ func (m *AuthMiddleware) RequireToken() gin.HandlerFunc {
 		}
 
 		// 验证 token
-		var apiToken model.APIToken
-		result := m.db.Where("token = ? AND enabled = ?", token, true).First(&apiToken)
-		if result.Error != nil {
+		apiToken, err := m.tokenService.ValidateToken(c.Request.Context(), token)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"success": false,
 				"error":   "无效的认证令牌",
@@ -55,12 +57,24 @@ func (m *AuthMiddleware) RequireToken() gin.HandlerFunc {
 			return
 		}
 
+		if !m.checkToken(c, apiToken) {
+			return
+		}
+		if !m.setTokenOwner(c, apiToken) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "认证令牌所属的用户不存在",
+			})
+			c.Abort()
+			return
+		}
+
 		// 更新最后使用时间
 		now := time.Now()
-		m.db.Model(&apiToken).Update("last_used_at", now)
+		m.db.Model(apiToken).Update("last_used_at", now)
 
 		// 将 token 信息存入 context
-		c.Set("api_token", &apiToken)
+		c.Set("api_token", apiToken)
 		c.Next()
 	}
 }
@@ -97,14 +111,13 @@ func (m *AuthMiddleware) RequireAuth() gin.HandlerFunc {
 		}
 
 		// 将用户信息存入 context
-		if userID, ok := (*claims)["user_id"].(float64); ok {
-			c.Set("user_id", uint(userID))
-		}
-		if username, ok := (*claims)["username"].(string); ok {
-			c.Set("username", username)
-		}
-		if isAdmin, ok := (*claims)["is_admin"].(bool); ok {
-			c.Set("is_admin", isAdmin)
+		if !m.setClaimsUser(c, claims) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "用户不存在，请重新登录",
+			})
+			c.Abort()
+			return
 		}
 
 		c.Next()
@@ -133,32 +146,26 @@ func (m *AuthMiddleware) RequireAuthOrToken() gin.HandlerFunc {
 
 		// 首先尝试验证 JWT token（用户登录）
 		claims, err := m.authService.ValidateToken(token)
-		if err == nil {
-			// JWT 验证成功，将用户信息存入 context
-			if userID, ok := (*claims)["user_id"].(float64); ok {
-				c.Set("user_id", uint(userID))
-			}
-			if username, ok := (*claims)["username"].(string); ok {
-				c.Set("username", username)
-			}
-			if isAdmin, ok := (*claims)["is_admin"].(bool); ok {
-				c.Set("is_admin", isAdmin)
-			}
+		if err == nil && m.setClaimsUser(c, claims) {
+			// JWT 验证成功，用户信息已存入 context
 			c.Next()
 			return
 		}
 
 		// JWT 验证失败，尝试验证 API Token
-		var apiToken model.APIToken
-		result := m.db.Where("token = ? AND enabled = ?", token, true).First(&apiToken)
-		if result.Error == nil {
+		apiToken, err := m.tokenService.ValidateToken(c.Request.Context(), token)
+		if err == nil && m.setTokenOwner(c, apiToken) {
+			if !m.checkToken(c, apiToken) {
+				return
+			}
+
 			// API Token 验证成功
 			// 更新最后使用时间
 			now := time.Now()
-			m.db.Model(&apiToken).Update("last_used_at", now)
+			m.db.Model(apiToken).Update("last_used_at", now)
 
 			// 将 token 信息存入 context
-			c.Set("api_token", &apiToken)
+			c.Set("api_token", apiToken)
 			c.Next()
 			return
 		}
@@ -170,4 +177,123 @@ func (m *AuthMiddleware) RequireAuthOrToken() gin.HandlerFunc {
 		})
 		c.Abort()
 	}
-}
\ No newline at end of file
+}
+
+// setUser 将用户信息存入 context
+func setUser(c *gin.Context, user *model.User) {
+	c.Set("user_id", user.ID)
+	c.Set("role", user.Role)
+	c.Set("is_admin", user.IsAdmin())
+}
+
+// setClaimsUser 按 JWT 中的用户 ID 读取用户，角色以数据库为准（修改角色后立即生效），用户已删除时返回 false
+func (m *AuthMiddleware) setClaimsUser(c *gin.Context, claims *jwt.MapClaims) bool {
+	userID, ok := (*claims)["user_id"].(float64)
+	if !ok {
+		return false
+	}
+	var user model.User
+	if err := m.db.First(&user, uint(userID)).Error; err != nil {
+		return false
+	}
+	setUser(c, &user)
+	c.Set("username", user.Username)
+	if sessionID, ok := (*claims)["sid"].(float64); ok {
+		c.Set("session_id", uint(sessionID))
+	}
+	return true
+}
+
+// setTokenOwner 使用 API Token 时按 Token 所属用户的角色和权限，不设置 username（提交者记为 Token 名称）
+func (m *AuthMiddleware) setTokenOwner(c *gin.Context, apiToken *model.APIToken) bool {
+	if apiToken.OwnerID == nil {
+		return false
+	}
+	var user model.User
+	if err := m.db.First(&user, *apiToken.OwnerID).Error; err != nil {
+		return false
+	}
+	setUser(c, &user)
+	return true
+}
+
+// checkToken 检查 Token 的过期时间和 IP 允许列表，不通过时返回错误并中止请求
+func (m *AuthMiddleware) checkToken(c *gin.Context, apiToken *model.APIToken) bool {
+	if service.TokenExpired(apiToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "认证令牌已过期",
+		})
+		c.Abort()
+		return false
+	}
+	if !service.TokenAllowsIP(apiToken, c.ClientIP()) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "认证令牌不允许从 " + c.ClientIP() + " 使用",
+		})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// RequireScope 使用 API Token 时要求 Token 有指定的权限范围，用户登录（JWT）不受限制
+func (m *AuthMiddleware) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, ok := c.Get("api_token"); ok {
+			if apiToken, ok := token.(*model.APIToken); ok && !service.TokenHasScope(apiToken, scope) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"success":       false,
+					"error":         "认证令牌缺少权限: " + scope,
+					"missing_scope": scope,
+				})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireRole 只允许指定角色访问，需要在 RequireAuth 或 RequireAuthOrToken 之后使用
+func (m *AuthMiddleware) RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "权限不足",
+		})
+		c.Abort()
+	}
+}
+
+// RequireTaskOwner 普通成员只能访问自己的任务（路径参数 id，包括回收站中的任务），其他任务返回 404
+// 管理员和只读用户可以访问所有任务（只读用户的修改操作由 RequireRole 限制）
+func (m *AuthMiddleware) RequireTaskOwner() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("role") != model.RoleMember {
+			c.Next()
+			return
+		}
+
+		var count int64
+		m.db.Unscoped().Model(&model.DownloadTask{}).
+			Where("id = ? AND owner_id = ?", c.Param("id"), c.GetUint("user_id")).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "任务未找到",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/matrix/mynest/backend/model"
+	"gorm.io/datatypes"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// serveToken 以 apiToken 的身份请求经过 checkToken 和 RequireScope(scope) 的路由
+func serveToken(t *testing.T, apiToken *model.APIToken, scope, remoteAddr, forwardedFor string) (int, map[string]interface{}) {
+	t.Helper()
+	m := &AuthMiddleware{}
+	r := gin.New()
+	if err := r.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/", func(c *gin.Context) {
+		if !m.checkToken(c, apiToken) {
+			return
+		}
+		c.Set("api_token", apiToken)
+		c.Next()
+	}, m.RequireScope(scope), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, body
+}
+
+func TestCheckTokenAndRequireScope(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	scopes := datatypes.JSON(`["download:submit","tasks:read"]`)
+	allowlist := datatypes.JSON(`["192.168.1.0/24"]`)
+
+	tests := []struct {
+		name         string
+		token        model.APIToken
+		scope        string
+		remoteAddr   string
+		forwardedFor string
+		wantCode     int
+		wantError    string // 响应 error 中应包含的文字
+	}{
+		{"allowed", model.APIToken{Scopes: scopes}, model.ScopeTasksRead, "203.0.113.5:1234", "", http.StatusOK, ""},
+		{"not yet expired", model.APIToken{Scopes: scopes, ExpiresAt: &future}, model.ScopeTasksRead, "203.0.113.5:1234", "", http.StatusOK, ""},
+		{"missing scope", model.APIToken{Scopes: scopes}, model.ScopeTasksWrite, "203.0.113.5:1234", "", http.StatusForbidden, model.ScopeTasksWrite},
+		{"expired", model.APIToken{Scopes: scopes, ExpiresAt: &past}, model.ScopeTasksRead, "203.0.113.5:1234", "", http.StatusUnauthorized, "过期"},
+		{"ip in allowlist", model.APIToken{Scopes: scopes, AllowedIPs: allowlist}, model.ScopeTasksRead, "192.168.1.20:1234", "", http.StatusOK, ""},
+		{"ip outside allowlist", model.APIToken{Scopes: scopes, AllowedIPs: allowlist}, model.ScopeTasksRead, "192.168.2.20:1234", "", http.StatusForbidden, "192.168.2.20"},
+		{"forwarded by trusted proxy", model.APIToken{Scopes: scopes, AllowedIPs: allowlist}, model.ScopeTasksRead, "10.0.0.1:1234", "192.168.1.20", http.StatusOK, ""},
+		{"spoofed forwarded-for", model.APIToken{Scopes: scopes, AllowedIPs: allowlist}, model.ScopeTasksRead, "203.0.113.5:1234", "192.168.1.20", http.StatusForbidden, "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		token := tt.token
+		code, body := serveToken(t, &token, tt.scope, tt.remoteAddr, tt.forwardedFor)
+		if code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d (%v)", tt.name, code, tt.wantCode, body)
+			continue
+		}
+		if tt.wantError == "" {
+			continue
+		}
+		if msg, _ := body["error"].(string); !strings.Contains(msg, tt.wantError) {
+			t.Errorf("%s: error = %q, want it to mention %q", tt.name, msg, tt.wantError)
+		}
+	}
+
+	_, body := serveToken(t, &model.APIToken{Scopes: scopes}, model.ScopePluginsManage, "203.0.113.5:1234", "")
+	if body["missing_scope"] != model.ScopePluginsManage {
+		t.Errorf("missing_scope = %v, want %s", body["missing_scope"], model.ScopePluginsManage)
+	}
+}
+
+func TestRequireScopeAllowsUserLogin(t *testing.T) {
+	m := &AuthMiddleware{}
+	r := gin.New()
+	r.GET("/", m.RequireScope(model.ScopePluginsManage), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d for a request without API token", w.Code, http.StatusOK)
+	}
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"fmt"
 
+	"gorm.io/datatypes"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -31,9 +32,79 @@ func InitDB(cfg DBConfig) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to connect database: %w", err)
 	}
 
-	if err := db.AutoMigrate(&SystemConfig{}, &Plugin{}, &DownloadTask{}, &APIToken{}, &User{}); err != nil {
+	if err := db.AutoMigrate(&SystemConfig{}, &Plugin{}, &DownloadTask{}, &DownloadQueue{}, &DownloadRule{}, &TrashEntry{}, &TaskSource{}, &APIToken{}, &User{}, &Session{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
+	if err := migrateUserRoles(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate user roles: %w", err)
+	}
+	// 旧版本的 Token 只能提交下载和查看任务
+	if err := db.Model(&APIToken{}).Where("scopes IS NULL").
+		Update("scopes", datatypes.JSON(`["`+ScopeDownloadSubmit+`","`+ScopeTasksRead+`"]`)).Error; err != nil {
+		return nil, fmt.Errorf("failed to migrate token scopes: %w", err)
+	}
+	if err := migrateTokenHashes(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate token hashes: %w", err)
+	}
+	// 旧版本只有 aria2 引擎，engine 列为空的任务都属于 aria2
+	if err := db.Model(&DownloadTask{}).Where("engine IS NULL OR engine = ''").
+		Update("engine", "aria2").Error; err != nil {
+		return nil, fmt.Errorf("failed to migrate task engines: %w", err)
+	}
 
 	return db, nil
-}
\ No newline at end of file
+}
+
+// migrateUserRoles 把旧版本的 is_admin 转换为角色
+// 旧版本只有一个管理员账号，已有的 API Token 归属于第一个管理员
+func migrateUserRoles(db *gorm.DB) error {
+	if db.Migrator().HasColumn(&User{}, "is_admin") {
+		if err := db.Exec("UPDATE users SET role = CASE WHEN is_admin THEN ? ELSE ? END WHERE role = ''", RoleAdmin, RoleMember).Error; err != nil {
+			return err
+		}
+		if err := db.Migrator().DropColumn(&User{}, "is_admin"); err != nil {
+			return err
+		}
+	}
+	if err := db.Model(&User{}).Where("role = ''").Update("role", RoleMember).Error; err != nil {
+		return err
+	}
+
+	var admin User
+	if err := db.Where("role = ?", RoleAdmin).Order("id ASC").Limit(1).Find(&admin).Error; err != nil || admin.ID == 0 {
+		return err
+	}
+	return db.Model(&APIToken{}).Where("owner_id IS NULL").Update("owner_id", admin.ID).Error
+}
+
+// migrateTokenHashes 把旧版本明文保存的 Token 转换为前缀和哈希，然后删除明文列
+func migrateTokenHashes(db *gorm.DB) error {
+	if !db.Migrator().HasColumn("api_tokens", "token") {
+		return nil
+	}
+
+	var tokens []struct {
+		ID    uint
+		Token string
+	}
+	if err := db.Table("api_tokens").Select("id, token").
+		Where("token_hash IS NULL OR token_hash = ''").Find(&tokens).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, t := range tokens {
+			prefix := t.Token
+			if len(prefix) > TokenPrefixLength {
+				prefix = prefix[:TokenPrefixLength]
+			}
+			if err := tx.Table("api_tokens").Where("id = ?", t.ID).Updates(map[string]interface{}{
+				"prefix":     prefix,
+				"token_hash": HashToken(t.Token),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Migrator().DropColumn("api_tokens", "token")
+	})
+}
@@ -1,9 +1,12 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	"gorm.io/datatypes"
+	"gorm.io/gorm"
 )
 
 type SystemConfig struct {
@@ -26,36 +29,163 @@ type Plugin struct {
 }
 
 type DownloadTask struct {
-	ID          uint       `gorm:"primaryKey" json:"id"`
-	URL         string     `gorm:"not null;type:text" json:"url"`
-	Filename    string     `json:"filename"`
-	FilePath    string     `gorm:"type:text" json:"file_path,omitempty"`
-	Status      string     `gorm:"default:'pending'" json:"status"`
-	PluginName  string     `json:"plugin_name"`
-	Category    string     `json:"category"`
-	GID         string     `json:"gid"`
-	ErrorMsg    string     `gorm:"type:text" json:"error_msg,omitempty"`
-	CreatedAt   time.Time  `json:"created_at"`
-	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ID                uint           `gorm:"primaryKey" json:"id"`
+	URL               string         `gorm:"not null;type:text" json:"url"`
+	FinalURL          string         `gorm:"type:text" json:"final_url,omitempty"` // 探测文件名时跟随重定向后的地址
+	Source            string         `gorm:"default:'uri'" json:"source"`          // uri / torrent / metalink
+	SourceData        []byte         `gorm:"-" json:"-"`                           // 上传的种子/metalink 文件内容（保存在 TaskSource 中），提交给下载引擎时加载
+	Filename          string         `json:"filename"`
+	FilePath          string         `gorm:"type:text" json:"file_path,omitempty"`
+	TotalLength       int64          `json:"total_length,omitempty"` // 文件总大小（探测、种子或下载引擎得到），未知时为 0
+	Status            string         `gorm:"default:'pending'" json:"status"`
+	PluginName        string         `json:"plugin_name"`
+	OwnerID           *uint          `gorm:"index" json:"owner_id,omitempty"` // 提交任务的用户（API Token 的所有者），为空时只有管理员可见
+	Category          string         `json:"category"`
+	Tags              datatypes.JSON `gorm:"type:jsonb" json:"tags,omitempty"`     // 下载规则设置的标签（[]string）
+	Metadata          datatypes.JSON `gorm:"type:jsonb" json:"metadata,omitempty"` // 插件提供的元数据（map[string]string），如 tg_chat
+	Engine            string         `gorm:"default:'aria2';index" json:"engine"`  // 持有 GID 的下载引擎
+	GID               string         `json:"gid"`
+	FileSelection     datatypes.JSON `gorm:"type:jsonb" json:"file_selection,omitempty"` // BT 文件选择规则（types.FileSelection）
+	SelectedFiles     string         `json:"selected_files,omitempty"`                   // 已应用的 select-file，如 "1,3"
+	Options           datatypes.JSON `gorm:"type:jsonb" json:"-"`                        // 请求选项（types.DownloadOptions），含 Cookie 等敏感信息，不在接口中返回
+	Queue             string         `gorm:"default:'default';index" json:"queue"`       // 所属队列
+	Priority          int            `gorm:"default:0" json:"priority"`                  // 队列内优先级，数值越大越先放行
+	Position          int64          `json:"position"`                                   // 同优先级内的排队顺序，越小越靠前
+	EngineOptions     datatypes.JSON `gorm:"type:jsonb" json:"-"`                        // 排队时保存的引擎选项，放行时提交给下载引擎
+	StartAt           *time.Time     `gorm:"index" json:"start_at,omitempty"`            // 最早开始时间
+	Window            string         `gorm:"column:time_window" json:"window,omitempty"` // 下载时间窗口，如 01:00-07:00，窗口外暂停
+	WindowPaused      bool           `gorm:"default:false" json:"window_paused"`         // 因时间窗口关闭被调度器暂停
+	NormalizedURL     string         `gorm:"type:text;index" json:"-"`                   // 规范化后的 URL，用于重复检测
+	InfoHash          string         `gorm:"index" json:"info_hash,omitempty"`           // BT info-hash（magnet 或上传的种子）
+	ContentHash       string         `gorm:"index" json:"content_hash,omitempty"`        // 下载完成后文件内容的 SHA-256
+	Checksum          string         `json:"checksum,omitempty"`                         // 期望的校验值，格式同 aria2 checksum 选项，如 sha-256=<hex>
+	VerifiedAt        *time.Time     `json:"verified_at,omitempty"`                      // 校验通过的时间
+	DuplicateOf       *uint          `gorm:"index" json:"duplicate_of,omitempty"`        // 与之重复的已有任务 ID
+	ErrorMsg          string         `gorm:"type:text" json:"error_msg,omitempty"`
+	ErrorCode         string         `json:"error_code,omitempty"`                        // 最近一次失败的 aria2 错误码
+	Attempts          int            `gorm:"default:0" json:"attempts"`                   // 已失败的尝试次数
+	NextRetryAt       *time.Time     `json:"next_retry_at,omitempty"`                     // 自动重试时间，调度器在此之前不放行
+	AttemptHistory    datatypes.JSON `gorm:"type:jsonb" json:"attempt_history,omitempty"` // 每次失败尝试的记录（[]service.TaskAttempt）
+	PostProcessStatus string         `gorm:"index" json:"post_process_status,omitempty"`  // 后处理状态：pending/running/completed/failed/skipped
+	PostProcess       datatypes.JSON `gorm:"type:jsonb" json:"post_process,omitempty"`    // 后处理步骤的执行记录（service.PostProcessState）
+	CreatedAt         time.Time      `json:"created_at"`
+	CompletedAt       *time.Time     `json:"completed_at,omitempty"`
+	DeletedAt         gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"` // 删除时间，删除的任务保留在回收站中，可以恢复
 }
 
-type APIToken struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	Name        string    `gorm:"not null" json:"name"`
-	Token       string    `gorm:"uniqueIndex;not null" json:"token"`
-	Description string    `gorm:"type:text" json:"description,omitempty"`
-	Enabled     bool      `gorm:"default:true" json:"enabled"`
-	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+// DownloadQueue MyNest 侧的下载队列，调度器按队列优先级和并发上限把排队任务放行给下载引擎
+type DownloadQueue struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	Name          string    `gorm:"uniqueIndex;not null" json:"name"`
+	Priority      int       `gorm:"default:0" json:"priority"`       // 数值越大越先放行
+	MaxConcurrent int       `gorm:"default:0" json:"max_concurrent"` // 同时运行的任务数上限，0 表示不限制
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
-type User struct {
+// DownloadRule 下载规则，提交任务时按 Position 顺序评估，命中时设置分类、路径模板、队列、标签和下载选项
+type DownloadRule struct {
+	ID        uint           `gorm:"primaryKey" json:"id"`
+	Name      string         `gorm:"not null" json:"name"`
+	Enabled   bool           `json:"enabled"`
+	Position  int            `gorm:"index" json:"position"`    // 评估顺序，越小越先评估
+	Stop      bool           `json:"stop"`                     // 命中后不再评估后续规则
+	Match     datatypes.JSON `gorm:"type:jsonb" json:"match"`  // 匹配条件（service.RuleMatch）
+	Action    datatypes.JSON `gorm:"type:jsonb" json:"action"` // 命中后的动作（service.RuleAction）
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// TaskSource 上传的种子/metalink 文件，与任务分开保存，查询任务列表时不会加载文件内容
+type TaskSource struct {
+	TaskID    uint      `gorm:"primaryKey" json:"task_id"`
+	Filename  string    `json:"filename"` // 上传时的文件名
+	Data      []byte    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TrashEntry 回收站中的文件，删除任务时从下载目录移到 .trash 目录
+type TrashEntry struct {
 	ID           uint      `gorm:"primaryKey" json:"id"`
-	Username     string    `gorm:"uniqueIndex;not null" json:"username"`
-	PasswordHash string    `gorm:"not null" json:"-"`
-	IsAdmin      bool      `gorm:"default:true" json:"is_admin"`
+	TaskID       uint      `gorm:"index" json:"task_id"`
+	OriginalPath string    `gorm:"type:text" json:"original_path"` // 删除前的路径，恢复时移回
+	TrashPath    string    `gorm:"type:text" json:"trash_path"`
+	Size         int64     `json:"size"`
 	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// TokenPrefixLength 保存的 Token 前缀长度
+const TokenPrefixLength = 8
+
+// HashToken 返回 API Token 的 SHA-256（十六进制）
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type APIToken struct {
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	Name         string         `gorm:"not null" json:"name"`
+	Prefix       string         `gorm:"index" json:"prefix"`      // Token 的前几个字符，用于查找和在列表中识别
+	TokenHash    string         `gorm:"index" json:"-"`           // Token 的 SHA-256，不保存明文
+	Token        string         `gorm:"-" json:"token,omitempty"` // 明文 Token，只在创建时返回一次
+	Description  string         `gorm:"type:text" json:"description,omitempty"`
+	Enabled      bool           `gorm:"default:true" json:"enabled"`
+	OwnerID      *uint          `gorm:"index" json:"owner_id,omitempty"`                            // 所属用户，使用 Token 时按该用户的角色和权限
+	Scopes       datatypes.JSON `gorm:"type:jsonb" json:"scopes"`                                   // 权限范围（[]string），如 download:submit、tasks:read
+	ExpiresAt    *time.Time     `json:"expires_at,omitempty"`                                       // 过期时间，为空时不过期
+	Categories   datatypes.JSON `gorm:"type:jsonb" json:"categories,omitempty"`                     // 允许提交的分类（[]string），为空时不限制
+	PathTemplate string         `json:"path_template,omitempty"`                                    // 提交的任务使用的路径模板，为空时按下载规则和系统配置
+	AllowedIPs   datatypes.JSON `gorm:"column:allowed_ips;type:jsonb" json:"allowed_ips,omitempty"` // 允许使用的客户端 IP 或 CIDR（[]string），为空时不限制
+	LastUsedAt   *time.Time     `json:"last_used_at,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// API Token 的权限范围
+const (
+	ScopeDownloadSubmit = "download:submit" // 提交下载任务
+	ScopeTasksRead      = "tasks:read"      // 查看任务和进度
+	ScopeTasksWrite     = "tasks:write"     // 暂停、重试、删除任务和选择文件
+	ScopePluginsManage  = "plugins:manage"  // 管理插件（还需要所属用户是管理员）
+)
+
+// 用户角色
+const (
+	RoleAdmin    = "admin"    // 管理全部任务、用户和系统配置
+	RoleMember   = "member"   // 提交和管理自己的任务
+	RoleReadOnly = "readonly" // 只能查看任务
+)
+
+type User struct {
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	Username      string         `gorm:"uniqueIndex;not null" json:"username"`
+	PasswordHash  string         `gorm:"not null" json:"-"`
+	Role          string         `gorm:"type:varchar(20);not null;default:''" json:"role"`
+	TOTPSecret    string         `gorm:"column:totp_secret" json:"-"`                           // 两步验证密钥（base32），开启前为待验证的密钥
+	TOTPEnabled   bool           `gorm:"column:totp_enabled;default:false" json:"totp_enabled"` // 是否已开启两步验证
+	TOTPLastStep  int64          `gorm:"column:totp_last_step" json:"-"`                        // 最后使用的验证码时间步，同一验证码不能重复使用
+	RecoveryCodes datatypes.JSON `gorm:"type:jsonb" json:"-"`                                   // 未使用的恢复码的 SHA-256（[]string）
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
+
+// IsAdmin 是否为管理员
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// Session 登录会话，每次登录创建一个，刷新令牌每次使用后轮换；退出登录或撤销时删除
+type Session struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	UserID            uint      `gorm:"index;not null" json:"user_id"`
+	RefreshTokenHash  string    `gorm:"uniqueIndex;not null" json:"-"` // 当前刷新令牌的 SHA-256
+	PreviousTokenHash string    `gorm:"index" json:"-"`                // 上一个刷新令牌，再次使用说明令牌可能已泄露
+	UserAgent         string    `gorm:"type:text" json:"user_agent"`
+	IP                string    `json:"ip"`
+	LastSeenAt        time.Time `json:"last_seen_at"`
+	ExpiresAt         time.Time `json:"expires_at"` // 刷新令牌的过期时间，每次刷新后顺延
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
 }
 
@@ -15,8 +15,9 @@ import (
 )
 
 type AuthService struct {
-	db        *gorm.DB
-	jwtSecret []byte
+	db                *gorm.DB
+	jwtSecret         []byte
+	twoFactorFailures twoFactorFailures
 }
 
 func NewAuthService(db *gorm.DB, jwtSecret string) *AuthService {
@@ -95,7 +96,7 @@ func (s *AuthService) InitializeDefaultUser(ctx context.Context, configPassword
 	user := &model.User{
 		Username:     "admin",
 		PasswordHash: hashedPassword,
-		IsAdmin:      true,
+		Role:         model.RoleAdmin,
 	}
 
 	if err := s.db.Create(user).Error; err != nil {
@@ -109,37 +110,46 @@ func (s *AuthService) InitializeDefaultUser(ctx context.Context, configPassword
 	return password, true, nil
 }
 
-// Login 用户登录
-func (s *AuthService) Login(ctx context.Context, username, password string) (string, error) {
+// Login 用户登录，创建新的会话并返回访问令牌和刷新令牌
+// 用户开启了两步验证时不创建会话，返回 ChallengeToken，需要再调用 LoginTwoFactor 提交验证码
+func (s *AuthService) Login(ctx context.Context, username, password string, client ClientInfo) (*LoginResult, error) {
 	var user model.User
 	if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return "", errors.New("用户名或密码错误")
+			return nil, errors.New("用户名或密码错误")
 		}
-		return "", err
+		return nil, err
 	}
 
 	// 验证密码
 	if !s.CheckPassword(user.PasswordHash, password) {
-		return "", errors.New("用户名或密码错误")
+		return nil, errors.New("用户名或密码错误")
 	}
 
-	// 生成 JWT token
-	token, err := s.GenerateToken(&user)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate token: %w", err)
+	if user.TOTPEnabled {
+		challenge, err := s.issueChallenge(&user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate token: %w", err)
+		}
+		return &LoginResult{ChallengeToken: challenge}, nil
 	}
 
-	return token, nil
+	tokens, err := s.createSession(ctx, &user, client)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{AuthTokens: tokens}, nil
 }
 
-// GenerateToken 生成 JWT token
-func (s *AuthService) GenerateToken(user *model.User) (string, error) {
+// GenerateToken 生成 JWT 访问令牌，绑定到会话，会话撤销后立即失效
+func (s *AuthService) GenerateToken(user *model.User, sessionID uint) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":  user.ID,
 		"username": user.Username,
-		"is_admin": user.IsAdmin,
-		"exp":      time.Now().Add(24 * 7 * time.Hour).Unix(), // 7天过期
+		"role":     user.Role,
+		"is_admin": user.IsAdmin(),
+		"sid":      sessionID,
+		"exp":      time.Now().Add(accessTokenTTL).Unix(),
 		"iat":      time.Now().Unix(),
 	}
 
@@ -147,7 +157,7 @@ func (s *AuthService) GenerateToken(user *model.User) (string, error) {
 	return token.SignedString(s.jwtSecret)
 }
 
-// ValidateToken 验证 JWT token
+// ValidateToken 验证 JWT token 及其会话是否仍然有效
 func (s *AuthService) ValidateToken(tokenString string) (*jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -160,15 +170,26 @@ func (s *AuthService) ValidateToken(tokenString string) (*jwt.MapClaims, error)
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return &claims, nil
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
 	}
 
-	return nil, errors.New("invalid token")
+	// 旧版本签发的令牌没有会话 ID，需要重新登录
+	sessionID, ok := claims["sid"].(float64)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	userID, _ := claims["user_id"].(float64)
+	if err := s.touchSession(uint(sessionID), uint(userID)); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
 }
 
-// ChangePassword 修改密码
-func (s *AuthService) ChangePassword(ctx context.Context, userID uint, oldPassword, newPassword string) error {
+// ChangePassword 修改密码，同时撤销该用户除当前会话以外的所有会话
+func (s *AuthService) ChangePassword(ctx context.Context, userID, sessionID uint, oldPassword, newPassword string) error {
 	var user model.User
 	if err := s.db.First(&user, userID).Error; err != nil {
 		return err
@@ -186,7 +207,12 @@ func (s *AuthService) ChangePassword(ctx context.Context, userID uint, oldPasswo
 	}
 
 	// 更新密码
-	return s.db.Model(&user).Update("password_hash", hashedPassword).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("password_hash", hashedPassword).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, userID, sessionID)
+	})
 }
 
 // GetUserByID 根据ID获取用户
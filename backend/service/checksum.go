@@ -0,0 +1,181 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+)
+
+// maxChecksumFileSize 校验文件（如 SHA256SUMS）的大小上限
+const maxChecksumFileSize = 1 << 20
+
+// checksumAlgorithms 支持的校验算法，名称与 aria2 checksum 选项一致，值为十六进制摘要长度
+var checksumAlgorithms = map[string]int{
+	"md5":     32,
+	"sha-1":   40,
+	"sha-256": 64,
+}
+
+// parseChecksum 解析校验值，格式为 <算法>=<摘要> 或 <算法>:<摘要>，省略算法时按摘要长度推断
+// 返回 aria2 checksum 选项格式，如 sha-256=<hex>
+func parseChecksum(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	algo, digest := "", value
+	if idx := strings.IndexAny(value, "=:"); idx != -1 {
+		algo, digest = normalizeChecksumAlgo(value[:idx]), value[idx+1:]
+	}
+	digest = strings.ToLower(strings.TrimSpace(digest))
+
+	if algo == "" {
+		algo = checksumAlgoByLength(len(digest))
+	}
+	length, ok := checksumAlgorithms[algo]
+	if !ok {
+		return "", fmt.Errorf("不支持的校验算法: %s（支持 md5、sha1、sha256）", value)
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != length {
+		return "", fmt.Errorf("无效的 %s 校验值: %s", algo, digest)
+	}
+	return algo + "=" + digest, nil
+}
+
+// normalizeChecksumAlgo 将 sha256、SHA-256 等写法统一为 aria2 的算法名
+func normalizeChecksumAlgo(algo string) string {
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	switch algo {
+	case "sha1":
+		return "sha-1"
+	case "sha256":
+		return "sha-256"
+	}
+	return algo
+}
+
+func checksumAlgoByLength(length int) string {
+	for algo, l := range checksumAlgorithms {
+		if l == length {
+			return algo
+		}
+	}
+	return ""
+}
+
+// newChecksumHash 返回算法对应的哈希函数
+func newChecksumHash(algo string) hash.Hash {
+	switch algo {
+	case "md5":
+		return md5.New()
+	case "sha-1":
+		return sha1.New()
+	case "sha-256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// setTaskChecksum 校验并设置任务的期望校验值，只支持单文件的 HTTP(S)/FTP 下载
+// 指定 checksum_url 时下载校验文件，按文件名查找对应的校验值
+func (s *DownloadService) setTaskChecksum(ctx context.Context, task *model.DownloadTask, req types.DownloadRequest) error {
+	if req.Checksum == "" && req.ChecksumURL == "" {
+		return nil
+	}
+	if task.InfoHash != "" || strings.HasPrefix(strings.ToLower(task.URL), "magnet:") {
+		return &RequestError{Err: fmt.Errorf("BT 任务不支持校验值")}
+	}
+
+	value := req.Checksum
+	if value == "" {
+		filename := req.Filename
+		if filename == "" {
+			filename = s.extractFilenameFromURL(req.URL)
+		}
+		fetched, err := fetchChecksum(ctx, req.ChecksumURL, filename, req.DownloadOptions)
+		if err != nil {
+			return fmt.Errorf("获取校验文件失败: %w", err)
+		}
+		value = fetched
+	}
+
+	checksum, err := parseChecksum(value)
+	if err != nil {
+		return &RequestError{Err: err}
+	}
+	task.Checksum = checksum
+	return nil
+}
+
+// fetchChecksum 下载校验文件并查找 filename 的校验值
+// 支持 GNU 格式（<摘要>  <文件名>）、BSD 格式（SHA256 (<文件名>) = <摘要>）和只有一个摘要的文件
+func fetchChecksum(ctx context.Context, checksumURL, filename string, opts types.DownloadOptions) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checksumURL, nil)
+	if err != nil {
+		return "", err
+	}
+	setRequestHeaders(req, opts)
+
+	client := &http.Client{Timeout: 15 * time.Second, Transport: requestTransport(opts)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+
+	var entries [][2]string // 文件名, 校验值
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxChecksumFileSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// BSD 格式: SHA256 (file.iso) = abcd...
+		if open, eq := strings.Index(line, " ("), strings.LastIndex(line, ") = "); open > 0 && eq > open {
+			entries = append(entries, [2]string{line[open+2 : eq], line[:open] + "=" + line[eq+4:]})
+			continue
+		}
+
+		// GNU 格式: abcd...  file.iso 或 abcd... *file.iso
+		fields := strings.Fields(line)
+		name := ""
+		if len(fields) > 1 {
+			name = strings.TrimPrefix(strings.TrimSpace(line[len(fields[0]):]), "*")
+		}
+		entries = append(entries, [2]string{name, fields[0]})
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if filename != "" && path.Base(entry[0]) == filename {
+			return entry[1], nil
+		}
+	}
+	if len(entries) == 1 {
+		return entries[0][1], nil
+	}
+	return "", fmt.Errorf("校验文件中没有 %s 的校验值", filename)
+}
+
+// setChecksumOption 将期望校验值交给下载引擎，aria2 会在下载完成后校验，不符时以错误码 32 失败
+func setChecksumOption(task *model.DownloadTask, options map[string]interface{}) {
+	if task.Checksum != "" {
+		options["checksum"] = task.Checksum
+	}
+}
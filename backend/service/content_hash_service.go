@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/gorm"
+)
+
+const (
+	// contentHashInterval 检查新完成任务的间隔
+	contentHashInterval = 30 * time.Second
+	// contentHashBatch 每轮最多计算的任务数，避免长时间占用磁盘 IO
+	contentHashBatch = 5
+)
+
+// ContentHashService 在任务完成后读取文件：
+// 指定了期望校验值的任务先进行校验（后处理在校验通过后才开始），不符时标记为 corrupt；
+// 后处理结束后计算内容的 SHA-256（多文件任务为所有文件的清单哈希），与更早完成的任务内容相同时记录 duplicate_of。
+// 只有系统配置 duplicate_remove_files 为 true 且 duplicate_policy 不是 allow 时才删除新下载的单文件副本，
+// 任务指向已有文件；默认不删除任何文件
+type ContentHashService struct {
+	db            *gorm.DB
+	engines       *downloader.Registry
+	configService *SystemConfigService
+	stopChan      chan struct{}
+	skipped       map[uint]bool // 无法计算哈希的任务（文件不存在、无法读取），本次运行不再重试
+}
+
+func NewContentHashService(db *gorm.DB, engines *downloader.Registry) *ContentHashService {
+	return &ContentHashService{
+		db:            db,
+		engines:       engines,
+		configService: NewSystemConfigService(db),
+		stopChan:      make(chan struct{}),
+		skipped:       make(map[uint]bool),
+	}
+}
+
+// hashableStatuses 可以计算内容哈希的后处理状态：没有后处理或后处理已结束，文件不会再被移动或删除
+// 后处理失败的任务等重试完成后再计算
+var hashableStatuses = []string{"", PostProcessCompleted, PostProcessSkipped}
+
+func (s *ContentHashService) Start() {
+	ticker := time.NewTicker(contentHashInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s.hashCompleted()
+			case <-s.stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (s *ContentHashService) Stop() {
+	close(s.stopChan)
+}
+
+// hashCompleted 校验并计算尚未处理的已完成任务
+func (s *ContentHashService) hashCompleted() {
+	skipped := make([]uint, 0, len(s.skipped))
+	for id := range s.skipped {
+		skipped = append(skipped, id)
+	}
+
+	query := s.db.Where("status = ? AND file_path <> ''", string(types.TaskStatusCompleted)).
+		Where("((checksum <> '' AND verified_at IS NULL) OR (content_hash = '' AND post_process_status IN ?))", hashableStatuses)
+	if len(skipped) > 0 {
+		query = query.Where("id NOT IN ?", skipped)
+	}
+
+	var tasks []*model.DownloadTask
+	if err := query.Order("id ASC").Limit(contentHashBatch).Find(&tasks).Error; err != nil {
+		log.Printf("[ContentHash] 查询已完成任务失败: %v", err)
+		return
+	}
+
+	for _, task := range tasks {
+		select {
+		case <-s.stopChan:
+			return
+		default:
+		}
+
+		if task.Checksum != "" && task.VerifiedAt == nil {
+			s.verify(task)
+			continue
+		}
+
+		files := s.taskFiles(task)
+		hash, err := contentHash(files)
+		if err != nil {
+			log.Printf("[ContentHash] 跳过任务 %d: %v", task.ID, err)
+			s.skipped[task.ID] = true
+			continue
+		}
+		s.recordHash(task, hash, files)
+	}
+}
+
+// verify 校验有期望校验值的任务（只有单文件任务可以指定校验值），
+// 没有后处理时同时记录内容哈希，否则等后处理结束后再计算
+func (s *ContentHashService) verify(task *model.DownloadTask) {
+	hash, checksum, err := fileDigests(task.FilePath, task.Checksum)
+	if err != nil {
+		log.Printf("[ContentHash] 跳过任务 %d: %v", task.ID, err)
+		s.skipped[task.ID] = true
+		return
+	}
+	if checksum != task.Checksum {
+		s.markCorrupt(task, hash, checksum)
+		return
+	}
+
+	log.Printf("[ContentHash] ✅ 任务 %d 校验通过: %s", task.ID, task.Checksum)
+	now := time.Now()
+	if task.PostProcessStatus == "" {
+		task.VerifiedAt = &now
+		s.recordHash(task, hash, []string{task.FilePath})
+		return
+	}
+	if err := s.db.Model(task).Update("verified_at", now).Error; err != nil {
+		log.Printf("[ContentHash] 保存任务 %d 的校验结果失败: %v", task.ID, err)
+	}
+}
+
+// taskFiles 返回任务的文件：后处理过的任务使用后处理后的文件列表，BT 任务从下载引擎读取选中的文件，其余使用 file_path
+func (s *ContentHashService) taskFiles(task *model.DownloadTask) []string {
+	var files []string
+	for _, file := range postProcessStateOf(task).Files {
+		if fileExists(file) {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		files = downloadedFiles(context.Background(), s.engines, task)
+	}
+	if len(files) == 0 {
+		files = []string{task.FilePath}
+	}
+	return files
+}
+
+// markCorrupt 文件校验值与期望不符，任务标记为 corrupt，可通过重试重新下载
+func (s *ContentHashService) markCorrupt(task *model.DownloadTask, hash, checksum string) {
+	log.Printf("[ContentHash] ❌ 任务 %d 校验失败: 期望 %s, 实际 %s", task.ID, task.Checksum, checksum)
+	if err := s.db.Model(task).Updates(map[string]interface{}{
+		"status":       string(types.TaskStatusCorrupt),
+		"content_hash": hash,
+		"error_msg":    fmt.Sprintf("文件校验失败: 期望 %s, 实际 %s", task.Checksum, checksum),
+	}).Error; err != nil {
+		log.Printf("[ContentHash] 更新任务 %d 状态失败: %v", task.ID, err)
+	}
+}
+
+// recordHash 保存任务的内容哈希，与同一所有者更早完成的任务内容相同时按策略处理
+func (s *ContentHashService) recordHash(task *model.DownloadTask, hash string, files []string) {
+	updates := map[string]interface{}{"content_hash": hash}
+	if task.VerifiedAt != nil {
+		updates["verified_at"] = task.VerifiedAt
+	}
+
+	var existing model.DownloadTask
+	err := sameOwner(s.db, task).Where("content_hash = ? AND id <> ? AND status = ?", hash, task.ID, string(types.TaskStatusCompleted)).
+		Order("id ASC").First(&existing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("[ContentHash] 查询重复内容失败: %v", err)
+		return
+	}
+
+	if err == nil && existing.ID < task.ID {
+		log.Printf("[ContentHash] 🔁 任务 %d 的内容与任务 %d 相同", task.ID, existing.ID)
+		updates["duplicate_of"] = existing.ID
+
+		if s.removeDuplicates() && len(files) == 1 && files[0] == task.FilePath &&
+			existing.FilePath != task.FilePath && fileExists(existing.FilePath) {
+			if err := os.Remove(task.FilePath); err != nil {
+				log.Printf("[ContentHash] 删除重复文件失败: %v", err)
+			} else {
+				log.Printf("[ContentHash] 🗑️  已删除重复文件: %s", task.FilePath)
+				updates["file_path"] = existing.FilePath
+				updates["error_msg"] = fmt.Sprintf("内容与任务 #%d 相同，已删除重复文件", existing.ID)
+			}
+		}
+	}
+
+	if err := s.db.Model(task).Updates(updates).Error; err != nil {
+		log.Printf("[ContentHash] 保存任务 %d 的哈希失败: %v", task.ID, err)
+	}
+}
+
+// removeDuplicates 是否删除内容重复的新下载副本：需要同时开启 duplicate_remove_files 且 duplicate_policy 不是 allow
+func (s *ContentHashService) removeDuplicates() bool {
+	configs, err := s.configService.GetConfigs(context.Background(), "duplicate_remove_files", "duplicate_policy")
+	if err != nil {
+		return false
+	}
+	return configs["duplicate_remove_files"] == "true" && configs["duplicate_policy"] != DuplicateAllow
+}
+
+// contentHash 计算任务内容的 SHA-256：单文件为文件本身的哈希，
+// 多文件为各文件相对路径和哈希组成的清单的哈希，与下载目录无关
+func contentHash(files []string) (string, error) {
+	if len(files) == 1 {
+		hash, _, err := fileDigests(files[0], "")
+		return hash, err
+	}
+
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+	root := filepath.Dir(sorted[0])
+	for _, file := range sorted[1:] {
+		for root != filepath.Dir(root) && !strings.HasPrefix(file, root+string(filepath.Separator)) {
+			root = filepath.Dir(root)
+		}
+	}
+
+	manifest := sha256.New()
+	for _, file := range sorted {
+		hash, _, err := fileDigests(file, "")
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			rel = filepath.Base(file)
+		}
+		fmt.Fprintf(manifest, "%s\x00%s\n", filepath.ToSlash(rel), hash)
+	}
+	return hex.EncodeToString(manifest.Sum(nil)), nil
+}
+
+// fileDigests 读取一遍文件，计算 SHA-256 以及期望校验值所用算法的摘要（格式同 expected，如 md5=<hex>）
+// 目录不计算
+func fileDigests(path, expected string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", "", fmt.Errorf("不是普通文件: %s", path)
+	}
+
+	h := sha256.New()
+	var w io.Writer = h
+	algo, _, _ := strings.Cut(expected, "=")
+	checksumHash := newChecksumHash(algo)
+	if checksumHash != nil {
+		w = io.MultiWriter(h, checksumHash)
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return "", "", err
+	}
+
+	checksum := ""
+	if checksumHash != nil {
+		checksum = algo + "=" + hex.EncodeToString(checksumHash.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), checksum, nil
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
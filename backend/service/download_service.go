@@ -1,34 +1,240 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/matrix/mynest/backend/downloader"
 	"github.com/matrix/mynest/backend/model"
 	"github.com/matrix/mynest/internal/types"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
 type DownloadService struct {
 	db            *gorm.DB
-	downloader    downloader.Downloader
+	engines       *downloader.Registry
 	configService *SystemConfigService
+	rules         *RuleService
+	space         *SpaceGuard
+	trash         *TrashService
+	wake          chan struct{} // 有新任务排队时唤醒队列调度器
 }
 
-func NewDownloadService(db *gorm.DB, dl downloader.Downloader) *DownloadService {
+func NewDownloadService(db *gorm.DB, engines *downloader.Registry) *DownloadService {
 	return &DownloadService{
 		db:            db,
-		downloader:    dl,
+		engines:       engines,
 		configService: NewSystemConfigService(db),
+		rules:         NewRuleService(db),
+		space:         NewSpaceGuard(db, engines),
+		trash:         NewTrashService(db),
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// engineFor 返回持有任务 GID 的下载引擎
+func (s *DownloadService) engineFor(task *model.DownloadTask) (downloader.Downloader, error) {
+	return s.engines.Get(task.Engine)
+}
+
+// routeEngine 按 downloader_routes 配置（JSON 规则数组）为 URL 选择引擎，配置的规则优先于默认规则
+func (s *DownloadService) routeEngine(ctx context.Context, rawURL string) string {
+	var rules []downloader.Rule
+	if routes, err := s.configService.GetConfig(ctx, "downloader_routes"); err == nil && routes != "" {
+		if err := json.Unmarshal([]byte(routes), &rules); err != nil {
+			log.Printf("[Download] ⚠️  downloader_routes 配置无效，使用默认路由: %v", err)
+			rules = nil
+		}
+	}
+	return s.engines.Route(rawURL, rules)
+}
+
+// 任务来源
+const (
+	SourceURI      = "uri"
+	SourceTorrent  = "torrent"
+	SourceMetalink = "metalink"
+)
+
+// ErrUnsupportedFile 上传的文件不是种子或 metalink
+var ErrUnsupportedFile = errors.New("只支持种子（.torrent）和 metalink 文件")
+
+// RequestError 提交的参数无效（时间格式、元数据、请求选项、重复任务策略等），handler 返回 400
+type RequestError struct {
+	Err error
+}
+
+func (e *RequestError) Error() string { return e.Err.Error() }
+
+func (e *RequestError) Unwrap() error { return e.Err }
+
+// sourceForFile 按文件内容判断上传文件的来源类型，不依赖扩展名
+func sourceForFile(data []byte) string {
+	if _, err := torrentInfoHash(data); err == nil {
+		return SourceTorrent
+	}
+	if isMetalink(data) {
+		return SourceMetalink
+	}
+	return ""
+}
+
+// isMetalink 检查 XML 根元素是否为 metalink（v3 和 RFC 5854 的 v4 都是）
+func isMetalink(data []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local == "metalink"
+		}
+	}
+}
+
+// routeTarget 返回任务用于选择引擎的地址，上传的文件按来源类型（upload.torrent / upload.metalink）匹配扩展名规则
+func routeTarget(task *model.DownloadTask) string {
+	if task.Source != "" && task.Source != SourceURI {
+		return "upload." + task.Source
+	}
+	return task.URL
+}
+
+// torrentMagnet 返回上传种子对应的 magnet 链接，作为任务的 URL
+func torrentMagnet(infoHash, name string) string {
+	return "magnet:?xt=urn:btih:" + infoHash + "&dn=" + url.QueryEscape(name)
+}
+
+// loadSourceData 加载上传任务的种子/metalink 文件内容
+func (s *DownloadService) loadSourceData(task *model.DownloadTask) error {
+	if task.Source == "" || task.Source == SourceURI || task.SourceData != nil {
+		return nil
+	}
+	var source model.TaskSource
+	if err := s.db.Where("task_id = ?", task.ID).First(&source).Error; err != nil {
+		return fmt.Errorf("读取上传的文件失败: %w", err)
+	}
+	task.SourceData = source.Data
+	return nil
+}
+
+// discardTask 提交过程中出错时删除已创建的任务记录，避免留下永远不会放行的 pending 任务
+func (s *DownloadService) discardTask(task *model.DownloadTask) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("task_id = ?", task.ID).Delete(&model.TaskSource{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(task).Error
+	})
+	if err != nil {
+		log.Printf("[DownloadService] ⚠️  删除提交失败的任务 %d 失败: %v", task.ID, err)
+	}
+}
+
+// setFileSelectionOptions 需要选择文件的任务在元数据就绪后暂停，等待选择
+// magnet 和 .torrent 链接由 pause-metadata 暂停后续任务，上传的种子直接以暂停状态添加
+func setFileSelectionOptions(task *model.DownloadTask, options map[string]interface{}) {
+	if len(task.FileSelection) == 0 {
+		return
+	}
+	if task.Source == SourceTorrent {
+		options["pause"] = "true"
+	} else {
+		options["pause-metadata"] = "true"
+	}
+}
+
+// requestOptionsOf 解析任务保存的请求选项
+func requestOptionsOf(task *model.DownloadTask) types.DownloadOptions {
+	var opts types.DownloadOptions
+	if len(task.Options) > 0 {
+		if err := json.Unmarshal(task.Options, &opts); err != nil {
+			log.Printf("[Download] ⚠️  任务 %d 的请求选项无效: %v", task.ID, err)
+		}
+	}
+	return opts
+}
+
+// validateRequestOptions 校验请求选项，避免非法请求头或代理地址传给下载引擎
+func validateRequestOptions(opts types.DownloadOptions) error {
+	for name, value := range opts.Headers {
+		if name == "" || strings.ContainsAny(name, ": \r\n") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("无效的请求头: %q", name)
+		}
+	}
+	for _, value := range []string{opts.Cookies, opts.Referer, opts.UserAgent} {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("请求选项不能包含换行符")
+		}
+	}
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("无效的代理地址: %s", opts.Proxy)
+		}
+	}
+	if opts.MaxConnections < 0 || opts.MaxConnections > 16 {
+		return fmt.Errorf("max_connections 范围为 1-16")
+	}
+	if opts.Split < 0 {
+		return fmt.Errorf("split 不能为负数")
+	}
+	return nil
+}
+
+// requestHeaderLines 将请求头和 Cookie 转换为 aria2 header 选项格式（Name: value）
+func requestHeaderLines(opts types.DownloadOptions) []string {
+	names := make([]string, 0, len(opts.Headers))
+	for name := range opts.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		lines = append(lines, name+": "+opts.Headers[name])
+	}
+	if opts.Cookies != "" {
+		lines = append(lines, "Cookie: "+opts.Cookies)
+	}
+	return lines
+}
+
+// setRequestOptions 用任务的请求选项覆盖通用下载选项
+func setRequestOptions(task *model.DownloadTask, options map[string]interface{}) {
+	opts := requestOptionsOf(task)
+
+	if lines := requestHeaderLines(opts); len(lines) > 0 {
+		options["header"] = lines
+	}
+	if opts.Referer != "" {
+		options["referer"] = opts.Referer
+	}
+	if opts.UserAgent != "" {
+		options["user-agent"] = opts.UserAgent
+	}
+	if opts.Proxy != "" {
+		options["all-proxy"] = opts.Proxy
+	}
+	if opts.MaxConnections > 0 {
+		options["max-connection-per-server"] = opts.MaxConnections
+	}
+	if opts.Split > 0 {
+		options["split"] = opts.Split
 	}
 }
 
@@ -46,23 +252,507 @@ func setCommonDownloadOptions(options map[string]interface{}) {
 }
 
 func (s *DownloadService) SubmitDownload(ctx context.Context, req types.DownloadRequest) (*model.DownloadTask, error) {
+	rules := s.applyRules(ctx, &req)
+
+	engine := s.routeEngine(ctx, req.URL)
+	dl, err := s.engines.Get(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := s.resolveQueue(ctx, req.Queue)
+	if err != nil {
+		return nil, err
+	}
+
 	task := &model.DownloadTask{
 		URL:        req.URL,
 		Filename:   req.Filename,
 		PluginName: req.PluginName,
 		Category:   req.Category,
+		Engine:     engine,
+		Queue:      queue,
+		Priority:   req.Priority,
 		Status:     string(types.TaskStatusPending),
 	}
+	setTaskOwner(task, req.OwnerID)
+	setTaskTags(task, rules.Tags)
+	if err := setTaskMetadata(task, req.Metadata); err != nil {
+		return nil, &RequestError{Err: err}
+	}
+	if err := setTaskSchedule(task, req.StartAt, req.At, req.Window); err != nil {
+		return nil, &RequestError{Err: err}
+	}
+	if !req.DownloadOptions.IsZero() {
+		if err := validateRequestOptions(req.DownloadOptions); err != nil {
+			return nil, &RequestError{Err: err}
+		}
+		opts, err := json.Marshal(req.DownloadOptions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download options: %w", err)
+		}
+		task.Options = opts
+	}
+	if req.FileSelection != nil {
+		selection, err := json.Marshal(req.FileSelection)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file selection: %w", err)
+		}
+		task.FileSelection = selection
+	}
+	setDuplicateKeys(task)
+	if err := s.setTaskChecksum(ctx, task, req); err != nil {
+		return nil, err
+	}
+
+	if err := s.createTask(ctx, task, req.OnDuplicate, nil); err != nil {
+		return nil, err
+	}
 
-	if err := s.db.Create(task).Error; err != nil {
-		return nil, fmt.Errorf("failed to create task: %w", err)
+	// 探测 HTTP(S) 链接，得到文件大小（用于空间检查）、重定向后的地址和文件名
+	var probe *URLProbe
+	if u, err := url.Parse(req.URL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if probe, err = probeURL(ctx, req.URL, req.DownloadOptions); err != nil {
+			log.Printf("[Download] ⚠️  探测链接失败: %v", err)
+		} else {
+			task.FinalURL = probe.FinalURL
+			if downloader.StreamKind(req.URL) == "" {
+				task.TotalLength = probe.Size
+			}
+		}
 	}
 
-	// 根据不同来源获取路径模板配置
+	// 优先使用请求中的 filename，否则按探测结果（Content-Disposition、URL、文件类型）确定
+	// 文件名都经过清理，不能包含路径分隔符等字符
+	filename := SanitizeFilename(req.Filename)
+	if filename == "" {
+		filename = SanitizeFilename(s.detectFilename(req.URL, probe))
+		log.Printf("[Download] Detected filename: %s", filename)
+	}
+
+	// HLS/DASH 播放列表会被合并为单个媒体文件，替换扩展名
+	if kind := downloader.StreamKind(req.URL); kind != "" && downloader.StreamKind(filename) == kind {
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + downloader.StreamOutputExt(kind)
+		log.Printf("[Download] Detected %s playlist, output filename: %s", kind, filename)
+	}
+
+	// 应用路径模板，API Token 限定的模板优先，其次是规则指定的模板
+	pathTemplate := req.PathTemplate
+	if pathTemplate == "" {
+		pathTemplate = rules.PathTemplate
+	}
+	if pathTemplate == "" {
+		pathTemplate = s.pathTemplateFor(ctx, req.PluginName)
+	}
+	vars := taskTemplateVars(task, filename)
+	vars.User = req.User
+	downloadPath := renderDownloadPath(pathTemplate, vars)
+	log.Printf("[Download] Template: %s, Plugin: %s, Filename: %s, Result: %s",
+		pathTemplate, req.PluginName, filename, downloadPath)
+
+	options, err := s.buildOptions(ctx, dl, task, downloadPath)
+	if err != nil {
+		s.discardTask(task)
+		return nil, err
+	}
+	setFileSelectionOptions(task, options)
+	setChecksumOption(task, options)
+
+	if err := s.enqueue(ctx, task, options); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[DownloadService] 任务已加入队列: %s, Queue: %s, Engine: %s, Plugin: %s", req.URL, task.Queue, engine, req.PluginName)
+
+	return task, nil
+}
+
+// SubmitFile 提交上传的种子或 metalink 文件，作为普通下载任务跟踪
+func (s *DownloadService) SubmitFile(ctx context.Context, req types.UploadRequest, data []byte) (*model.DownloadTask, error) {
+	if len(data) == 0 {
+		return nil, &RequestError{Err: fmt.Errorf("上传的文件为空")}
+	}
+	source := sourceForFile(data)
+	if source == "" {
+		return nil, ErrUnsupportedFile
+	}
+
+	rules := s.evaluateRules(ctx, &RuleSubject{Filename: req.Filename, PluginName: req.PluginName})
+	if req.Category == "" {
+		req.Category = rules.Category
+	}
+	if req.Queue == "" {
+		req.Queue = rules.Queue
+	}
+
+	engine := s.routeEngine(ctx, routeTarget(&model.DownloadTask{Source: source}))
+	dl, err := s.engines.Get(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	var selection []byte
+	if req.FileSelection != "" {
+		var rule types.FileSelection
+		if err := json.Unmarshal([]byte(req.FileSelection), &rule); err != nil {
+			return nil, &RequestError{Err: fmt.Errorf("file_selection 格式无效: %w", err)}
+		}
+		selection, _ = json.Marshal(rule)
+	}
+
+	queue, err := s.resolveQueue(ctx, req.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	name := SanitizeFilename(strings.TrimSuffix(filepath.Base(req.Filename), filepath.Ext(req.Filename)))
+	if name == "" {
+		name = source
+	}
+	task := &model.DownloadTask{
+		Queue:         queue,
+		Priority:      req.Priority,
+		FileSelection: selection,
+		Source:        source,
+		SourceData:    data,
+		Filename:      name,
+		PluginName:    req.PluginName,
+		Category:      req.Category,
+		Engine:        engine,
+		Status:        string(types.TaskStatusPending),
+	}
+
+	if source == SourceTorrent {
+		task.TotalLength = torrentTotalLength(data)
+		if hash, err := torrentInfoHash(data); err == nil {
+			task.URL = torrentMagnet(hash, name)
+		}
+	}
+	setTaskOwner(task, req.OwnerID)
+	setTaskTags(task, rules.Tags)
+	if req.Metadata != "" {
+		var metadata map[string]string
+		if err := json.Unmarshal([]byte(req.Metadata), &metadata); err != nil {
+			return nil, &RequestError{Err: fmt.Errorf("metadata 格式无效: %w", err)}
+		}
+		if err := setTaskMetadata(task, metadata); err != nil {
+			return nil, &RequestError{Err: err}
+		}
+	}
+	var requestOptions types.DownloadOptions
+	if req.Options != "" {
+		if err := json.Unmarshal([]byte(req.Options), &requestOptions); err != nil {
+			return nil, &RequestError{Err: fmt.Errorf("options 格式无效: %w", err)}
+		}
+		if err := validateRequestOptions(requestOptions); err != nil {
+			return nil, &RequestError{Err: err}
+		}
+	}
+	// 请求中的选项优先于规则设置的选项
+	if opts := mergeDownloadOptions(requestOptions, rules.Options); !opts.IsZero() {
+		data, err := json.Marshal(opts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download options: %w", err)
+		}
+		task.Options = data
+	}
+
+	var startAt *time.Time
+	if !req.StartAt.IsZero() {
+		startAt = &req.StartAt
+	}
+	if err := setTaskSchedule(task, startAt, req.At, req.Window); err != nil {
+		return nil, &RequestError{Err: err}
+	}
+	setDuplicateKeys(task)
+
+	// 文件内容单独保存，任务列表查询不会加载
+	if err := s.createTask(ctx, task, req.OnDuplicate, &model.TaskSource{Filename: req.Filename, Data: data}); err != nil {
+		return nil, err
+	}
+
+	// 种子可能包含多个文件，以种子名作为目录，文件名由种子内容决定
+	pathTemplate := req.PathTemplate
+	if pathTemplate == "" {
+		pathTemplate = rules.PathTemplate
+	}
+	if pathTemplate == "" {
+		pathTemplate = s.pathTemplateFor(ctx, req.PluginName)
+	}
+	vars := taskTemplateVars(task, name+"/")
+	vars.User = req.User
+	downloadPath := renderDownloadPath(pathTemplate, vars)
+	log.Printf("[Download] Template: %s, Plugin: %s, Source: %s, Result: %s",
+		pathTemplate, req.PluginName, source, downloadPath)
+
+	options, err := s.buildOptions(ctx, dl, task, downloadPath)
+	if err != nil {
+		s.discardTask(task)
+		return nil, err
+	}
+	setFileSelectionOptions(task, options)
+
+	if err := s.enqueue(ctx, task, options); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[DownloadService] 任务已加入队列: %s (%s), Queue: %s, Engine: %s, Plugin: %s", req.Filename, source, task.Queue, engine, req.PluginName)
+
+	return task, nil
+}
+
+// addToEngine 按任务来源提交到下载引擎
+// metalink 中每个文件对应一个 GID，任务只跟踪第一个
+func (s *DownloadService) addToEngine(ctx context.Context, dl downloader.Downloader, task *model.DownloadTask, options map[string]interface{}) (string, error) {
+	if err := s.loadSourceData(task); err != nil {
+		return "", err
+	}
+	switch task.Source {
+	case SourceTorrent:
+		return dl.AddTorrent(ctx, task.SourceData, options)
+	case SourceMetalink:
+		gids, err := dl.AddMetalink(ctx, task.SourceData, options)
+		if err != nil {
+			return "", err
+		}
+		if len(gids) == 0 {
+			return "", fmt.Errorf("metalink 中没有可下载的文件")
+		}
+		if len(gids) > 1 {
+			log.Printf("[DownloadService] ⚠️  metalink 包含 %d 个下载，仅跟踪第一个: %v", len(gids), gids)
+		}
+		return gids[0], nil
+	default:
+		return dl.AddURI(ctx, []string{task.URL}, options)
+	}
+}
+
+// setTaskOwner 记录提交任务的用户，ownerID 为 0（未知）时任务只有管理员可见
+func setTaskOwner(task *model.DownloadTask, ownerID uint) {
+	if ownerID != 0 {
+		task.OwnerID = &ownerID
+	}
+}
+
+// setTaskMetadata 保存插件提供的元数据，键名需带插件前缀（如 tg_chat），可在路径模板中作为变量使用
+func setTaskMetadata(task *model.DownloadTask, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	for key := range metadata {
+		if !metadataVariable.MatchString(key) {
+			return fmt.Errorf("无效的元数据键名: %s（需要小写并带插件前缀，如 tg_chat）", key)
+		}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	task.Metadata = data
+	return nil
+}
+
+// renderDownloadPath 渲染下载路径并逐级清理，模板无效时（如升级前保存的配置）使用默认模板
+func renderDownloadPath(pathTemplate string, vars PathTemplateVars) string {
+	downloadPath, err := RenderPathTemplate(pathTemplate, vars)
+	if err != nil {
+		log.Printf("[Download] ⚠️  %v，使用默认模板", err)
+		downloadPath, _ = RenderPathTemplate(GetDefaultTemplate(), vars)
+	}
+	return sanitizeDownloadPath(downloadPath)
+}
+
+// taskTemplateVars 返回渲染路径模板所需的任务信息
+func taskTemplateVars(task *model.DownloadTask, filename string) PathTemplateVars {
+	vars := PathTemplateVars{
+		Plugin:   task.PluginName,
+		Category: task.Category,
+		Filename: filename,
+		URL:      task.URL,
+		TaskID:   task.ID,
+	}
+	if len(task.Tags) > 0 {
+		json.Unmarshal(task.Tags, &vars.Tags)
+	}
+	if len(task.Metadata) > 0 {
+		json.Unmarshal(task.Metadata, &vars.Metadata)
+	}
+	return vars
+}
+
+// setTaskSchedule 校验并设置任务的开始时间和下载时间窗口，at 非空时按服务器本地时间解析并覆盖 startAt
+func setTaskSchedule(task *model.DownloadTask, startAt *time.Time, at, window string) error {
+	if at != "" {
+		t, err := ParseStartAt(at, time.Now())
+		if err != nil {
+			return err
+		}
+		startAt = &t
+	}
+	window = strings.TrimSpace(window)
+	if window != "" {
+		if _, err := ParseTimeWindow(window); err != nil {
+			return err
+		}
+	}
+	task.StartAt = startAt
+	task.Window = window
+	return nil
+}
+
+// enqueue 保存引擎选项并把任务置为排队状态，由 QueueScheduler 放行给下载引擎
+// 磁盘空间或存储配额不足时按 disk_space_policy 拒绝（返回 *SpaceError）或进入 waiting_for_space
+func (s *DownloadService) enqueue(ctx context.Context, task *model.DownloadTask, options map[string]interface{}) error {
+	engineOptions, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to encode options: %w", err)
+	}
+
+	task.EngineOptions = engineOptions
+	task.Status = string(types.TaskStatusQueued)
+	task.Position = time.Now().UnixNano()
+
+	dir, _ := options["dir"].(string)
+	spaceErr := s.space.Check(ctx, task, dir, s.space.snapshot())
+	if spaceErr != nil {
+		log.Printf("[DownloadService] 💾 任务 %d: %v", task.ID, spaceErr)
+		task.ErrorMsg = spaceErr.Error()
+		if s.space.Policy(ctx) == SpacePolicyReject {
+			task.Status = string(types.TaskStatusFailed)
+		} else {
+			task.Status = string(types.TaskStatusWaitingForSpace)
+			spaceErr = nil
+		}
+	}
+
+	if err := s.db.Save(task).Error; err != nil {
+		return fmt.Errorf("failed to update task: %w", err)
+	}
+	if spaceErr != nil {
+		return spaceErr
+	}
+
+	if task.Status == string(types.TaskStatusQueued) {
+		s.notifyScheduler()
+	}
+	return nil
+}
+
+// notifyScheduler 非阻塞地唤醒调度器
+func (s *DownloadService) notifyScheduler() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// releaseTask 把排队任务提交给下载引擎，提交失败时任务标记为失败
+// progress 为本轮调度共用的已完成大小快照
+func (s *DownloadService) releaseTask(ctx context.Context, task *model.DownloadTask, progress *progressSnapshot) error {
+	// 排队期间其他任务可能已占用空间，放行前再检查一次
+	if err := s.space.Check(ctx, task, taskDir(task), progress); err != nil {
+		log.Printf("[DownloadService] 💾 任务 %d 暂不放行: %v", task.ID, err)
+		status := string(types.TaskStatusWaitingForSpace)
+		if s.space.Policy(ctx) == SpacePolicyReject {
+			status = string(types.TaskStatusFailed)
+		}
+		s.db.Model(task).Updates(map[string]interface{}{
+			"status":    status,
+			"error_msg": err.Error(),
+		})
+		return err
+	}
+
+	// 暂停后恢复的任务仍在引擎中，直接继续下载
+	if resumed, err := s.resumeInEngine(ctx, task); resumed || err != nil {
+		return err
+	}
+
+	gid, err := s.submitToEngine(ctx, task)
+	var exists *FileExistsError
+	if errors.As(err, &exists) {
+		// skip 策略：不下载，任务直接指向已有文件
+		log.Printf("[DownloadService] ⏭️  任务 %d 的目标文件已存在，跳过下载: %s", task.ID, exists.Path)
+		now := time.Now()
+		s.db.Model(task).Updates(map[string]interface{}{
+			"status":       string(types.TaskStatusCompleted),
+			"file_path":    exists.Path,
+			"completed_at": &now,
+			"error_msg":    exists.Error(),
+		})
+		return err
+	}
+	if err != nil {
+		log.Printf("[DownloadService] ❌ 下载任务添加失败: URL=%s, Plugin=%s, Error=%v", task.URL, task.PluginName, err)
+		s.db.Model(task).Updates(map[string]interface{}{
+			"status":    string(types.TaskStatusFailed),
+			"error_msg": err.Error(),
+		})
+		return fmt.Errorf("failed to add download: %w", err)
+	}
+
+	log.Printf("[DownloadService] 开始下载任务: %s, Queue: %s, Engine: %s, GID: %s, Plugin: %s", task.URL, task.Queue, task.Engine, gid, task.PluginName)
+	return s.db.Model(task).Updates(map[string]interface{}{
+		"gid":       gid,
+		"status":    string(types.TaskStatusDownloading),
+		"error_msg": "",
+	}).Error
+}
+
+// resumeInEngine 恢复引擎中处于暂停状态的任务，任务不在引擎中（如引擎已重启）时返回 false，由调用方重新提交
+func (s *DownloadService) resumeInEngine(ctx context.Context, task *model.DownloadTask) (bool, error) {
+	if task.GID == "" {
+		return false, nil
+	}
+	dl, err := s.engineFor(task)
+	if err != nil {
+		return false, nil
+	}
+	if status, err := dl.TellStatus(ctx, task.GID); err != nil || status.Status != "paused" {
+		return false, nil
+	}
+
+	if err := dl.Unpause(ctx, task.GID); err != nil {
+		log.Printf("[DownloadService] ❌ 恢复任务 %d 失败 (GID: %s): %v", task.ID, task.GID, err)
+		s.db.Model(task).Updates(map[string]interface{}{
+			"status":    string(types.TaskStatusPaused),
+			"error_msg": fmt.Sprintf("恢复下载失败: %v", err),
+		})
+		return true, fmt.Errorf("恢复下载失败: %w", err)
+	}
+
+	log.Printf("[DownloadService] ▶️  恢复任务 %d, Queue: %s, GID: %s", task.ID, task.Queue, task.GID)
+	return true, s.db.Model(task).Updates(map[string]interface{}{
+		"status":    string(types.TaskStatusDownloading),
+		"error_msg": "",
+	}).Error
+}
+
+// submitToEngine 按排队时保存的选项把任务提交给所属引擎
+func (s *DownloadService) submitToEngine(ctx context.Context, task *model.DownloadTask) (string, error) {
+	dl, err := s.engineFor(task)
+	if err != nil {
+		return "", err
+	}
+
+	options := make(map[string]interface{})
+	if len(task.EngineOptions) > 0 {
+		if err := json.Unmarshal(task.EngineOptions, &options); err != nil {
+			return "", fmt.Errorf("invalid engine options: %w", err)
+		}
+	}
+	if err := s.applyCollisionPolicy(ctx, task, options); err != nil {
+		return "", err
+	}
+	return s.addToEngine(ctx, dl, task, options)
+}
+
+// pathTemplateFor 根据不同来源获取路径模板配置
+func (s *DownloadService) pathTemplateFor(ctx context.Context, pluginName string) string {
 	var pathTemplate string
 	var err error
 
-	switch req.PluginName {
+	switch pluginName {
 	case "manual", "web": // 手动下载（兼容旧的 "web"）
 		pathTemplate, err = s.configService.GetConfig(ctx, "manual_download_path")
 		if err != nil || pathTemplate == "" {
@@ -80,29 +770,16 @@ func (s *DownloadService) SubmitDownload(ctx context.Context, req types.Download
 		}
 	}
 
-	// 优先级：1. 请求中的 filename  2. URL 中的文件名  3. Content-Type 检测
-	filename := req.Filename
-	if filename == "" {
-		// 尝试从 URL 提取文件名
-		filename = s.extractFilenameFromURL(req.URL)
-		if filename == "" {
-			// URL 中没有文件名，通过 Content-Type 检测
-			filename = s.detectFilenameByContentType(ctx, req.URL)
-			log.Printf("[Download] Detected filename by Content-Type: %s", filename)
-		} else {
-			log.Printf("[Download] Extracted filename from URL: %s", filename)
-		}
-	}
-
-	// 应用路径模板
-	downloadPath := ApplyPathTemplate(pathTemplate, req.PluginName, filename)
-	log.Printf("[Download] Template: %s, Plugin: %s, Filename: %s, Result: %s",
-		pathTemplate, req.PluginName, filename, downloadPath)
+	return pathTemplate
+}
 
+// buildOptions 获取下载目录并按模板路径生成下载选项
+// 模板路径以 / 结尾时只指定目录，否则拆分为 dir 和 out 并把文件名写回任务
+func (s *DownloadService) buildOptions(ctx context.Context, dl downloader.Downloader, task *model.DownloadTask, downloadPath string) (map[string]interface{}, error) {
 	// 获取 aria2 基础下载目录
 	baseDir, err := s.configService.GetConfig(ctx, "aria2_download_dir")
 	if err != nil || baseDir == "" {
-		opts, err := s.downloader.GetGlobalOption(ctx)
+		opts, err := dl.GetGlobalOption(ctx)
 		if err == nil {
 			if dir, ok := opts["dir"].(string); ok && dir != "" {
 				baseDir = dir
@@ -119,28 +796,37 @@ func (s *DownloadService) SubmitDownload(ctx context.Context, req types.Download
 
 	options := make(map[string]interface{})
 	setCommonDownloadOptions(options)
+	setRequestOptions(task, options)
 
 	if downloadPath != "" {
+		dirPath := filepath.Dir(downloadPath)
+		if strings.HasSuffix(downloadPath, "/") {
+			dirPath = strings.TrimSuffix(downloadPath, "/")
+		}
+		fullDirPath, err := resolveDownloadDir(baseDir, dirPath)
+		if err != nil {
+			task.Status = string(types.TaskStatusFailed)
+			task.ErrorMsg = err.Error()
+			s.db.Save(task)
+			return nil, err
+		}
+
 		if strings.HasSuffix(downloadPath, "/") {
 			// 只有目录，让 aria2 自动命名
-			dirPath := strings.TrimSuffix(downloadPath, "/")
-			fullPath := filepath.Join(baseDir, dirPath)
-			if err := os.MkdirAll(fullPath, 0755); err != nil {
-				log.Printf("[Download] Failed to create directory %s: %v", fullPath, err)
+			if err := os.MkdirAll(fullDirPath, 0755); err != nil {
+				log.Printf("[Download] Failed to create directory %s: %v", fullDirPath, err)
 			} else {
-				log.Printf("[Download] Created directory: %s", fullPath)
+				log.Printf("[Download] Created directory: %s", fullDirPath)
 				// 确保 aria2 容器可以写入
-				if err := os.Chmod(fullPath, 0755); err != nil {
+				if err := os.Chmod(fullDirPath, 0755); err != nil {
 					log.Printf("[Download] Failed to change directory permissions: %v", err)
 				}
 			}
-			options["dir"] = fullPath
-			log.Printf("[Download] Using dir mode: %s", fullPath)
+			options["dir"] = fullDirPath
+			log.Printf("[Download] Using dir mode: %s", fullDirPath)
 		} else {
 			// 有完整路径，拆分成 dir 和 out
-			dirPath := filepath.Dir(downloadPath)
 			fileName := filepath.Base(downloadPath)
-			fullDirPath := filepath.Join(baseDir, dirPath)
 
 			if err := os.MkdirAll(fullDirPath, 0755); err != nil {
 				log.Printf("[Download] Failed to create directory %s: %v", fullDirPath, err)
@@ -159,28 +845,7 @@ func (s *DownloadService) SubmitDownload(ctx context.Context, req types.Download
 		}
 	}
 
-	gid, err := s.downloader.AddURI(ctx, []string{req.URL}, options)
-	if err != nil {
-		task.Status = string(types.TaskStatusFailed)
-		task.ErrorMsg = err.Error()
-		s.db.Save(task)
-
-		log.Printf("[DownloadService] ❌ 下载任务添加失败: URL=%s, Plugin=%s, Error=%v", req.URL, req.PluginName, err)
-		log.Printf("[DownloadService] 下载任务失败: %s, 错误: %v", req.URL, err)
-
-		return nil, fmt.Errorf("failed to add download: %w", err)
-	}
-
-	task.GID = gid
-	task.Status = string(types.TaskStatusDownloading)
-	if err := s.db.Save(task).Error; err != nil {
-		return nil, fmt.Errorf("failed to update task: %w", err)
-	}
-
-	// TODO: 记录下载开始日志
-	log.Printf("[DownloadService] 开始下载任务: %s, GID: %s, Plugin: %s", req.URL, gid, req.PluginName)
-
-	return task, nil
+	return options, nil
 }
 
 func (s *DownloadService) GetTask(ctx context.Context, id uint) (*model.DownloadTask, error) {
@@ -207,6 +872,7 @@ type TaskQueryParams struct {
 	PluginName string
 	Category   string
 	Filename   string
+	OwnerID    uint // 只查询该用户的任务，为 0 时不限制
 }
 
 // TaskQueryResult 任务查询结果
@@ -216,7 +882,7 @@ type TaskQueryResult struct {
 }
 
 func (s *DownloadService) ListTasksWithPagination(ctx context.Context, params TaskQueryParams) (*TaskQueryResult, error) {
-	query := s.db.Model(&model.DownloadTask{})
+	query := ownedBy(s.db.Model(&model.DownloadTask{}), params.OwnerID)
 
 	// Debug: 打印查询参数
 	log.Printf("[DEBUG] Service ListTasksWithPagination: Statuses=%v, PluginName=%s, Category=%s, Filename=%s",
@@ -273,82 +939,192 @@ func (s *DownloadService) RetryTask(ctx context.Context, id uint) error {
 	}
 
 	if task.GID != "" {
-		s.downloader.Remove(ctx, task.GID)
+		if old, err := s.engineFor(task); err == nil {
+			old.Remove(ctx, task.GID)
+		}
 	}
 
-	options := make(map[string]interface{})
-	setCommonDownloadOptions(options)
-	if task.Filename != "" {
-		options["out"] = task.Filename
+	// 重新路由，路由规则可能已变化
+	engine := s.routeEngine(ctx, routeTarget(task))
+	if _, err := s.engines.Get(engine); err != nil {
+		return err
 	}
 
-	gid, err := s.downloader.AddURI(ctx, []string{task.URL}, options)
+	// 校验失败的文件需要删除，否则下载引擎会另存为新文件名
+	// 文件仍被其他任务使用（跳过下载的已有文件、内容去重后指向的文件）时保留，新下载的文件另存为新文件名
+	if task.Status == string(types.TaskStatusCorrupt) && task.FilePath != "" {
+		if shared := s.fileUsers(task, task.FilePath); shared > 0 {
+			log.Printf("[RetryTask] 文件仍被其他 %d 个任务使用，不删除: %s", shared, task.FilePath)
+		} else if err := os.Remove(task.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("[RetryTask] 警告：删除校验失败的文件失败: %v", err)
+		}
+	}
+
+	engineOptions, err := retryEngineOptions(task)
 	if err != nil {
-		return fmt.Errorf("failed to retry download: %w", err)
+		return err
 	}
 
+	// 重新排队，由调度器放行
 	updates := map[string]interface{}{
-		"gid":       gid,
-		"status":    string(types.TaskStatusPending),
-		"error_msg": "",
+		"engine":              engine,
+		"gid":                 "",
+		"status":              string(types.TaskStatusQueued),
+		"error_msg":           "",
+		"error_code":          "",
+		"selected_files":      "", // 重新下载元数据后需要重新选择文件
+		"engine_options":      datatypes.JSON(engineOptions),
+		"position":            time.Now().UnixNano(),
+		"window_paused":       false,
+		"attempts":            0, // 手动重试重新计算自动重试次数，保留历史记录
+		"next_retry_at":       nil,
+		"verified_at":         nil,
+		"content_hash":        "",
+		"post_process_status": "",
+		"post_process":        nil,
 	}
 
-	return s.db.Model(task).Updates(updates).Error
+	if err := s.db.Model(task).Updates(updates).Error; err != nil {
+		return err
+	}
+	s.notifyScheduler()
+	return nil
+}
+
+// retryEngineOptions 在排队时保存的引擎选项上重新应用请求、文件选择和校验选项，
+// 保留路径模板生成的 dir 等提交时才能确定的选项
+func retryEngineOptions(task *model.DownloadTask) (datatypes.JSON, error) {
+	options := make(map[string]interface{})
+	if len(task.EngineOptions) > 0 {
+		if err := json.Unmarshal(task.EngineOptions, &options); err != nil {
+			log.Printf("[RetryTask] 警告：任务 %d 的引擎选项无效，重新生成: %v", task.ID, err)
+			options = make(map[string]interface{})
+		}
+	}
+	setCommonDownloadOptions(options)
+	setRequestOptions(task, options)
+	if task.Filename != "" && task.Source != SourceTorrent && task.Source != SourceMetalink {
+		options["out"] = task.Filename
+	}
+	setFileSelectionOptions(task, options)
+	setChecksumOption(task, options)
+
+	engineOptions, err := json.Marshal(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode options: %w", err)
+	}
+	return engineOptions, nil
 }
 
+// DeleteTask 删除任务，任务记录和文件（deleteFiles 时）进入回收站，可以通过 TrashService 恢复
 func (s *DownloadService) DeleteTask(ctx context.Context, id uint, deleteFiles bool) error {
 	task, err := s.GetTask(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	// 先从 aria2 中删除任务
-	if task.GID != "" {
-		if err := s.downloader.Remove(ctx, task.GID); err != nil {
-			log.Printf("[DeleteTask] 警告：从 aria2 删除任务失败 (GID: %s): %v", task.GID, err)
-			// 继续执行，即使 aria2 删除失败也要删除数据库记录
-		} else {
-			log.Printf("[DeleteTask] 已从 aria2 删除任务 (GID: %s)", task.GID)
-		}
+	// 从下载引擎删除前读取文件列表（多文件种子的全部文件）
+	var files []string
+	if deleteFiles {
+		files = s.taskFilePaths(ctx, task)
 	}
 
-	// 如果需要删除本地文件
-	if deleteFiles && task.FilePath != "" {
-		log.Printf("[DeleteTask] 尝试删除本地文件: %s", task.FilePath)
-		if err := os.Remove(task.FilePath); err != nil {
-			if !os.IsNotExist(err) {
-				log.Printf("[DeleteTask] 警告：删除本地文件失败: %v", err)
-				// 继续执行，即使文件删除失败也要删除数据库记录
-			} else {
-				log.Printf("[DeleteTask] 文件不存在，跳过删除: %s", task.FilePath)
-			}
+	// 先从下载引擎中删除任务
+	if task.GID != "" {
+		dl, err := s.engineFor(task)
+		if err == nil {
+			err = dl.Remove(ctx, task.GID)
+		}
+		if err != nil {
+			log.Printf("[DeleteTask] 警告：从 %s 删除任务失败 (GID: %s): %v", task.Engine, task.GID, err)
+			// 继续执行，即使引擎删除失败也要删除数据库记录
 		} else {
-			log.Printf("[DeleteTask] ✅ 已删除本地文件: %s", task.FilePath)
+			log.Printf("[DeleteTask] 已从 %s 删除任务 (GID: %s)", task.Engine, task.GID)
 		}
 	}
 
-	// 从数据库删除任务记录
-	if err := s.db.Delete(task).Error; err != nil {
-		return fmt.Errorf("删除数据库记录失败: %w", err)
+	if err := s.trash.Delete(ctx, task, files); err != nil {
+		return err
 	}
 
 	log.Printf("[DeleteTask] ✅ 任务 %d 已删除", id)
 	return nil
 }
 
+// taskFilePaths 返回任务在磁盘上的全部文件：后处理后的文件，或下载引擎中的文件和 aria2 控制文件
+// 内容重复的任务会指向已有任务的文件，仍被其他任务使用的文件不包括在内
+func (s *DownloadService) taskFilePaths(ctx context.Context, task *model.DownloadTask) []string {
+	candidates := postProcessStateOf(task).Files
+	if len(candidates) == 0 {
+		for _, f := range s.GetTaskFiles(ctx, task) {
+			candidates = append(candidates, f.Path, f.Path+".aria2")
+		}
+	}
+	if task.FilePath != "" {
+		candidates = append(candidates, task.FilePath)
+	}
+
+	var files []string
+	for _, file := range candidates {
+		if file == "" || containsString(files, file) || !fileExists(file) {
+			continue
+		}
+		if shared := s.fileUsers(task, file); shared > 0 {
+			log.Printf("[DeleteTask] 文件仍被其他 %d 个任务使用，跳过删除: %s", shared, file)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// fileUsers 返回 file_path 为 file 的其他任务数
+func (s *DownloadService) fileUsers(task *model.DownloadTask, file string) int64 {
+	var shared int64
+	s.db.Model(&model.DownloadTask{}).Where("file_path = ? AND id <> ?", file, task.ID).Count(&shared)
+	return shared
+}
+
 func (s *DownloadService) PauseTask(ctx context.Context, id uint) error {
 	task, err := s.GetTask(ctx, id)
 	if err != nil {
 		return err
 	}
 
+	// 已从下载引擎中移除的暂停任务没有 GID，恢复时重新排队提交
+	if task.GID == "" && task.Status == string(types.TaskStatusPaused) {
+		if err := s.db.Model(task).Updates(map[string]interface{}{
+			"status":        string(types.TaskStatusQueued),
+			"error_msg":     "",
+			"window_paused": false,
+		}).Error; err != nil {
+			return err
+		}
+		s.notifyScheduler()
+		return nil
+	}
+
 	if task.GID == "" {
 		return fmt.Errorf("task has no GID")
 	}
 
+	// 等待选择文件的任务在引擎中已是暂停状态，需通过选择文件恢复
+	if task.Status == string(types.TaskStatusAwaitingSelection) {
+		return fmt.Errorf("请先选择要下载的文件")
+	}
+	// 已恢复但仍在排队的任务在引擎中还是暂停状态，直接改回暂停
+	if task.Status == string(types.TaskStatusQueued) {
+		return s.db.Model(task).Update("status", string(types.TaskStatusPaused)).Error
+	}
+
+	dl, err := s.engineFor(task)
+	if err != nil {
+		return err
+	}
+
 	// 获取当前任务状态，检查是否有后续任务（magnet 链接）
 	actualGID := task.GID
-	status, err := s.downloader.TellStatus(ctx, task.GID)
+	status, err := dl.TellStatus(ctx, task.GID)
 	if err == nil && len(status.FollowedBy) > 0 {
 		// 如果有后续任务，使用后续任务的 GID
 		actualGID = status.FollowedBy[0]
@@ -356,18 +1132,20 @@ func (s *DownloadService) PauseTask(ctx context.Context, id uint) error {
 	}
 
 	if task.Status == string(types.TaskStatusPaused) {
-		// 恢复下载
-		if err := s.downloader.Unpause(ctx, actualGID); err != nil {
-			return fmt.Errorf("恢复下载失败: %w", err)
+		// 恢复下载：重新排队，由调度器在队列有空闲名额且处于时间窗口内时恢复，避免超过并发上限
+		if err := s.db.Model(task).Updates(map[string]interface{}{
+			"status":        string(types.TaskStatusQueued),
+			"gid":           actualGID, // 更新为实际的 GID
+			"window_paused": false,
+		}).Error; err != nil {
+			return err
 		}
-		return s.db.Model(task).Updates(map[string]interface{}{
-			"status": string(types.TaskStatusDownloading),
-			"gid":    actualGID, // 更新为实际的 GID
-		}).Error
+		s.notifyScheduler()
+		return nil
 	}
 
 	// 暂停下载
-	if err := s.downloader.Pause(ctx, actualGID); err != nil {
+	if err := dl.Pause(ctx, actualGID); err != nil {
 		return fmt.Errorf("暂停下载失败: %w", err)
 	}
 
@@ -394,7 +1172,12 @@ func (s *DownloadService) GetTaskProgress(ctx context.Context, task *model.Downl
 		return progress
 	}
 
-	status, err := s.downloader.TellStatus(ctx, task.GID)
+	dl, err := s.engineFor(task)
+	if err != nil {
+		return progress
+	}
+
+	status, err := dl.TellStatus(ctx, task.GID)
 	if err != nil {
 		return progress
 	}
@@ -404,7 +1187,7 @@ func (s *DownloadService) GetTaskProgress(ctx context.Context, task *model.Downl
 	if len(status.FollowedBy) > 0 {
 		// 使用第一个后续任务的 GID（实际下载任务）
 		followedGID := status.FollowedBy[0]
-		followedStatus, err := s.downloader.TellStatus(ctx, followedGID)
+		followedStatus, err := dl.TellStatus(ctx, followedGID)
 		if err == nil {
 			// 成功获取到实际下载任务的状态，使用它的进度
 			status = followedStatus
@@ -452,130 +1235,104 @@ func (s *DownloadService) extractFilenameFromURL(urlStr string) string {
 	return ""
 }
 
-func (s *DownloadService) detectFilenameByContentType(ctx context.Context, urlStr string) string {
-	log.Printf("[Download] 🔍 开始检测文件类型: %s", urlStr)
-
-	// 创建支持重定向的 HTTP 客户端（使用默认 Transport 以支持代理）
-	client := &http.Client{
-		Timeout:   10 * time.Second,
-		Transport: http.DefaultTransport, // 自动从环境变量读取 HTTP_PROXY/HTTPS_PROXY
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// 最多跟随 10 次重定向
-			if len(via) >= 10 {
-				log.Printf("[Download] ⚠️  重定向次数超过 10 次")
-				return fmt.Errorf("stopped after 10 redirects")
-			}
-			log.Printf("[Download] 🔄 跟随重定向 (#%d): %s", len(via), req.URL.String())
-			return nil
-		},
+// requestTransport 返回任务请求使用的 Transport，指定了代理时使用该代理，
+// 否则使用默认 Transport（自动从环境变量读取 HTTP_PROXY/HTTPS_PROXY）
+func requestTransport(opts types.DownloadOptions) http.RoundTripper {
+	if opts.Proxy != "" {
+		if proxyURL, err := url.Parse(opts.Proxy); err == nil {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.Proxy = http.ProxyURL(proxyURL)
+			return t
+		}
 	}
-	log.Printf("[Download] ✅ HTTP 客户端创建成功（超时: 10s，代理: %v）", http.DefaultTransport)
+	return http.DefaultTransport
+}
 
-	// 发送 HEAD 请求获取 Content-Type（跟随重定向）
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, urlStr, nil)
-	if err != nil {
-		log.Printf("[Download] ❌ 创建 HEAD 请求失败: %v", err)
-		return ""
+// setRequestHeaders 为 HEAD 探测、校验文件等辅助请求设置与下载相同的请求头
+func setRequestHeaders(req *http.Request, opts types.DownloadOptions) {
+	for _, line := range requestHeaderLines(opts) {
+		if idx := strings.Index(line, ":"); idx > 0 {
+			req.Header.Set(line[:idx], strings.TrimSpace(line[idx+1:]))
+		}
 	}
-
-	// 添加常见的请求头，避免某些服务器拒绝 HEAD 请求
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
-	req.Header.Set("Accept", "*/*")
-	log.Printf("[Download] 📤 发送 HEAD 请求: %s", urlStr)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("[Download] ❌ HEAD 请求失败: %v", err)
-		return ""
+	if opts.Referer != "" {
+		req.Header.Set("Referer", opts.Referer)
 	}
-	defer resp.Body.Close()
-
-	log.Printf("[Download] ✅ HEAD 响应: status=%d, content-type=%s, final-url=%s",
-		resp.StatusCode, resp.Header.Get("Content-Type"), resp.Request.URL.String())
-
-	// 检查 HTTP 状态码
-	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		log.Printf("[Download] ⚠️  HTTP 状态码异常: %d", resp.StatusCode)
-		return ""
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
 	}
+}
 
-	// 从 Content-Type 获取扩展名
-	contentType := resp.Header.Get("Content-Type")
-	log.Printf("[Download] 📋 原始 Content-Type: '%s'", contentType)
-
-	if contentType == "" {
-		log.Printf("[Download] ⚠️  Content-Type 为空")
-		return ""
+// detectFilename 按探测结果确定文件名，probe 为空（探测失败或不是 HTTP 链接）时只从 URL 提取
+// 优先级：1. Content-Disposition  2. URL 中的文件名  3. 重定向后 URL 中的文件名
+// 4. URL 路径最后一级（或 file_<时间戳>）加上按 Content-Type 或文件内容识别的扩展名
+func (s *DownloadService) detectFilename(rawURL string, probe *URLProbe) string {
+	if probe == nil {
+		return s.extractFilenameFromURL(rawURL)
 	}
 
-	// 去掉参数部分，如 "image/jpeg; charset=utf-8" -> "image/jpeg"
-	if idx := strings.Index(contentType, ";"); idx != -1 {
-		contentType = contentType[:idx]
+	if probe.Filename != "" {
+		log.Printf("[Download] ✅ 使用 Content-Disposition 文件名: %s", probe.Filename)
+		return probe.Filename
+	}
+	if filename := s.extractFilenameFromURL(rawURL); filename != "" {
+		return filename
+	}
+	if filename := s.extractFilenameFromURL(probe.FinalURL); filename != "" {
+		log.Printf("[Download] ✅ 使用重定向后 URL 中的文件名: %s", filename)
+		return filename
 	}
-	contentType = strings.TrimSpace(contentType)
-	log.Printf("[Download] 📋 清理后 Content-Type: '%s'", contentType)
 
-	// 获取扩展名
-	exts, err := mime.ExtensionsByType(contentType)
-	if err != nil {
-		log.Printf("[Download] ❌ 无法从 Content-Type '%s' 获取扩展名: %v", contentType, err)
+	ext := ""
+	if !genericMimeTypes[probe.MimeType] {
+		ext = extensionForMimeType(probe.MimeType)
+	}
+	if ext == "" && len(probe.Head) > 0 {
+		ext = sniffExtension(probe.Head)
+	}
+	if ext == "" {
+		log.Printf("[Download] ⚠️  无法识别文件类型: content-type=%s", probe.MimeType)
 		return ""
 	}
 
-	var ext string
-	if len(exts) > 0 {
-		ext = exts[0] // 使用第一个扩展名
-		log.Printf("[Download] 📋 从系统 MIME 数据库获取扩展名: %s", ext)
-	} else {
-		// Fallback: 常见 MIME 类型的硬编码映射（Alpine 环境可能缺少 /etc/mime.types）
-		commonTypes := map[string]string{
-			"video/mp4":        ".mp4",
-			"video/mpeg":       ".mpeg",
-			"video/webm":       ".webm",
-			"video/x-matroska": ".mkv",
-			"video/quicktime":  ".mov",
-			"audio/mpeg":       ".mp3",
-			"audio/wav":        ".wav",
-			"audio/ogg":        ".ogg",
-			"image/jpeg":       ".jpg",
-			"image/png":        ".png",
-			"image/gif":        ".gif",
-			"image/webp":       ".webp",
-			"image/svg+xml":    ".svg",
-			"application/pdf":  ".pdf",
-			"application/zip":  ".zip",
-			"text/plain":       ".txt",
-			"text/html":        ".html",
-		}
-
-		if fallbackExt, ok := commonTypes[contentType]; ok {
-			ext = fallbackExt
-			log.Printf("[Download] 📋 使用 fallback 扩展名映射: %s -> %s", contentType, ext)
-		} else {
-			log.Printf("[Download] ⚠️  Content-Type '%s' 没有对应的扩展名（系统和 fallback 都未找到）", contentType)
-			return ""
-		}
+	base := urlBasename(probe.FinalURL)
+	if base == "" {
+		base = fmt.Sprintf("file_%d", time.Now().Unix())
 	}
-	timestamp := time.Now().Unix()
-	filename := fmt.Sprintf("file_%d%s", timestamp, ext)
-	log.Printf("[Download] ✅ 检测成功: Content-Type=%s, 扩展名=%s, 文件名=%s", contentType, ext, filename)
+	filename := base + ext
+	log.Printf("[Download] ✅ 检测成功: Content-Type=%s, 扩展名=%s, 文件名=%s", probe.MimeType, ext, filename)
 	return filename
 }
 
 func (s *DownloadService) CheckDownloaderStatus(ctx context.Context) (map[string]interface{}, error) {
-	version, err := s.downloader.GetVersion(ctx)
+	dl, err := s.engines.Get("")
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := dl.GetVersion(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("aria2 连接失败")
+		return nil, fmt.Errorf("%s 连接失败", s.engines.Default())
 	}
 
 	// 获取全局配置以读取下载目录
-	opts, err := s.downloader.GetGlobalOption(ctx)
+	opts, err := dl.GetGlobalOption(ctx)
 	if err == nil {
 		if dir, ok := opts["dir"].(string); ok {
 			version["dir"] = dir
 		}
 	}
 
+	// 各引擎连接状态
+	engines := make(map[string]bool)
+	for _, name := range s.engines.Names() {
+		engine, _ := s.engines.Get(name)
+		_, err := engine.GetVersion(ctx)
+		engines[name] = err == nil
+	}
+	version["engine"] = s.engines.Default()
+	version["engines"] = engines
+
 	return version, nil
 }
 
@@ -586,11 +1343,14 @@ func (s *DownloadService) ClearFailedTasks(ctx context.Context) (int64, error) {
 		return 0, err
 	}
 
-	// 从 aria2 中移除这些任务（如果有 GID）
+	// 从下载引擎中移除这些任务（如果有 GID）
 	for _, task := range failedTasks {
-		if task.GID != "" {
-			// 忽略 aria2 移除错误，因为任务可能已经不在 aria2 中了
-			s.downloader.Remove(ctx, task.GID)
+		if task.GID == "" {
+			continue
+		}
+		// 忽略移除错误，因为任务可能已经不在引擎中了
+		if dl, err := s.engineFor(task); err == nil {
+			dl.Remove(ctx, task.GID)
 		}
 	}
 
@@ -604,8 +1364,10 @@ func (s *DownloadService) ClearFailedTasks(ctx context.Context) (int64, error) {
 }
 
 type TaskFile struct {
-	Path   string `json:"path"`
-	Length int64  `json:"length"`
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Selected bool   `json:"selected"`
 }
 
 func (s *DownloadService) GetTaskFiles(ctx context.Context, task *model.DownloadTask) []TaskFile {
@@ -615,7 +1377,12 @@ func (s *DownloadService) GetTaskFiles(ctx context.Context, task *model.Download
 		return files
 	}
 
-	status, err := s.downloader.TellStatus(ctx, task.GID)
+	dl, err := s.engineFor(task)
+	if err != nil {
+		return files
+	}
+
+	status, err := dl.TellStatus(ctx, task.GID)
 	if err != nil {
 		return files
 	}
@@ -623,7 +1390,7 @@ func (s *DownloadService) GetTaskFiles(ctx context.Context, task *model.Download
 	// 对于 magnet 链接，如果有后续任务，获取实际下载任务的文件列表
 	if len(status.FollowedBy) > 0 {
 		followedGID := status.FollowedBy[0]
-		followedStatus, err := s.downloader.TellStatus(ctx, followedGID)
+		followedStatus, err := dl.TellStatus(ctx, followedGID)
 		if err == nil {
 			status = followedStatus
 		}
@@ -631,8 +1398,10 @@ func (s *DownloadService) GetTaskFiles(ctx context.Context, task *model.Download
 
 	for _, f := range status.Files {
 		files = append(files, TaskFile{
-			Path:   f.Path,
-			Length: f.Length,
+			Index:    f.Index,
+			Path:     f.Path,
+			Length:   f.Length,
+			Selected: f.Selected,
 		})
 	}
 
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix/mynest/backend/model"
+	"gorm.io/datatypes"
+)
+
+func TestRetryEngineOptions(t *testing.T) {
+	task := &model.DownloadTask{
+		ID:            1,
+		Filename:      "movie.mkv",
+		Checksum:      "sha-256=abc",
+		Options:       datatypes.JSON(`{"referer": "https://example.com/"}`),
+		EngineOptions: datatypes.JSON(`{"dir": "/downloads/movies/2026", "out": "old.mkv", "split": 5}`),
+	}
+	raw, err := retryEngineOptions(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var options map[string]interface{}
+	if err := json.Unmarshal(raw, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"dir":       "/downloads/movies/2026", // 路径模板生成的目录保留
+		"out":       "movie.mkv",
+		"referer":   "https://example.com/",
+		"checksum":  "sha-256=abc",
+		"seed-time": float64(0),
+	}
+	for key, value := range want {
+		if options[key] != value {
+			t.Errorf("options[%q] = %v, want %v", key, options[key], value)
+		}
+	}
+
+	task.EngineOptions = datatypes.JSON(`not json`)
+	if raw, err = retryEngineOptions(task); err != nil {
+		t.Fatal(err)
+	}
+	options = nil
+	if err := json.Unmarshal(raw, &options); err != nil || options["dir"] != nil || options["out"] != "movie.mkv" {
+		t.Errorf("options from invalid engine options = %v, %v", options, err)
+	}
+}
@@ -0,0 +1,390 @@
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/gorm"
+)
+
+// 重复任务处理策略
+const (
+	DuplicateReject = "reject" // 拒绝提交，返回已有任务
+	DuplicateLink   = "link"   // 不创建新任务，直接返回已有任务
+	DuplicateAllow  = "allow"  // 照常创建，记录与哪个任务重复
+)
+
+// 重复的判定依据
+const (
+	DuplicateByURL      = "url"
+	DuplicateByInfoHash = "info_hash"
+	DuplicateByContent  = "content"
+)
+
+// DuplicateError 提交的任务与已有任务重复（reject 和 link 策略）
+type DuplicateError struct {
+	Task   *model.DownloadTask // 已有任务
+	Reason string              // url / info_hash
+	Policy string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("已存在相同任务 #%d（%s）", e.Task.ID, e.Reason)
+}
+
+// trackingParams 规范化 URL 时去掉的跟踪参数，utm_ 前缀的参数也会去掉
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "dclid": true, "gbraid": true, "wbraid": true,
+	"msclkid": true, "yclid": true, "igshid": true, "mc_cid": true, "mc_eid": true,
+	"_ga": true, "_gl": true, "spm": true, "share_source": true, "share_medium": true,
+}
+
+// NormalizeURL 规范化 URL 用于重复检测：
+// 协议和主机名转小写、去掉默认端口和锚点、去掉跟踪参数并按参数名排序；magnet 链接只保留 info-hash
+func NormalizeURL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	if hash := magnetInfoHash(rawURL); hash != "" {
+		return "magnet:?xt=urn:btih:" + hash
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		u.Host = u.Hostname()
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	query := u.Query()
+	for key := range query {
+		lower := strings.ToLower(key)
+		if trackingParams[lower] || strings.HasPrefix(lower, "utm_") {
+			query.Del(key)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// magnetInfoHash 提取 magnet 链接中的 BitTorrent info-hash（40 位小写十六进制），不是 magnet 时返回空
+func magnetInfoHash(rawURL string) string {
+	if !strings.HasPrefix(strings.ToLower(rawURL), "magnet:") {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	for _, xt := range u.Query()["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), "urn:btih:") {
+			continue
+		}
+		hash := xt[len("urn:btih:"):]
+		switch len(hash) {
+		case 40:
+			if _, err := hex.DecodeString(hash); err == nil {
+				return strings.ToLower(hash)
+			}
+		case 32:
+			// base32 编码的 info-hash
+			if decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash)); err == nil {
+				return hex.EncodeToString(decoded)
+			}
+		}
+	}
+	return ""
+}
+
+// torrentInfoHash 计算种子文件的 info-hash（info 字典的 SHA-1）
+func torrentInfoHash(data []byte) (string, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return "", fmt.Errorf("无效的种子文件")
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		key, next, err := bencodeString(data, pos)
+		if err != nil {
+			return "", err
+		}
+		end, err := bencodeSkip(data, next, 0)
+		if err != nil {
+			return "", err
+		}
+		if key == "info" {
+			sum := sha1.Sum(data[next:end])
+			return hex.EncodeToString(sum[:]), nil
+		}
+		pos = end
+	}
+	return "", fmt.Errorf("种子文件缺少 info 字段")
+}
+
+// torrentTotalLength 返回种子中所有文件的总大小，解析失败时返回 0
+func torrentTotalLength(data []byte) int64 {
+	info, err := bencodeDictValue(data, 0, "info")
+	if err != nil {
+		return 0
+	}
+
+	// 单文件种子：info.length
+	if length, err := bencodeDictValue(info, 0, "length"); err == nil {
+		n, _ := bencodeInt(length)
+		return n
+	}
+
+	// 多文件种子：info.files[].length
+	files, err := bencodeDictValue(info, 0, "files")
+	if err != nil || len(files) == 0 || files[0] != 'l' {
+		return 0
+	}
+	var total int64
+	for pos := 1; pos < len(files) && files[pos] != 'e'; {
+		end, err := bencodeSkip(files, pos, 0)
+		if err != nil {
+			return 0
+		}
+		if length, err := bencodeDictValue(files[pos:end], 0, "length"); err == nil {
+			n, _ := bencodeInt(length)
+			total += n
+		}
+		pos = end
+	}
+	return total
+}
+
+var errBencode = errors.New("种子文件格式错误")
+
+// bencodeString 解析 pos 处的字符串（<长度>:<内容>），返回内容和下一个位置
+func bencodeString(data []byte, pos int) (string, int, error) {
+	colon := pos
+	length := 0
+	for colon < len(data) && data[colon] >= '0' && data[colon] <= '9' {
+		length = length*10 + int(data[colon]-'0')
+		if length > len(data) {
+			return "", 0, errBencode
+		}
+		colon++
+	}
+	if colon == pos || colon >= len(data) || data[colon] != ':' || colon+1+length > len(data) {
+		return "", 0, errBencode
+	}
+	return string(data[colon+1 : colon+1+length]), colon + 1 + length, nil
+}
+
+// bencodeDictValue 返回 pos 处字典中 key 对应的原始值
+func bencodeDictValue(data []byte, pos int, key string) ([]byte, error) {
+	if pos >= len(data) || data[pos] != 'd' {
+		return nil, errBencode
+	}
+	pos++
+	for pos < len(data) && data[pos] != 'e' {
+		k, next, err := bencodeString(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		end, err := bencodeSkip(data, next, 0)
+		if err != nil {
+			return nil, err
+		}
+		if k == key {
+			return data[next:end], nil
+		}
+		pos = end
+	}
+	return nil, fmt.Errorf("缺少 %s 字段", key)
+}
+
+// bencodeInt 解析整数值（i<数字>e）
+func bencodeInt(value []byte) (int64, error) {
+	if len(value) < 3 || value[0] != 'i' || value[len(value)-1] != 'e' {
+		return 0, errBencode
+	}
+	return strconv.ParseInt(string(value[1:len(value)-1]), 10, 64)
+}
+
+// bencodeSkip 跳过 pos 处的一个值，返回其结束位置
+func bencodeSkip(data []byte, pos, depth int) (int, error) {
+	if pos >= len(data) || depth > 64 {
+		return 0, errBencode
+	}
+
+	switch data[pos] {
+	case 'i':
+		end := pos + 1
+		for end < len(data) && data[end] != 'e' {
+			end++
+		}
+		if end >= len(data) {
+			return 0, errBencode
+		}
+		return end + 1, nil
+	case 'l', 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := bencodeSkip(data, pos, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(data) {
+			return 0, errBencode
+		}
+		return pos + 1, nil
+	default:
+		_, next, err := bencodeString(data, pos)
+		return next, err
+	}
+}
+
+// setDuplicateKeys 计算任务用于重复检测的规范化 URL 和 info-hash
+// 上传的种子按 info-hash 检测，上传的 metalink 按文件内容检测
+func setDuplicateKeys(task *model.DownloadTask) {
+	switch task.Source {
+	case SourceTorrent:
+		if hash, err := torrentInfoHash(task.SourceData); err == nil {
+			task.InfoHash = hash
+		} else {
+			log.Printf("[Duplicate] ⚠️  无法计算种子 info-hash: %v", err)
+		}
+	case SourceMetalink:
+		sum := sha256.Sum256(task.SourceData)
+		task.NormalizedURL = "metalink:sha256:" + hex.EncodeToString(sum[:])
+	default:
+		task.NormalizedURL = NormalizeURL(task.URL)
+		task.InfoHash = magnetInfoHash(task.URL)
+	}
+}
+
+// duplicatePolicy 返回请求指定的策略，未指定时使用系统配置 duplicate_policy（默认 link）
+func (s *DownloadService) duplicatePolicy(ctx context.Context, override string) (string, error) {
+	policy := strings.TrimSpace(override)
+	if policy == "" {
+		policy, _ = s.configService.GetConfig(ctx, "duplicate_policy")
+	}
+	switch policy {
+	case "":
+		return DuplicateLink, nil
+	case DuplicateReject, DuplicateLink, DuplicateAllow:
+		return policy, nil
+	}
+	return "", &RequestError{Err: fmt.Errorf("无效的重复任务策略: %s（可选 reject、link、allow）", policy)}
+}
+
+// createTask 检查重复并创建任务（source 非空时同时保存上传的文件），任务的重复检测键需已由 setDuplicateKeys 计算
+// 检查和创建在同一事务中，并按重复检测键加事务级 advisory lock：
+// 并发提交相同的链接或种子时，后到的请求等先到的任务创建后再检查，不会同时通过
+func (s *DownloadService) createTask(ctx context.Context, task *model.DownloadTask, override string, source *model.TaskSource) error {
+	policy, err := s.duplicatePolicy(ctx, override)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, key := range duplicateLockKeys(task) {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", key).Error; err != nil {
+				return fmt.Errorf("failed to lock duplicate key: %w", err)
+			}
+		}
+		if err := checkDuplicate(tx, task, policy); err != nil {
+			return err
+		}
+		if err := tx.Create(task).Error; err != nil {
+			return fmt.Errorf("failed to create task: %w", err)
+		}
+		if source != nil {
+			source.TaskID = task.ID
+			if err := tx.Create(source).Error; err != nil {
+				return fmt.Errorf("failed to create task: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// duplicateLockKeys 返回任务的重复检测键（按所有者区分），按固定顺序加锁避免死锁
+func duplicateLockKeys(task *model.DownloadTask) []string {
+	prefix := fmt.Sprintf("duplicate:%d:", taskOwnerID(task))
+	var keys []string
+	if task.InfoHash != "" {
+		keys = append(keys, prefix+"info_hash:"+task.InfoHash)
+	}
+	if task.NormalizedURL != "" {
+		keys = append(keys, prefix+"url:"+task.NormalizedURL)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkDuplicate 按规范化 URL 和 info-hash 查找同一所有者未失败的已有任务，不会匹配到提交者看不到的其他用户的任务
+// reject/link 策略返回 *DuplicateError，allow 策略记录到 task.DuplicateOf 后继续创建
+func checkDuplicate(db *gorm.DB, task *model.DownloadTask, policy string) error {
+	if task.NormalizedURL == "" && task.InfoHash == "" {
+		return nil
+	}
+
+	query := sameOwner(db.Where("status <> ?", string(types.TaskStatusFailed)), task)
+	switch {
+	case task.NormalizedURL != "" && task.InfoHash != "":
+		query = query.Where("normalized_url = ? OR info_hash = ?", task.NormalizedURL, task.InfoHash)
+	case task.InfoHash != "":
+		query = query.Where("info_hash = ?", task.InfoHash)
+	default:
+		query = query.Where("normalized_url = ?", task.NormalizedURL)
+	}
+
+	var existing model.DownloadTask
+	if err := query.Order("id ASC").First(&existing).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	reason := DuplicateByURL
+	if task.InfoHash != "" && existing.InfoHash == task.InfoHash {
+		reason = DuplicateByInfoHash
+	}
+	log.Printf("[Duplicate] 🔁 提交的任务与任务 %d 重复（%s），策略: %s", existing.ID, reason, policy)
+
+	if policy == DuplicateAllow {
+		task.DuplicateOf = &existing.ID
+		return nil
+	}
+	return &DuplicateError{Task: &existing, Reason: reason, Policy: policy}
+}
+
+// sameOwner 只匹配与 task 同一所有者的任务，没有所有者的任务只匹配同样没有所有者的任务
+func sameOwner(db *gorm.DB, task *model.DownloadTask) *gorm.DB {
+	if ownerID := taskOwnerID(task); ownerID != 0 {
+		return ownedBy(db, ownerID)
+	}
+	return db.Where("owner_id IS NULL")
+}
+
+// taskOwnerID 返回任务的所有者，所有者未知时返回 0
+func taskOwnerID(task *model.DownloadTask) uint {
+	if task.OwnerID == nil {
+		return 0
+	}
+	return *task.OwnerID
+}
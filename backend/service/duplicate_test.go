@@ -0,0 +1,90 @@
+package service
+
+import "testing"
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"https://example.com/file.zip", "https://example.com/file.zip"},
+		{"  HTTPS://Example.COM:443/file.zip  ", "https://example.com/file.zip"},
+		{"http://example.com:80/file.zip", "http://example.com/file.zip"},
+		{"http://example.com:8080/file.zip", "http://example.com:8080/file.zip"},
+		{"https://example.com/file.zip#section", "https://example.com/file.zip"},
+		{"https://example.com/f?b=2&a=1", "https://example.com/f?a=1&b=2"},
+		{"https://example.com/f?utm_source=x&UTM_Medium=y&fbclid=1&id=3", "https://example.com/f?id=3"},
+		{"magnet:?xt=urn:btih:000102030405060708090A0B0C0D0E0F10111213&dn=name&tr=udp://t",
+			"magnet:?xt=urn:btih:000102030405060708090a0b0c0d0e0f10111213"},
+		{"magnet:?xt=urn:btih:AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQT",
+			"magnet:?xt=urn:btih:000102030405060708090a0b0c0d0e0f10111213"},
+		{"not a url", "not a url"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeURL(tt.in); got != tt.want {
+			t.Errorf("NormalizeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMagnetInfoHash(t *testing.T) {
+	const hash = "000102030405060708090a0b0c0d0e0f10111213"
+	tests := []struct {
+		in, want string
+	}{
+		{"magnet:?xt=urn:btih:" + hash, hash},
+		{"MAGNET:?xt=URN:BTIH:000102030405060708090A0B0C0D0E0F10111213", hash},
+		{"magnet:?xt=urn:btih:AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQT", hash},       // base32
+		{"magnet:?xt=urn:btih:aaaqeayeaudaocajbifqydiob4ibceqt", hash},       // base32 小写
+		{"magnet:?xt=urn:sha1:abc&xt=urn:btih:" + hash, hash},                // 多个 xt
+		{"magnet:?xt=urn:btih:0001020304", ""},                               // 长度不对
+		{"magnet:?xt=urn:btih:zz0102030405060708090a0b0c0d0e0f10111213", ""}, // 不是十六进制
+		{"magnet:?xt=urn:btih:11111111111111111111111111111111", ""},         // 不是 base32
+		{"magnet:?dn=name", ""},
+		{"https://example.com/?xt=urn:btih:" + hash, ""},
+	}
+	for _, tt := range tests {
+		if got := magnetInfoHash(tt.in); got != tt.want {
+			t.Errorf("magnetInfoHash(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTorrentInfoHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"info dict", "d8:announce3:foo4:infod6:lengthi5e4:name1:aee", "525ba536945d8397fa2c220c63629c0325ffde36", false},
+		{"info before other keys", "d4:infod6:lengthi5e4:name1:ae8:announce3:fooe", "525ba536945d8397fa2c220c63629c0325ffde36", false},
+		{"empty", "", "", true},
+		{"not a dict", "l4:infoe", "", true},
+		{"missing info", "d8:announce3:fooe", "", true},
+		{"truncated", "d4:infod6:lengthi5e", "", true},
+		{"bad string length", "d99:infoe", "", true},
+	}
+	for _, tt := range tests {
+		got, err := torrentInfoHash([]byte(tt.data))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: torrentInfoHash = %q, %v, want %q (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTorrentTotalLength(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want int64
+	}{
+		{"single file", "d4:infod6:lengthi5e4:name1:aee", 5},
+		{"multiple files", "d4:infod5:filesld6:lengthi3e4:pathl1:aeed6:lengthi4e4:pathl1:beee4:name1:dee", 7},
+		{"invalid", "d4:infoi1ee", 0},
+	}
+	for _, tt := range tests {
+		if got := torrentTotalLength([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s: torrentTotalLength = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
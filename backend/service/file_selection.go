@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/gorm"
+)
+
+// ErrNotAwaitingSelection 任务不在等待选择文件的状态
+var ErrNotAwaitingSelection = errors.New("任务不在等待选择文件状态")
+
+// videoExtensions 用于"只下载最大视频"规则
+var videoExtensions = map[string]bool{
+	".mp4": true, ".mkv": true, ".avi": true, ".mov": true, ".wmv": true,
+	".flv": true, ".webm": true, ".m4v": true, ".ts": true, ".rmvb": true,
+}
+
+// fileSelectionOf 解析任务上保存的文件选择规则
+func fileSelectionOf(task *model.DownloadTask) (*types.FileSelection, bool) {
+	if len(task.FileSelection) == 0 {
+		return nil, false
+	}
+	var rule types.FileSelection
+	if err := json.Unmarshal(task.FileSelection, &rule); err != nil {
+		log.Printf("[FileSelection] 任务 %d 的文件选择规则无效: %v", task.ID, err)
+		return nil, false
+	}
+	return &rule, true
+}
+
+// selectionPending 任务要求选择文件且尚未应用选择
+func selectionPending(task *model.DownloadTask) bool {
+	return len(task.FileSelection) > 0 && task.SelectedFiles == ""
+}
+
+// hasSelectableFiles 判断文件列表是否已是实际内容（magnet 元数据阶段只有 [METADATA] 占位文件）
+func hasSelectableFiles(files []downloader.File) bool {
+	return len(files) > 0 && !strings.HasPrefix(files[0].Path, "[METADATA]")
+}
+
+// primaryFile 返回第一个被选中的文件，用作任务的文件路径
+func primaryFile(files []downloader.File) downloader.File {
+	for _, f := range files {
+		if f.Selected {
+			return f
+		}
+	}
+	return files[0]
+}
+
+// MatchFileSelection 按规则选出要下载的文件序号
+func MatchFileSelection(files []downloader.File, rule types.FileSelection) []int {
+	var candidates []downloader.File
+	for _, f := range files {
+		if !excluded(f.Path, rule.Exclude) {
+			candidates = append(candidates, f)
+		}
+	}
+
+	if rule.LargestVideoOnly {
+		var largest *downloader.File
+		for i, f := range candidates {
+			if !videoExtensions[strings.ToLower(path.Ext(f.Path))] {
+				continue
+			}
+			if largest == nil || f.Length > largest.Length {
+				largest = &candidates[i]
+			}
+		}
+		if largest == nil {
+			return nil
+		}
+		return []int{largest.Index}
+	}
+
+	indexes := make([]int, 0, len(candidates))
+	for _, f := range candidates {
+		indexes = append(indexes, f.Index)
+	}
+	return indexes
+}
+
+// excluded 判断文件是否命中排除规则：含通配符时匹配文件名，否则按路径关键字匹配
+func excluded(filePath string, patterns []string) bool {
+	lowerPath := strings.ToLower(filePath)
+	base := path.Base(lowerPath)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if strings.ContainsAny(pattern, "*?[") {
+			if matched, _ := path.Match(pattern, base); matched {
+				return true
+			}
+			continue
+		}
+		if strings.Contains(lowerPath, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFileSelection 向下载引擎提交文件选择并恢复任务
+func applyFileSelection(ctx context.Context, db *gorm.DB, dl downloader.Downloader, task *model.DownloadTask, gid string, indexes []int) error {
+	if len(indexes) == 0 {
+		return fmt.Errorf("没有符合条件的文件")
+	}
+
+	if err := dl.SelectFiles(ctx, gid, indexes); err != nil {
+		return err
+	}
+
+	selected := make([]string, len(indexes))
+	for i, index := range indexes {
+		selected[i] = strconv.Itoa(index)
+	}
+
+	log.Printf("[FileSelection] ✅ 任务 %d 已选择文件: %s", task.ID, strings.Join(selected, ","))
+	return db.Model(task).Updates(map[string]interface{}{
+		"gid":            gid,
+		"selected_files": strings.Join(selected, ","),
+		"status":         string(types.TaskStatusDownloading),
+		"error_msg":      "",
+	}).Error
+}
+
+// autoSelectFiles 任务进入 awaiting_selection 后，非手动模式按规则自动选择文件
+// 没有文件符合规则时保持等待状态，交由用户手动选择
+func autoSelectFiles(ctx context.Context, db *gorm.DB, dl downloader.Downloader, task *model.DownloadTask, gid string) {
+	rule, ok := fileSelectionOf(task)
+	if !ok || rule.Manual {
+		return
+	}
+
+	status, err := dl.TellStatus(ctx, gid)
+	if err != nil {
+		log.Printf("[FileSelection] 获取任务 %d 文件列表失败: %v", task.ID, err)
+		return
+	}
+
+	indexes := MatchFileSelection(status.Files, *rule)
+	if len(indexes) == 0 {
+		log.Printf("[FileSelection] ⚠️  任务 %d 没有符合规则的文件，等待手动选择", task.ID)
+		db.Model(task).Update("error_msg", "没有符合自动选择规则的文件，请手动选择")
+		return
+	}
+
+	if err := applyFileSelection(ctx, db, dl, task, gid, indexes); err != nil {
+		log.Printf("[FileSelection] 任务 %d 自动选择文件失败: %v", task.ID, err)
+	}
+}
+
+// SelectTaskFiles 为等待选择的任务选择文件，indexes 为空时按 rule 选择
+func (s *DownloadService) SelectTaskFiles(ctx context.Context, id uint, indexes []int, rule *types.FileSelection) ([]int, error) {
+	task, err := s.GetTask(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != string(types.TaskStatusAwaitingSelection) {
+		return nil, ErrNotAwaitingSelection
+	}
+
+	dl, err := s.engineFor(task)
+	if err != nil {
+		return nil, err
+	}
+	status, err := dl.TellStatus(ctx, task.GID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(indexes) == 0 {
+		if rule == nil {
+			return nil, fmt.Errorf("请指定文件序号或选择规则")
+		}
+		indexes = MatchFileSelection(status.Files, *rule)
+	}
+
+	valid := make(map[int]bool, len(status.Files))
+	for _, f := range status.Files {
+		valid[f.Index] = true
+	}
+	for _, index := range indexes {
+		if !valid[index] {
+			return nil, fmt.Errorf("文件序号无效: %d", index)
+		}
+	}
+
+	if err := applyFileSelection(ctx, s.db, dl, task, task.GID, indexes); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
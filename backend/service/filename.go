@@ -0,0 +1,272 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+)
+
+// 目标文件已存在时的处理策略（系统配置 filename_collision_policy）
+const (
+	CollisionRename    = "rename"    // 追加序号，如 video (1).mp4
+	CollisionOverwrite = "overwrite" // 覆盖已有文件
+	CollisionSkip      = "skip"      // 不下载，任务直接指向已有文件
+)
+
+const (
+	// maxFilenameBytes 文件名的最大字节数
+	// 大多数文件系统限制为 255 字节，预留序号和 aria2 控制文件后缀 .aria2 的长度
+	maxFilenameBytes = 240
+	// maxExtBytes 截断文件名时保留的扩展名最大长度，更长的视为文件名的一部分
+	maxExtBytes = 16
+	// maxCollisionSuffix 追加序号的上限
+	maxCollisionSuffix = 1000
+)
+
+// windowsReservedNames Windows 保留的设备名，下载目录通过 SMB 共享时无法访问
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename 把文件名清理为单个安全的路径片段：
+// 路径分隔符、控制字符和 < > : " | ? * 替换为 _，去掉首尾的空格和点，
+// 避开 Windows 保留名，并按字节截断（保留扩展名，不截断 UTF-8 字符）
+// 清理后为空时返回空字符串
+func SanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return ""
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if windowsReservedNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+	return truncateFilename(name, maxFilenameBytes)
+}
+
+// truncateFilename 把文件名截断到 limit 字节以内，尽量保留扩展名
+func truncateFilename(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxExtBytes || len(ext) >= limit {
+		ext = ""
+	}
+	base := truncateBytes(strings.TrimSuffix(name, ext), limit-len(ext))
+	return strings.TrimRight(base, " .") + ext
+}
+
+// truncateBytes 按字节截断字符串，不拆开多字节字符
+func truncateBytes(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	s = s[:limit]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// sanitizeDownloadPath 逐级清理模板渲染出的相对路径，以 / 结尾时保留结尾的 /
+// 模板变量（如元数据）中的 .. 和绝对路径不会被原样保留，最终路径还会在 resolveDownloadDir 中检查
+func sanitizeDownloadPath(downloadPath string) string {
+	isDir := strings.HasSuffix(downloadPath, "/")
+
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(downloadPath), "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		if part = SanitizeFilename(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	result := strings.Join(parts, "/")
+	if isDir && result != "" {
+		result += "/"
+	}
+	return result
+}
+
+// resolveDownloadDir 把相对目录拼接到下载根目录，结果不能超出根目录
+func resolveDownloadDir(baseDir, dirPath string) (string, error) {
+	fullPath := filepath.Join(baseDir, dirPath)
+	if rel, err := filepath.Rel(baseDir, fullPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("下载路径超出下载目录: %s", dirPath)
+	}
+	return fullPath, nil
+}
+
+// FileExistsError 目标文件已存在且策略为 skip
+type FileExistsError struct {
+	Path string
+}
+
+func (e *FileExistsError) Error() string {
+	return fmt.Sprintf("文件已存在，跳过下载: %s", e.Path)
+}
+
+// collisionPolicy 返回系统配置的文件名冲突策略，未配置或无效时使用 rename
+func (s *DownloadService) collisionPolicy(ctx context.Context) string {
+	return loadCollisionPolicy(ctx, s.configService)
+}
+
+func loadCollisionPolicy(ctx context.Context, configService *SystemConfigService) string {
+	policy, _ := configService.GetConfig(ctx, "filename_collision_policy")
+	switch policy {
+	case CollisionRename, CollisionOverwrite, CollisionSkip:
+		return policy
+	case "":
+	default:
+		log.Printf("[Download] ⚠️  无效的文件名冲突策略: %s，使用 rename", policy)
+	}
+	return CollisionRename
+}
+
+// applyCollisionPolicy 提交给下载引擎前检查目标文件是否已存在或被其他下载中的任务占用
+// rename 选择新的文件名并写回任务，overwrite 允许下载引擎覆盖，skip 返回 *FileExistsError
+// 只处理指定了 out 的任务，种子和 metalink 的文件名由内容决定
+func (s *DownloadService) applyCollisionPolicy(ctx context.Context, task *model.DownloadTask, options map[string]interface{}) error {
+	dir, _ := options["dir"].(string)
+	out, _ := options["out"].(string)
+	if dir == "" || out == "" || task.Source == SourceTorrent || task.Source == SourceMetalink {
+		return nil
+	}
+	inUse := s.pathInUse(task, dir, out)
+	if !inUse && !fileTaken(task, dir, out) {
+		return nil
+	}
+
+	switch policy := s.collisionPolicy(ctx); policy {
+	case CollisionOverwrite:
+		// 只覆盖磁盘上已完成的文件，其他任务正在下载的文件改为重命名，避免两个任务写同一个文件
+		if !inUse {
+			log.Printf("[Download] ⚠️  任务 %d 将覆盖已有文件: %s", task.ID, filepath.Join(dir, out))
+			// aria2 和内置引擎都按 allow-overwrite 覆盖，关闭自动改名，覆盖失败时报错而不是另存
+			options["allow-overwrite"] = "true"
+			options["auto-file-renaming"] = "false"
+			return nil
+		}
+		log.Printf("[Download] 其他任务正在下载 %s，任务 %d 改为重命名", filepath.Join(dir, out), task.ID)
+	case CollisionSkip:
+		return &FileExistsError{Path: filepath.Join(dir, out)}
+	}
+
+	for i := 1; i <= maxCollisionSuffix; i++ {
+		candidate := collisionName(out, i)
+		if s.filenameTaken(task, dir, candidate) {
+			continue
+		}
+
+		log.Printf("[Download] 🔀 任务 %d 的文件名已存在，重命名为: %s", task.ID, candidate)
+		options["out"] = candidate
+		task.Filename = candidate
+		engineOptions, err := json.Marshal(options)
+		if err != nil {
+			return fmt.Errorf("failed to encode options: %w", err)
+		}
+		return s.db.Model(task).Updates(map[string]interface{}{
+			"filename":       candidate,
+			"engine_options": engineOptions,
+		}).Error
+	}
+	return fmt.Errorf("无法为 %s 找到可用的文件名", filepath.Join(dir, out))
+}
+
+// collisionName 在扩展名前追加序号，如 video (1).mp4，不超过文件名的字节上限
+func collisionName(name string, i int) string {
+	ext := filepath.Ext(name)
+	if len(ext) > maxExtBytes {
+		ext = ""
+	}
+	suffix := fmt.Sprintf(" (%d)", i)
+	return truncateBytes(strings.TrimSuffix(name, ext), maxFilenameBytes-len(suffix)-len(ext)) + suffix + ext
+}
+
+// collisionTarget 后处理写入 path 前按冲突策略选择目标路径：path 未被占用或策略为 overwrite 时返回 path，
+// skip 时返回空字符串，rename 时返回同一目录下追加序号的第一个可用路径
+func collisionTarget(path, policy string) (string, error) {
+	if !pathExists(path) {
+		return path, nil
+	}
+	switch policy {
+	case CollisionOverwrite:
+		return path, nil
+	case CollisionSkip:
+		return "", nil
+	}
+
+	dir, name := filepath.Split(path)
+	for i := 1; i <= maxCollisionSuffix; i++ {
+		if candidate := filepath.Join(dir, collisionName(name, i)); !pathExists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("无法为 %s 找到可用的文件名", path)
+}
+
+// pathExists 路径已存在（包括其他任务未完成的下载）
+func pathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// filenameTaken 目标文件已存在（不属于本任务），或者其他下载中的任务使用同一路径
+func (s *DownloadService) filenameTaken(task *model.DownloadTask, dir, name string) bool {
+	return fileTaken(task, dir, name) || s.pathInUse(task, dir, name)
+}
+
+// fileTaken 目标文件已存在且不属于本任务
+// 存在 aria2 的 .aria2 或内置引擎的 .mynest 控制文件时说明是未完成的下载，由下载引擎续传，不算冲突
+func fileTaken(task *model.DownloadTask, dir, name string) bool {
+	path := filepath.Join(dir, name)
+	if path == task.FilePath {
+		return false
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return false
+	}
+	return !downloader.IsPartialDownload(path)
+}
+
+// pathInUse 其他下载中或暂停的任务使用同一路径
+func (s *DownloadService) pathInUse(task *model.DownloadTask, dir, name string) bool {
+	var active []*model.DownloadTask
+	if err := s.db.Select("id", "engine_options").
+		Where("filename = ? AND id <> ? AND status IN ?", name, task.ID,
+			[]string{string(types.TaskStatusDownloading), string(types.TaskStatusPaused)}).
+		Find(&active).Error; err != nil {
+		log.Printf("[Download] 查询同名任务失败: %v", err)
+		return false
+	}
+	for _, other := range active {
+		var options map[string]interface{}
+		if json.Unmarshal(other.EngineOptions, &options) == nil && options["dir"] == dir {
+			return true
+		}
+	}
+	return false
+}
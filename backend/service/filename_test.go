@@ -0,0 +1,150 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"movie.mkv", "movie.mkv"},
+		{"a/b\\c.txt", "a_b_c.txt"},
+		{`a:b*?"<>|.txt`, "a_b______.txt"},
+		{"a\x00b\nc", "a_b_c"},
+		{"a\xffb", "a_b"},
+		{"  .hidden. ", "hidden"},
+		{"..", ""},
+		{"../etc/passwd", "_etc_passwd"},
+		{"/etc/passwd", "_etc_passwd"},
+		{"   ", ""},
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"LPT1.log", "_LPT1.log"},
+		{"console.txt", "console.txt"},
+		{"COM10", "COM10"},
+	}
+	for _, tt := range tests {
+		if got := SanitizeFilename(tt.in); got != tt.want {
+			t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameTruncates(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{strings.Repeat("a", 300) + ".mp4", strings.Repeat("a", maxFilenameBytes-4) + ".mp4"},
+		{strings.Repeat("中", 100) + ".mp4", strings.Repeat("中", 78) + ".mp4"}, // 236 字节放不下第 79 个字符
+		{strings.Repeat("中", 100), strings.Repeat("中", 80)},
+		{strings.Repeat("a", 300) + "." + strings.Repeat("x", 20), strings.Repeat("a", maxFilenameBytes)}, // 过长的扩展名不保留
+	}
+	for _, tt := range tests {
+		got := SanitizeFilename(tt.in)
+		if got != tt.want {
+			t.Errorf("SanitizeFilename(%d bytes) = %q, want %q", len(tt.in), got, tt.want)
+		}
+		if len(got) > maxFilenameBytes || !utf8.ValidString(got) {
+			t.Errorf("SanitizeFilename(%d bytes) = %d bytes, valid UTF-8 %v", len(tt.in), len(got), utf8.ValidString(got))
+		}
+	}
+}
+
+func TestTruncateFilename(t *testing.T) {
+	tests := []struct {
+		in    string
+		limit int
+		want  string
+	}{
+		{"short.txt", 20, "short.txt"},
+		{"abcdef.txt", 10, "abcdef.txt"},
+		{"abcdefg.txt", 10, "abcdef.txt"},
+		{"ab .txt", 6, "ab.txt"}, // 截断后去掉结尾的空格
+		{"中中中", 7, "中中"},
+		{"中中中.txt", 10, "中中.txt"},
+		{"abc.verylongextension", 10, "abc.verylo"},
+	}
+	for _, tt := range tests {
+		got := truncateFilename(tt.in, tt.limit)
+		if got != tt.want {
+			t.Errorf("truncateFilename(%q, %d) = %q, want %q", tt.in, tt.limit, got, tt.want)
+		}
+		if len(got) > tt.limit || !utf8.ValidString(got) {
+			t.Errorf("truncateFilename(%q, %d) = %q exceeds limit or splits a character", tt.in, tt.limit, got)
+		}
+	}
+}
+
+func TestSanitizeDownloadPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"movies/2024", "movies/2024"},
+		{"movies/2024/", "movies/2024/"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"/etc/passwd", "etc/passwd"},
+		{"a/./b//c", "a/b/c"},
+		{"a/../b", "a/b"},
+		{"..", ""},
+		{"../", ""},
+		{"tg/Chat: News?/", "tg/Chat_ News_/"},
+		{"tg/con/file.txt", "tg/_con/file.txt"},
+		{".trash/file.txt", "trash/file.txt"},
+		{"a/" + strings.Repeat("中", 100), "a/" + strings.Repeat("中", 80)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeDownloadPath(tt.in); got != tt.want {
+			t.Errorf("sanitizeDownloadPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveDownloadDir(t *testing.T) {
+	base := filepath.FromSlash("/downloads")
+	tests := []struct {
+		dir     string
+		want    string
+		wantErr bool
+	}{
+		{"", "/downloads", false},
+		{"movies", "/downloads/movies", false},
+		{"movies/../tv", "/downloads/tv", false},
+		{"/etc", "/downloads/etc", false},
+		{"..", "", true},
+		{"../etc", "", true},
+		{"movies/../../etc", "", true},
+		{"../downloads2", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveDownloadDir(base, tt.dir)
+		if (err != nil) != tt.wantErr || (err == nil && got != filepath.FromSlash(tt.want)) {
+			t.Errorf("resolveDownloadDir(%q) = %q, %v, want %q (error %v)", tt.dir, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCollisionName(t *testing.T) {
+	tests := []struct {
+		name string
+		i    int
+		want string
+	}{
+		{"video.mp4", 1, "video (1).mp4"},
+		{"video", 2, "video (2)"},
+		{"archive.tar.gz", 1, "archive.tar (1).gz"},
+		{strings.Repeat("中", 80) + ".mp4", 1, strings.Repeat("中", 77) + " (1).mp4"},
+	}
+	for _, tt := range tests {
+		got := collisionName(tt.name, tt.i)
+		if got != tt.want {
+			t.Errorf("collisionName(%q, %d) = %q, want %q", tt.name, tt.i, got, tt.want)
+		}
+		if len(got) > maxFilenameBytes {
+			t.Errorf("collisionName(%q, %d) = %d bytes", tt.name, tt.i, len(got))
+		}
+	}
+}
@@ -3,34 +3,224 @@ package service
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
+	"net/url"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// ApplyPathTemplate 应用路径模板
-// 支持的变量:
+// PathTemplateVars 渲染路径模板时可用的任务信息
+type PathTemplateVars struct {
+	Plugin   string
+	Category string
+	Filename string
+	URL      string
+	User     string
+	TaskID   uint
+	Tags     []string
+	Metadata map[string]string // 插件提供的元数据，如 tg_chat、tg_sender
+	Time     time.Time         // 为零时使用当前时间
+}
+
+// pathTemplateVariables 内置变量
 // {plugin} - 插件名称
-// {date} - 下载日期 (YYYY-MM-DD)
-// {datetime} - 下载日期时间 (YYYY-MM-DD_HH-MM-SS)
-// {filename} - 文件名
+// {category} - 分类
+// {filename} - 文件名，{basename} 去掉扩展名，{ext} 扩展名（不含点）
+// {domain} - 下载链接的域名
+// {date} - 下载日期 (YYYY-MM-DD)，{datetime} 日期时间 (YYYY-MM-DD_HH-MM-SS)，{year}/{month}/{day}
 // {random} - 随机字符串 (8位十六进制)
-func ApplyPathTemplate(template, pluginName, filename string) string {
-	now := time.Now()
+// {task_id} - 任务 ID
+// {tag} - 第一个标签
+// {user} - 提交任务的用户或 API Token 名称
+var pathTemplateVariables = map[string]func(v *PathTemplateVars) string{
+	"plugin":   func(v *PathTemplateVars) string { return v.Plugin },
+	"category": func(v *PathTemplateVars) string { return v.Category },
+	"filename": func(v *PathTemplateVars) string { return v.Filename },
+	"basename": func(v *PathTemplateVars) string {
+		return strings.TrimSuffix(v.Filename, filepath.Ext(v.Filename))
+	},
+	"ext": func(v *PathTemplateVars) string {
+		return strings.TrimPrefix(filepath.Ext(v.Filename), ".")
+	},
+	"domain": func(v *PathTemplateVars) string {
+		if u, err := url.Parse(v.URL); err == nil {
+			return strings.ToLower(u.Hostname())
+		}
+		return ""
+	},
+	"date":     func(v *PathTemplateVars) string { return v.Time.Format("2006-01-02") },
+	"datetime": func(v *PathTemplateVars) string { return v.Time.Format("2006-01-02_15-04-05") },
+	"year":     func(v *PathTemplateVars) string { return v.Time.Format("2006") },
+	"month":    func(v *PathTemplateVars) string { return v.Time.Format("01") },
+	"day":      func(v *PathTemplateVars) string { return v.Time.Format("02") },
+	"random":   func(v *PathTemplateVars) string { return generateRandomString() },
+	"task_id": func(v *PathTemplateVars) string {
+		if v.TaskID == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(v.TaskID), 10)
+	},
+	"tag": func(v *PathTemplateVars) string {
+		if len(v.Tags) == 0 {
+			return ""
+		}
+		return v.Tags[0]
+	},
+	"user": func(v *PathTemplateVars) string { return v.User },
+}
+
+// metadataVariable 插件元数据变量名，需要带插件前缀，如 tg_chat
+var metadataVariable = regexp.MustCompile(`^[a-z][a-z0-9]*_[a-z0-9_]+$`)
+
+// pathTemplateFilters 过滤器及其参数个数
+var pathTemplateFilters = map[string]int{
+	"lower":    0,
+	"upper":    0,
+	"trim":     0,
+	"slug":     0, // 空白和 / \ : * ? " < > | 替换为 -
+	"truncate": 1, // 按字符截断，如 truncate:80
+	"replace":  2, // replace:旧:新
+	"default":  1, // 值为空时使用的文字，如 default:other
+}
+
+var slugReplacer = regexp.MustCompile(`[\s/\\:*?"<>|]+`)
+
+// templateSegment 模板的一段：普通文字，或 {变量?备选变量|过滤器:参数} 表达式
+type templateSegment struct {
+	literal string
+	vars    []string // 依次尝试，使用第一个非空的值
+	filters [][]string
+}
+
+// parsePathTemplate 解析并校验模板
+func parsePathTemplate(template string) ([]templateSegment, error) {
+	var segments []templateSegment
+	rest := template
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open == -1 {
+			segments = append(segments, templateSegment{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("多余的 }")
+		}
+		if open > 0 {
+			segments = append(segments, templateSegment{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end == -1 || rest[open+1+end] == '{' {
+			return nil, fmt.Errorf("缺少 }")
+		}
+		seg, err := parseTemplateExpr(rest[open+1 : open+1+end])
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+		rest = rest[open+1+end+1:]
+	}
+	return segments, nil
+}
+
+func parseTemplateExpr(expr string) (templateSegment, error) {
+	parts := strings.Split(expr, "|")
+	seg := templateSegment{}
+
+	for _, name := range strings.Split(parts[0], "?") {
+		name = strings.TrimSpace(name)
+		if _, ok := pathTemplateVariables[name]; !ok && !metadataVariable.MatchString(name) {
+			return seg, fmt.Errorf("未知变量: {%s}", name)
+		}
+		seg.vars = append(seg.vars, name)
+	}
+
+	for _, part := range parts[1:] {
+		filter := strings.Split(part, ":")
+		filter[0] = strings.TrimSpace(filter[0])
+		argc, ok := pathTemplateFilters[filter[0]]
+		if !ok {
+			return seg, fmt.Errorf("未知过滤器: %s", filter[0])
+		}
+		if filter[0] == "default" && len(filter) > 2 {
+			// default 的文字中可以包含 :
+			filter = []string{filter[0], strings.Join(filter[1:], ":")}
+		}
+		if len(filter)-1 != argc {
+			return seg, fmt.Errorf("过滤器 %s 需要 %d 个参数", filter[0], argc)
+		}
+		if filter[0] == "truncate" {
+			if n, err := strconv.Atoi(filter[1]); err != nil || n <= 0 {
+				return seg, fmt.Errorf("truncate 的参数必须是正整数: %s", filter[1])
+			}
+		}
+		seg.filters = append(seg.filters, filter)
+	}
+	return seg, nil
+}
 
-	replacements := map[string]string{
-		"{plugin}":   pluginName,
-		"{date}":     now.Format("2006-01-02"),
-		"{datetime}": now.Format("2006-01-02_15-04-05"),
-		"{filename}": filename,
-		"{random}":   generateRandomString(),
+// ValidatePathTemplate 校验路径模板：语法、变量和过滤器，不允许绝对路径和 ..
+func ValidatePathTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("路径模板不能为空")
+	}
+	segments, err := parsePathTemplate(template)
+	if err != nil {
+		return fmt.Errorf("无效的路径模板 %q: %w", template, err)
+	}
+	if strings.HasPrefix(template, "/") {
+		return fmt.Errorf("路径模板必须是相对路径: %s", template)
+	}
+	for _, seg := range segments {
+		for _, part := range strings.Split(seg.literal, "/") {
+			if part == ".." {
+				return fmt.Errorf("路径模板不能包含 ..: %s", template)
+			}
+		}
 	}
+	return nil
+}
 
-	result := template
-	for placeholder, value := range replacements {
-		result = strings.ReplaceAll(result, placeholder, value)
+// RenderPathTemplate 渲染路径模板
+// 变量写作 {name}，{a?b} 在 a 为空时使用 b，过滤器用 | 串联，如 {filename|lower|truncate:80}、{tg_chat?plugin|default:other}
+// 以 / 结尾的模板表示目录，渲染结果同样以 / 结尾
+func RenderPathTemplate(template string, vars PathTemplateVars) (string, error) {
+	segments, err := parsePathTemplate(template)
+	if err != nil {
+		return "", fmt.Errorf("无效的路径模板 %q: %w", template, err)
+	}
+	if vars.Time.IsZero() {
+		vars.Time = time.Now()
 	}
 
+	var b strings.Builder
+	for _, seg := range segments {
+		if seg.vars == nil {
+			b.WriteString(seg.literal)
+			continue
+		}
+
+		value := ""
+		for _, name := range seg.vars {
+			if fn, ok := pathTemplateVariables[name]; ok {
+				value = fn(&vars)
+			} else {
+				value = vars.Metadata[name]
+			}
+			if value != "" {
+				break
+			}
+		}
+		for _, filter := range seg.filters {
+			value = applyTemplateFilter(value, filter)
+		}
+		b.WriteString(value)
+	}
+
+	result := b.String()
 	isDir := strings.HasSuffix(result, "/")
 	result = filepath.Clean(result)
 
@@ -38,7 +228,32 @@ func ApplyPathTemplate(template, pluginName, filename string) string {
 		result += "/"
 	}
 
-	return result
+	return result, nil
+}
+
+func applyTemplateFilter(value string, filter []string) string {
+	switch filter[0] {
+	case "lower":
+		return strings.ToLower(value)
+	case "upper":
+		return strings.ToUpper(value)
+	case "trim":
+		return strings.TrimSpace(value)
+	case "slug":
+		return strings.Trim(slugReplacer.ReplaceAllString(value, "-"), "-")
+	case "truncate":
+		n, _ := strconv.Atoi(filter[1])
+		if runes := []rune(value); len(runes) > n {
+			return string(runes[:n])
+		}
+	case "replace":
+		return strings.ReplaceAll(value, filter[1], filter[2])
+	case "default":
+		if value == "" {
+			return filter[1]
+		}
+	}
+	return value
 }
 
 func generateRandomString() string {
@@ -47,7 +262,16 @@ func generateRandomString() string {
 	return hex.EncodeToString(bytes)
 }
 
+// IsPathTemplateConfig 判断系统配置项是否为路径模板，保存时需要校验
+func IsPathTemplateConfig(key string) bool {
+	switch key {
+	case "download_path_template", "manual_download_path", "chrome_extension_path":
+		return true
+	}
+	return false
+}
+
 // GetDefaultTemplate 返回默认路径模板
 func GetDefaultTemplate() string {
 	return "{plugin}/{date}/{filename}"
-}
\ No newline at end of file
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRenderPathTemplate(t *testing.T) {
+	vars := PathTemplateVars{
+		Plugin:   "telegram",
+		Category: "Movies",
+		Filename: "Big Buck Bunny.MKV",
+		URL:      "https://CDN.Example.com/files/bunny.mkv?token=1",
+		User:     "alice",
+		TaskID:   42,
+		Tags:     []string{"anime", "hd"},
+		Metadata: map[string]string{"tg_chat": "My Channel"},
+		Time:     time.Date(2026, 3, 7, 9, 5, 2, 0, time.UTC),
+	}
+	tests := []struct {
+		template, want string
+	}{
+		{"{plugin}/{date}/{filename}", "telegram/2026-03-07/Big Buck Bunny.MKV"},
+		{"{category}/{basename}.{ext}", "Movies/Big Buck Bunny.MKV"},
+		{"{domain}/{year}/{month}/{day}/", "cdn.example.com/2026/03/07/"},
+		{"{datetime}_{task_id}", "2026-03-07_09-05-02_42"},
+		{"{user}/{tag}/{tg_chat}", "alice/anime/My Channel"},
+		{"a//b/./{plugin}", "a/b/telegram"},
+		{"x/{tg_sender}/{filename}", "x/Big Buck Bunny.MKV"}, // 空的元数据变量
+	}
+	for _, tt := range tests {
+		got, err := RenderPathTemplate(tt.template, vars)
+		if err != nil {
+			t.Errorf("RenderPathTemplate(%q): %v", tt.template, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("RenderPathTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestRenderPathTemplateFilters(t *testing.T) {
+	vars := PathTemplateVars{
+		Filename: "  Big Buck: Bunny?.mkv ",
+		Category: "Movies",
+		Metadata: map[string]string{"tg_chat": "Café 日本語 Channel"},
+		Time:     time.Date(2026, 3, 7, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		template, want string
+	}{
+		{"{category|lower}", "movies"},
+		{"{category|upper}", "MOVIES"},
+		{"{filename|trim}", "Big Buck: Bunny?.mkv"},
+		{"{filename|slug}", "Big-Buck-Bunny-.mkv"},
+		{"{category|truncate:3}", "Mov"},
+		{"{category|truncate:80}", "Movies"},
+		{"{tg_chat|truncate:7}", "Café 日本"}, // 按字符截断，不会截断多字节字符
+		{"{category|replace:ie:y}", "Movys"},
+		{"x/{category|replace:Movies:}/y", "x/y"}, // 替换为空
+		{"{plugin|default:other}", "other"},
+		{"{category|default:other}", "Movies"},
+		{"{plugin|default:at 12:30}", "at 12:30"}, // default 的文字中可以包含 :
+		{"{category|lower|truncate:3|upper}", "MOV"},
+		{"{plugin|default:Other|lower}", "other"}, // 过滤器按顺序执行
+	}
+	for _, tt := range tests {
+		got, err := RenderPathTemplate(tt.template, vars)
+		if err != nil {
+			t.Errorf("RenderPathTemplate(%q): %v", tt.template, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("RenderPathTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestRenderPathTemplateFallback(t *testing.T) {
+	tests := []struct {
+		template string
+		vars     PathTemplateVars
+		want     string
+	}{
+		{"{tg_chat?plugin}", PathTemplateVars{Plugin: "telegram", Metadata: map[string]string{"tg_chat": "chat"}}, "chat"},
+		{"{tg_chat?plugin}", PathTemplateVars{Plugin: "telegram"}, "telegram"},
+		{"{tg_chat?category?plugin}", PathTemplateVars{Plugin: "telegram", Category: "video"}, "video"},
+		{"{tg_chat?plugin|default:other}", PathTemplateVars{}, "other"},
+		{"{ tag ? category }", PathTemplateVars{Category: "video"}, "video"},
+		{"{tag?category}", PathTemplateVars{Tags: []string{"anime"}, Category: "video"}, "anime"},
+		{"{task_id?plugin}", PathTemplateVars{TaskID: 7, Plugin: "telegram"}, "7"},
+	}
+	for _, tt := range tests {
+		got, err := RenderPathTemplate(tt.template, tt.vars)
+		if err != nil {
+			t.Errorf("RenderPathTemplate(%q): %v", tt.template, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("RenderPathTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestRenderPathTemplateRandom(t *testing.T) {
+	got, err := RenderPathTemplate("{random}", PathTemplateVars{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}$`).MatchString(got) {
+		t.Errorf("{random} = %q, want 8 hex digits", got)
+	}
+}
+
+func TestValidatePathTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{"{plugin}/{date}/{filename}", true},
+		{"downloads/", true},
+		{"{tg_chat?plugin|slug|default:other}/{filename}", true},
+		{"{plugin|default:a:b:c}", true},
+		{"{filename|replace:a:}", true},
+		{"", false},
+		{"   ", false},
+		{"{plugin", false},
+		{"plugin}", false},
+		{"{plugin}}", false},
+		{"{{plugin}}", false},
+		{"{plugin{date}}", false},
+		{"{}", false},
+		{"{unknown}", false},
+		{"{Plugin}", false},
+		{"{plugin?}", false},
+		{"{plugin|nope}", false},
+		{"{plugin|lower:1}", false},
+		{"{plugin|truncate}", false},
+		{"{plugin|truncate:0}", false},
+		{"{plugin|truncate:-1}", false},
+		{"{plugin|truncate:abc}", false},
+		{"{plugin|replace:a}", false},
+		{"{plugin|replace:a:b:c}", false},
+		{"{plugin|default}", false},
+		{"/absolute/{filename}", false},
+		{"../{filename}", false},
+		{"{plugin}/../{filename}", false},
+		{"{plugin}/..", false},
+		{"a..b/{filename}", true},
+	}
+	for _, tt := range tests {
+		err := ValidatePathTemplate(tt.template)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidatePathTemplate(%q) = %v, want valid %v", tt.template, err, tt.valid)
+		}
+	}
+}
+
+func TestRenderPathTemplateRejectsInvalid(t *testing.T) {
+	for _, template := range []string{"{plugin", "{unknown}", "{plugin|truncate:0}"} {
+		if got, err := RenderPathTemplate(template, PathTemplateVars{}); err == nil {
+			t.Errorf("RenderPathTemplate(%q) = %q, want error", template, got)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// 后处理状态（任务的 post_process_status 和单个步骤的 status）
+const (
+	PostProcessPending   = "pending"
+	PostProcessRunning   = "running"
+	PostProcessCompleted = "completed"
+	PostProcessFailed    = "failed"
+	PostProcessSkipped   = "skipped" // 文件与其他任务共用，不处理
+)
+
+const (
+	// postProcessInterval 空闲 worker 检查待处理任务的间隔
+	postProcessInterval = 10 * time.Second
+	// defaultPostProcessWorkers 未配置 post_process_workers 时的 worker 数
+	defaultPostProcessWorkers = 2
+)
+
+var (
+	ErrStepNotFound  = errors.New("后处理步骤不存在")
+	ErrStepNotFailed = errors.New("步骤未失败，无需重试") // 只能重试失败的步骤
+)
+
+// PostProcessStepState 步骤的执行记录
+type PostProcessStepState struct {
+	PostProcessStep
+	Status     string     `json:"status"`
+	Output     string     `json:"output,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Attempts   int        `json:"attempts"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// PostProcessState 保存在 DownloadTask.PostProcess 中
+// Steps 在开始处理时按分类的流水线生成，之后修改配置不影响已开始的任务；Files 为当前的文件列表
+type PostProcessState struct {
+	Files []string               `json:"files"`
+	Steps []PostProcessStepState `json:"steps"`
+}
+
+// loadPipelines 读取系统配置 post_process_pipelines：分类 -> 步骤列表的 JSON，"*" 匹配没有单独配置的分类
+func loadPipelines(ctx context.Context, configService *SystemConfigService) (map[string][]PostProcessStep, error) {
+	value, err := configService.GetConfig(ctx, "post_process_pipelines")
+	if err != nil || value == "" {
+		return nil, nil
+	}
+
+	var pipelines map[string][]PostProcessStep
+	if err := json.Unmarshal([]byte(value), &pipelines); err != nil {
+		return nil, fmt.Errorf("post_process_pipelines 格式错误: %w", err)
+	}
+	for category, steps := range pipelines {
+		for i, step := range steps {
+			if err := step.validate(); err != nil {
+				return nil, fmt.Errorf("分类 %s 的第 %d 个步骤: %w", category, i+1, err)
+			}
+		}
+	}
+	return pipelines, nil
+}
+
+// pipelineFor 返回分类对应的流水线
+func pipelineFor(pipelines map[string][]PostProcessStep, category string) []PostProcessStep {
+	if steps, ok := pipelines[category]; ok {
+		return steps
+	}
+	return pipelines["*"]
+}
+
+// applyPostProcess 任务变为已完成且所属分类配置了流水线时，标记为等待后处理
+func applyPostProcess(task *model.DownloadTask, updates map[string]interface{}, pipelines map[string][]PostProcessStep) map[string]interface{} {
+	if updates["status"] != string(types.TaskStatusCompleted) || task.Status == string(types.TaskStatusCompleted) {
+		return updates
+	}
+	if len(pipelineFor(pipelines, task.Category)) == 0 {
+		return updates
+	}
+	updates["post_process_status"] = PostProcessPending
+	updates["post_process"] = nil
+	return updates
+}
+
+// postProcessStateOf 解析任务的后处理记录
+func postProcessStateOf(task *model.DownloadTask) PostProcessState {
+	var state PostProcessState
+	if len(task.PostProcess) > 0 {
+		if err := json.Unmarshal(task.PostProcess, &state); err != nil {
+			log.Printf("[PostProcess] ⚠️  任务 %d 的后处理记录无效: %v", task.ID, err)
+		}
+	}
+	return state
+}
+
+// PostProcessService 下载完成后按分类执行后处理流水线（解压、移动、权限、校验值、删除样片）
+// 多个 worker 各自认领 post_process_status 为 pending 的任务，每完成一步保存一次进度；
+// 失败的步骤通过 RetryStep 单独重试，从该步骤继续执行
+type PostProcessService struct {
+	db            *gorm.DB
+	engines       *downloader.Registry
+	configService *SystemConfigService
+	space         *SpaceGuard
+	stopChan      chan struct{}
+	wakeChan      chan struct{}
+}
+
+func NewPostProcessService(db *gorm.DB, engines *downloader.Registry) *PostProcessService {
+	return &PostProcessService{
+		db:            db,
+		engines:       engines,
+		configService: NewSystemConfigService(db),
+		space:         NewSpaceGuard(db, engines),
+		stopChan:      make(chan struct{}),
+		wakeChan:      make(chan struct{}, 1),
+	}
+}
+
+func (s *PostProcessService) Start() {
+	ctx := context.Background()
+
+	// 上次退出时正在处理的任务重新执行未完成的步骤
+	if err := s.db.Model(&model.DownloadTask{}).
+		Where("post_process_status = ?", PostProcessRunning).
+		Update("post_process_status", PostProcessPending).Error; err != nil {
+		log.Printf("[PostProcess] 重置处理中的任务失败: %v", err)
+	}
+
+	workers := defaultPostProcessWorkers
+	if value, err := s.configService.GetConfig(ctx, "post_process_workers"); err == nil && value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			workers = n
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	log.Printf("[PostProcess] 启动 %d 个后处理 worker", workers)
+}
+
+func (s *PostProcessService) Stop() {
+	close(s.stopChan)
+}
+
+// wake 唤醒一个空闲的 worker
+func (s *PostProcessService) wake() {
+	select {
+	case s.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *PostProcessService) worker() {
+	ticker := time.NewTicker(postProcessInterval)
+	defer ticker.Stop()
+
+	for {
+		// 连续处理直到没有待处理的任务
+		for {
+			task := s.claim()
+			if task == nil {
+				break
+			}
+			s.run(task)
+
+			select {
+			case <-s.stopChan:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.wakeChan:
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// claim 认领一个待处理的任务，有期望校验值的任务在校验通过后才处理
+func (s *PostProcessService) claim() *model.DownloadTask {
+	for {
+		var task model.DownloadTask
+		err := s.db.Where("status = ? AND post_process_status = ? AND (checksum = '' OR verified_at IS NOT NULL)",
+			string(types.TaskStatusCompleted), PostProcessPending).
+			Order("completed_at ASC").First(&task).Error
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Printf("[PostProcess] 查询待处理任务失败: %v", err)
+			}
+			return nil
+		}
+
+		// 条件更新，多个 worker 同时认领时只有一个成功
+		result := s.db.Model(&model.DownloadTask{}).
+			Where("id = ? AND post_process_status = ?", task.ID, PostProcessPending).
+			Update("post_process_status", PostProcessRunning)
+		if result.Error != nil {
+			log.Printf("[PostProcess] 认领任务 %d 失败: %v", task.ID, result.Error)
+			return nil
+		}
+		if result.RowsAffected == 1 {
+			task.PostProcessStatus = PostProcessRunning
+			return &task
+		}
+	}
+}
+
+// run 从第一个未完成的步骤开始执行流水线
+func (s *PostProcessService) run(task *model.DownloadTask) {
+	ctx := context.Background()
+	state := postProcessStateOf(task)
+
+	if len(state.Steps) == 0 {
+		pipelines, err := loadPipelines(ctx, s.configService)
+		if err != nil {
+			log.Printf("[PostProcess] ❌ %v", err)
+			s.save(task, state, PostProcessFailed)
+			return
+		}
+		steps := pipelineFor(pipelines, task.Category)
+		if len(steps) == 0 {
+			// 流水线在任务完成后被删除
+			s.save(task, state, PostProcessSkipped)
+			return
+		}
+
+		// 内容重复的任务可能指向其他任务的文件，不能移动或删除
+		var shared int64
+		s.db.Model(&model.DownloadTask{}).Where("file_path = ? AND id <> ?", task.FilePath, task.ID).Count(&shared)
+		if shared > 0 {
+			log.Printf("[PostProcess] 任务 %d 的文件被其他任务使用，跳过后处理", task.ID)
+			s.save(task, state, PostProcessSkipped)
+			return
+		}
+
+		for _, step := range steps {
+			state.Steps = append(state.Steps, PostProcessStepState{PostProcessStep: step, Status: PostProcessPending})
+		}
+	}
+
+	if len(state.Files) == 0 {
+		// 首次处理或上次没有找到文件时读取文件列表，仍然找不到时记录在第一个未完成的步骤上
+		state.Files = s.taskFiles(ctx, task)
+		if len(state.Files) == 0 {
+			log.Printf("[PostProcess] ❌ 任务 %d 的文件不存在: %s", task.ID, task.FilePath)
+			for i := range state.Steps {
+				if state.Steps[i].Status != PostProcessCompleted {
+					state.Steps[i].Status = PostProcessFailed
+					state.Steps[i].Error = "找不到下载的文件"
+					break
+				}
+			}
+			s.save(task, state, PostProcessFailed)
+			return
+		}
+	}
+
+	baseDir, _ := s.configService.GetConfig(ctx, "aria2_download_dir")
+	sc := &stepContext{ctx: ctx, task: task, baseDir: baseDir, files: state.Files, engines: s.engines, space: s.space,
+		collision: loadCollisionPolicy(ctx, s.configService)}
+
+	log.Printf("[PostProcess] ⚙️  开始处理任务 %d（%d 个步骤）", task.ID, len(state.Steps))
+	for i := range state.Steps {
+		step := &state.Steps[i]
+		if step.Status == PostProcessCompleted {
+			continue
+		}
+
+		started := time.Now()
+		step.Status = PostProcessRunning
+		step.Attempts++
+		step.StartedAt = &started
+		step.FinishedAt = nil
+
+		var output string
+		var err error
+		if step.Type == StepMove && baseDir == "" {
+			err = fmt.Errorf("未配置下载目录 aria2_download_dir")
+		} else {
+			output, err = runStep(sc, step.PostProcessStep)
+		}
+
+		finished := time.Now()
+		step.FinishedAt = &finished
+		step.Output = output
+		state.Files = sc.files
+
+		if err != nil {
+			step.Status = PostProcessFailed
+			step.Error = err.Error()
+			log.Printf("[PostProcess] ❌ 任务 %d 步骤 %d（%s）失败: %v", task.ID, i, step.Type, err)
+			s.save(task, state, PostProcessFailed)
+			return
+		}
+
+		step.Status = PostProcessCompleted
+		step.Error = ""
+		log.Printf("[PostProcess] ✅ 任务 %d 步骤 %d（%s）完成: %s", task.ID, i, step.Type, lastLine(output))
+		if !s.save(task, state, PostProcessRunning) {
+			return
+		}
+	}
+
+	s.save(task, state, PostProcessCompleted)
+	log.Printf("[PostProcess] 🎉 任务 %d 后处理完成", task.ID)
+}
+
+// taskFiles 返回任务下载的文件：BT 任务从下载引擎读取选中的文件，其余使用 file_path
+func (s *PostProcessService) taskFiles(ctx context.Context, task *model.DownloadTask) []string {
+	files := downloadedFiles(ctx, s.engines, task)
+	if len(files) == 0 && fileExists(task.FilePath) {
+		files = []string{task.FilePath}
+	}
+	return files
+}
+
+// downloadedFiles 从下载引擎读取任务选中且存在的文件，引擎中已没有该任务时返回空
+func downloadedFiles(ctx context.Context, engines *downloader.Registry, task *model.DownloadTask) []string {
+	var files []string
+	if dl, err := engines.Get(task.Engine); err == nil && task.GID != "" {
+		if status, err := dl.TellStatus(ctx, task.GID); err == nil {
+			for _, f := range status.Files {
+				if f.Selected && fileExists(f.Path) {
+					files = append(files, f.Path)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// save 保存后处理进度，文件被移动后同时更新 file_path
+func (s *PostProcessService) save(task *model.DownloadTask, state PostProcessState, status string) bool {
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("[PostProcess] 编码任务 %d 的后处理记录失败: %v", task.ID, err)
+		return false
+	}
+
+	updates := map[string]interface{}{
+		"post_process":        datatypes.JSON(data),
+		"post_process_status": status,
+	}
+	if len(state.Files) > 0 && !containsString(state.Files, task.FilePath) {
+		updates["file_path"] = state.Files[0]
+		task.FilePath = state.Files[0]
+	}
+
+	if err := s.db.Model(task).Updates(updates).Error; err != nil {
+		log.Printf("[PostProcess] 保存任务 %d 的后处理进度失败: %v", task.ID, err)
+		return false
+	}
+	return true
+}
+
+// RetryStep 重试失败的步骤，index 从 0 开始；之后的步骤随后继续执行
+func (s *PostProcessService) RetryStep(ctx context.Context, taskID uint, index int) (*model.DownloadTask, error) {
+	var task model.DownloadTask
+	if err := s.db.WithContext(ctx).First(&task, taskID).Error; err != nil {
+		return nil, err
+	}
+
+	state := postProcessStateOf(&task)
+	if index < 0 || index >= len(state.Steps) {
+		return nil, fmt.Errorf("%w: %d", ErrStepNotFound, index)
+	}
+	if state.Steps[index].Status != PostProcessFailed || task.PostProcessStatus != PostProcessFailed {
+		return nil, ErrStepNotFailed
+	}
+
+	state.Steps[index].Status = PostProcessPending
+	state.Steps[index].Error = ""
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.WithContext(ctx).Model(&task).Updates(map[string]interface{}{
+		"post_process":        datatypes.JSON(data),
+		"post_process_status": PostProcessPending,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	log.Printf("[PostProcess] 🔄 重试任务 %d 的步骤 %d（%s）", task.ID, index, state.Steps[index].Type)
+	s.wake()
+	return &task, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
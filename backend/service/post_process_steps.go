@@ -0,0 +1,679 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+)
+
+// 解压限制，防止压缩炸弹写满磁盘；总大小同时不超过磁盘扣除保留空间后的可用空间
+const (
+	extractMaxEntries   = 100000   // 单个压缩包最多的条目数
+	extractMaxEntrySize = 64 << 30 // 单个文件解压后的最大大小
+	extractMaxTotalSize = 1 << 40  // 单个压缩包解压后的最大总大小
+)
+
+// seedingStopTimeout 移动文件前等待下载引擎停止做种的时间
+const seedingStopTimeout = 10 * time.Second
+
+// reservedDirNames 下载目录下由 MyNest 使用的目录，move 步骤不能把文件移进去
+var reservedDirNames = map[string]bool{
+	trashDirName: true,
+}
+
+// 后处理步骤类型
+const (
+	StepExtract       = "extract"        // 解压 zip/tar/tar.gz/tar.bz2，7z/rar/tar.xz 需要 7z 命令
+	StepMove          = "move"           // 按路径模板移动/重命名
+	StepChmod         = "chmod"          // 设置权限和属主
+	StepChecksum      = "checksum"       // 计算校验值
+	StepDeleteSamples = "delete_samples" // 删除 sample 等样片文件
+)
+
+// PostProcessStep 后处理步骤配置，未用到的参数留空
+type PostProcessStep struct {
+	Type          string   `json:"type"`
+	DeleteArchive bool     `json:"delete_archive,omitempty"` // extract: 解压后删除压缩包
+	Template      string   `json:"template,omitempty"`       // move: 相对下载目录的路径模板，变量同下载路径模板
+	Mode          string   `json:"mode,omitempty"`           // chmod: 八进制权限，如 0644
+	UID           *int     `json:"uid,omitempty"`            // chmod: 属主，为空时不修改
+	GID           *int     `json:"gid,omitempty"`            // chmod: 属组，为空时不修改
+	Algorithm     string   `json:"algorithm,omitempty"`      // checksum: md5/sha1/sha256，默认 sha256
+	Patterns      []string `json:"patterns,omitempty"`       // delete_samples: 匹配规则同 BT 文件排除规则，默认 sample
+}
+
+// validate 检查步骤配置
+func (s PostProcessStep) validate() error {
+	switch s.Type {
+	case StepExtract, StepDeleteSamples:
+	case StepMove:
+		if strings.TrimSpace(s.Template) == "" {
+			return fmt.Errorf("move 步骤缺少 template")
+		}
+		if err := ValidatePathTemplate(s.Template); err != nil {
+			return err
+		}
+	case StepChmod:
+		if s.Mode == "" && s.UID == nil && s.GID == nil {
+			return fmt.Errorf("chmod 步骤需要 mode、uid 或 gid")
+		}
+		if s.Mode != "" {
+			if _, err := strconv.ParseUint(s.Mode, 8, 32); err != nil {
+				return fmt.Errorf("无效的权限: %s", s.Mode)
+			}
+		}
+	case StepChecksum:
+		if s.Algorithm != "" && newChecksumHash(normalizeChecksumAlgo(s.Algorithm)) == nil {
+			return fmt.Errorf("不支持的校验算法: %s", s.Algorithm)
+		}
+	default:
+		return fmt.Errorf("未知的后处理步骤: %s", s.Type)
+	}
+	return nil
+}
+
+// stepContext 步骤执行时的上下文，files 为任务当前的文件列表，步骤可以修改它
+type stepContext struct {
+	ctx       context.Context
+	task      *model.DownloadTask
+	baseDir   string
+	files     []string
+	engines   *downloader.Registry
+	space     *SpaceGuard
+	collision string // 目标文件已存在时的处理策略（filename_collision_policy）
+}
+
+// runStep 执行单个步骤，返回记录在任务上的输出
+func runStep(sc *stepContext, step PostProcessStep) (string, error) {
+	switch step.Type {
+	case StepExtract:
+		return stepExtract(sc, step)
+	case StepMove:
+		return stepMove(sc, step)
+	case StepChmod:
+		return stepChmod(sc, step)
+	case StepChecksum:
+		return stepChecksum(sc, step)
+	case StepDeleteSamples:
+		return stepDeleteSamples(sc, step)
+	}
+	return "", fmt.Errorf("未知的后处理步骤: %s", step.Type)
+}
+
+// archiveKind 按扩展名判断压缩包类型，返回类型和去掉扩展名后的名称
+func archiveKind(name string) (string, string) {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz", ".tar", ".zip", ".7z", ".rar"} {
+		if strings.HasSuffix(lower, ext) {
+			return ext, name[:len(name)-len(ext)]
+		}
+	}
+	return "", ""
+}
+
+func stepExtract(sc *stepContext, step PostProcessStep) (string, error) {
+	var files, extracted []string
+	for _, file := range sc.files {
+		kind, base := archiveKind(file)
+		if kind == "" {
+			files = append(files, file)
+			continue
+		}
+
+		dest := base
+		budget, err := newExtractBudget(sc, dest)
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return "", err
+		}
+		out, err := extractArchive(sc.ctx, kind, file, dest, budget, sc.collision)
+		if err != nil {
+			return "", fmt.Errorf("解压 %s 失败: %w", filepath.Base(file), err)
+		}
+		extracted = append(extracted, out...)
+
+		if step.DeleteArchive {
+			if err := os.Remove(file); err != nil {
+				return "", err
+			}
+		} else {
+			files = append(files, file)
+		}
+	}
+
+	if len(extracted) == 0 {
+		return "没有需要解压的文件", nil
+	}
+	sc.files = append(extracted, files...)
+	return fmt.Sprintf("解压出 %d 个文件", len(extracted)), nil
+}
+
+// extractBudget 解压一个压缩包时剩余的条目数和字节数
+type extractBudget struct {
+	entries   int
+	remaining int64
+}
+
+// newExtractBudget 按解压限制和 dest 所在磁盘的可用空间创建解压预算
+func newExtractBudget(sc *stepContext, dest string) (*extractBudget, error) {
+	budget := &extractBudget{entries: extractMaxEntries, remaining: extractMaxTotalSize}
+	if sc.space != nil {
+		if available, err := sc.space.Available(sc.ctx, dest); err == nil && available < budget.remaining {
+			if available <= 0 {
+				return nil, fmt.Errorf("磁盘剩余空间不足，无法解压")
+			}
+			budget.remaining = available
+		}
+	}
+	return budget, nil
+}
+
+// reserve 检查压缩包声明的条目大小，超出限制时返回错误
+func (b *extractBudget) reserve(name string, size int64) error {
+	if b.entries--; b.entries < 0 {
+		return fmt.Errorf("压缩包的条目超过 %d 个", extractMaxEntries)
+	}
+	if size > extractMaxEntrySize {
+		return fmt.Errorf("%s 解压后 %s，超过单个文件上限 %s", name, formatByteSize(size), formatByteSize(extractMaxEntrySize))
+	}
+	if size > b.remaining {
+		return fmt.Errorf("解压 %s 需要 %s，剩余可用 %s", name, formatByteSize(size), formatByteSize(b.remaining))
+	}
+	return nil
+}
+
+// checkTotal 解压前检查声明的总大小（zip 目录或 7z 列表）
+func (b *extractBudget) checkTotal(entries int, total int64) error {
+	if entries > b.entries {
+		return fmt.Errorf("压缩包的条目超过 %d 个", extractMaxEntries)
+	}
+	if total > b.remaining {
+		return fmt.Errorf("解压需要 %s，剩余可用 %s", formatByteSize(total), formatByteSize(b.remaining))
+	}
+	return nil
+}
+
+// write 写入一个文件，实际写入的大小不能超过单个文件上限和剩余预算（压缩包声明的大小可能是伪造的）
+func (b *extractBudget) write(target string, r io.Reader) error {
+	limit := min(b.remaining, int64(extractMaxEntrySize))
+	n, err := writeExtractedFile(target, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		os.Remove(target)
+		err = fmt.Errorf("%s 解压后超过剩余可用空间或单个文件上限", filepath.Base(target))
+	}
+	b.remaining -= n
+	return err
+}
+
+// extractArchive 解压到 dest，返回解压出的文件路径
+// dest 中已有同名文件（可能属于其他下载）时按 collision 策略改名、跳过或覆盖
+func extractArchive(ctx context.Context, kind, archive, dest string, budget *extractBudget, collision string) ([]string, error) {
+	switch kind {
+	case ".zip":
+		return extractZip(archive, dest, budget, collision)
+	case ".tar":
+		return extractTarFile(archive, dest, nil, budget, collision)
+	case ".tar.gz", ".tgz":
+		return extractTarFile(archive, dest, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }, budget, collision)
+	case ".tar.bz2", ".tbz2":
+		return extractTarFile(archive, dest, func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }, budget, collision)
+	}
+	return extractWith7z(ctx, archive, dest, budget, collision)
+}
+
+// safeJoin 拼接压缩包内的路径，拒绝跳出目标目录的条目
+func safeJoin(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if rel, err := filepath.Rel(dest, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("压缩包包含非法路径: %s", name)
+	}
+	return target, nil
+}
+
+func extractZip(archive, dest string, budget *extractBudget, collision string) ([]string, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var total int64
+	for _, f := range r.File {
+		total += int64(f.UncompressedSize64)
+	}
+	if err := budget.checkTotal(len(r.File), total); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, f := range r.File {
+		target, err := safeJoin(dest, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue // 忽略符号链接等特殊文件
+		}
+		if target, err = collisionTarget(target, collision); err != nil {
+			return nil, err
+		}
+		if target == "" {
+			continue
+		}
+		if err := budget.reserve(f.Name, int64(f.UncompressedSize64)); err != nil {
+			return nil, err
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = budget.write(target, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, target)
+	}
+	return files, nil
+}
+
+func extractTarFile(archive, dest string, decompress func(io.Reader) (io.Reader, error), budget *extractBudget, collision string) ([]string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if decompress != nil {
+		if r, err = decompress(f); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		target, err := safeJoin(dest, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		// tar 没有 zip 那样的文件列表，逐个条目检查；目录和忽略的特殊文件同样计入条目数，避免大量空条目绕过限制
+		var size int64
+		if hdr.Typeflag == tar.TypeReg {
+			size = hdr.Size
+		}
+		if err := budget.reserve(hdr.Name, size); err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			if target, err = collisionTarget(target, collision); err != nil {
+				return nil, err
+			}
+			if target == "" {
+				continue
+			}
+			if err := budget.write(target, tr); err != nil {
+				return nil, err
+			}
+			files = append(files, target)
+		}
+	}
+}
+
+// writeExtractedFile 写入解压出的文件，调用方已按冲突策略选好路径，overwrite 策略下覆盖已有文件
+func writeExtractedFile(target string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, r)
+	if err != nil {
+		out.Close()
+		return n, err
+	}
+	return n, out.Close()
+}
+
+// extractWith7z 标准库不支持的格式交给 7z 命令，解压前用 7z l 列出条目检查解压限制
+func extractWith7z(ctx context.Context, archive, dest string, budget *extractBudget, collision string) ([]string, error) {
+	bin, err := exec.LookPath("7z")
+	if err != nil {
+		return nil, fmt.Errorf("解压 %s 需要安装 7z 命令", filepath.Ext(archive))
+	}
+
+	list, err := exec.CommandContext(ctx, bin, "l", "-slt", archive).Output()
+	if err != nil {
+		return nil, fmt.Errorf("读取压缩包列表失败: %v", err)
+	}
+	entries, total, err := parse7zList(list)
+	if err != nil {
+		return nil, err
+	}
+	if err := budget.checkTotal(entries, total); err != nil {
+		return nil, err
+	}
+
+	// 已有同名文件时：-aou 自动改名，-aos 跳过，-aoa 覆盖
+	overwriteMode := "-aou"
+	switch collision {
+	case CollisionSkip:
+		overwriteMode = "-aos"
+	case CollisionOverwrite:
+		overwriteMode = "-aoa"
+	}
+
+	before := make(map[string]time.Time)
+	listFiles(dest, func(path string) {
+		if info, err := os.Stat(path); err == nil {
+			before[path] = info.ModTime()
+		}
+	})
+
+	cmd := exec.CommandContext(ctx, bin, "x", "-y", overwriteMode, "-o"+dest, archive)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, lastLine(string(out)))
+	}
+
+	// 新出现或被覆盖（修改时间变化）的文件为解压出的文件
+	var files []string
+	listFiles(dest, func(path string) {
+		modTime, existed := before[path]
+		if info, err := os.Stat(path); err == nil && (!existed || !info.ModTime().Equal(modTime)) {
+			files = append(files, path)
+		}
+	})
+	return files, nil
+}
+
+// parse7zList 解析 7z l -slt 的输出，返回文件条目数和解压后的总大小，单个文件超过上限时返回错误
+func parse7zList(list []byte) (int, int64, error) {
+	var entries int
+	var total int64
+	var path string
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " = ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Path":
+			path = value
+		case "Size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			if size > extractMaxEntrySize {
+				return 0, 0, fmt.Errorf("%s 解压后 %s，超过单个文件上限 %s", path, formatByteSize(size), formatByteSize(extractMaxEntrySize))
+			}
+			entries++
+			total += size
+		}
+	}
+	return entries, total, scanner.Err()
+}
+
+func listFiles(root string, fn func(path string)) {
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			fn(path)
+		}
+		return nil
+	})
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
+
+// commonDir 返回文件列表的公共目录，单个文件时为其所在目录
+func commonDir(files []string) string {
+	dir := filepath.Dir(files[0])
+	for _, file := range files[1:] {
+		for !strings.HasPrefix(file, dir+string(filepath.Separator)) && dir != filepath.Dir(dir) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return dir
+}
+
+// stepMove 按模板移动文件，{filename} 为文件相对公共目录的路径；模板以 / 结尾时移动到该目录下
+func stepMove(sc *stepContext, step PostProcessStep) (string, error) {
+	if len(sc.files) == 0 {
+		return "", fmt.Errorf("没有可移动的文件")
+	}
+
+	if err := stopSeeding(sc); err != nil {
+		return "", err
+	}
+
+	root := commonDir(sc.files)
+
+	moved := make([]string, 0, len(sc.files))
+	skipped := 0
+	for _, file := range sc.files {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return "", err
+		}
+
+		target, err := RenderPathTemplate(step.Template, taskTemplateVars(sc.task, rel))
+		if err != nil {
+			return "", err
+		}
+		// 与下载路径一样逐级清理，插件元数据等变量中的非法字符、过长的名称和 .. 不会原样进入路径
+		target = sanitizeDownloadPath(target)
+		if target == "" {
+			return "", fmt.Errorf("move 的目标路径为空")
+		}
+		if strings.HasSuffix(target, "/") {
+			target = filepath.Join(target, rel)
+		}
+		if err := checkReservedPath(target); err != nil {
+			return "", err
+		}
+		target, err = safeJoin(sc.baseDir, target)
+		if err != nil {
+			return "", err
+		}
+
+		if target != file {
+			// 目标已有其他文件时按 filename_collision_policy 改名、保留在原位置或覆盖
+			dest, err := collisionTarget(target, sc.collision)
+			if err != nil {
+				return "", err
+			}
+			if dest == "" {
+				log.Printf("[PostProcess] 任务 %d 的目标文件已存在，保留在原位置: %s", sc.task.ID, target)
+				moved = append(moved, file)
+				skipped++
+				continue
+			}
+			if dest != target {
+				log.Printf("[PostProcess] 🔀 任务 %d 的目标文件已存在，重命名为: %s", sc.task.ID, dest)
+			}
+			target = dest
+
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return "", err
+			}
+			if err := os.Rename(file, target); err != nil {
+				return "", err
+			}
+		}
+		moved = append(moved, target)
+	}
+
+	sc.files = moved
+	if skipped > 0 {
+		return fmt.Sprintf("已移动到 %s，%d 个文件的目标已存在，保留在原位置", commonDir(moved), skipped), nil
+	}
+	return fmt.Sprintf("已移动到 %s", commonDir(moved)), nil
+}
+
+// checkReservedPath 相对下载目录的路径不能位于回收站等 MyNest 使用的目录中
+func checkReservedPath(rel string) error {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if reservedDirNames[part] {
+			return fmt.Errorf("不能移动到 %s 目录: %s", part, rel)
+		}
+	}
+	return nil
+}
+
+// stopSeeding 移动文件前从下载引擎移除仍在做种的 BT 任务，否则 aria2 会继续读取原路径的文件，
+// 等待引擎确认任务已停止后才返回
+func stopSeeding(sc *stepContext) error {
+	if sc.engines == nil || sc.task.GID == "" {
+		return nil
+	}
+	dl, err := sc.engines.Get(sc.task.Engine)
+	if err != nil {
+		return nil
+	}
+	status, err := dl.TellStatus(sc.ctx, sc.task.GID)
+	if err != nil || status.Status != "active" {
+		return nil
+	}
+
+	log.Printf("[PostProcess] 任务 %d 仍在做种，移动文件前从 %s 移除 (GID: %s)", sc.task.ID, sc.task.Engine, sc.task.GID)
+	if err := dl.Remove(sc.ctx, sc.task.GID); err != nil {
+		return fmt.Errorf("停止做种失败: %w", err)
+	}
+	deadline := time.Now().Add(seedingStopTimeout)
+	for time.Now().Before(deadline) {
+		status, err := dl.TellStatus(sc.ctx, sc.task.GID)
+		if err != nil || status.Status != "active" {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("等待停止做种超时")
+}
+
+func stepChmod(sc *stepContext, step PostProcessStep) (string, error) {
+	for _, file := range sc.files {
+		if step.Mode != "" {
+			mode, _ := strconv.ParseUint(step.Mode, 8, 32)
+			if err := os.Chmod(file, os.FileMode(mode)); err != nil {
+				return "", err
+			}
+		}
+		if step.UID != nil || step.GID != nil {
+			uid, gid := -1, -1
+			if step.UID != nil {
+				uid = *step.UID
+			}
+			if step.GID != nil {
+				gid = *step.GID
+			}
+			if err := os.Lchown(file, uid, gid); err != nil {
+				return "", err
+			}
+		}
+	}
+	return fmt.Sprintf("已设置 %d 个文件", len(sc.files)), nil
+}
+
+// stepChecksum 计算每个文件的校验值，结果记录在步骤输出中
+func stepChecksum(sc *stepContext, step PostProcessStep) (string, error) {
+	algo := normalizeChecksumAlgo(step.Algorithm)
+	if algo == "" {
+		algo = "sha-256"
+	}
+
+	lines := make([]string, 0, len(sc.files))
+	for _, file := range sc.files {
+		h := newChecksumHash(algo)
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s=%s", filepath.Base(file), algo, hex.EncodeToString(h.Sum(nil))))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// stepDeleteSamples 删除命中规则的文件，规则按文件相对公共目录的路径匹配，不会删除全部文件
+func stepDeleteSamples(sc *stepContext, step PostProcessStep) (string, error) {
+	patterns := step.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"sample"}
+	}
+
+	root := commonDir(sc.files)
+	var kept, samples []string
+	for _, file := range sc.files {
+		rel, _ := filepath.Rel(root, file)
+		if excluded(filepath.ToSlash(rel), patterns) {
+			samples = append(samples, file)
+		} else {
+			kept = append(kept, file)
+		}
+	}
+
+	if len(samples) == 0 {
+		return "没有样片文件", nil
+	}
+	if len(kept) == 0 {
+		return "", fmt.Errorf("所有文件都命中删除规则，已跳过")
+	}
+
+	for _, file := range samples {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	sc.files = kept
+	return fmt.Sprintf("已删除 %d 个样片文件", len(samples)), nil
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix/mynest/backend/model"
+)
+
+func TestSafeJoin(t *testing.T) {
+	dest := filepath.FromSlash("/downloads/archive")
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"file.txt", "/downloads/archive/file.txt", false},
+		{"dir/file.txt", "/downloads/archive/dir/file.txt", false},
+		{"dir/../file.txt", "/downloads/archive/file.txt", false},
+		{"/etc/passwd", "/downloads/archive/etc/passwd", false}, // 绝对路径拼接在目标目录下
+		{"..", "", true},
+		{"../file.txt", "", true},
+		{"dir/../../file.txt", "", true},
+		{"../archive2/file.txt", "", true},
+	}
+	for _, tt := range tests {
+		got, err := safeJoin(dest, tt.name)
+		if (err != nil) != tt.wantErr || (err == nil && got != filepath.FromSlash(tt.want)) {
+			t.Errorf("safeJoin(%q) = %q, %v, want %q (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckReservedPath(t *testing.T) {
+	tests := []struct {
+		rel     string
+		wantErr bool
+	}{
+		{"library/movie.mkv", false},
+		{"trash/movie.mkv", false},
+		{".trash/movie.mkv", true},
+		{"library/.trash/movie.mkv", true},
+	}
+	for _, tt := range tests {
+		if err := checkReservedPath(tt.rel); (err != nil) != tt.wantErr {
+			t.Errorf("checkReservedPath(%q) = %v, want error %v", tt.rel, err, tt.wantErr)
+		}
+	}
+}
+
+// writeZip 创建 zip 文件，entries 为条目名到内容
+func writeZip(t *testing.T, path string, entries [][2]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for _, entry := range entries {
+		e, err := w.Create(entry[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Write([]byte(entry[1]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func newTestBudget() *extractBudget {
+	return &extractBudget{entries: extractMaxEntries, remaining: 1 << 20}
+}
+
+func TestExtractZipRejectsEscapingEntries(t *testing.T) {
+	for _, name := range []string{"../escape.txt", "a/../../escape.txt"} {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "test.zip")
+		writeZip(t, archive, [][2]string{{"ok.txt", "ok"}, {name, "evil"}})
+
+		dest := filepath.Join(dir, "test")
+		if _, err := extractZip(archive, dest, newTestBudget(), CollisionRename); err == nil {
+			t.Errorf("entry %q extracted", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "escape.txt")); !os.IsNotExist(err) {
+			t.Errorf("entry %q written outside dest", name)
+		}
+	}
+}
+
+func TestExtractZipBudget(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "test.zip")
+	writeZip(t, archive, [][2]string{{"a.txt", "0123456789"}, {"b.txt", "0123456789"}})
+
+	budget := &extractBudget{entries: extractMaxEntries, remaining: 15}
+	if _, err := extractZip(archive, filepath.Join(dir, "test"), budget, CollisionRename); err == nil {
+		t.Error("archive larger than budget extracted")
+	}
+	budget = &extractBudget{entries: 1, remaining: 1 << 20}
+	if _, err := extractZip(archive, filepath.Join(dir, "test"), budget, CollisionRename); err == nil {
+		t.Error("archive with too many entries extracted")
+	}
+}
+
+// writeTar 创建 tar 文件，name 以 / 结尾的条目为目录
+func writeTar(t *testing.T, path string, entries [][2]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tar.NewWriter(f)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry[0], Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry[1]))}
+		if strings.HasSuffix(entry[0], "/") {
+			hdr = &tar.Header{Name: entry[0], Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry[1]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestExtractTarBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries [][2]string
+		budget  extractBudget
+		ok      bool
+	}{
+		{"within budget", [][2]string{{"d/", ""}, {"d/a.txt", "0123456789"}}, extractBudget{entries: 2, remaining: 10}, true},
+		{"too large", [][2]string{{"a.txt", "0123456789"}, {"b.txt", "0123456789"}}, extractBudget{entries: 10, remaining: 15}, false},
+		{"too many files", [][2]string{{"a.txt", "a"}, {"b.txt", "b"}}, extractBudget{entries: 1, remaining: 1 << 20}, false},
+		{"too many directories", [][2]string{{"a/", ""}, {"b/", ""}, {"c/", ""}}, extractBudget{entries: 2, remaining: 1 << 20}, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "test.tar")
+		writeTar(t, archive, tt.entries)
+
+		budget := tt.budget
+		_, err := extractTarFile(archive, filepath.Join(dir, "test"), nil, &budget, CollisionRename)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestExtractZipCollision(t *testing.T) {
+	tests := []struct {
+		policy   string
+		existing string // 解压后已有文件的内容
+		created  string // 新建的文件名，为空表示没有新建
+	}{
+		{CollisionRename, "other", "a (1).txt"},
+		{CollisionSkip, "other", ""},
+		{CollisionOverwrite, "zip", "a.txt"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "test.zip")
+		writeZip(t, archive, [][2]string{{"a.txt", "zip"}})
+		dest := filepath.Join(dir, "test")
+		os.MkdirAll(dest, 0755)
+		os.WriteFile(filepath.Join(dest, "a.txt"), []byte("other"), 0644)
+
+		files, err := extractZip(archive, dest, newTestBudget(), tt.policy)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.policy, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dest, "a.txt")); string(data) != tt.existing {
+			t.Errorf("%s: existing file = %q, want %q", tt.policy, data, tt.existing)
+		}
+		switch {
+		case tt.created == "" && len(files) != 0:
+			t.Errorf("%s: files = %v, want none", tt.policy, files)
+		case tt.created != "" && (len(files) != 1 || files[0] != filepath.Join(dest, tt.created)):
+			t.Errorf("%s: files = %v, want %s", tt.policy, files, tt.created)
+		}
+	}
+}
+
+func TestStepMove(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		policy   string
+		want     string // 相对下载目录，为空表示保留在原位置
+		wantErr  bool
+	}{
+		{"template", "library/{filename}", CollisionRename, "library/movie.mkv", false},
+		{"directory", "library/", CollisionRename, "library/movie.mkv", false},
+		{"category", "{category}/{filename}", CollisionRename, "video/movie.mkv", false},
+		{"nested", "library/{plugin}/{filename}", CollisionRename, "library/telegram/movie.mkv", false},
+		{"sanitized", "library/a:b?/{filename}", CollisionRename, "library/a_b_/movie.mkv", false},
+		{"dot dot", "../../{filename}", CollisionRename, "movie.mkv", false},
+		{"existing renamed", "done/{filename}", CollisionRename, "done/movie (1).mkv", false},
+		{"existing skipped", "done/{filename}", CollisionSkip, "", false},
+		{"existing overwritten", "done/{filename}", CollisionOverwrite, "done/movie.mkv", false},
+		{"dot directory", ".trash/{filename}", CollisionRename, "trash/movie.mkv", false}, // 开头的 . 被去掉
+		{"empty", "../", CollisionRename, "", true},
+	}
+	for _, tt := range tests {
+		base := t.TempDir()
+		src := filepath.Join(base, "incoming", "movie.mkv")
+		os.MkdirAll(filepath.Dir(src), 0755)
+		os.WriteFile(src, []byte("movie"), 0644)
+		os.MkdirAll(filepath.Join(base, "done"), 0755)
+		os.WriteFile(filepath.Join(base, "done", "movie.mkv"), []byte("other"), 0644)
+
+		task := &model.DownloadTask{Category: "video", PluginName: "telegram"}
+		sc := &stepContext{ctx: context.Background(), task: task, baseDir: base, files: []string{src}, collision: tt.policy}
+		_, err := stepMove(sc, PostProcessStep{Type: StepMove, Template: tt.template})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+
+		want := src
+		if tt.want != "" {
+			want = filepath.Join(base, filepath.FromSlash(tt.want))
+		}
+		if len(sc.files) != 1 || sc.files[0] != want {
+			t.Errorf("%s: files = %v, want %s", tt.name, sc.files, want)
+			continue
+		}
+		if data, _ := os.ReadFile(want); string(data) != "movie" {
+			t.Errorf("%s: %s = %q", tt.name, want, data)
+		}
+	}
+}
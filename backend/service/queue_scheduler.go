@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/gorm"
+)
+
+const (
+	// scheduleInterval 调度器检查空闲名额的间隔，任务完成后最多延迟该时间放行下一个
+	scheduleInterval = 3 * time.Second
+	// speedLimitRefresh 全局限速未变化时重新下发的间隔
+	speedLimitRefresh = 10 * time.Minute
+	// speedLimitMaxBackoff 下发全局限速失败（如 aria2 不可用）后重试间隔的上限
+	speedLimitMaxBackoff = 5 * time.Minute
+)
+
+// QueueScheduler 按队列优先级、任务优先级和排队顺序把排队任务放行给下载引擎
+// 每个队列的运行任务数不超过 max_concurrent，所有队列合计不超过系统配置 max_active_downloads
+// 同时负责任务的开始时间、下载时间窗口以及全局限速计划
+type QueueScheduler struct {
+	db        *gorm.DB
+	downloads *DownloadService
+	stopChan  chan struct{}
+
+	// 最近一次下发的全局限速，用于避免重复调用 changeGlobalOption
+	lastLimits    string
+	lastLimitsAt  time.Time
+	lastLimitsErr string
+
+	// 下发全局限速失败后按指数退避重试，只在失败原因变化和恢复时记录日志
+	limitsBackoff  time.Duration
+	limitsRetryAt  time.Time
+	limitsApplyErr string
+}
+
+func NewQueueScheduler(db *gorm.DB, downloads *DownloadService) *QueueScheduler {
+	return &QueueScheduler{
+		db:        db,
+		downloads: downloads,
+		stopChan:  make(chan struct{}),
+	}
+}
+
+func (s *QueueScheduler) Start() {
+	ticker := time.NewTicker(scheduleInterval)
+	go func() {
+		s.schedule()
+		for {
+			select {
+			case <-s.downloads.wake:
+				s.schedule()
+			case <-ticker.C:
+				s.schedule()
+			case <-s.stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (s *QueueScheduler) Stop() {
+	close(s.stopChan)
+}
+
+func (s *QueueScheduler) schedule() {
+	ctx := context.Background()
+	now := time.Now()
+
+	s.enforceWindows(ctx, now)
+	s.applySpeedLimits(ctx, now)
+	s.releaseQueued(ctx, now)
+}
+
+// releaseQueued 放行排队任务，跳过未到开始时间、未到重试时间或不在时间窗口内的任务
+func (s *QueueScheduler) releaseQueued(ctx context.Context, now time.Time) {
+	var queued []*model.DownloadTask
+	if err := s.db.Where("status = ?", string(types.TaskStatusQueued)).Find(&queued).Error; err != nil {
+		log.Printf("[Scheduler] 查询排队任务失败: %v", err)
+		return
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	var queueList []model.DownloadQueue
+	if err := s.db.Find(&queueList).Error; err != nil {
+		log.Printf("[Scheduler] 查询队列失败: %v", err)
+		return
+	}
+	queues := make(map[string]model.DownloadQueue, len(queueList))
+	for _, queue := range queueList {
+		queues[queue.Name] = queue
+	}
+	// 队列被删除但任务尚未迁移时按 default 队列处理
+	queueOf := func(task *model.DownloadTask) model.DownloadQueue {
+		if queue, ok := queues[task.Queue]; ok {
+			return queue
+		}
+		return queues[DefaultQueue]
+	}
+
+	running, err := NewQueueService(s.db).countByQueue(runningStatuses)
+	if err != nil {
+		log.Printf("[Scheduler] 统计运行任务失败: %v", err)
+		return
+	}
+	var total int64
+	for _, count := range running {
+		total += count
+	}
+
+	maxActive := 0
+	if value, err := s.downloads.configService.GetConfig(ctx, "max_active_downloads"); err == nil && value != "" {
+		maxActive, _ = strconv.Atoi(value)
+	}
+
+	sort.SliceStable(queued, func(i, j int) bool {
+		qi, qj := queueOf(queued[i]), queueOf(queued[j])
+		if qi.Priority != qj.Priority {
+			return qi.Priority > qj.Priority
+		}
+		if queued[i].Priority != queued[j].Priority {
+			return queued[i].Priority > queued[j].Priority
+		}
+		if queued[i].Position != queued[j].Position {
+			return queued[i].Position < queued[j].Position
+		}
+		return queued[i].ID < queued[j].ID
+	})
+
+	// 本轮放行的任务共用一份下载引擎的进度快照，刚放行的任务不在快照中，按未下载计算
+	progress := s.downloads.space.snapshot()
+	released := 0
+	for _, task := range queued {
+		if maxActive > 0 && total >= int64(maxActive) {
+			break
+		}
+
+		if task.StartAt != nil && task.StartAt.After(now) {
+			continue
+		}
+		if task.NextRetryAt != nil && task.NextRetryAt.After(now) {
+			continue
+		}
+		if !inWindow(task.Window, now) {
+			continue
+		}
+
+		queue := queueOf(task)
+		if queue.MaxConcurrent > 0 && running[queue.Name] >= int64(queue.MaxConcurrent) {
+			continue
+		}
+
+		if err := s.downloads.releaseTask(ctx, task, progress); err != nil {
+			continue
+		}
+		running[queue.Name]++
+		total++
+		released++
+	}
+
+	if released > 0 {
+		log.Printf("[Scheduler] 放行 %d 个任务，剩余排队 %d 个", released, len(queued)-released)
+	}
+}
+
+// enforceWindows 时间窗口关闭时暂停运行中的任务，窗口重新打开时恢复被调度器暂停的任务
+func (s *QueueScheduler) enforceWindows(ctx context.Context, now time.Time) {
+	var tasks []*model.DownloadTask
+	if err := s.db.Where("time_window <> '' AND (status IN ? OR window_paused = ?)", []string{
+		string(types.TaskStatusPending),
+		string(types.TaskStatusDownloading),
+	}, true).
+		Find(&tasks).Error; err != nil {
+		log.Printf("[Scheduler] 查询时间窗口任务失败: %v", err)
+		return
+	}
+
+	for _, task := range tasks {
+		open := inWindow(task.Window, now)
+		// 只处理窗口关闭但仍在运行、或窗口打开但仍被调度器暂停的任务
+		if open != task.WindowPaused || task.GID == "" {
+			continue
+		}
+
+		dl, err := s.downloads.engineFor(task)
+		if err != nil {
+			continue
+		}
+
+		if !open {
+			if err := dl.Pause(ctx, task.GID); err != nil {
+				log.Printf("[Scheduler] 时间窗口关闭，暂停任务 %d 失败: %v", task.ID, err)
+				continue
+			}
+			log.Printf("[Scheduler] ⏸️  时间窗口 %s 已关闭，暂停任务 %d", task.Window, task.ID)
+			s.db.Model(task).Updates(map[string]interface{}{
+				"status":        string(types.TaskStatusPaused),
+				"window_paused": true,
+				"error_msg":     fmt.Sprintf("等待下载时间窗口 %s", task.Window),
+			})
+			continue
+		}
+
+		// 窗口打开后重新排队，与手动恢复一样由 releaseQueued 按并发名额恢复
+		updates := map[string]interface{}{"window_paused": false}
+		if task.Status == string(types.TaskStatusPaused) {
+			log.Printf("[Scheduler] ▶️  时间窗口 %s 已打开，任务 %d 重新排队", task.Window, task.ID)
+			updates["status"] = string(types.TaskStatusQueued)
+			updates["error_msg"] = ""
+		}
+		s.db.Model(task).Updates(updates)
+	}
+}
+
+// applySpeedLimits 按 speed_limit_schedule 配置调整下载引擎的全局限速
+// 限速未变化时每隔 speedLimitRefresh 重新下发一次，避免引擎重启后丢失
+func (s *QueueScheduler) applySpeedLimits(ctx context.Context, now time.Time) {
+	value, _ := s.downloads.configService.GetConfig(ctx, "speed_limit_schedule")
+	if value == "" && s.lastLimits == "" {
+		// 从未配置限速计划，不覆盖引擎自身的限速设置
+		return
+	}
+
+	rules, err := ParseSpeedLimitSchedule(value)
+	if err != nil {
+		if s.lastLimitsErr != err.Error() {
+			log.Printf("[Scheduler] ⚠️  %v", err)
+			s.lastLimitsErr = err.Error()
+		}
+		return
+	}
+	s.lastLimitsErr = ""
+
+	limits := currentSpeedLimits(rules, now)
+	key := fmt.Sprint(limits)
+	if key == s.lastLimits && now.Sub(s.lastLimitsAt) < speedLimitRefresh {
+		return
+	}
+	if now.Before(s.limitsRetryAt) {
+		return
+	}
+
+	for _, name := range s.downloads.engines.Names() {
+		dl, _ := s.downloads.engines.Get(name)
+		if err := dl.ChangeGlobalOption(ctx, limits); err != nil {
+			if errors.Is(err, downloader.ErrUnsupported) {
+				continue
+			}
+			msg := fmt.Sprintf("设置 %s 全局限速失败: %v", name, err)
+			if msg != s.limitsApplyErr {
+				log.Printf("[Scheduler] %s，稍后重试", msg)
+				s.limitsApplyErr = msg
+			}
+			s.limitsBackoff = min(max(s.limitsBackoff*2, scheduleInterval), speedLimitMaxBackoff)
+			s.limitsRetryAt = now.Add(s.limitsBackoff)
+			return
+		}
+	}
+	if s.limitsApplyErr != "" {
+		log.Printf("[Scheduler] ✅ 全局限速已恢复下发")
+		s.limitsApplyErr = ""
+	}
+	s.limitsBackoff = 0
+	s.limitsRetryAt = time.Time{}
+
+	if key != s.lastLimits {
+		log.Printf("[Scheduler] 🚦 全局限速: 下载 %v, 上传 %v", limits["max-overall-download-limit"], limits["max-overall-upload-limit"])
+	}
+	if value == "" {
+		// 限速计划已删除，恢复不限速后不再下发
+		s.lastLimits = ""
+		return
+	}
+	s.lastLimits = key
+	s.lastLimitsAt = now
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/gorm"
+)
+
+// DefaultQueue 未指定队列的任务进入 default 队列，该队列不可删除
+const DefaultQueue = "default"
+
+var (
+	ErrQueueNotFound = errors.New("队列不存在")
+	ErrTaskNotQueued = errors.New("只能调整排队中的任务")
+)
+
+// runningStatuses 占用队列并发名额的任务状态，即在下载引擎中处于活动状态的任务
+// 等待选择文件的任务在引擎中保留着，选择后直接开始下载，同样占用名额；
+// 暂停的任务不占用名额，恢复时重新排队，由调度器在有空闲名额时恢复
+var runningStatuses = []string{
+	string(types.TaskStatusPending),
+	string(types.TaskStatusDownloading),
+	string(types.TaskStatusAwaitingSelection),
+}
+
+type QueueService struct {
+	db *gorm.DB
+}
+
+func NewQueueService(db *gorm.DB) *QueueService {
+	return &QueueService{db: db}
+}
+
+// QueueInfo 队列及其当前任务数
+type QueueInfo struct {
+	model.DownloadQueue
+	Queued  int64 `json:"queued"`
+	Running int64 `json:"running"`
+}
+
+// EnsureDefaultQueue 创建 default 队列（已存在时不修改）
+func (s *QueueService) EnsureDefaultQueue(ctx context.Context, maxConcurrent int) error {
+	queue := model.DownloadQueue{Name: DefaultQueue, MaxConcurrent: maxConcurrent}
+	return s.db.Where("name = ?", DefaultQueue).FirstOrCreate(&queue).Error
+}
+
+// ListQueues 列出所有队列，按优先级从高到低排列
+func (s *QueueService) ListQueues(ctx context.Context) ([]QueueInfo, error) {
+	var queues []model.DownloadQueue
+	if err := s.db.Order("priority DESC, name ASC").Find(&queues).Error; err != nil {
+		return nil, err
+	}
+
+	queued, err := s.countByQueue([]string{string(types.TaskStatusQueued)})
+	if err != nil {
+		return nil, err
+	}
+	running, err := s.countByQueue(runningStatuses)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]QueueInfo, 0, len(queues))
+	for _, queue := range queues {
+		infos = append(infos, QueueInfo{
+			DownloadQueue: queue,
+			Queued:        queued[queue.Name],
+			Running:       running[queue.Name],
+		})
+	}
+	return infos, nil
+}
+
+// CreateQueue 创建队列
+func (s *QueueService) CreateQueue(ctx context.Context, name string, priority, maxConcurrent int) (*model.DownloadQueue, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("队列名称不能为空")
+	}
+	if maxConcurrent < 0 {
+		return nil, fmt.Errorf("max_concurrent 不能为负数")
+	}
+
+	queue := &model.DownloadQueue{
+		Name:          name,
+		Priority:      priority,
+		MaxConcurrent: maxConcurrent,
+	}
+	if err := s.db.Create(queue).Error; err != nil {
+		return nil, fmt.Errorf("failed to create queue: %w", err)
+	}
+	return queue, nil
+}
+
+// UpdateQueue 更新队列的优先级和并发上限
+func (s *QueueService) UpdateQueue(ctx context.Context, name string, priority, maxConcurrent int) error {
+	if maxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent 不能为负数")
+	}
+
+	result := s.db.Model(&model.DownloadQueue{}).Where("name = ?", name).Updates(map[string]interface{}{
+		"priority":       priority,
+		"max_concurrent": maxConcurrent,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrQueueNotFound
+	}
+	return nil
+}
+
+// DeleteQueue 删除队列，队列中的任务移入 default 队列
+func (s *QueueService) DeleteQueue(ctx context.Context, name string) error {
+	if name == DefaultQueue {
+		return fmt.Errorf("default 队列不能删除")
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("name = ?", name).Delete(&model.DownloadQueue{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrQueueNotFound
+		}
+		// 回收站中的任务一并移动，恢复后仍属于存在的队列
+		return tx.Unscoped().Model(&model.DownloadTask{}).Where("queue = ?", name).Update("queue", DefaultQueue).Error
+	})
+}
+
+// MoveTask 把排队中的任务移动到指定队列的指定位置
+// queue 为空时留在原队列，index 为目标队列排队任务中的位置（从 0 开始，负数或越界时放到末尾），
+// priority 非空时同时修改任务优先级
+func (s *QueueService) MoveTask(ctx context.Context, id uint, queue string, index int, priority *int) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var task model.DownloadTask
+		if err := tx.First(&task, id).Error; err != nil {
+			return err
+		}
+		if task.Status != string(types.TaskStatusQueued) {
+			return ErrTaskNotQueued
+		}
+
+		if queue == "" {
+			queue = task.Queue
+		}
+		if queue != DefaultQueue {
+			var count int64
+			if err := tx.Model(&model.DownloadQueue{}).Where("name = ?", queue).Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				return ErrQueueNotFound
+			}
+		}
+
+		// 取出目标队列中的其他排队任务，插入后重新编号
+		var others []*model.DownloadTask
+		if err := tx.Select("id").Where("queue = ? AND status = ? AND id <> ?", queue, string(types.TaskStatusQueued), task.ID).
+			Order("position ASC, id ASC").Find(&others).Error; err != nil {
+			return err
+		}
+
+		if index < 0 || index > len(others) {
+			index = len(others)
+		}
+		ordered := make([]uint, 0, len(others)+1)
+		for _, other := range others[:index] {
+			ordered = append(ordered, other.ID)
+		}
+		ordered = append(ordered, task.ID)
+		for _, other := range others[index:] {
+			ordered = append(ordered, other.ID)
+		}
+
+		for i, taskID := range ordered {
+			updates := map[string]interface{}{"position": int64(i + 1)}
+			if taskID == task.ID {
+				updates["queue"] = queue
+				if priority != nil {
+					updates["priority"] = *priority
+				}
+			}
+			if err := tx.Model(&model.DownloadTask{}).Where("id = ?", taskID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// countByQueue 按队列统计指定状态的任务数
+func (s *QueueService) countByQueue(statuses []string) (map[string]int64, error) {
+	var rows []struct {
+		Queue string
+		Count int64
+	}
+	if err := s.db.Model(&model.DownloadTask{}).Select("queue, COUNT(*) AS count").
+		Where("status IN ?", statuses).Group("queue").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Queue] = row.Count
+	}
+	return counts, nil
+}
+
+// resolveQueue 校验提交任务时指定的队列，为空时使用 default 队列
+func (s *DownloadService) resolveQueue(ctx context.Context, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == DefaultQueue {
+		return DefaultQueue, nil
+	}
+
+	var count int64
+	if err := s.db.Model(&model.DownloadQueue{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return "", fmt.Errorf("%w: %s", ErrQueueNotFound, name)
+	}
+	return name, nil
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/datatypes"
+)
+
+// RetryPolicy 失败任务的自动重试策略
+// 第 n 次失败后等待 BaseDelay * 2^(n-1)（不超过 MaxDelay），再按 Jitter 比例随机浮动
+type RetryPolicy struct {
+	MaxAttempts int           // 最多尝试次数（含首次），1 表示不自动重试
+	BaseDelay   time.Duration // 首次重试的等待时间
+	MaxDelay    time.Duration // 等待时间上限
+	Jitter      float64       // 随机浮动比例，0.2 表示 ±20%
+}
+
+// defaultRetryPolicy 未配置时的重试策略
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    time.Hour,
+	Jitter:      0.2,
+}
+
+// 任务在下载引擎中被移除或丢失时记录的错误码，不是 aria2 的退出状态码
+const (
+	errCodeRemoved = "removed" // 任务在引擎中被移除（如通过 aria2 的其他客户端）
+	errCodeMissing = "missing" // 任务在引擎中查询不到（如引擎重启且未保存会话）
+)
+
+// isTransientFailure 判断第 attempt 次失败是否可以自动重试：丢失的任务重新提交即可恢复；
+// 被移除的任务是用户或其他客户端主动移除的，不自动重试；未知错误可能是临时的也可能不是，只自动重试一次
+func isTransientFailure(code string, attempt int) bool {
+	switch code {
+	case errCodeMissing:
+		return true
+	case errCodeRemoved:
+		return false
+	}
+	if downloader.IsUnknownError(code) {
+		return attempt == 1
+	}
+	return downloader.IsTransientError(code)
+}
+
+// retryConfigKeys 重试策略相关的系统配置项
+var retryConfigKeys = []string{"retry_max_attempts", "retry_base_delay", "retry_max_delay", "retry_jitter"}
+
+// TaskAttempt 一次失败尝试的记录，保存在 DownloadTask.AttemptHistory 中
+type TaskAttempt struct {
+	Attempt     int        `json:"attempt"`
+	Engine      string     `json:"engine"`
+	GID         string     `json:"gid"`
+	ErrorCode   string     `json:"error_code,omitempty"`
+	Error       string     `json:"error"`
+	Transient   bool       `json:"transient"`
+	FailedAt    time.Time  `json:"failed_at"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+}
+
+// loadRetryPolicy 从系统配置读取重试策略，无效的配置项使用默认值
+// retry_max_attempts 次数，retry_base_delay / retry_max_delay 秒，retry_jitter 比例
+func loadRetryPolicy(ctx context.Context, configService *SystemConfigService) RetryPolicy {
+	policy := defaultRetryPolicy
+
+	configs, err := configService.GetConfigs(ctx, retryConfigKeys...)
+	if err != nil {
+		log.Printf("[Retry] ⚠️  读取重试策略失败，使用默认值: %v", err)
+		return policy
+	}
+	if value := configs["retry_max_attempts"]; value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+			policy.MaxAttempts = n
+		}
+	}
+	if value := configs["retry_base_delay"]; value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			policy.BaseDelay = time.Duration(n) * time.Second
+		}
+	}
+	if value := configs["retry_max_delay"]; value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			policy.MaxDelay = time.Duration(n) * time.Second
+		}
+	}
+	if value := configs["retry_jitter"]; value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil && f >= 0 && f < 1 {
+			policy.Jitter = f
+		}
+	}
+	return policy
+}
+
+// Backoff 返回第 attempt 次失败后的等待时间
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return delay
+}
+
+// attemptHistoryOf 解析任务的尝试记录
+func attemptHistoryOf(task *model.DownloadTask) []TaskAttempt {
+	var history []TaskAttempt
+	if len(task.AttemptHistory) > 0 {
+		if err := json.Unmarshal(task.AttemptHistory, &history); err != nil {
+			log.Printf("[Retry] ⚠️  任务 %d 的尝试记录无效: %v", task.ID, err)
+		}
+	}
+	return history
+}
+
+// applyRetryPolicy 任务在下载引擎中出错、被移除或丢失时记录本次尝试，并按策略决定重新排队还是标记失败
+// 临时性错误在未达到最大尝试次数前重新排队，由 QueueScheduler 在 next_retry_at 之后放行；
+// 永久性错误（404、磁盘已满、认证失败等）立即失败。重新排队的任务由调用方调用 discardAttempt 清理引擎中的旧任务
+func applyRetryPolicy(task *model.DownloadTask, updates map[string]interface{}, policy RetryPolicy, now time.Time) map[string]interface{} {
+	code, failed := updates["error_code"].(string)
+	if !failed {
+		return updates
+	}
+
+	errorMsg, _ := updates["error_msg"].(string)
+	attempt := task.Attempts + 1
+	record := TaskAttempt{
+		Attempt:   attempt,
+		Engine:    task.Engine,
+		GID:       updatedGID(task, updates),
+		ErrorCode: code,
+		Error:     errorMsg,
+		Transient: isTransientFailure(code, attempt),
+		FailedAt:  now,
+	}
+
+	retry := record.Transient && attempt < policy.MaxAttempts
+	if retry {
+		next := now.Add(policy.Backoff(attempt))
+		record.NextRetryAt = &next
+
+		updates["status"] = string(types.TaskStatusQueued)
+		updates["gid"] = ""
+		updates["next_retry_at"] = &next
+		updates["position"] = now.UnixNano()
+		updates["selected_files"] = "" // 重新下载元数据后需要重新选择文件
+		updates["window_paused"] = false
+		updates["error_msg"] = fmt.Sprintf("第 %d/%d 次尝试失败，将于 %s 重试: %s",
+			attempt, policy.MaxAttempts, next.Format("15:04:05"), errorMsg)
+		log.Printf("[Retry] 🔄 任务 %d 第 %d 次尝试失败（错误码 %s），%s 后重试", task.ID, attempt, code, next.Sub(now).Round(time.Second))
+	} else if !record.Transient {
+		log.Printf("[Retry] ⛔ 任务 %d 永久性错误（错误码 %s），不再重试", task.ID, code)
+	} else {
+		log.Printf("[Retry] ⛔ 任务 %d 已达到最大尝试次数 %d", task.ID, policy.MaxAttempts)
+	}
+
+	history, err := json.Marshal(append(attemptHistoryOf(task), record))
+	if err != nil {
+		log.Printf("[Retry] 记录任务 %d 的尝试失败: %v", task.ID, err)
+		return updates
+	}
+	updates["attempts"] = attempt
+	updates["attempt_history"] = datatypes.JSON(history)
+	return updates
+}
+
+// retriedGIDs 重新排队前任务在引擎中使用的 GID（magnet 任务包括元数据任务和后续任务）
+func retriedGIDs(task *model.DownloadTask, updates map[string]interface{}) []string {
+	gids := []string{task.GID}
+	if gid := updatedGID(task, updates); gid != "" && gid != task.GID {
+		gids = append(gids, gid)
+	}
+	return gids
+}
+
+// discardAttempt 从引擎中移除重试前的任务及其下载结果，避免旧 GID 残留在引擎中或被误恢复
+func discardAttempt(ctx context.Context, dl downloader.Downloader, task *model.DownloadTask, gids []string) {
+	for _, gid := range gids {
+		if gid == "" {
+			continue
+		}
+		// 忽略错误：已结束的任务 Remove 会失败，丢失的任务两者都会失败
+		dl.Remove(ctx, gid)
+		dl.RemoveDownloadResult(ctx, gid)
+	}
+}
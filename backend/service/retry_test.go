@@ -0,0 +1,152 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/datatypes"
+)
+
+func TestIsTransientFailure(t *testing.T) {
+	tests := []struct {
+		code    string
+		attempt int
+		want    bool
+	}{
+		{downloader.ErrCodeNetwork, 1, true},
+		{downloader.ErrCodeBadResponse, 2, true},
+		{downloader.ErrCodeNotFound, 1, false},
+		{downloader.ErrCodeDiskFull, 1, false},
+		{downloader.ErrCodeChecksumMismatched, 1, false},
+		{errCodeMissing, 1, true},
+		{errCodeMissing, 3, true},
+		{errCodeRemoved, 1, false},
+		{downloader.ErrCodeUnknown, 1, true},
+		{downloader.ErrCodeUnknown, 2, false},
+		{"", 1, true},
+		{"", 2, false},
+	}
+	for _, tt := range tests {
+		if got := isTransientFailure(tt.code, tt.attempt); got != tt.want {
+			t.Errorf("isTransientFailure(%q, %d) = %v, want %v", tt.code, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour}, // 64 分钟超过上限
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := policy.Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Jitter: 0.2}
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 24 * time.Second, 36 * time.Second},
+		{2, 48 * time.Second, 72 * time.Second},
+		{10, 48 * time.Minute, 72 * time.Minute}, // 浮动在上限之后计算
+	}
+	for _, tt := range tests {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 200; i++ {
+			got := policy.Backoff(tt.attempt)
+			if got < tt.min || got > tt.max {
+				t.Fatalf("Backoff(%d) = %v, want within [%v, %v]", tt.attempt, got, tt.min, tt.max)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("Backoff(%d) returned the same delay every time, jitter not applied", tt.attempt)
+		}
+	}
+}
+
+func TestApplyRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	queued, failed := string(types.TaskStatusQueued), string(types.TaskStatusFailed)
+	tests := []struct {
+		name          string
+		code          string
+		attempts      int // 之前已失败的次数
+		wantStatus    string
+		wantDelay     time.Duration // 重新排队时的等待时间
+		wantTransient bool
+	}{
+		{"transient first failure", downloader.ErrCodeNetwork, 0, queued, 30 * time.Second, true},
+		{"transient second failure", downloader.ErrCodeTimeout, 1, queued, time.Minute, true},
+		{"transient last attempt", downloader.ErrCodeNetwork, 2, failed, 0, true},
+		{"5xx", downloader.ErrCodeBadResponse, 0, queued, 30 * time.Second, true},
+		{"not found", downloader.ErrCodeNotFound, 0, failed, 0, false},
+		{"auth failed", downloader.ErrCodeAuthFailed, 0, failed, 0, false},
+		{"missing", errCodeMissing, 0, queued, 30 * time.Second, true},
+		{"removed", errCodeRemoved, 0, failed, 0, false},
+		{"unknown first failure", downloader.ErrCodeUnknown, 0, queued, 30 * time.Second, true},
+		{"unknown second failure", downloader.ErrCodeUnknown, 1, failed, 0, false},
+	}
+	for _, tt := range tests {
+		task := &model.DownloadTask{ID: 1, Engine: "aria2", GID: "abc", Attempts: tt.attempts}
+		updates := applyRetryPolicy(task, map[string]interface{}{
+			"status":     string(types.TaskStatusFailed),
+			"error_code": tt.code,
+			"error_msg":  "boom",
+		}, policy, now)
+
+		if updates["status"] != tt.wantStatus {
+			t.Errorf("%s: status = %v, want %s", tt.name, updates["status"], tt.wantStatus)
+		}
+		if updates["attempts"] != tt.attempts+1 {
+			t.Errorf("%s: attempts = %v, want %d", tt.name, updates["attempts"], tt.attempts+1)
+		}
+		next, _ := updates["next_retry_at"].(*time.Time)
+		if tt.wantDelay > 0 {
+			if next == nil || !next.Equal(now.Add(tt.wantDelay)) {
+				t.Errorf("%s: next_retry_at = %v, want %v", tt.name, next, now.Add(tt.wantDelay))
+			}
+			if updates["gid"] != "" {
+				t.Errorf("%s: gid = %v, want cleared", tt.name, updates["gid"])
+			}
+		} else if next != nil {
+			t.Errorf("%s: next_retry_at = %v, want none", tt.name, next)
+		}
+
+		var history []TaskAttempt
+		raw, _ := updates["attempt_history"].(datatypes.JSON)
+		if err := json.Unmarshal(raw, &history); err != nil {
+			t.Fatalf("%s: attempt_history: %v", tt.name, err)
+		}
+		if len(history) != 1 || history[0].ErrorCode != tt.code || history[0].GID != "abc" || history[0].Transient != tt.wantTransient {
+			t.Errorf("%s: attempt_history = %+v", tt.name, history)
+		}
+	}
+}
+
+func TestApplyRetryPolicyIgnoresSuccess(t *testing.T) {
+	task := &model.DownloadTask{ID: 1, GID: "abc"}
+	updates := applyRetryPolicy(task, map[string]interface{}{"status": string(types.TaskStatusCompleted)},
+		defaultRetryPolicy, time.Now())
+	if len(updates) != 1 || updates["attempts"] != nil {
+		t.Errorf("updates = %v, want unchanged", updates)
+	}
+}
@@ -0,0 +1,475 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var ErrRuleNotFound = errors.New("规则不存在")
+
+// RuleMatch 规则的匹配条件，设置了的条件全部满足才算命中，没有设置任何条件时匹配所有任务
+type RuleMatch struct {
+	Domains    []string `json:"domains,omitempty"`    // 域名，同时匹配其子域名
+	URLRegex   string   `json:"url_regex,omitempty"`  // 匹配完整 URL 的正则表达式
+	Extensions []string `json:"extensions,omitempty"` // 文件扩展名，如 mp4、.iso，不区分大小写
+	MimeTypes  []string `json:"mime_types,omitempty"` // MIME 类型，支持 video/* 形式，需要发送 HEAD 请求
+	MinSize    int64    `json:"min_size,omitempty"`   // 文件大小下限（字节），需要发送 HEAD 请求
+	MaxSize    int64    `json:"max_size,omitempty"`   // 文件大小上限（字节），0 表示不限制
+	Plugins    []string `json:"plugins,omitempty"`    // 来源插件，如 telegram-bot、chrome-extension
+}
+
+// needsProbe 判断是否需要 HEAD 请求获取 MIME 类型和文件大小
+func (m RuleMatch) needsProbe() bool {
+	return len(m.MimeTypes) > 0 || m.MinSize > 0 || m.MaxSize > 0
+}
+
+// RuleAction 规则命中后设置的字段，留空的字段不修改
+type RuleAction struct {
+	Category     string                 `json:"category,omitempty"`
+	PathTemplate string                 `json:"path_template,omitempty"` // 下载路径模板，变量同 download_path_template
+	Queue        string                 `json:"queue,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	Options      *types.DownloadOptions `json:"options,omitempty"` // 下载选项，请求中已设置的字段优先
+}
+
+// RuleInput 创建或更新规则的参数
+type RuleInput struct {
+	Name     string     `json:"name" binding:"required"`
+	Enabled  *bool      `json:"enabled"`  // 默认启用
+	Position *int       `json:"position"` // 评估顺序，创建时默认排在最后
+	Stop     bool       `json:"stop"`
+	Match    RuleMatch  `json:"match"`
+	Action   RuleAction `json:"action"`
+}
+
+// RuleSubject 参与规则匹配的任务信息
+type RuleSubject struct {
+	URL        string
+	Filename   string // 用于匹配扩展名
+	PluginName string
+	Options    types.DownloadOptions // HEAD 请求使用的请求选项
+
+	probed   bool
+	mimeType string
+	size     int64
+}
+
+// RuleResult 规则评估结果，字段以最先命中并设置了该字段的规则为准，标签合并
+type RuleResult struct {
+	Matched      []MatchedRule         `json:"matched"`
+	Category     string                `json:"category,omitempty"`
+	PathTemplate string                `json:"path_template,omitempty"`
+	Queue        string                `json:"queue,omitempty"`
+	Tags         []string              `json:"tags,omitempty"`
+	Options      types.DownloadOptions `json:"options"`
+	MimeType     string                `json:"mime_type,omitempty"` // HEAD 请求得到的 MIME 类型
+	Size         int64                 `json:"size,omitempty"`      // HEAD 请求得到的文件大小
+}
+
+type MatchedRule struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// RuleService 管理下载规则：提交任务时按 position 顺序评估已启用的规则，
+// 命中的规则设置分类、路径模板、队列、标签和下载选项，stop 为 true 时不再评估后续规则
+type RuleService struct {
+	db *gorm.DB
+}
+
+func NewRuleService(db *gorm.DB) *RuleService {
+	return &RuleService{db: db}
+}
+
+// ListRules 按评估顺序列出所有规则
+func (s *RuleService) ListRules(ctx context.Context) ([]model.DownloadRule, error) {
+	var rules []model.DownloadRule
+	if err := s.db.Order("position ASC, id ASC").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// CreateRule 创建规则
+func (s *RuleService) CreateRule(ctx context.Context, input RuleInput) (*model.DownloadRule, error) {
+	rule := &model.DownloadRule{Enabled: true}
+	if input.Position == nil {
+		var last model.DownloadRule
+		if err := s.db.Order("position DESC").First(&last).Error; err == nil {
+			rule.Position = last.Position + 1
+		}
+	}
+	if err := applyRuleInput(rule, input); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Create(rule).Error; err != nil {
+		return nil, fmt.Errorf("failed to create rule: %w", err)
+	}
+	return rule, nil
+}
+
+// UpdateRule 更新规则
+func (s *RuleService) UpdateRule(ctx context.Context, id uint, input RuleInput) (*model.DownloadRule, error) {
+	var rule model.DownloadRule
+	if err := s.db.First(&rule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRuleNotFound
+		}
+		return nil, err
+	}
+	if err := applyRuleInput(&rule, input); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Save(&rule).Error; err != nil {
+		return nil, fmt.Errorf("failed to update rule: %w", err)
+	}
+	return &rule, nil
+}
+
+// DeleteRule 删除规则
+func (s *RuleService) DeleteRule(ctx context.Context, id uint) error {
+	result := s.db.Delete(&model.DownloadRule{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
+
+// applyRuleInput 校验参数并写入规则
+func applyRuleInput(rule *model.DownloadRule, input RuleInput) error {
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return fmt.Errorf("规则名称不能为空")
+	}
+	if input.Match.URLRegex != "" {
+		if _, err := regexp.Compile(input.Match.URLRegex); err != nil {
+			return fmt.Errorf("无效的 url_regex: %w", err)
+		}
+	}
+	if input.Match.MinSize < 0 || input.Match.MaxSize < 0 {
+		return fmt.Errorf("文件大小不能为负数")
+	}
+	if input.Match.MaxSize > 0 && input.Match.MinSize > input.Match.MaxSize {
+		return fmt.Errorf("min_size 不能大于 max_size")
+	}
+	if input.Action.PathTemplate != "" {
+		if err := ValidatePathTemplate(input.Action.PathTemplate); err != nil {
+			return err
+		}
+	}
+	if input.Action.Options != nil {
+		if err := validateRequestOptions(*input.Action.Options); err != nil {
+			return err
+		}
+	}
+
+	match, err := json.Marshal(input.Match)
+	if err != nil {
+		return err
+	}
+	action, err := json.Marshal(input.Action)
+	if err != nil {
+		return err
+	}
+
+	rule.Name = name
+	rule.Stop = input.Stop
+	rule.Match = datatypes.JSON(match)
+	rule.Action = datatypes.JSON(action)
+	if input.Enabled != nil {
+		rule.Enabled = *input.Enabled
+	}
+	if input.Position != nil {
+		rule.Position = *input.Position
+	}
+	return nil
+}
+
+// Evaluate 按顺序评估已启用的规则
+// 只有规则用到 MIME 类型或文件大小、且其他条件都满足时才会对 URL 发送一次 HEAD 请求
+func (s *RuleService) Evaluate(ctx context.Context, subject *RuleSubject) (*RuleResult, error) {
+	var rules []model.DownloadRule
+	if err := s.db.Where("enabled = ?", true).Order("position ASC, id ASC").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	result := &RuleResult{Matched: []MatchedRule{}}
+	for _, rule := range rules {
+		var match RuleMatch
+		var action RuleAction
+		if err := json.Unmarshal(rule.Match, &match); err != nil {
+			log.Printf("[Rules] ⚠️  规则 %d 的匹配条件无效: %v", rule.ID, err)
+			continue
+		}
+		if err := json.Unmarshal(rule.Action, &action); err != nil {
+			log.Printf("[Rules] ⚠️  规则 %d 的动作无效: %v", rule.ID, err)
+			continue
+		}
+
+		if !s.matches(ctx, match, subject) {
+			continue
+		}
+		result.apply(rule, action)
+		if rule.Stop {
+			break
+		}
+	}
+
+	result.MimeType = subject.mimeType
+	result.Size = subject.size
+	return result, nil
+}
+
+// evaluateRules 评估下载规则，查询规则失败时不应用任何规则
+func (s *DownloadService) evaluateRules(ctx context.Context, subject *RuleSubject) *RuleResult {
+	result, err := s.rules.Evaluate(ctx, subject)
+	if err != nil {
+		log.Printf("[Rules] ⚠️  评估下载规则失败: %v", err)
+		return &RuleResult{}
+	}
+	if len(result.Matched) > 0 {
+		name := subject.URL
+		if name == "" {
+			name = subject.Filename
+		}
+		log.Printf("[Rules] 📐 %s 命中规则: %v", name, result.Matched)
+	}
+	return result
+}
+
+// applyRules 评估下载规则，请求中未指定的分类、队列和下载选项使用规则的结果
+func (s *DownloadService) applyRules(ctx context.Context, req *types.DownloadRequest) *RuleResult {
+	filename := req.Filename
+	if filename == "" {
+		filename = s.extractFilenameFromURL(req.URL)
+	}
+	result := s.evaluateRules(ctx, &RuleSubject{
+		URL:        req.URL,
+		Filename:   filename,
+		PluginName: req.PluginName,
+		Options:    req.DownloadOptions,
+	})
+
+	if req.Category == "" {
+		req.Category = result.Category
+	}
+	if req.Queue == "" {
+		req.Queue = result.Queue
+	}
+	req.DownloadOptions = mergeDownloadOptions(req.DownloadOptions, result.Options)
+	return result
+}
+
+// TestRules 试运行下载规则，返回评估结果、生效的路径模板和下载路径（相对下载目录），不创建任务
+// 未指定文件名且 URL 中没有文件名时，下载路径中的文件名为空；{task_id} 渲染为空
+func (s *DownloadService) TestRules(ctx context.Context, req types.DownloadRequest) (*RuleResult, string, string, error) {
+	result := s.applyRules(ctx, &req)
+
+	pathTemplate := result.PathTemplate
+	if pathTemplate == "" {
+		pathTemplate = s.pathTemplateFor(ctx, req.PluginName)
+	}
+	filename := SanitizeFilename(req.Filename)
+	if filename == "" {
+		filename = SanitizeFilename(s.extractFilenameFromURL(req.URL))
+	}
+	downloadPath, err := RenderPathTemplate(pathTemplate, PathTemplateVars{
+		Plugin:   req.PluginName,
+		Category: req.Category,
+		Filename: filename,
+		URL:      req.URL,
+		User:     req.User,
+		Tags:     result.Tags,
+		Metadata: req.Metadata,
+	})
+	if err != nil {
+		return result, pathTemplate, "", err
+	}
+	return result, pathTemplate, sanitizeDownloadPath(downloadPath), nil
+}
+
+// setTaskTags 保存规则设置的标签
+func setTaskTags(task *model.DownloadTask, tags []string) {
+	if len(tags) > 0 {
+		data, _ := json.Marshal(tags)
+		task.Tags = data
+	}
+}
+
+// apply 合并命中规则的动作，已由更早的规则设置的字段不覆盖
+func (r *RuleResult) apply(rule model.DownloadRule, action RuleAction) {
+	r.Matched = append(r.Matched, MatchedRule{ID: rule.ID, Name: rule.Name})
+	if r.Category == "" {
+		r.Category = action.Category
+	}
+	if r.PathTemplate == "" {
+		r.PathTemplate = action.PathTemplate
+	}
+	if r.Queue == "" {
+		r.Queue = action.Queue
+	}
+	for _, tag := range action.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !containsString(r.Tags, tag) {
+			r.Tags = append(r.Tags, tag)
+		}
+	}
+	if action.Options != nil {
+		r.Options = mergeDownloadOptions(r.Options, *action.Options)
+	}
+}
+
+// matches 判断任务是否满足规则的全部条件
+func (s *RuleService) matches(ctx context.Context, match RuleMatch, subject *RuleSubject) bool {
+	if len(match.Plugins) > 0 && !containsFold(match.Plugins, subject.PluginName) {
+		return false
+	}
+	if len(match.Domains) > 0 && !matchDomain(match.Domains, subject.URL) {
+		return false
+	}
+	if match.URLRegex != "" {
+		re, err := regexp.Compile(match.URLRegex)
+		if err != nil || !re.MatchString(subject.URL) {
+			return false
+		}
+	}
+	if len(match.Extensions) > 0 && !matchExtension(match.Extensions, subject.Filename) {
+		return false
+	}
+
+	if !match.needsProbe() {
+		return true
+	}
+	subject.probe(ctx)
+	if len(match.MimeTypes) > 0 && !matchMimeType(match.MimeTypes, subject.mimeType) {
+		return false
+	}
+	if match.MinSize > 0 && subject.size < match.MinSize {
+		return false
+	}
+	if match.MaxSize > 0 && (subject.size == 0 || subject.size > match.MaxSize) {
+		return false
+	}
+	return true
+}
+
+// probe 探测 HTTP(S) 链接获取 MIME 类型和文件大小，失败时两者为空
+func (subject *RuleSubject) probe(ctx context.Context) {
+	if subject.probed {
+		return
+	}
+	subject.probed = true
+
+	probe, err := probeURL(ctx, subject.URL, subject.Options)
+	if err != nil {
+		log.Printf("[Rules] ⚠️  探测链接失败: %v", err)
+		return
+	}
+	subject.mimeType = probe.MimeType
+	subject.size = probe.Size
+}
+
+// matchDomain 判断 URL 的主机名是否为列表中的域名或其子域名
+func matchDomain(domains []string, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*."))
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchExtension(extensions []string, filename string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(filename)), ".")
+	if ext == "" {
+		return false
+	}
+	for _, e := range extensions {
+		if strings.TrimPrefix(strings.ToLower(strings.TrimSpace(e)), ".") == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMimeType 匹配 MIME 类型，支持 video/* 形式
+func matchMimeType(patterns []string, mimeType string) bool {
+	if mimeType == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeDownloadOptions 用 extra 补充 base 中未设置的字段，请求头按名称合并
+func mergeDownloadOptions(base, extra types.DownloadOptions) types.DownloadOptions {
+	if len(extra.Headers) > 0 {
+		headers := make(map[string]string, len(base.Headers)+len(extra.Headers))
+		for name, value := range extra.Headers {
+			headers[name] = value
+		}
+		for name, value := range base.Headers {
+			headers[name] = value
+		}
+		base.Headers = headers
+	}
+	if base.Cookies == "" {
+		base.Cookies = extra.Cookies
+	}
+	if base.Referer == "" {
+		base.Referer = extra.Referer
+	}
+	if base.UserAgent == "" {
+		base.UserAgent = extra.UserAgent
+	}
+	if base.Proxy == "" {
+		base.Proxy = extra.Proxy
+	}
+	if base.MaxConnections == 0 {
+		base.MaxConnections = extra.MaxConnections
+	}
+	if base.Split == 0 {
+		base.Split = extra.Split
+	}
+	return base
+}
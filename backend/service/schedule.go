@@ -0,0 +1,137 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TimeWindow 每天的时间窗口（服务器本地时间），如 01:00-07:00
+// Start 大于 End 时表示跨越午夜，如 22:00-06:00
+type TimeWindow struct {
+	Start int // 距 00:00 的分钟数
+	End   int
+}
+
+// ParseTimeWindow 解析 "HH:MM-HH:MM" 格式的时间窗口
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 2 {
+		return TimeWindow{}, fmt.Errorf("时间窗口格式应为 HH:MM-HH:MM: %s", s)
+	}
+
+	var w TimeWindow
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return TimeWindow{}, fmt.Errorf("时间窗口格式应为 HH:MM-HH:MM: %s", s)
+		}
+		minutes := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.Start = minutes
+		} else {
+			w.End = minutes
+		}
+	}
+	if w.Start == w.End {
+		return TimeWindow{}, fmt.Errorf("时间窗口起止时间不能相同: %s", s)
+	}
+	return w, nil
+}
+
+// Contains 判断时间是否落在窗口内（含起点，不含终点）
+func (w TimeWindow) Contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return minutes >= w.Start && minutes < w.End
+	}
+	return minutes >= w.Start || minutes < w.End
+}
+
+// ParseStartAt 解析开始时间，不带时区的时间按服务器本地时间处理，与时间窗口一致
+// 支持 23:30（今天该时刻，已过则为明天）、2006-01-02T15:04 和 RFC3339
+func ParseStartAt(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", value, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", value, now.Location()); err == nil {
+		startAt := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !startAt.After(now) {
+			startAt = startAt.AddDate(0, 0, 1)
+		}
+		return startAt, nil
+	}
+	return time.Time{}, fmt.Errorf("无法识别的开始时间: %s（支持 23:30、2006-01-02T15:04 或 RFC3339）", value)
+}
+
+// inWindow 任务未设置时间窗口或当前处于窗口内；窗口格式无效时视为不限制
+func inWindow(window string, now time.Time) bool {
+	if window == "" {
+		return true
+	}
+	w, err := ParseTimeWindow(window)
+	if err != nil {
+		return true
+	}
+	return w.Contains(now)
+}
+
+// SpeedLimitRule 全局限速计划中的一条规则，限速值沿用 aria2 格式（如 1M、500K，0 表示不限速）
+type SpeedLimitRule struct {
+	Window        string `json:"window"`
+	DownloadLimit string `json:"download_limit"`
+	UploadLimit   string `json:"upload_limit"`
+}
+
+// speedLimitPattern aria2 的限速格式：非负整数，可带 K 或 M 后缀
+var speedLimitPattern = regexp.MustCompile(`^[0-9]+[KkMm]?$`)
+
+// ParseSpeedLimitSchedule 解析并校验 speed_limit_schedule 配置（JSON 数组），保存配置时同样使用
+func ParseSpeedLimitSchedule(value string) ([]SpeedLimitRule, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var rules []SpeedLimitRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("限速计划格式无效: %w", err)
+	}
+	for _, rule := range rules {
+		if _, err := ParseTimeWindow(rule.Window); err != nil {
+			return nil, err
+		}
+		for _, limit := range []string{rule.DownloadLimit, rule.UploadLimit} {
+			if limit != "" && !speedLimitPattern.MatchString(limit) {
+				return nil, fmt.Errorf("无效的限速值 %q（支持 0、500K、1M 等格式）", limit)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// currentSpeedLimits 返回当前时间适用的全局限速选项，按顺序取第一条命中的规则，都未命中时不限速
+func currentSpeedLimits(rules []SpeedLimitRule, now time.Time) map[string]interface{} {
+	limits := map[string]interface{}{
+		"max-overall-download-limit": "0",
+		"max-overall-upload-limit":   "0",
+	}
+	for _, rule := range rules {
+		if !inWindow(rule.Window, now) {
+			continue
+		}
+		if rule.DownloadLimit != "" {
+			limits["max-overall-download-limit"] = rule.DownloadLimit
+		}
+		if rule.UploadLimit != "" {
+			limits["max-overall-upload-limit"] = rule.UploadLimit
+		}
+		break
+	}
+	return limits
+}
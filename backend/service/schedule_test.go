@@ -0,0 +1,160 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// todayAt 返回 2026-03-07 的 hh:mm（UTC）
+func todayAt(hour, minute int) time.Time {
+	return time.Date(2026, 3, 7, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  TimeWindow
+		valid bool
+	}{
+		{"01:00-07:00", TimeWindow{Start: 60, End: 420}, true},
+		{" 22:00 - 06:30 ", TimeWindow{Start: 1320, End: 390}, true},
+		{"00:00-23:59", TimeWindow{Start: 0, End: 1439}, true},
+		{"08:00-08:00", TimeWindow{}, false},
+		{"08:00", TimeWindow{}, false},
+		{"08:00-09:00-10:00", TimeWindow{}, false},
+		{"8am-9am", TimeWindow{}, false},
+		{"24:00-06:00", TimeWindow{}, false},
+		{"", TimeWindow{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeWindow(tt.in)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseTimeWindow(%q) error = %v, want valid %v", tt.in, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTimeWindow(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	day := TimeWindow{Start: 9 * 60, End: 18 * 60}   // 09:00-18:00
+	night := TimeWindow{Start: 22 * 60, End: 6 * 60} // 22:00-06:00，跨越午夜
+	tests := []struct {
+		window TimeWindow
+		t      time.Time
+		want   bool
+	}{
+		{day, todayAt(9, 0), true}, // 含起点
+		{day, todayAt(12, 30), true},
+		{day, todayAt(17, 59), true},
+		{day, todayAt(18, 0), false}, // 不含终点
+		{day, todayAt(8, 59), false},
+		{day, todayAt(23, 0), false},
+		{night, todayAt(22, 0), true},
+		{night, todayAt(23, 59), true},
+		{night, todayAt(0, 0), true},
+		{night, todayAt(5, 59), true},
+		{night, todayAt(6, 0), false},
+		{night, todayAt(12, 0), false},
+		{night, todayAt(21, 59), false},
+	}
+	for _, tt := range tests {
+		if got := tt.window.Contains(tt.t); got != tt.want {
+			t.Errorf("%+v.Contains(%s) = %v, want %v", tt.window, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseStartAt(t *testing.T) {
+	now := todayAt(12, 0)
+	tests := []struct {
+		in    string
+		want  time.Time
+		valid bool
+	}{
+		{"23:30", todayAt(23, 30), true},
+		{"12:01", todayAt(12, 1), true},
+		{"12:00", todayAt(12, 0).AddDate(0, 0, 1), true}, // 已到达的时刻为明天
+		{"08:15", todayAt(8, 15).AddDate(0, 0, 1), true}, // 已过去的时刻为明天
+		{"00:00", todayAt(0, 0).AddDate(0, 0, 1), true},
+		{"2026-03-01T08:00", time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC), true}, // 指定日期时不调整
+		{"2026-03-08T01:30:00+08:00", time.Date(2026, 3, 7, 17, 30, 0, 0, time.UTC), true},
+		{" 23:30 ", todayAt(23, 30), true},
+		{"25:00", time.Time{}, false},
+		{"tomorrow", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseStartAt(tt.in, now)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseStartAt(%q) error = %v, want valid %v", tt.in, err, tt.valid)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseStartAt(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSpeedLimitSchedule(t *testing.T) {
+	tests := []struct {
+		in    string
+		valid bool
+	}{
+		{"", true},
+		{"[]", true},
+		{`[{"window": "09:00-18:00", "download_limit": "1M", "upload_limit": "100K"}]`, true},
+		{`[{"window": "22:00-06:00", "download_limit": "0"}]`, true},
+		{`[{"window": "22:00-06:00", "upload_limit": "512k"}]`, true},
+		{`[{"window": "09:00-18:00", "download_limit": "1048576"}]`, true},
+		{`{"window": "09:00-18:00"}`, false},
+		{`[{"window": "09:00", "download_limit": "1M"}]`, false},
+		{`[{"window": "09:00-18:00", "download_limit": "fast"}]`, false},
+		{`[{"window": "09:00-18:00", "download_limit": "1MB"}]`, false},
+		{`[{"window": "09:00-18:00", "download_limit": "1.5M"}]`, false},
+		{`[{"window": "09:00-18:00", "download_limit": "-1"}]`, false},
+		{`[{"window": "09:00-18:00", "upload_limit": "1G"}]`, false},
+		{`[{"window": "09:00-18:00", "upload_limit": " 1M"}]`, false},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSpeedLimitSchedule(tt.in); (err == nil) != tt.valid {
+			t.Errorf("ParseSpeedLimitSchedule(%s) error = %v, want valid %v", tt.in, err, tt.valid)
+		}
+	}
+}
+
+func TestCurrentSpeedLimits(t *testing.T) {
+	rules := []SpeedLimitRule{
+		{Window: "09:00-18:00", DownloadLimit: "1M", UploadLimit: "100K"},
+		{Window: "12:00-13:00", DownloadLimit: "5M"}, // 被第一条覆盖，不会生效
+		{Window: "22:00-06:00", DownloadLimit: "10M"},
+	}
+	limits := func(download, upload string) map[string]interface{} {
+		return map[string]interface{}{
+			"max-overall-download-limit": download,
+			"max-overall-upload-limit":   upload,
+		}
+	}
+	tests := []struct {
+		t    time.Time
+		want map[string]interface{}
+	}{
+		{todayAt(9, 0), limits("1M", "100K")},
+		{todayAt(12, 30), limits("1M", "100K")}, // 按顺序取第一条命中的规则
+		{todayAt(18, 0), limits("0", "0")},      // 窗口不含终点，都未命中时不限速
+		{todayAt(23, 0), limits("10M", "0")},
+		{todayAt(5, 59), limits("10M", "0")},
+		{todayAt(6, 0), limits("0", "0")},
+	}
+	for _, tt := range tests {
+		if got := currentSpeedLimits(rules, tt.t); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("currentSpeedLimits(%s) = %v, want %v", tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+	if got := currentSpeedLimits(nil, todayAt(12, 0)); !reflect.DeepEqual(got, limits("0", "0")) {
+		t.Errorf("currentSpeedLimits(nil) = %v, want no limits", got)
+	}
+}
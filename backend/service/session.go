@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/matrix/mynest/backend/model"
+	"gorm.io/gorm"
+)
+
+const (
+	accessTokenTTL       = 15 * time.Minute    // 访问令牌（JWT）有效期，过期后用刷新令牌换新的
+	refreshTokenTTL      = 30 * 24 * time.Hour // 刷新令牌有效期，每次刷新后顺延
+	sessionTouchInterval = time.Minute         // 最后活动时间的更新间隔，避免每个请求都写数据库
+)
+
+var (
+	ErrSessionNotFound     = errors.New("会话不存在或已退出登录")
+	ErrInvalidRefreshToken = errors.New("登录已过期，请重新登录")
+)
+
+// ClientInfo 登录或刷新令牌时的客户端信息，显示在会话列表中
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// AuthTokens 登录或刷新令牌后返回给客户端的令牌
+type AuthTokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // 访问令牌有效期（秒）
+}
+
+// createSession 为用户创建会话，返回访问令牌和刷新令牌
+func (s *AuthService) createSession(ctx context.Context, user *model.User, client ClientInfo) (*AuthTokens, error) {
+	// 顺便清理已过期的会话
+	if err := s.db.Where("expires_at < ?", time.Now()).Delete(&model.Session{}).Error; err != nil {
+		log.Printf("[Auth] 清理过期会话失败: %v", err)
+	}
+
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	now := time.Now()
+	session := &model.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: model.HashToken(refreshToken),
+		UserAgent:        client.UserAgent,
+		IP:               client.IP,
+		LastSeenAt:       now,
+		ExpiresAt:        now.Add(refreshTokenTTL),
+	}
+	if err := s.db.Create(session).Error; err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return s.issueTokens(user, session.ID, refreshToken)
+}
+
+// Refresh 用刷新令牌换取新的访问令牌，刷新令牌同时轮换，旧的立即失效
+// 已轮换的刷新令牌再次使用时说明令牌可能已泄露，撤销整个会话
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string, client ClientInfo) (*AuthTokens, error) {
+	hash := model.HashToken(refreshToken)
+
+	var session model.Session
+	if err := s.db.Where("refresh_token_hash = ?", hash).First(&session).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		var reused model.Session
+		if s.db.Where("previous_token_hash = ?", hash).Limit(1).Find(&reused).Error == nil && reused.ID != 0 {
+			log.Printf("[Auth] ⚠️  会话 %d 的刷新令牌被重复使用，可能已泄露，撤销该会话", reused.ID)
+			s.db.Delete(&reused)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	if time.Now().After(session.ExpiresAt) {
+		s.db.Delete(&session)
+		return nil, ErrInvalidRefreshToken
+	}
+
+	user, err := s.GetUserByID(ctx, session.UserID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	newToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	// 按旧的哈希条件更新，并发刷新时只有一个请求成功
+	now := time.Now()
+	result := s.db.Model(&model.Session{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":  model.HashToken(newToken),
+			"previous_token_hash": hash,
+			"user_agent":          client.UserAgent,
+			"ip":                  client.IP,
+			"last_seen_at":        now,
+			"expires_at":          now.Add(refreshTokenTTL),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	return s.issueTokens(user, session.ID, newToken)
+}
+
+func (s *AuthService) issueTokens(user *model.User, sessionID uint, refreshToken string) (*AuthTokens, error) {
+	accessToken, err := s.GenerateToken(user, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	return &AuthTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+	}, nil
+}
+
+// touchSession 检查访问令牌所属的会话仍然有效，并更新最后活动时间
+func (s *AuthService) touchSession(sessionID, userID uint) error {
+	var session model.Session
+	if err := s.db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		s.db.Model(&session).UpdateColumn("last_seen_at", time.Now())
+	}
+	return nil
+}
+
+// ListSessions 列出用户未过期的会话，最近活动的在前
+func (s *AuthService) ListSessions(ctx context.Context, userID uint) ([]model.Session, error) {
+	var sessions []model.Session
+	if err := s.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession 撤销用户的一个会话（退出登录），该会话的访问令牌和刷新令牌立即失效
+func (s *AuthService) RevokeSession(ctx context.Context, userID, sessionID uint) error {
+	result := s.db.Where("id = ? AND user_id = ?", sessionID, userID).Delete(&model.Session{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSessions 撤销用户除 exceptID 以外的所有会话，exceptID 为 0 时全部撤销
+func (s *AuthService) RevokeSessions(ctx context.Context, userID, exceptID uint) error {
+	return revokeSessions(s.db, userID, exceptID)
+}
+
+func revokeSessions(db *gorm.DB, userID, exceptID uint) error {
+	query := db.Where("user_id = ?", userID)
+	if exceptID != 0 {
+		query = query.Where("id <> ?", exceptID)
+	}
+	return query.Delete(&model.Session{}).Error
+}
+
+// generateRefreshToken 生成随机刷新令牌，数据库只保存其哈希
+func generateRefreshToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
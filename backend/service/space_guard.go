@@ -0,0 +1,379 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/matrix/mynest/backend/downloader"
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/gorm"
+)
+
+// 空间不足时的处理策略（系统配置 disk_space_policy）
+const (
+	SpacePolicyWait   = "wait"   // 任务进入 waiting_for_space，空间足够后重新排队
+	SpacePolicyReject = "reject" // 拒绝提交，任务标记为失败
+)
+
+// spaceUsageStatuses 计入存储配额的任务状态：已经提交给下载引擎或已完成的任务
+var spaceUsageStatuses = []string{
+	string(types.TaskStatusPending),
+	string(types.TaskStatusDownloading),
+	string(types.TaskStatusPaused),
+	string(types.TaskStatusAwaitingSelection),
+	string(types.TaskStatusCompleted),
+	string(types.TaskStatusCorrupt),
+}
+
+// outstandingStatuses 已交给下载引擎、还会继续写入磁盘的任务状态，暂停的任务恢复后同样需要空间
+var outstandingStatuses = []string{
+	string(types.TaskStatusPending),
+	string(types.TaskStatusDownloading),
+	string(types.TaskStatusPaused),
+	string(types.TaskStatusAwaitingSelection),
+}
+
+// SpaceError 磁盘剩余空间或存储配额不足
+type SpaceError struct {
+	Reason string
+}
+
+func (e *SpaceError) Error() string {
+	return e.Reason
+}
+
+// ByteSize 字节数，JSON 中可以写数字或带单位的字符串，如 "500G"、"1.5T"
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("无效的大小: %s", data)
+	}
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+// parseByteSize 解析带单位的大小，单位 K/M/G/T 按 1024 进位，可带 B 或 iB 后缀
+func parseByteSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("无效的大小: %s", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// formatByteSize 格式化为便于阅读的大小，如 1.5G
+func formatByteSize(n int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// StorageQuotas 按分类和插件的存储配额（系统配置 storage_quotas），0 或未配置表示不限制
+type StorageQuotas struct {
+	Categories map[string]ByteSize `json:"categories"`
+	Plugins    map[string]ByteSize `json:"plugins"`
+}
+
+// SpaceGuard 提交和放行任务前检查下载目录的剩余空间和存储配额
+// 剩余空间扣除其他下载中任务还未写入的部分后，需要在放下任务后仍不少于保留空间（disk_reserve 和 disk_reserve_percent 中较大的一个）；
+// 配额按同分类/插件已提交和已完成任务的文件大小之和计算
+type SpaceGuard struct {
+	db            *gorm.DB
+	engines       *downloader.Registry
+	configService *SystemConfigService
+}
+
+func NewSpaceGuard(db *gorm.DB, engines *downloader.Registry) *SpaceGuard {
+	return &SpaceGuard{
+		db:            db,
+		engines:       engines,
+		configService: NewSystemConfigService(db),
+	}
+}
+
+// Policy 返回空间不足时的处理策略，未配置或无效时使用 wait
+func (g *SpaceGuard) Policy(ctx context.Context) string {
+	policy, _ := g.configService.GetConfig(ctx, "disk_space_policy")
+	switch policy {
+	case SpacePolicyWait, SpacePolicyReject:
+		return policy
+	case "":
+	default:
+		log.Printf("[SpaceGuard] ⚠️  无效的空间不足策略: %s，使用 wait", policy)
+	}
+	return SpacePolicyWait
+}
+
+// Check 检查任务能否下载到 dir，空间或配额不足时返回 *SpaceError
+// 任务大小未知（如 magnet 尚未获取元数据）时只检查保留空间和已用完的配额；
+// progress 为下载引擎报告的已完成大小，一轮检查多个任务时共用同一个快照
+func (g *SpaceGuard) Check(ctx context.Context, task *model.DownloadTask, dir string, progress *progressSnapshot) error {
+	return g.CheckAfter(ctx, task, dir, progress, nil)
+}
+
+// CheckAfter 同 Check，released 为已经放行、还没有交给下载引擎的任务，它们需要的空间和配额同样计入
+func (g *SpaceGuard) CheckAfter(ctx context.Context, task *model.DownloadTask, dir string, progress *progressSnapshot, released []*model.DownloadTask) error {
+	if dir == "" {
+		dir, _ = g.configService.GetConfig(ctx, "aria2_download_dir")
+	}
+	if dir != "" {
+		var reserved int64
+		for _, t := range released {
+			reserved += t.TotalLength
+		}
+		if err := g.checkFree(ctx, task, dir, progress, reserved); err != nil {
+			return err
+		}
+	}
+	return g.checkQuotas(ctx, task, released)
+}
+
+func (g *SpaceGuard) checkFree(ctx context.Context, task *model.DownloadTask, dir string, progress *progressSnapshot, reserved int64) error {
+	free, total, err := diskSpace(dir)
+	if err != nil {
+		log.Printf("[SpaceGuard] ⚠️  无法获取 %s 的磁盘空间: %v", dir, err)
+		return nil
+	}
+
+	// 其他任务还要写入的部分已经被占用，不能再分给这个任务
+	free -= g.outstanding(ctx, task, progress) + reserved
+	reserve := g.reserve(ctx, total)
+	if free-task.TotalLength < reserve {
+		return &SpaceError{Reason: fmt.Sprintf("磁盘剩余空间不足: 扣除下载中的任务后剩余 %s，任务需要 %s，保留 %s",
+			formatByteSize(max(free, 0)), formatByteSize(task.TotalLength), formatByteSize(reserve))}
+	}
+	return nil
+}
+
+// outstanding 返回其他已交给下载引擎的任务还未写入的字节数（总大小减去下载引擎报告的已完成大小）
+// 大小未知的任务不计入；下载引擎不可用时按未下载计算
+func (g *SpaceGuard) outstanding(ctx context.Context, task *model.DownloadTask, progress *progressSnapshot) int64 {
+	var tasks []*model.DownloadTask
+	if err := g.db.Select("id", "engine", "gid", "total_length").
+		Where("id <> ? AND total_length > 0 AND status IN ?", task.ID, outstandingStatuses).
+		Find(&tasks).Error; err != nil {
+		log.Printf("[SpaceGuard] 查询下载中的任务失败: %v", err)
+		return 0
+	}
+
+	var sum int64
+	for _, t := range tasks {
+		if remaining := t.TotalLength - progress.completedLength(ctx, t.Engine, t.GID); remaining > 0 {
+			sum += remaining
+		}
+	}
+	return sum
+}
+
+// progressSnapshot 下载引擎报告的任务已完成大小，每个引擎在第一次用到时查询一次；
+// 一轮调度或对账中检查多个任务时共用同一个快照，查询下载引擎的次数不随任务数增加
+type progressSnapshot struct {
+	engines   *downloader.Registry
+	completed map[string]map[string]int64 // 引擎 -> GID -> 已完成大小
+}
+
+// snapshot 创建空的已完成大小快照
+func (g *SpaceGuard) snapshot() *progressSnapshot {
+	return &progressSnapshot{
+		engines:   g.engines,
+		completed: make(map[string]map[string]int64),
+	}
+}
+
+// record 记录已经查询到的任务状态（如对账时拉取的全部状态），该引擎不再单独查询
+func (p *progressSnapshot) record(engine string, statuses map[string]*downloader.Status) {
+	byGID := make(map[string]int64, len(statuses))
+	for gid, status := range statuses {
+		byGID[gid] = status.CompletedLength
+	}
+	p.completed[engine] = byGID
+}
+
+// completedLength 返回任务在下载引擎中的已完成大小
+func (p *progressSnapshot) completedLength(ctx context.Context, engine, gid string) int64 {
+	byGID, ok := p.completed[engine]
+	if !ok {
+		byGID = p.query(ctx, engine)
+		p.completed[engine] = byGID
+	}
+	return byGID[gid]
+}
+
+// query 查询下载引擎中活动和等待中任务的已完成大小
+func (p *progressSnapshot) query(ctx context.Context, engine string) map[string]int64 {
+	result := make(map[string]int64)
+	if p.engines == nil {
+		return result
+	}
+	dl, err := p.engines.Get(engine)
+	if err != nil {
+		return result
+	}
+	active, err := dl.TellActive(ctx)
+	if err != nil {
+		return result
+	}
+	waiting, _ := fetchPages(ctx, dl.TellWaiting)
+	for _, status := range append(active, waiting...) {
+		result[status.GID] = status.CompletedLength
+	}
+	return result
+}
+
+// reserve 返回总空间为 total 的磁盘需要保留的空间，disk_reserve 和 disk_reserve_percent 中较大的一个
+func (g *SpaceGuard) reserve(ctx context.Context, total int64) int64 {
+	reserve := int64(0)
+	if value, _ := g.configService.GetConfig(ctx, "disk_reserve"); value != "" {
+		var err error
+		if reserve, err = parseByteSize(value); err != nil {
+			log.Printf("[SpaceGuard] ⚠️  disk_reserve 配置无效: %v", err)
+		}
+	}
+	if value, _ := g.configService.GetConfig(ctx, "disk_reserve_percent"); value != "" {
+		if percent, err := strconv.ParseFloat(value, 64); err == nil && percent > 0 {
+			if byPercent := int64(float64(total) * percent / 100); byPercent > reserve {
+				reserve = byPercent
+			}
+		}
+	}
+	return reserve
+}
+
+// Available 返回 dir 所在磁盘扣除保留空间后还能写入的字节数
+func (g *SpaceGuard) Available(ctx context.Context, dir string) (int64, error) {
+	free, total, err := diskSpace(dir)
+	if err != nil {
+		return 0, err
+	}
+	return free - g.reserve(ctx, total), nil
+}
+
+func (g *SpaceGuard) checkQuotas(ctx context.Context, task *model.DownloadTask, released []*model.DownloadTask) error {
+	value, _ := g.configService.GetConfig(ctx, "storage_quotas")
+	if value == "" {
+		return nil
+	}
+	var quotas StorageQuotas
+	if err := json.Unmarshal([]byte(value), &quotas); err != nil {
+		log.Printf("[SpaceGuard] ⚠️  storage_quotas 配置无效: %v", err)
+		return nil
+	}
+
+	if quota := quotas.Categories[task.Category]; task.Category != "" && quota > 0 {
+		if err := g.checkQuota(task, "category", task.Category, int64(quota), releasedLength(released, func(t *model.DownloadTask) bool {
+			return t.Category == task.Category
+		})); err != nil {
+			return err
+		}
+	}
+	if quota := quotas.Plugins[task.PluginName]; task.PluginName != "" && quota > 0 {
+		if err := g.checkQuota(task, "plugin_name", task.PluginName, int64(quota), releasedLength(released, func(t *model.DownloadTask) bool {
+			return t.PluginName == task.PluginName
+		})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *SpaceGuard) checkQuota(task *model.DownloadTask, column, value string, quota, reserved int64) error {
+	var used int64
+	if err := g.db.Model(&model.DownloadTask{}).
+		Where(column+" = ? AND id <> ? AND status IN ?", value, task.ID, spaceUsageStatuses).
+		Select("COALESCE(SUM(total_length), 0)").Scan(&used).Error; err != nil {
+		log.Printf("[SpaceGuard] 查询已用空间失败: %v", err)
+		return nil
+	}
+	used += reserved
+
+	if used+task.TotalLength > quota || (task.TotalLength == 0 && used >= quota) {
+		return &SpaceError{Reason: fmt.Sprintf("%s 的存储配额不足: 已用 %s，任务需要 %s，配额 %s",
+			value, formatByteSize(used), formatByteSize(task.TotalLength), formatByteSize(quota))}
+	}
+	return nil
+}
+
+// releasedLength 返回 released 中符合条件的任务的总大小
+func releasedLength(released []*model.DownloadTask, match func(*model.DownloadTask) bool) int64 {
+	var sum int64
+	for _, t := range released {
+		if match(t) {
+			sum += t.TotalLength
+		}
+	}
+	return sum
+}
+
+// diskSpace 返回 dir 所在文件系统的可用空间和总空间，dir 不存在时使用最近的上级目录
+func diskSpace(dir string) (int64, int64, error) {
+	dir = filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	return statDisk(dir)
+}
+
+// taskDir 返回任务排队时保存的下载目录，没有时为空（使用下载根目录）
+func taskDir(task *model.DownloadTask) string {
+	var options map[string]interface{}
+	if len(task.EngineOptions) > 0 && json.Unmarshal(task.EngineOptions, &options) == nil {
+		if dir, ok := options["dir"].(string); ok {
+			return dir
+		}
+	}
+	return ""
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package service
+
+import "errors"
+
+// statDisk 当前平台无法获取磁盘空间，返回错误，检查时跳过磁盘空间只检查配额
+func statDisk(dir string) (int64, int64, error) {
+	return 0, 0, errors.New("当前平台不支持获取磁盘空间")
+}
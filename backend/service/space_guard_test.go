@@ -0,0 +1,32 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix/mynest/backend/downloader"
+)
+
+func TestProgressSnapshot(t *testing.T) {
+	progress := (&SpaceGuard{}).snapshot()
+	progress.record("aria2", map[string]*downloader.Status{
+		"2089b05ecca3d829": {GID: "2089b05ecca3d829", CompletedLength: 1024},
+		"d270c8a2c8f2b1a5": {GID: "d270c8a2c8f2b1a5"},
+	})
+
+	ctx := context.Background()
+	tests := []struct {
+		engine, gid string
+		want        int64
+	}{
+		{"aria2", "2089b05ecca3d829", 1024},
+		{"aria2", "d270c8a2c8f2b1a5", 0},
+		{"aria2", "unknown", 0},           // 引擎中不存在的任务按未下载计算
+		{"native", "2089b05ecca3d829", 0}, // 没有下载引擎时按未下载计算
+	}
+	for _, tt := range tests {
+		if got := progress.completedLength(ctx, tt.engine, tt.gid); got != tt.want {
+			t.Errorf("completedLength(%q, %q) = %d, want %d", tt.engine, tt.gid, got, tt.want)
+		}
+	}
+}
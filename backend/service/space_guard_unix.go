@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package service
+
+import "syscall"
+
+// statDisk 返回 dir 所在文件系统的可用空间和总空间
+func statDisk(dir string) (int64, int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
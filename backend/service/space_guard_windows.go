@@ -0,0 +1,18 @@
+//go:build windows
+
+package service
+
+import "golang.org/x/sys/windows"
+
+// statDisk 返回 dir 所在卷的可用空间（当前用户可用，已计入磁盘配额）和总空间
+func statDisk(dir string) (int64, int64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &free, &total, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return int64(free), int64(total), nil
+}
@@ -26,6 +26,20 @@ func (s *SystemConfigService) GetConfig(ctx context.Context, key string) (string
 	return config.Value, nil
 }
 
+// GetConfigs 一次读取多个配置项，未设置的配置项不出现在结果中
+func (s *SystemConfigService) GetConfigs(ctx context.Context, keys ...string) (map[string]string, error) {
+	var configs []model.SystemConfig
+	if err := s.db.Where("key IN ?", keys).Find(&configs).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(configs))
+	for _, config := range configs {
+		result[config.Key] = config.Value
+	}
+	return result, nil
+}
+
 func (s *SystemConfigService) SetConfig(ctx context.Context, key, value string) error {
 	config := model.SystemConfig{
 		Key:   key,
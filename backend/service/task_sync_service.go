@@ -2,6 +2,8 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -11,29 +13,89 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	// pollInterval 推送通道不可用时的轮询间隔
+	pollInterval = 3 * time.Second
+	// reconcileInterval 推送通道可用时的兜底对账间隔
+	reconcileInterval = 60 * time.Second
+	// statusPageSize tellWaiting/tellStopped 每页拉取的数量
+	statusPageSize = 1000
+)
+
 type TaskSyncService struct {
-	db                 *gorm.DB
-	downloader         downloader.Downloader
-	stopChan           chan struct{}
-	aria2Available     bool
-	aria2CheckFailures int
+	db            *gorm.DB
+	engines       *downloader.Registry
+	configService *SystemConfigService
+	space         *SpaceGuard
+	stopChan      chan struct{}
+	health        map[string]*engineHealth
+	lastSyncAt    time.Time
+
+	// 重试策略和后处理流水线配置的缓存，由 loadConfig 按轮询周期刷新
+	retryPolicy    RetryPolicy
+	pipelines      map[string][]PostProcessStep
+	configLoadedAt time.Time
+}
+
+// engineHealth 记录单个下载引擎的可用性
+type engineHealth struct {
+	available bool
+	failures  int
+}
+
+// engineEvent 带引擎名称的下载事件
+type engineEvent struct {
+	engine string
+	event  downloader.Event
 }
 
-func NewTaskSyncService(db *gorm.DB, dl downloader.Downloader) *TaskSyncService {
+func NewTaskSyncService(db *gorm.DB, engines *downloader.Registry) *TaskSyncService {
 	return &TaskSyncService{
-		db:             db,
-		downloader:     dl,
-		stopChan:       make(chan struct{}),
-		aria2Available: true, // 初始假设可用
+		db:            db,
+		engines:       engines,
+		configService: NewSystemConfigService(db),
+		space:         NewSpaceGuard(db, engines),
+		stopChan:      make(chan struct{}),
+		health:        make(map[string]*engineHealth),
 	}
 }
 
 func (s *TaskSyncService) Start() {
-	ticker := time.NewTicker(3 * time.Second)
+	// 汇总所有支持推送的引擎事件
+	events := make(chan engineEvent, 256)
+	for _, name := range s.engines.Names() {
+		dl, _ := s.engines.Get(name)
+		notifier, ok := dl.(downloader.Notifier)
+		if !ok {
+			continue
+		}
+		go func(name string, ch <-chan downloader.Event) {
+			for {
+				select {
+				case ev := <-ch:
+					select {
+					case events <- engineEvent{engine: name, event: ev}:
+					case <-s.stopChan:
+						return
+					}
+				case <-s.stopChan:
+					return
+				}
+			}
+		}(name, notifier.Events())
+	}
+
+	ticker := time.NewTicker(pollInterval)
 	go func() {
 		for {
 			select {
+			case ev := <-events:
+				s.handleEvent(ev)
 			case <-ticker.C:
+				// 所有引擎的推送通道都可用时只做低频对账，任一断开时回退到轮询
+				if s.allConnected() && time.Since(s.lastSyncAt) < reconcileInterval {
+					continue
+				}
 				s.syncActiveTasks()
 			case <-s.stopChan:
 				ticker.Stop()
@@ -47,199 +109,622 @@ func (s *TaskSyncService) Stop() {
 	close(s.stopChan)
 }
 
+// allConnected 判断是否所有引擎都支持推送且推送通道可用
+func (s *TaskSyncService) allConnected() bool {
+	for _, name := range s.engines.Names() {
+		dl, _ := s.engines.Get(name)
+		notifier, ok := dl.(downloader.Notifier)
+		if !ok || !notifier.Connected() {
+			return false
+		}
+	}
+	return true
+}
+
+// handleEvent 处理下载器推送的事件，只同步事件对应的任务
+func (s *TaskSyncService) handleEvent(ev engineEvent) {
+	if ev.event.Type == downloader.EventReconnect {
+		// 推送通道断开期间的事件已丢失，立即对账一次，不等待下一个对账周期
+		log.Printf("[TaskSync] 🔌 %s 的推送通道已重新连接，开始对账", ev.engine)
+		s.syncActiveTasks()
+		return
+	}
+
+	dl, err := s.engines.Get(ev.engine)
+	if err != nil {
+		return
+	}
+
+	var task model.DownloadTask
+	err = s.db.Where("engine = ? AND gid = ? AND status IN ?", ev.engine, ev.event.GID, []string{
+		string(types.TaskStatusPending),
+		string(types.TaskStatusDownloading),
+		string(types.TaskStatusPaused),
+		string(types.TaskStatusAwaitingSelection),
+	}).First(&task).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("[TaskSync] 查询事件对应任务失败 (GID: %s): %v", ev.event.GID, err)
+		}
+		// 未知 GID（如 magnet 的后续任务尚未切换），交给对账处理
+		return
+	}
+
+	log.Printf("[TaskSync] 📨 收到 %s 事件 %s: 任务 %d (GID: %s)", ev.engine, ev.event.Type, task.ID, ev.event.GID)
+	s.syncTask(context.Background(), dl, &task)
+}
+
 func (s *TaskSyncService) syncActiveTasks() {
-	// 先检查 aria2 是否可用
+	s.lastSyncAt = time.Now()
 	ctx := context.Background()
-	_, err := s.downloader.GetVersion(ctx)
-	if err != nil {
-		s.aria2CheckFailures++
-		if s.aria2Available {
-			log.Printf("⚠️  aria2 服务不可用，连续失败次数: %d", s.aria2CheckFailures)
+	progress := s.space.snapshot()
+
+	var tasks []*model.DownloadTask
+	if err := s.db.Where("status IN ?", []string{
+		string(types.TaskStatusPending),
+		string(types.TaskStatusDownloading),
+		string(types.TaskStatusPaused), // 同步暂停的任务，以便检测恢复
+		string(types.TaskStatusAwaitingSelection),
+	}).Find(&tasks).Error; err != nil {
+		log.Printf("Failed to fetch active tasks: %v", err)
+		return
+	}
+
+	// 按引擎分组，每个引擎独立对账
+	byEngine := make(map[string][]*model.DownloadTask)
+	for _, task := range tasks {
+		name := task.Engine
+		if name == "" {
+			name = s.engines.Default()
+		}
+		byEngine[name] = append(byEngine[name], task)
+	}
+
+	for name, engineTasks := range byEngine {
+		dl, err := s.engines.Get(name)
+		if err != nil {
+			log.Printf("[TaskSync] 跳过 %d 个任务: %v", len(engineTasks), err)
+			continue
+		}
+		if !s.checkEngine(ctx, name, dl) {
+			continue
+		}
+		s.reconcileTasks(ctx, name, dl, engineTasks, progress)
+	}
+
+	// 对账时拉取的任务状态已记录在 progress 中，检查空间时不再查询这些引擎
+	s.recheckSpace(ctx, progress)
+}
+
+// recheckSpace 重新检查等待空间的任务，空间和配额足够时重新排队，由队列调度器放行
+// 按队列顺序逐个放行，已放行的任务还没有写入磁盘，后面的任务扣除它们需要的空间后再检查
+func (s *TaskSyncService) recheckSpace(ctx context.Context, progress *progressSnapshot) {
+	var tasks []*model.DownloadTask
+	if err := s.db.Where("status = ?", string(types.TaskStatusWaitingForSpace)).
+		Order("position ASC, id ASC").Find(&tasks).Error; err != nil {
+		log.Printf("[TaskSync] 查询等待空间的任务失败: %v", err)
+		return
+	}
+
+	var released []*model.DownloadTask
+	for _, task := range tasks {
+		if err := s.space.CheckAfter(ctx, task, taskDir(task), progress, released); err != nil {
+			if err.Error() != task.ErrorMsg {
+				s.db.Model(task).Update("error_msg", err.Error())
+			}
+			continue
+		}
+		log.Printf("[TaskSync] 💾 任务 %d 的空间已足够，重新排队", task.ID)
+		if err := s.db.Model(task).Updates(map[string]interface{}{
+			"status":    string(types.TaskStatusQueued),
+			"error_msg": "",
+		}).Error; err != nil {
+			log.Printf("[TaskSync] 更新任务 %d 失败: %v", task.ID, err)
+			continue
+		}
+		released = append(released, task)
+	}
+}
+
+// checkEngine 检查引擎是否可用，连续失败 3 次后将该引擎的运行中任务标记为暂停
+func (s *TaskSyncService) checkEngine(ctx context.Context, name string, dl downloader.Downloader) bool {
+	health, ok := s.health[name]
+	if !ok {
+		health = &engineHealth{available: true} // 初始假设可用
+		s.health[name] = health
+	}
+
+	if _, err := dl.GetVersion(ctx); err != nil {
+		health.failures++
+		if health.available {
+			log.Printf("⚠️  下载引擎 %s 不可用，连续失败次数: %d", name, health.failures)
 		}
 
 		// 连续失败3次后，标记运行中的任务为已暂停（避免误判）
-		if s.aria2CheckFailures >= 3 && s.aria2Available {
-			s.aria2Available = false
-			log.Printf("⏸️  aria2 服务已停止，标记运行中任务为已暂停")
+		if health.failures >= 3 && health.available {
+			health.available = false
+			log.Printf("⏸️  下载引擎 %s 已停止，标记运行中任务为已暂停", name)
 
 			// 只标记 pending 和 downloading 状态的任务，不修改已暂停的任务
-			var tasks []*model.DownloadTask
-			if err := s.db.Where("status IN ?", []string{
+			if err := s.db.Model(&model.DownloadTask{}).Where("engine = ? AND status IN ?", name, []string{
 				string(types.TaskStatusPending),
 				string(types.TaskStatusDownloading),
-			}).Find(&tasks).Error; err != nil {
-				log.Printf("Failed to fetch active tasks: %v", err)
-				return
+			}).Updates(map[string]interface{}{
+				"status":    string(types.TaskStatusPaused),
+				"error_msg": fmt.Sprintf("%s 服务已停止，请重启后重试", name),
+			}).Error; err != nil {
+				log.Printf("Failed to pause active tasks: %v", err)
 			}
+		}
+		return false
+	}
 
-			for _, task := range tasks {
-				updates := map[string]interface{}{
-					"status":    string(types.TaskStatusPaused),
-					"error_msg": "aria2 服务已停止，请重启后重试",
-				}
-				if err := s.db.Model(task).Updates(updates).Error; err != nil {
-					log.Printf("Failed to update task %d: %v", task.ID, err)
+	// 引擎可用，重置失败计数
+	if !health.available {
+		log.Printf("✅ 下载引擎 %s 已恢复", name)
+	}
+	health.failures = 0
+	health.available = true
+	return true
+}
+
+// reconcileTasks 以少量 RPC 拉取所有任务状态，并逐个更新有变化的任务
+func (s *TaskSyncService) reconcileTasks(ctx context.Context, name string, dl downloader.Downloader, tasks []*model.DownloadTask, progress *progressSnapshot) {
+	statuses, err := s.fetchAllStatuses(ctx, dl, tasks)
+	if err != nil {
+		log.Printf("[TaskSync] 批量获取任务状态失败: %v", err)
+		return
+	}
+	progress.record(name, statuses)
+
+	lookup := func(gid string) (*downloader.Status, bool) {
+		status, ok := statuses[gid]
+		return status, ok
+	}
+
+	type reconciled struct {
+		task    *model.DownloadTask
+		updates map[string]interface{}
+		gids    []string   // 重试时需要从下载引擎中清理的 GID
+		stop    *spaceStop // 空间不足时需要在下载引擎中暂停或移除
+	}
+
+	// 先计算全部更新，写入数据库期间不调用下载引擎
+	var pending []reconciled
+	policy, pipelines := s.loadConfig(ctx)
+	now := time.Now()
+	for _, task := range tasks {
+		if task.GID == "" {
+			continue
+		}
+
+		var updates map[string]interface{}
+		if status, ok := statuses[task.GID]; ok {
+			updates = buildTaskUpdates(task, status, lookup)
+		} else {
+			log.Printf("[TaskSync] 任务 %d 在 %s 中不存在 (GID: %s)", task.ID, task.Engine, task.GID)
+			updates = missingTaskUpdates(task)
+		}
+
+		gids := retriedGIDs(task, updates)
+		updates = applyRetryPolicy(task, updates, policy, now)
+		updates = applyPostProcess(task, updates, pipelines)
+		updates, stop := s.checkSizeKnown(ctx, task, updates, progress)
+		updates = pruneUnchanged(task, updates)
+		if len(updates) == 0 {
+			continue
+		}
+		pending = append(pending, reconciled{task: task, updates: updates, gids: gids, stop: stop})
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	// 在一个事务中批量更新，每个任务使用一个保存点，单个任务更新失败时回滚到保存点并跳过，不影响其他任务
+	var applied []reconciled
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, r := range pending {
+			savepoint := fmt.Sprintf("task_%d", r.task.ID)
+			if err := tx.SavePoint(savepoint).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(r.task).Updates(r.updates).Error; err != nil {
+				log.Printf("[TaskSync] 更新任务 %d 失败: %v", r.task.ID, err)
+				if err := tx.RollbackTo(savepoint).Error; err != nil {
+					return err
 				}
+				continue
 			}
+			applied = append(applied, r)
 		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[TaskSync] 批量更新任务失败: %v", err)
 		return
 	}
+	if len(applied) > 0 {
+		log.Printf("[TaskSync] 对账完成: %d 个任务，更新 %d 个", len(tasks), len(applied))
+	}
 
-	// aria2 可用，重置失败计数
-	if s.aria2CheckFailures > 0 || !s.aria2Available {
-		if !s.aria2Available {
-			log.Printf("✅ aria2 服务已恢复")
+	// 事务提交后再清理重试前的下载、暂停或移除空间不足的任务和自动选择文件，避免事务回滚后下载引擎与数据库不一致
+	for _, r := range applied {
+		if r.stop != nil {
+			s.stopForSpace(ctx, dl, r.task, r.stop)
+		}
+		switch r.updates["status"] {
+		case string(types.TaskStatusQueued):
+			discardAttempt(ctx, dl, r.task, r.gids)
+		case string(types.TaskStatusAwaitingSelection):
+			autoSelectFiles(ctx, s.db, dl, r.task, updatedGID(r.task, r.updates))
 		}
-		s.aria2CheckFailures = 0
-		s.aria2Available = true
 	}
+}
 
-	var tasks []*model.DownloadTask
-	if err := s.db.Where("status IN ?", []string{
-		string(types.TaskStatusPending),
-		string(types.TaskStatusDownloading),
-		string(types.TaskStatusPaused), // 同步暂停的任务，以便检测恢复
-	}).Find(&tasks).Error; err != nil {
-		log.Printf("Failed to fetch active tasks: %v", err)
-		return
+// fetchAllStatuses 通过 tellActive/tellWaiting/tellStopped 获取引擎中全部任务状态，
+// 不在列表中的 GID（如已超出 max-download-result 的历史任务）再用一次 multicall 补齐
+func (s *TaskSyncService) fetchAllStatuses(ctx context.Context, dl downloader.Downloader, tasks []*model.DownloadTask) (map[string]*downloader.Status, error) {
+	statuses := make(map[string]*downloader.Status)
+
+	active, err := dl.TellActive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	waiting, err := fetchPages(ctx, dl.TellWaiting)
+	if err != nil {
+		return nil, err
+	}
+	stopped, err := fetchPages(ctx, dl.TellStopped)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range [][]*downloader.Status{active, waiting, stopped} {
+		for _, status := range list {
+			statuses[status.GID] = status
+		}
 	}
 
+	var missing []string
 	for _, task := range tasks {
 		if task.GID == "" {
 			continue
 		}
+		if _, ok := statuses[task.GID]; !ok {
+			missing = append(missing, task.GID)
+		}
+	}
 
-		status, err := s.downloader.TellStatus(ctx, task.GID)
+	if len(missing) > 0 {
+		extra, err := dl.TellStatusBatch(ctx, missing)
 		if err != nil {
-			log.Printf("Failed to get status for task %d (GID: %s): %v", task.ID, task.GID, err)
-			// 单个任务查询失败（任务可能被手动停止、删除或 aria2 重启未恢复会话）
-			// 如果任务正在下载或等待中，标记为暂停；如果已经是暂停状态，标记为失败
-			updates := map[string]interface{}{}
-			if task.Status == string(types.TaskStatusPaused) {
-				// 已经是暂停状态，持续查询失败，标记为失败
-				updates["status"] = string(types.TaskStatusFailed)
-				updates["error_msg"] = "任务已从 aria2 中移除，无法恢复"
-			} else {
-				// 从活动状态变为查询失败，可能是手动停止，标记为暂停
-				updates["status"] = string(types.TaskStatusPaused)
-				updates["error_msg"] = "任务已从 aria2 中停止或丢失"
-			}
-			if err := s.db.Model(task).Updates(updates).Error; err != nil {
-				log.Printf("Failed to update task %d status: %v", task.ID, err)
-			}
-			continue
+			return nil, err
+		}
+		for gid, status := range extra {
+			statuses[gid] = status
 		}
+	}
 
-		// 对于 magnet 链接，如果有后续任务，优先使用后续任务的状态
-		actualGID := task.GID
-		if len(status.FollowedBy) > 0 {
-			followedGID := status.FollowedBy[0]
-			followedStatus, err := s.downloader.TellStatus(ctx, followedGID)
-			if err == nil {
-				// 成功获取后续任务状态，使用它
-				status = followedStatus
-				actualGID = followedGID
-				log.Printf("[TaskSync] 使用后续任务状态: %s -> %s (status: %s)", task.GID, followedGID, status.Status)
+	return statuses, nil
+}
+
+// fetchPages 分页拉取 tellWaiting/tellStopped 的全部结果
+func fetchPages(ctx context.Context, tell func(ctx context.Context, offset, num int) ([]*downloader.Status, error)) ([]*downloader.Status, error) {
+	var all []*downloader.Status
+	for offset := 0; ; offset += statusPageSize {
+		page, err := tell(ctx, offset, statusPageSize)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < statusPageSize {
+			return all, nil
+		}
+	}
+}
+
+// syncTask 查询单个任务在下载器中的状态并更新数据库
+func (s *TaskSyncService) syncTask(ctx context.Context, dl downloader.Downloader, task *model.DownloadTask) {
+	status, err := dl.TellStatus(ctx, task.GID)
+	var updates map[string]interface{}
+	if err != nil {
+		log.Printf("Failed to get status for task %d (GID: %s): %v", task.ID, task.GID, err)
+		updates = missingTaskUpdates(task)
+	} else {
+		updates = buildTaskUpdates(task, status, func(gid string) (*downloader.Status, bool) {
+			followed, err := dl.TellStatus(ctx, gid)
+			return followed, err == nil
+		})
+	}
+
+	policy, pipelines := s.loadConfig(ctx)
+	gids := retriedGIDs(task, updates)
+	updates = applyRetryPolicy(task, updates, policy, time.Now())
+	updates = applyPostProcess(task, updates, pipelines)
+	updates, stop := s.checkSizeKnown(ctx, task, updates, s.space.snapshot())
+	updates = pruneUnchanged(task, updates)
+	if len(updates) > 0 {
+		if err := s.db.Model(task).Updates(updates).Error; err != nil {
+			log.Printf("Failed to update task %d: %v", task.ID, err)
+			return
+		}
+		if stop != nil {
+			s.stopForSpace(ctx, dl, task, stop)
+		}
+		if updates["status"] == string(types.TaskStatusQueued) {
+			discardAttempt(ctx, dl, task, gids)
+		}
+		if updates["status"] == string(types.TaskStatusAwaitingSelection) {
+			autoSelectFiles(ctx, s.db, dl, task, updatedGID(task, updates))
+		}
+	}
+}
+
+// spaceStop 任务大小确定后空间不足，需要在写入数据库后暂停或移除的下载
+type spaceStop struct {
+	gid    string
+	remove bool   // disk_space_policy 为 reject 时移除任务，否则暂停
+	status string // 检查空间前的状态，下载引擎操作失败时恢复
+}
+
+// checkSizeKnown magnet 元数据下载完成或没有 Content-Length 的任务开始下载后才知道任务大小，
+// 提交时只能按未知大小检查，此时重新检查空间和配额；不足时按 disk_space_policy 把任务标记为 waiting_for_space
+// （空间足够后由 recheckSpace 重新排队、从暂停处继续下载）或失败，并返回需要在下载引擎中执行的暂停或移除。
+// 下载引擎的操作由调用方在更新写入数据库后通过 stopForSpace 执行
+func (s *TaskSyncService) checkSizeKnown(ctx context.Context, task *model.DownloadTask, updates map[string]interface{}, progress *progressSnapshot) (map[string]interface{}, *spaceStop) {
+	total, ok := updates["total_length"].(int64)
+	if !ok || total <= 0 || task.TotalLength > 0 {
+		return updates, nil
+	}
+	status, ok := updates["status"].(string)
+	if !ok {
+		status = task.Status
+	}
+	if status != string(types.TaskStatusPending) && status != string(types.TaskStatusDownloading) {
+		return updates, nil
+	}
+
+	sized := *task
+	sized.TotalLength = total
+	err := s.space.Check(ctx, &sized, taskDir(task), progress)
+	if err == nil {
+		return updates, nil
+	}
+
+	stop := &spaceStop{gid: updatedGID(task, updates), status: status}
+	if s.space.Policy(ctx) == SpacePolicyReject {
+		log.Printf("[TaskSync] 💾 任务 %d 的大小为 %s，空间不足，移除任务: %v", task.ID, formatByteSize(total), err)
+		stop.remove = true
+		updates["status"] = string(types.TaskStatusFailed)
+	} else {
+		log.Printf("[TaskSync] 💾 任务 %d 的大小为 %s，空间不足，暂停等待空间: %v", task.ID, formatByteSize(total), err)
+		updates["status"] = string(types.TaskStatusWaitingForSpace)
+	}
+	updates["error_msg"] = err.Error()
+	return updates, stop
+}
+
+// stopForSpace 在下载引擎中暂停或移除空间不足的任务；失败时恢复检查前的状态并清空大小，下个周期重新检查
+func (s *TaskSyncService) stopForSpace(ctx context.Context, dl downloader.Downloader, task *model.DownloadTask, stop *spaceStop) {
+	var err error
+	if stop.remove {
+		err = dl.Remove(ctx, stop.gid)
+	} else {
+		err = dl.Pause(ctx, stop.gid)
+	}
+	if err == nil {
+		return
+	}
+
+	log.Printf("[TaskSync] 暂停或移除空间不足的任务 %d 失败 (GID: %s): %v", task.ID, stop.gid, err)
+	if err := s.db.Model(task).Updates(map[string]interface{}{
+		"status":       stop.status,
+		"total_length": 0,
+		"error_msg":    "",
+	}).Error; err != nil {
+		log.Printf("[TaskSync] 恢复任务 %d 的状态失败: %v", task.ID, err)
+	}
+}
+
+// loadConfig 返回重试策略和后处理流水线配置，每个轮询周期最多读取一次，
+// 避免推送事件频繁时每个事件都查询系统配置；流水线配置无效时不触发后处理
+func (s *TaskSyncService) loadConfig(ctx context.Context) (RetryPolicy, map[string][]PostProcessStep) {
+	if time.Since(s.configLoadedAt) < pollInterval {
+		return s.retryPolicy, s.pipelines
+	}
+
+	pipelines, err := loadPipelines(ctx, s.configService)
+	if err != nil {
+		log.Printf("[TaskSync] ⚠️  %v", err)
+	}
+	s.retryPolicy = loadRetryPolicy(ctx, s.configService)
+	s.pipelines = pipelines
+	s.configLoadedAt = time.Now()
+	return s.retryPolicy, s.pipelines
+}
+
+// missingTaskUpdates 任务在下载器中查询不到时的状态变更
+// 任务可能被手动停止、删除或下载引擎重启未恢复会话
+func missingTaskUpdates(task *model.DownloadTask) map[string]interface{} {
+	updates := map[string]interface{}{}
+	if task.Status == string(types.TaskStatusPaused) && task.ErrorMsg == "" && !task.WindowPaused {
+		// 用户暂停的任务保持暂停，清空 GID，恢复时重新提交
+		updates["gid"] = ""
+		updates["error_msg"] = "任务已从下载引擎中移除，恢复时将重新下载"
+	} else if task.Status == string(types.TaskStatusPaused) {
+		// 已经是暂停状态，持续查询失败，标记为失败，由 applyRetryPolicy 决定是否自动重试
+		updates["status"] = string(types.TaskStatusFailed)
+		updates["error_code"] = errCodeMissing
+		updates["error_msg"] = "任务已从下载引擎中移除"
+	} else {
+		// 从活动状态变为查询失败，可能是手动停止，标记为暂停
+		updates["status"] = string(types.TaskStatusPaused)
+		updates["error_msg"] = "任务已从下载引擎中停止或丢失"
+	}
+	return updates
+}
+
+// pruneUnchanged 去掉与数据库当前值相同的字段，避免无意义的 UPDATE
+func pruneUnchanged(task *model.DownloadTask, updates map[string]interface{}) map[string]interface{} {
+	current := map[string]string{
+		"status":    task.Status,
+		"gid":       task.GID,
+		"error_msg": task.ErrorMsg,
+		"file_path": task.FilePath,
+		"filename":  task.Filename,
+	}
+	for key, value := range updates {
+		if str, ok := value.(string); ok {
+			if cur, tracked := current[key]; tracked && cur == str {
+				delete(updates, key)
 			}
 		}
+	}
+	return updates
+}
 
-		updates := make(map[string]interface{})
+// updatedGID 返回更新后的 GID（magnet 任务可能切换到后续任务）
+func updatedGID(task *model.DownloadTask, updates map[string]interface{}) string {
+	if gid, ok := updates["gid"].(string); ok {
+		return gid
+	}
+	return task.GID
+}
 
-		// 如果实际 GID 与数据库中的不同，更新它
-		if actualGID != task.GID {
-			updates["gid"] = actualGID
+// buildTaskUpdates 根据下载器状态计算任务需要更新的字段
+// lookup 用于查询 magnet 后续任务的状态
+func buildTaskUpdates(task *model.DownloadTask, status *downloader.Status, lookup func(gid string) (*downloader.Status, bool)) map[string]interface{} {
+	// 对于 magnet 链接，如果有后续任务，优先使用后续任务的状态
+	actualGID := task.GID
+	if len(status.FollowedBy) > 0 {
+		followedGID := status.FollowedBy[0]
+		if followedStatus, ok := lookup(followedGID); ok {
+			// 成功获取后续任务状态，使用它
+			status = followedStatus
+			actualGID = followedGID
+			log.Printf("[TaskSync] 使用后续任务状态: %s -> %s (status: %s)", task.GID, followedGID, status.Status)
 		}
+	}
 
-		switch status.Status {
-		case "active":
-			// 检查是否下载完成（可能正在做种）
-			if status.TotalLength > 0 && status.CompletedLength >= status.TotalLength {
-				// BT/Magnet 任务下载完成，可能正在做种
-				log.Printf("[TaskSync] ✅ 任务 %d 下载完成（可能正在做种）: %s", task.ID, task.URL)
-				updates["status"] = string(types.TaskStatusCompleted)
-				now := time.Now()
-				updates["completed_at"] = &now
-				if len(status.Files) > 0 {
-					updates["file_path"] = status.Files[0].Path
-					if task.Filename == "" {
-						updates["filename"] = status.Files[0].Path
-					}
-				}
-			} else {
-				// 正在下载中
-				updates["status"] = string(types.TaskStatusDownloading)
-				updates["error_msg"] = "" // 清除之前的错误信息
-				if len(status.Files) > 0 {
-					// 更新文件路径
-					updates["file_path"] = status.Files[0].Path
-					// 如果还没有设置文件名，也同时设置
-					if task.Filename == "" {
-						updates["filename"] = status.Files[0].Path
-					}
+	updates := make(map[string]interface{})
+
+	// 如果实际 GID 与数据库中的不同，更新它
+	if actualGID != task.GID {
+		updates["gid"] = actualGID
+	}
+
+	switch status.Status {
+	case "active":
+		// 检查是否下载完成（可能正在做种）
+		if status.TotalLength > 0 && status.CompletedLength >= status.TotalLength {
+			// BT/Magnet 任务下载完成，可能正在做种
+			log.Printf("[TaskSync] ✅ 任务 %d 下载完成（可能正在做种）: %s", task.ID, task.URL)
+			updates["status"] = string(types.TaskStatusCompleted)
+			now := time.Now()
+			updates["completed_at"] = &now
+			if len(status.Files) > 0 {
+				updates["file_path"] = primaryFile(status.Files).Path
+				if task.Filename == "" {
+					updates["filename"] = primaryFile(status.Files).Path
 				}
 			}
-		case "waiting":
-			// aria2 队列中等待下载
-			updates["status"] = string(types.TaskStatusPending)
-			updates["error_msg"] = "" // 清除错误信息
-			log.Printf("[TaskSync] ⏳ 任务 %d 等待中: %s", task.ID, task.URL)
-		case "paused":
-			// 用户手动暂停或系统暂停
-			updates["status"] = string(types.TaskStatusPaused)
-			updates["error_msg"] = "" // 清除错误信息，暂停不是错误
-			log.Printf("[TaskSync] ⏸️  任务 %d 已暂停: %s", task.ID, task.URL)
-		case "complete":
-			// 检查是否有后续任务（magnet 链接元数据下载完成）
-			if len(status.FollowedBy) > 0 {
-				// 这是 magnet 链接的元数据任务，切换到实际下载任务
-				followedGID := status.FollowedBy[0]
-				log.Printf("[TaskSync] 🔄 任务 %d 元数据下载完成，切换到实际下载任务: %s -> %s", task.ID, task.GID, followedGID)
-
-				// 更新 GID 为实际下载任务的 GID
-				updates["gid"] = followedGID
-				updates["status"] = string(types.TaskStatusDownloading)
-				updates["error_msg"] = "" // 清除可能的错误信息
-
-				// 尝试获取实际任务的信息
-				followedStatus, err := s.downloader.TellStatus(ctx, followedGID)
-				if err == nil && len(followedStatus.Files) > 0 {
-					// 更新为实际文件的路径和名称
-					updates["file_path"] = followedStatus.Files[0].Path
-					if task.Filename == "" || task.Filename == "[METADATA]Big+Buck+Bunny" {
-						updates["filename"] = followedStatus.Files[0].Path
-					}
-				}
-			} else {
-				// 普通下载任务完成
-				updates["status"] = string(types.TaskStatusCompleted)
-				now := time.Now()
-				updates["completed_at"] = &now
-				// 设置文件的完整路径
-				if len(status.Files) > 0 {
-					updates["file_path"] = status.Files[0].Path
-					if task.Filename == "" {
-						updates["filename"] = status.Files[0].Path
-					}
+		} else {
+			// 正在下载中
+			updates["status"] = string(types.TaskStatusDownloading)
+			updates["error_msg"] = "" // 清除之前的错误信息
+			if len(status.Files) > 0 {
+				// 更新文件路径
+				updates["file_path"] = primaryFile(status.Files).Path
+				// 如果还没有设置文件名，也同时设置
+				if task.Filename == "" {
+					updates["filename"] = primaryFile(status.Files).Path
 				}
 			}
-		case "error", "removed":
-			updates["status"] = string(types.TaskStatusFailed)
-			if status.ErrorMessage != "" {
-				updates["error_msg"] = status.ErrorMessage
-				log.Printf("[TaskSync] ❌ 任务 %d 失败: %s, Aria2状态: %s, 错误: %s", task.ID, task.URL, status.Status, status.ErrorMessage)
-			} else if status.Status == "error" {
-				updates["error_msg"] = "下载失败，未知错误"
-				log.Printf("[TaskSync] ❌ 任务 %d 失败: %s, Aria2状态: %s, 原因: 未知错误", task.ID, task.URL, status.Status)
-			} else {
-				updates["error_msg"] = "任务已被移除"
-				log.Printf("[TaskSync] ❌ 任务 %d 被移除: %s, Aria2状态: %s", task.ID, task.URL, status.Status)
+		}
+	case "waiting":
+		// aria2 队列中等待下载
+		updates["status"] = string(types.TaskStatusPending)
+		updates["error_msg"] = "" // 清除错误信息
+		log.Printf("[TaskSync] ⏳ 任务 %d 等待中: %s", task.ID, task.URL)
+	case "paused":
+		// 要求选择文件的 BT 任务在元数据就绪后由 aria2 暂停，等待选择
+		if selectionPending(task) && hasSelectableFiles(status.Files) {
+			updates["status"] = string(types.TaskStatusAwaitingSelection)
+			// 已在等待选择的任务保留自动选择失败的提示，直到用户选择文件
+			if task.Status != string(types.TaskStatusAwaitingSelection) {
+				updates["error_msg"] = ""
+				log.Printf("[TaskSync] 📋 任务 %d 元数据已就绪，等待选择文件: %s", task.ID, task.URL)
 			}
+			break
 		}
+		// 用户手动暂停或系统暂停
+		updates["status"] = string(types.TaskStatusPaused)
+		updates["error_msg"] = "" // 清除错误信息，暂停不是错误
+		log.Printf("[TaskSync] ⏸️  任务 %d 已暂停: %s", task.ID, task.URL)
+	case "complete":
+		// 检查是否有后续任务（magnet 链接元数据下载完成）
+		if len(status.FollowedBy) > 0 {
+			// 这是 magnet 链接的元数据任务，切换到实际下载任务
+			followedGID := status.FollowedBy[0]
+			log.Printf("[TaskSync] 🔄 任务 %d 元数据下载完成，切换到实际下载任务: %s -> %s", task.ID, task.GID, followedGID)
+
+			// 更新 GID 为实际下载任务的 GID
+			updates["gid"] = followedGID
+			updates["status"] = string(types.TaskStatusDownloading)
+			updates["error_msg"] = "" // 清除可能的错误信息
 
-		if len(updates) > 0 {
-			if err := s.db.Model(task).Updates(updates).Error; err != nil {
-				log.Printf("Failed to update task %d: %v", task.ID, err)
+			// 尝试获取实际任务的信息
+			if followedStatus, ok := lookup(followedGID); ok && len(followedStatus.Files) > 0 {
+				// 更新为实际文件的路径和名称
+				updates["file_path"] = primaryFile(followedStatus.Files).Path
+				if task.Filename == "" || task.Filename == "[METADATA]Big+Buck+Bunny" {
+					updates["filename"] = primaryFile(followedStatus.Files).Path
+				}
+			}
+		} else {
+			// 普通下载任务完成
+			updates["status"] = string(types.TaskStatusCompleted)
+			now := time.Now()
+			updates["completed_at"] = &now
+			// 设置文件的完整路径
+			if len(status.Files) > 0 {
+				updates["file_path"] = primaryFile(status.Files).Path
+				if task.Filename == "" {
+					updates["filename"] = primaryFile(status.Files).Path
+				}
+			}
+		}
+	case "error", "removed":
+		updates["status"] = string(types.TaskStatusFailed)
+		if status.ErrorCode == downloader.ErrCodeChecksumMismatched {
+			// aria2 校验失败，与后台校验不通过一样标记为 corrupt，重试时删除损坏的文件重新下载
+			updates["status"] = string(types.TaskStatusCorrupt)
+			if len(status.Files) > 0 {
+				updates["file_path"] = primaryFile(status.Files).Path
 			}
 		}
+		// 由 applyRetryPolicy 按错误码决定是否自动重试
+		if status.Status == "error" {
+			updates["error_code"] = status.ErrorCode
+		} else {
+			updates["error_code"] = errCodeRemoved
+		}
+		if status.ErrorMessage != "" {
+			updates["error_msg"] = status.ErrorMessage
+			log.Printf("[TaskSync] ❌ 任务 %d 失败: %s, Aria2状态: %s, 错误: %s", task.ID, task.URL, status.Status, status.ErrorMessage)
+		} else if status.Status == "error" {
+			updates["error_msg"] = "下载失败，未知错误"
+			log.Printf("[TaskSync] ❌ 任务 %d 失败: %s, Aria2状态: %s, 原因: 未知错误", task.ID, task.URL, status.Status)
+		} else {
+			updates["error_msg"] = "任务已被移除"
+			log.Printf("[TaskSync] ❌ 任务 %d 被移除: %s, Aria2状态: %s", task.ID, task.URL, status.Status)
+		}
+	}
+
+	// 记录文件总大小，用于存储配额统计（magnet 元数据任务的大小不是实际文件大小）
+	if status.TotalLength > 0 && status.TotalLength != task.TotalLength && len(status.FollowedBy) == 0 {
+		updates["total_length"] = status.TotalLength
 	}
-}
\ No newline at end of file
+
+	return updates
+}
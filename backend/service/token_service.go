@@ -3,10 +3,15 @@ package service
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/matrix/mynest/backend/model"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
@@ -27,65 +32,260 @@ func (s *TokenService) GenerateToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// CreateToken 创建新的API token
-func (s *TokenService) CreateToken(ctx context.Context, name, description string) (*model.APIToken, error) {
+// TokenInput 创建或更新 Token 的参数，更新时为 nil 的字段保持不变
+type TokenInput struct {
+	Name         string   `json:"name" binding:"required"`
+	Description  string   `json:"description"`
+	Enabled      *bool    `json:"enabled"`       // 仅更新时有效，新建的 Token 总是启用
+	Scopes       []string `json:"scopes"`        // 新建时为空则使用 download:submit 和 tasks:read
+	ExpiresAt    *string  `json:"expires_at"`    // RFC3339 格式，空字符串表示不过期
+	Categories   []string `json:"categories"`    // 允许提交的分类，[] 表示不限制
+	PathTemplate *string  `json:"path_template"` // 提交的任务使用的路径模板，空字符串表示不限制
+	AllowedIPs   []string `json:"allowed_ips"`   // IP 或 CIDR，如 192.168.1.0/24，[] 表示不限制
+}
+
+// tokenScopes 所有可用的权限范围
+var tokenScopes = map[string]bool{
+	model.ScopeDownloadSubmit: true,
+	model.ScopeTasksRead:      true,
+	model.ScopeTasksWrite:     true,
+	model.ScopePluginsManage:  true,
+}
+
+// defaultTokenScopes 未指定权限范围时新建 Token 的权限，与旧版本 Token 相同
+var defaultTokenScopes = []string{model.ScopeDownloadSubmit, model.ScopeTasksRead}
+
+// tokenUpdates 校验参数并返回需要更新的字段
+func tokenUpdates(input TokenInput) (map[string]interface{}, error) {
+	updates := map[string]interface{}{
+		"name":        input.Name,
+		"description": input.Description,
+	}
+
+	if input.Scopes != nil {
+		if len(input.Scopes) == 0 {
+			return nil, fmt.Errorf("至少需要一个权限范围")
+		}
+		for _, scope := range input.Scopes {
+			if !tokenScopes[scope] {
+				return nil, fmt.Errorf("未知的权限范围: %s", scope)
+			}
+		}
+		updates["scopes"] = stringsJSON(input.Scopes)
+	}
+
+	if input.ExpiresAt != nil {
+		if *input.ExpiresAt == "" {
+			updates["expires_at"] = nil
+		} else {
+			expiresAt, err := time.Parse(time.RFC3339, *input.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("无效的过期时间 %q，需要 RFC3339 格式", *input.ExpiresAt)
+			}
+			updates["expires_at"] = expiresAt
+		}
+	}
+
+	if input.Categories != nil {
+		updates["categories"] = stringsJSON(input.Categories)
+	}
+
+	if input.PathTemplate != nil {
+		if *input.PathTemplate != "" {
+			if err := ValidatePathTemplate(*input.PathTemplate); err != nil {
+				return nil, err
+			}
+		}
+		updates["path_template"] = *input.PathTemplate
+	}
+
+	if input.AllowedIPs != nil {
+		for _, entry := range input.AllowedIPs {
+			if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+				return nil, fmt.Errorf("无效的 IP 或 CIDR: %s", entry)
+			}
+		}
+		updates["allowed_ips"] = stringsJSON(input.AllowedIPs)
+	}
+	return updates, nil
+}
+
+// tokenUpdateFields 返回更新 Token 时需要写入的字段，没有传 enabled 时保持原来的启用状态
+func tokenUpdateFields(input TokenInput) (map[string]interface{}, error) {
+	updates, err := tokenUpdates(input)
+	if err != nil {
+		return nil, err
+	}
+	if input.Enabled != nil {
+		updates["enabled"] = *input.Enabled
+	}
+	return updates, nil
+}
+
+// stringsJSON 编码字符串列表，空列表保存为 NULL
+func stringsJSON(list []string) interface{} {
+	if len(list) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(list)
+	return datatypes.JSON(data)
+}
+
+// jsonStrings 解码字符串列表
+func jsonStrings(data datatypes.JSON) []string {
+	var list []string
+	if len(data) > 0 {
+		json.Unmarshal(data, &list)
+	}
+	return list
+}
+
+// CreateToken 创建新的API token，归属于 ownerID 用户
+func (s *TokenService) CreateToken(ctx context.Context, ownerID uint, input TokenInput) (*model.APIToken, error) {
+	if input.Scopes == nil {
+		input.Scopes = defaultTokenScopes
+	}
+	updates, err := tokenUpdates(input)
+	if err != nil {
+		return nil, err
+	}
+
 	token, err := s.GenerateToken()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
 
 	apiToken := &model.APIToken{
-		Name:        name,
-		Token:       token,
-		Description: description,
-		Enabled:     true,
+		Prefix:    token[:model.TokenPrefixLength],
+		TokenHash: model.HashToken(token),
+		Enabled:   true,
+		OwnerID:   &ownerID,
 	}
 
-	if err := s.db.Create(apiToken).Error; err != nil {
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(apiToken).Error; err != nil {
+			return err
+		}
+		return tx.Model(apiToken).Updates(updates).Error
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to create token: %w", err)
 	}
 
-	return apiToken, nil
+	created, err := s.GetToken(ctx, apiToken.ID, 0)
+	if err != nil {
+		return nil, err
+	}
+	// 明文 Token 只在创建时返回这一次
+	created.Token = token
+	return created, nil
 }
 
-// ListTokens 列出所有token
-func (s *TokenService) ListTokens(ctx context.Context) ([]model.APIToken, error) {
+// ListTokens 列出 ownerID 用户的token，ownerID 为 0 时列出所有token
+func (s *TokenService) ListTokens(ctx context.Context, ownerID uint) ([]model.APIToken, error) {
 	var tokens []model.APIToken
-	if err := s.db.Order("created_at DESC").Find(&tokens).Error; err != nil {
+	if err := ownedBy(s.db, ownerID).Order("created_at DESC").Find(&tokens).Error; err != nil {
 		return nil, err
 	}
 	return tokens, nil
 }
 
 // GetToken 获取token详情
-func (s *TokenService) GetToken(ctx context.Context, id uint) (*model.APIToken, error) {
+func (s *TokenService) GetToken(ctx context.Context, id, ownerID uint) (*model.APIToken, error) {
 	var token model.APIToken
-	if err := s.db.First(&token, id).Error; err != nil {
+	if err := ownedBy(s.db, ownerID).First(&token, id).Error; err != nil {
 		return nil, err
 	}
 	return &token, nil
 }
 
 // UpdateToken 更新token
-func (s *TokenService) UpdateToken(ctx context.Context, id uint, name, description string, enabled bool) error {
-	updates := map[string]interface{}{
-		"name":        name,
-		"description": description,
-		"enabled":     enabled,
+func (s *TokenService) UpdateToken(ctx context.Context, id, ownerID uint, input TokenInput) error {
+	if _, err := s.GetToken(ctx, id, ownerID); err != nil {
+		return err
+	}
+
+	updates, err := tokenUpdateFields(input)
+	if err != nil {
+		return err
 	}
 	return s.db.Model(&model.APIToken{}).Where("id = ?", id).Updates(updates).Error
 }
 
 // DeleteToken 删除token
-func (s *TokenService) DeleteToken(ctx context.Context, id uint) error {
+func (s *TokenService) DeleteToken(ctx context.Context, id, ownerID uint) error {
+	if _, err := s.GetToken(ctx, id, ownerID); err != nil {
+		return err
+	}
 	return s.db.Delete(&model.APIToken{}, id).Error
 }
 
 // ValidateToken 验证token是否有效
+// 数据库只保存 Token 的前缀和哈希，先按前缀查找，再用常量时间比较哈希
 func (s *TokenService) ValidateToken(ctx context.Context, token string) (*model.APIToken, error) {
-	var apiToken model.APIToken
-	if err := s.db.Where("token = ? AND enabled = ?", token, true).First(&apiToken).Error; err != nil {
+	if len(token) <= model.TokenPrefixLength {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var candidates []model.APIToken
+	if err := s.db.Where("prefix = ? AND enabled = ?", token[:model.TokenPrefixLength], true).Find(&candidates).Error; err != nil {
 		return nil, err
 	}
-	return &apiToken, nil
-}
\ No newline at end of file
+	if matched := matchToken(candidates, token); matched != nil {
+		return matched, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// matchToken 返回哈希与 token 相同的候选 Token，没有时返回 nil
+func matchToken(candidates []model.APIToken, token string) *model.APIToken {
+	hash := []byte(model.HashToken(token))
+	for i := range candidates {
+		if subtle.ConstantTimeCompare(hash, []byte(candidates[i].TokenHash)) == 1 {
+			return &candidates[i]
+		}
+	}
+	return nil
+}
+
+// TokenExpired Token 是否已过期
+func TokenExpired(token *model.APIToken) bool {
+	return token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt)
+}
+
+// TokenHasScope Token 是否有指定的权限范围
+func TokenHasScope(token *model.APIToken, scope string) bool {
+	for _, s := range jsonStrings(token.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenAllowsIP 客户端 IP 是否在 Token 的允许列表中，未设置允许列表时不限制
+func TokenAllowsIP(token *model.APIToken, clientIP string) bool {
+	allowed := jsonStrings(token.AllowedIPs)
+	if len(allowed) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range allowed {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(entry); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenCategories Token 允许提交的分类，为空时不限制
+func TokenCategories(token *model.APIToken) []string {
+	return jsonStrings(token.Categories)
+}
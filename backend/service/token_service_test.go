@@ -0,0 +1,150 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix/mynest/backend/model"
+	"gorm.io/datatypes"
+)
+
+func TestMatchToken(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+	candidates := []model.APIToken{
+		{ID: 1, Prefix: secret[:model.TokenPrefixLength], TokenHash: model.HashToken("01234567ffffffff")},
+		{ID: 2, Prefix: secret[:model.TokenPrefixLength], TokenHash: model.HashToken(secret)},
+	}
+	tests := []struct {
+		token  string
+		wantID uint
+	}{
+		{secret, 2},
+		{"01234567ffffffff", 1},
+		{secret[:model.TokenPrefixLength] + "wrong-secret", 0}, // 前缀相同，密钥错误
+		{secret + "x", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		got := matchToken(candidates, tt.token)
+		if tt.wantID == 0 {
+			if got != nil {
+				t.Errorf("matchToken(%q) = token %d, want none", tt.token, got.ID)
+			}
+			continue
+		}
+		if got == nil || got.ID != tt.wantID {
+			t.Errorf("matchToken(%q) = %v, want token %d", tt.token, got, tt.wantID)
+		}
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		expiresAt *time.Time
+		want      bool
+	}{
+		{nil, false},
+		{&past, true},
+		{&future, false},
+	}
+	for _, tt := range tests {
+		if got := TokenExpired(&model.APIToken{ExpiresAt: tt.expiresAt}); got != tt.want {
+			t.Errorf("TokenExpired(%v) = %v, want %v", tt.expiresAt, got, tt.want)
+		}
+	}
+}
+
+func TestTokenHasScope(t *testing.T) {
+	token := &model.APIToken{Scopes: datatypes.JSON(`["download:submit","tasks:read"]`)}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{model.ScopeDownloadSubmit, true},
+		{model.ScopeTasksRead, true},
+		{model.ScopeTasksWrite, false},
+		{model.ScopePluginsManage, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := TokenHasScope(token, tt.scope); got != tt.want {
+			t.Errorf("TokenHasScope(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+	if TokenHasScope(&model.APIToken{}, model.ScopeTasksRead) {
+		t.Error("token without scopes has tasks:read")
+	}
+}
+
+func TestTokenAllowsIP(t *testing.T) {
+	token := &model.APIToken{AllowedIPs: datatypes.JSON(`["192.168.1.0/24","10.0.0.5","2001:db8::/32"]`)}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.20", true},
+		{"192.168.2.20", false},
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:192.168.1.20", true},
+		{"", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := TokenAllowsIP(token, tt.ip); got != tt.want {
+			t.Errorf("TokenAllowsIP(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if !TokenAllowsIP(&model.APIToken{}, "203.0.113.1") {
+		t.Error("token without allowlist rejects 203.0.113.1")
+	}
+}
+
+func TestTokenUpdatesValidation(t *testing.T) {
+	empty, badTime, badTemplate := "", "tomorrow", "../{filename}"
+	tests := []struct {
+		name  string
+		input TokenInput
+		valid bool
+	}{
+		{"defaults", TokenInput{Name: "a"}, true},
+		{"scopes", TokenInput{Name: "a", Scopes: []string{model.ScopeTasksRead}}, true},
+		{"no scopes", TokenInput{Name: "a", Scopes: []string{}}, false},
+		{"unknown scope", TokenInput{Name: "a", Scopes: []string{"admin"}}, false},
+		{"clear expiry", TokenInput{Name: "a", ExpiresAt: &empty}, true},
+		{"invalid expiry", TokenInput{Name: "a", ExpiresAt: &badTime}, false},
+		{"invalid path template", TokenInput{Name: "a", PathTemplate: &badTemplate}, false},
+		{"allowed IPs", TokenInput{Name: "a", AllowedIPs: []string{"10.0.0.1", "192.168.0.0/16"}}, true},
+		{"invalid IP", TokenInput{Name: "a", AllowedIPs: []string{"10.0.0.300"}}, false},
+	}
+	for _, tt := range tests {
+		if _, err := tokenUpdates(tt.input); (err == nil) != tt.valid {
+			t.Errorf("%s: tokenUpdates = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestTokenUpdateFieldsEnabled(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name    string
+		enabled *bool
+		want    interface{} // nil 表示不更新 enabled
+	}{
+		{"omitted", nil, nil}, // 没有传 enabled 时保持原状态
+		{"disable", &disabled, false},
+	}
+	for _, tt := range tests {
+		updates, err := tokenUpdateFields(TokenInput{Name: "a", Enabled: tt.enabled})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, ok := updates["enabled"]; got != tt.want || ok != (tt.want != nil) {
+			t.Errorf("%s: enabled = %v (set %v), want %v", tt.name, got, ok, tt.want)
+		}
+	}
+}
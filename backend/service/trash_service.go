@@ -0,0 +1,393 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matrix/mynest/backend/model"
+	"github.com/matrix/mynest/internal/types"
+	"gorm.io/gorm"
+)
+
+const (
+	// trashDirName 回收站目录名，位于下载根目录下
+	trashDirName = ".trash"
+	// trashPurgeInterval 清理过期回收站内容的间隔
+	trashPurgeInterval = time.Hour
+	// defaultTrashRetentionDays 未配置 trash_retention_days 时的保留天数
+	defaultTrashRetentionDays = 7
+)
+
+var (
+	ErrTrashNotFound = errors.New("回收站中没有该任务")
+	ErrTrashConflict = errors.New("原位置已存在同名文件，无法恢复")
+)
+
+// TrashedTask 回收站中的任务及其文件
+type TrashedTask struct {
+	*model.DownloadTask
+	Files     []model.TrashEntry `json:"files"`
+	ExpiresAt time.Time          `json:"expires_at"` // 超过保留时间后自动彻底删除
+}
+
+// TrashService 回收站：删除任务时任务记录只做软删除，选择删除文件时文件移到下载目录的 .trash 下
+// 每个任务的文件放在 .trash/<任务ID>-<删除时间>/ 中，保持原来的相对路径，trash_entries 记录原路径用于恢复；
+// 超过 trash_retention_days 天的任务和文件自动彻底删除，保留天数为 0 时不使用回收站，直接删除
+type TrashService struct {
+	db            *gorm.DB
+	configService *SystemConfigService
+	stopChan      chan struct{}
+}
+
+func NewTrashService(db *gorm.DB) *TrashService {
+	return &TrashService{
+		db:            db,
+		configService: NewSystemConfigService(db),
+		stopChan:      make(chan struct{}),
+	}
+}
+
+func (s *TrashService) Start() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	go func() {
+		s.purgeExpired()
+		for {
+			select {
+			case <-ticker.C:
+				s.purgeExpired()
+			case <-s.stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (s *TrashService) Stop() {
+	close(s.stopChan)
+}
+
+// retention 返回回收站的保留时间，为 0 时不使用回收站
+func (s *TrashService) retention(ctx context.Context) time.Duration {
+	days := float64(defaultTrashRetentionDays)
+	if value, _ := s.configService.GetConfig(ctx, "trash_retention_days"); value != "" {
+		if n, err := strconv.ParseFloat(value, 64); err == nil && n >= 0 {
+			days = n
+		} else {
+			log.Printf("[Trash] ⚠️  trash_retention_days 配置无效: %s，使用 %d 天", value, defaultTrashRetentionDays)
+		}
+	}
+	return time.Duration(days * float64(24*time.Hour))
+}
+
+// Delete 删除任务：文件移到回收站，任务记录软删除
+// 不使用回收站或没有配置下载目录时，文件和任务记录直接彻底删除
+func (s *TrashService) Delete(ctx context.Context, task *model.DownloadTask, files []string) error {
+	baseDir, _ := s.configService.GetConfig(ctx, "aria2_download_dir")
+	if s.retention(ctx) <= 0 || baseDir == "" {
+		for _, file := range files {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				log.Printf("[Trash] 警告：删除文件失败: %v", err)
+				continue
+			}
+			log.Printf("[Trash] ✅ 已删除文件: %s", file)
+			removeEmptyDirs(filepath.Dir(file), baseDir)
+		}
+		err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("task_id = ?", task.ID).Delete(&model.TaskSource{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(task).Error
+		})
+		if err != nil {
+			return fmt.Errorf("删除数据库记录失败: %w", err)
+		}
+		return nil
+	}
+
+	entries := make([]model.TrashEntry, 0, len(files))
+	if len(files) > 0 {
+		root := baseDir
+		for _, file := range files {
+			if !isWithinDir(baseDir, file) {
+				root = commonDir(files)
+				break
+			}
+		}
+		trashDir := filepath.Join(baseDir, trashDirName, fmt.Sprintf("%d-%d", task.ID, time.Now().UnixNano()))
+
+		for _, file := range files {
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				rel = filepath.Base(file)
+			}
+			target := filepath.Join(trashDir, rel)
+
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			if err := moveFile(file, target); err != nil {
+				log.Printf("[Trash] 警告：移动文件到回收站失败: %v", err)
+				continue
+			}
+			log.Printf("[Trash] 🗑️  已移到回收站: %s -> %s", file, target)
+			entries = append(entries, model.TrashEntry{
+				TaskID:       task.ID,
+				OriginalPath: file,
+				TrashPath:    target,
+				Size:         info.Size(),
+			})
+			removeEmptyDirs(filepath.Dir(file), baseDir)
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if len(entries) > 0 {
+			if err := tx.Create(&entries).Error; err != nil {
+				return fmt.Errorf("记录回收站文件失败: %w", err)
+			}
+		}
+		if err := tx.Delete(task).Error; err != nil {
+			return fmt.Errorf("删除数据库记录失败: %w", err)
+		}
+		return nil
+	})
+}
+
+// List 列出回收站中的任务，最近删除的在前；ownerID 不为 0 时只列出该用户的任务
+func (s *TrashService) List(ctx context.Context, ownerID uint) ([]TrashedTask, error) {
+	var tasks []*model.DownloadTask
+	if err := ownedBy(s.db.WithContext(ctx).Unscoped(), ownerID).Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC").Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	var entries []model.TrashEntry
+	if len(ids) > 0 {
+		if err := s.db.WithContext(ctx).Where("task_id IN ?", ids).Order("id ASC").Find(&entries).Error; err != nil {
+			return nil, err
+		}
+	}
+	filesByTask := make(map[uint][]model.TrashEntry)
+	for _, entry := range entries {
+		filesByTask[entry.TaskID] = append(filesByTask[entry.TaskID], entry)
+	}
+
+	retention := s.retention(ctx)
+	result := make([]TrashedTask, 0, len(tasks))
+	for _, task := range tasks {
+		files := filesByTask[task.ID]
+		if files == nil {
+			files = []model.TrashEntry{}
+		}
+		result = append(result, TrashedTask{
+			DownloadTask: task,
+			Files:        files,
+			ExpiresAt:    task.DeletedAt.Time.Add(retention),
+		})
+	}
+	return result, nil
+}
+
+// trashedTask 读取回收站中的任务，ownerID 不为 0 时只能读取该用户的任务
+func (s *TrashService) trashedTask(ctx context.Context, id, ownerID uint) (*model.DownloadTask, []model.TrashEntry, error) {
+	var task model.DownloadTask
+	if err := ownedBy(s.db.WithContext(ctx).Unscoped(), ownerID).
+		Where("id = ? AND deleted_at IS NOT NULL", id).First(&task).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrTrashNotFound
+		}
+		return nil, nil, err
+	}
+	var entries []model.TrashEntry
+	if err := s.db.WithContext(ctx).Where("task_id = ?", id).Find(&entries).Error; err != nil {
+		return nil, nil, err
+	}
+	return &task, entries, nil
+}
+
+// Restore 把文件移回原位置并恢复任务记录
+// 原位置已有文件时不做任何移动，返回 ErrTrashConflict；
+// 删除时还在下载引擎中的任务已被移除，恢复后标记为失败，需要手动重试
+func (s *TrashService) Restore(ctx context.Context, id, ownerID uint) (*model.DownloadTask, error) {
+	task, entries, err := s.trashedTask(ctx, id, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if _, err := os.Lstat(entry.OriginalPath); err == nil {
+			return nil, fmt.Errorf("%w: %s", ErrTrashConflict, entry.OriginalPath)
+		}
+		if _, err := os.Stat(entry.TrashPath); err != nil {
+			return nil, fmt.Errorf("回收站中的文件已不存在: %s", entry.TrashPath)
+		}
+	}
+
+	for _, entry := range entries {
+		if err := moveFile(entry.TrashPath, entry.OriginalPath); err != nil {
+			return nil, fmt.Errorf("恢复文件失败: %w", err)
+		}
+		log.Printf("[Trash] ♻️  已恢复文件: %s", entry.OriginalPath)
+		removeEmptyDirs(filepath.Dir(entry.TrashPath), trashRootOf(entry.TrashPath))
+	}
+
+	updates := map[string]interface{}{"deleted_at": nil}
+	switch types.TaskStatus(task.Status) {
+	case types.TaskStatusPending, types.TaskStatusDownloading, types.TaskStatusPaused, types.TaskStatusAwaitingSelection:
+		updates["status"] = string(types.TaskStatusFailed)
+		updates["gid"] = ""
+		updates["error_msg"] = "任务在下载过程中被删除，已从回收站恢复，需要重试"
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("task_id = ?", id).Delete(&model.TrashEntry{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(task).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("恢复任务记录失败: %w", err)
+	}
+
+	log.Printf("[Trash] ✅ 任务 %d 已从回收站恢复", id)
+	return task, nil
+}
+
+// Purge 彻底删除回收站中的任务及其文件
+func (s *TrashService) Purge(ctx context.Context, id, ownerID uint) error {
+	task, entries, err := s.trashedTask(ctx, id, ownerID)
+	if err != nil {
+		return err
+	}
+	return s.purge(ctx, task, entries)
+}
+
+func (s *TrashService) purge(ctx context.Context, task *model.DownloadTask, entries []model.TrashEntry) error {
+	for _, entry := range entries {
+		if err := os.Remove(entry.TrashPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除回收站文件失败: %w", err)
+		}
+		removeEmptyDirs(filepath.Dir(entry.TrashPath), trashRootOf(entry.TrashPath))
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("task_id = ?", task.ID).Delete(&model.TrashEntry{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("task_id = ?", task.ID).Delete(&model.TaskSource{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(task).Error
+	})
+	if err != nil {
+		return fmt.Errorf("删除数据库记录失败: %w", err)
+	}
+
+	log.Printf("[Trash] ✅ 任务 %d 已彻底删除", task.ID)
+	return nil
+}
+
+// purgeExpired 彻底删除超过保留时间的任务
+func (s *TrashService) purgeExpired() {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-s.retention(ctx))
+
+	var tasks []*model.DownloadTask
+	if err := s.db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).Find(&tasks).Error; err != nil {
+		log.Printf("[Trash] 查询过期任务失败: %v", err)
+		return
+	}
+
+	for _, task := range tasks {
+		var entries []model.TrashEntry
+		if err := s.db.Where("task_id = ?", task.ID).Find(&entries).Error; err != nil {
+			log.Printf("[Trash] 查询任务 %d 的回收站文件失败: %v", task.ID, err)
+			continue
+		}
+		if err := s.purge(ctx, task, entries); err != nil {
+			log.Printf("[Trash] 清理任务 %d 失败: %v", task.ID, err)
+		}
+	}
+	if len(tasks) > 0 {
+		log.Printf("[Trash] 🧹 已清理 %d 个过期任务", len(tasks))
+	}
+}
+
+// moveFile 移动文件并创建目标目录，跨文件系统时复制后删除源文件
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// removeEmptyDirs 从 dir 开始逐级向上删除空目录，到 stop 为止（不删除 stop）
+func removeEmptyDirs(dir, stop string) {
+	if stop == "" {
+		return
+	}
+	stop = filepath.Clean(stop)
+	for dir = filepath.Clean(dir); dir != stop && isWithinDir(stop, dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// trashRootOf 返回回收站文件所在的 .trash 目录
+func trashRootOf(path string) string {
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if filepath.Base(dir) == trashDirName {
+			return dir
+		}
+	}
+	return ""
+}
+
+// isWithinDir path 是否位于 dir 之下
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,393 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/matrix/mynest/backend/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 两步验证（RFC 6238 TOTP，HMAC-SHA1、6 位、30 秒），只用于网页登录，API Token 不受影响
+const (
+	totpIssuer            = "MyNest"
+	totpPeriod            = 30
+	totpDigits            = 6
+	totpSkew              = 1               // 允许前后各一个时间步的时钟误差
+	twoFactorChallengeTTL = 5 * time.Minute // 密码验证通过后输入验证码的时限
+	recoveryCodeCount     = 10
+	maxTwoFactorFailures  = 5 // 连续输错验证码的次数上限，超过后锁定一段时间
+	twoFactorLockout      = 5 * time.Minute
+)
+
+var (
+	ErrInvalidTwoFactorCode = errors.New("验证码错误")
+	ErrTwoFactorEnabled     = errors.New("已开启两步验证")
+	ErrTwoFactorNotEnabled  = errors.New("未开启两步验证")
+	ErrTwoFactorNotSetup    = errors.New("请先生成两步验证密钥")
+	ErrTwoFactorLocked      = errors.New("验证码错误次数过多，请稍后再试")
+	ErrInvalidChallenge     = errors.New("两步验证已过期，请重新登录")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// LoginResult 登录结果，用户开启了两步验证时只返回 ChallengeToken，需要再提交验证码才能登录
+type LoginResult struct {
+	*AuthTokens
+	ChallengeToken string
+}
+
+// TwoFactorSetup 生成的两步验证密钥，OTPAuthURL 可以生成二维码供验证器应用扫描
+type TwoFactorSetup struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+}
+
+// TwoFactorStatus 两步验证状态
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// twoFactorFailures 按用户记录连续输错验证码的次数
+type twoFactorFailures struct {
+	mu       sync.Mutex
+	failures map[uint]*twoFactorFailure
+}
+
+type twoFactorFailure struct {
+	count int
+	until time.Time
+}
+
+func (f *twoFactorFailures) locked(userID uint) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failure, ok := f.failures[userID]
+	return ok && failure.count >= maxTwoFactorFailures && time.Now().Before(failure.until)
+}
+
+func (f *twoFactorFailures) fail(userID uint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures == nil {
+		f.failures = make(map[uint]*twoFactorFailure)
+	}
+	failure, ok := f.failures[userID]
+	if !ok || time.Now().After(failure.until) {
+		failure = &twoFactorFailure{}
+		f.failures[userID] = failure
+	}
+	failure.count++
+	failure.until = time.Now().Add(twoFactorLockout)
+}
+
+func (f *twoFactorFailures) reset(userID uint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.failures, userID)
+}
+
+// GetTwoFactorStatus 获取用户的两步验证状态
+func (s *AuthService) GetTwoFactorStatus(ctx context.Context, userID uint) (*TwoFactorStatus, error) {
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &TwoFactorStatus{
+		Enabled:           user.TOTPEnabled,
+		RecoveryCodesLeft: len(jsonStrings(user.RecoveryCodes)),
+	}, nil
+}
+
+// SetupTwoFactor 生成新的两步验证密钥，用验证码确认（EnableTwoFactor）后才开启
+func (s *AuthService) SetupTwoFactor(ctx context.Context, userID uint) (*TwoFactorSetup, error) {
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(key)
+	if err := s.db.Model(user).Update("totp_secret", secret).Error; err != nil {
+		return nil, err
+	}
+
+	return &TwoFactorSetup{
+		Secret:     secret,
+		OTPAuthURL: totpURL(user.Username, secret),
+	}, nil
+}
+
+// EnableTwoFactor 用验证器应用生成的验证码确认密钥并开启两步验证，返回恢复码（只返回这一次）
+// 开启后撤销除当前会话以外的所有会话，其他设备需要用验证码重新登录
+func (s *AuthService) EnableTwoFactor(ctx context.Context, userID, currentSID uint, code string) ([]string, error) {
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			return ErrTwoFactorEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrTwoFactorNotSetup
+		}
+
+		step, ok := validateTOTP(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+
+		var hashes []string
+		codes, hashes, err = generateRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+			"recovery_codes": stringsJSON(hashes),
+		}).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, userID, currentSID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor 关闭两步验证，需要密码和验证码（或恢复码）
+func (s *AuthService) DisableTwoFactor(ctx context.Context, userID uint, password, code string) error {
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnabled
+	}
+	if !s.CheckPassword(user.PasswordHash, password) {
+		return errors.New("密码错误")
+	}
+	if err := s.checkTwoFactorCode(userID, code); err != nil {
+		return err
+	}
+	return s.db.Model(user).Updates(twoFactorResetUpdates()).Error
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码，之前的恢复码全部失效，需要密码和验证码（或恢复码）
+func (s *AuthService) RegenerateRecoveryCodes(ctx context.Context, userID uint, password, code string) ([]string, error) {
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.CheckPassword(user.PasswordHash, password) {
+		return nil, errors.New("密码错误")
+	}
+	if err := s.checkTwoFactorCode(userID, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&model.User{}).Where("id = ?", userID).Update("recovery_codes", stringsJSON(hashes)).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// LoginTwoFactor 登录第二步：校验验证码（或恢复码），通过后创建会话
+func (s *AuthService) LoginTwoFactor(ctx context.Context, challengeToken, code string, client ClientInfo) (*AuthTokens, error) {
+	userID, err := s.parseChallenge(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkTwoFactorCode(userID, code); err != nil {
+		return nil, err
+	}
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, ErrInvalidChallenge
+	}
+	return s.createSession(ctx, user, client)
+}
+
+// checkTwoFactorCode 校验验证码或恢复码，验证码不能重复使用，恢复码使用后失效
+func (s *AuthService) checkTwoFactorCode(userID uint, code string) error {
+	if s.twoFactorFailures.locked(userID) {
+		return ErrTwoFactorLocked
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if !user.TOTPEnabled {
+			return ErrTwoFactorNotEnabled
+		}
+
+		if step, ok := validateTOTP(user.TOTPSecret, code, time.Now()); ok && step > user.TOTPLastStep {
+			return tx.Model(user).Update("totp_last_step", step).Error
+		}
+
+		hashes := jsonStrings(user.RecoveryCodes)
+		hash := model.HashToken(normalizeRecoveryCode(code))
+		for i, h := range hashes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				log.Printf("[Auth] 用户 %s 使用了恢复码，剩余 %d 个", user.Username, len(hashes)-1)
+				remaining := append(hashes[:i:i], hashes[i+1:]...)
+				return tx.Model(user).Update("recovery_codes", stringsJSON(remaining)).Error
+			}
+		}
+		return ErrInvalidTwoFactorCode
+	})
+
+	switch {
+	case err == nil:
+		s.twoFactorFailures.reset(userID)
+	case errors.Is(err, ErrInvalidTwoFactorCode):
+		s.twoFactorFailures.fail(userID)
+	}
+	return err
+}
+
+// issueChallenge 密码验证通过后签发两步验证的临时令牌，不能用于访问接口
+func (s *AuthService) issueChallenge(user *model.User) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id": user.ID,
+		"purpose": "2fa",
+		"exp":     time.Now().Add(twoFactorChallengeTTL).Unix(),
+		"iat":     time.Now().Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(s.jwtSecret)
+}
+
+func (s *AuthService) parseChallenge(challengeToken string) (uint, error) {
+	token, err := jwt.Parse(challengeToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return 0, ErrInvalidChallenge
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != "2fa" {
+		return 0, ErrInvalidChallenge
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, ErrInvalidChallenge
+	}
+	return uint(userID), nil
+}
+
+// twoFactorResetUpdates 关闭两步验证时需要清除的字段
+func twoFactorResetUpdates() map[string]interface{} {
+	return map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+		"recovery_codes": gorm.Expr("NULL"),
+	}
+}
+
+func lockUser(tx *gorm.DB, userID uint) (*model.User, error) {
+	var user model.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// totpURL 返回验证器应用使用的 otpauth:// 地址
+func totpURL(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + query.Encode()
+}
+
+// totpCode 计算时间步 counter 的验证码（RFC 4226 HOTP）
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// validateTOTP 校验验证码，返回匹配的时间步
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	for delta := int64(-totpSkew); delta <= totpSkew; delta++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step+delta)), []byte(code)) == 1 {
+			return step + delta, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes 生成恢复码，返回明文（给用户）和哈希（保存到数据库）
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		bytes := make([]byte, 5)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(bytes)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, model.HashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode 恢复码不区分大小写，忽略空格和连字符
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix/mynest/backend/model"
+)
+
+// rfc6238Secret RFC 6238 附录 B 的 SHA-1 测试密钥 "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6238 的 8 位验证码取后 6 位
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	// 287082 是时间步 1（30-59 秒）的验证码
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		unix     int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfc6238Secret, "287082", 59, 1, true},
+		{"previous step", rfc6238Secret, "287082", 89, 1, true},
+		{"next step", rfc6238Secret, "287082", 29, 1, true},
+		{"two steps later", rfc6238Secret, "287082", 90, 0, false},
+		{"two steps earlier", rfc6238Secret, "081804", 1111111109 - 2*totpPeriod, 0, false},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", 59, 1, true},
+		{"wrong code", rfc6238Secret, "287083", 59, 0, false},
+		{"too short", rfc6238Secret, "28708", 59, 0, false},
+		{"too long", rfc6238Secret, "94287082", 59, 0, false},
+		{"empty", rfc6238Secret, "", 59, 0, false},
+		{"invalid secret", "not base32!", "287082", 59, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := validateTOTP(tt.secret, tt.code, time.Unix(tt.unix, 0))
+		if ok != tt.wantOK || step != tt.wantStep {
+			t.Errorf("%s: validateTOTP = %d, %v, want %d, %v", tt.name, step, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"abcde-12345", "abcde12345"},
+		{"ABCDE-12345", "abcde12345"},
+		{" abcde 12345 ", "abcde12345"},
+		{"ab-cd-e1 23-45", "abcde12345"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecoveryCode(tt.in); got != tt.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("code %q has unexpected format", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+		// 用户输入的恢复码规范化后与保存的哈希匹配
+		if model.HashToken(normalizeRecoveryCode(code)) != hashes[i] {
+			t.Errorf("hash of %q does not match", code)
+		}
+	}
+}
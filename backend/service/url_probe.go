@@ -0,0 +1,309 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix/mynest/internal/types"
+)
+
+// sniffBytes 识别文件类型读取的字节数，与 http.DetectContentType 一致
+const sniffBytes = 512
+
+// URLProbe 探测下载链接得到的信息
+type URLProbe struct {
+	FinalURL string // 跟随重定向后的地址
+	MimeType string // 不含参数的 Content-Type
+	Size     int64  // 文件大小，未知时为 0
+	Filename string // Content-Disposition 中的文件名
+	Head     []byte // 文件开头的字节，只有发送了 GET 请求时才有
+}
+
+// genericMimeTypes 不能说明文件类型的 Content-Type，需要按文件内容识别
+var genericMimeTypes = map[string]bool{
+	"":                           true,
+	"application/octet-stream":   true,
+	"binary/octet-stream":        true,
+	"application/force-download": true,
+	"application/x-download":     true,
+	"application/download":       true,
+	"application/unknown":        true,
+}
+
+// probeURL 探测 HTTP(S) 链接，使用与下载相同的请求头、Cookie 和代理
+// 先发送 HEAD 请求，被拒绝时（部分 CDN 签名链接只接受 GET）改用 Range: bytes=0-511 的 GET 请求；
+// HEAD 成功但既没有 Content-Disposition 文件名、Content-Type 也不能说明类型时，同样读取开头的字节用于识别
+func probeURL(ctx context.Context, rawURL string, opts types.DownloadOptions) (*URLProbe, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("不支持探测的链接: %s", rawURL)
+	}
+
+	// 最多跟随 10 次重定向（任务指定了代理时探测请求也走该代理）
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: requestTransport(opts),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			log.Printf("[Probe] 🔄 跟随重定向 (#%d): %s", len(via), req.URL.String())
+			return nil
+		},
+	}
+
+	probe, err := probeHead(ctx, client, rawURL, opts)
+	if err != nil {
+		log.Printf("[Probe] ⚠️  HEAD 请求失败，改用 GET 请求: %v", err)
+		return probeRangedGet(ctx, client, rawURL, opts)
+	}
+	if probe.Filename == "" && genericMimeTypes[probe.MimeType] {
+		if ranged, err := probeRangedGet(ctx, client, rawURL, opts); err == nil {
+			probe.Head = ranged.Head
+		}
+	}
+	return probe, nil
+}
+
+// newProbeRequest 创建探测请求，默认使用浏览器 UA（部分服务器会拒绝其他 UA），任务的请求头优先
+func newProbeRequest(ctx context.Context, method, rawURL string, opts types.DownloadOptions) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	req.Header.Set("Accept", "*/*")
+	setRequestHeaders(req, opts)
+	return req, nil
+}
+
+func probeHead(ctx context.Context, client *http.Client, rawURL string, opts types.DownloadOptions) (*URLProbe, error) {
+	req, err := newProbeRequest(ctx, http.MethodHead, rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	probe := probeFromResponse(resp)
+	if resp.ContentLength > 0 {
+		probe.Size = resp.ContentLength
+	}
+	return probe, nil
+}
+
+func probeRangedGet(ctx context.Context, client *http.Client, rawURL string, opts types.DownloadOptions) (*URLProbe, error) {
+	req, err := newProbeRequest(ctx, http.MethodGet, rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", sniffBytes-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	probe := probeFromResponse(resp)
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-511/12345
+		contentRange := resp.Header.Get("Content-Range")
+		if idx := strings.LastIndex(contentRange, "/"); idx != -1 {
+			probe.Size, _ = strconv.ParseInt(contentRange[idx+1:], 10, 64)
+		}
+	} else if resp.ContentLength > 0 {
+		probe.Size = resp.ContentLength
+	}
+
+	// 服务器不支持 Range 时返回完整内容，只读取开头部分
+	probe.Head, _ = io.ReadAll(io.LimitReader(resp.Body, sniffBytes))
+	return probe, nil
+}
+
+func probeFromResponse(resp *http.Response) *URLProbe {
+	probe := &URLProbe{
+		FinalURL: resp.Request.URL.String(),
+		Filename: contentDispositionFilename(resp.Header.Get("Content-Disposition")),
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		probe.MimeType = strings.ToLower(mediaType)
+	}
+	log.Printf("[Probe] ✅ %s: status=%d, content-type=%s, filename=%q, final-url=%s",
+		resp.Request.Method, resp.StatusCode, probe.MimeType, probe.Filename, probe.FinalURL)
+	return probe
+}
+
+// contentDispositionFilename 解析 Content-Disposition 中的文件名，filename*（RFC 5987）优先于 filename
+// 标准库无法解析时（未加引号的空格、ISO-8859-1 编码等）按参数逐个解析
+func contentDispositionFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	var name string
+	if _, params, err := mime.ParseMediaType(header); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	} else {
+		var plain, extended string
+		for _, param := range strings.Split(header, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "filename":
+				plain = strings.Trim(value, `"`)
+			case "filename*":
+				extended = decodeRFC5987(strings.Trim(value, `"`))
+			}
+		}
+		name = extended
+		if name == "" {
+			name = plain
+		}
+	}
+
+	// 只保留最后一级，路径分隔符之前的部分忽略
+	if idx := strings.LastIndexAny(name, `/\`); idx != -1 {
+		name = name[idx+1:]
+	}
+	return strings.TrimSpace(name)
+}
+
+// decodeRFC5987 解码 charset'lang'percent-encoded 格式的参数值，支持 UTF-8 和 ISO-8859-1
+func decodeRFC5987(value string) string {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	decoded, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return ""
+	}
+	if strings.EqualFold(parts[0], "iso-8859-1") || strings.EqualFold(parts[0], "latin1") {
+		runes := make([]rune, len(decoded))
+		for i := 0; i < len(decoded); i++ {
+			runes[i] = rune(decoded[i])
+		}
+		return string(runes)
+	}
+	return decoded
+}
+
+// magicSignatures http.DetectContentType 不能识别的常见下载文件格式
+var magicSignatures = []struct {
+	offset int
+	magic  []byte
+	ext    string
+}{
+	{0, []byte("7z\xBC\xAF\x27\x1C"), ".7z"},
+	{0, []byte("\xFD7zXZ\x00"), ".xz"},
+	{0, []byte("BZh"), ".bz2"},
+	{0, []byte("fLaC"), ".flac"},
+	{0, []byte("d8:announce"), ".torrent"},
+	{0, []byte("MZ"), ".exe"},
+	{4, []byte("ftypqt"), ".mov"},
+	{4, []byte("ftypM4A"), ".m4a"},
+	{257, []byte("ustar"), ".tar"},
+}
+
+// sniffExtension 按文件开头的字节识别扩展名，无法识别时返回空字符串
+func sniffExtension(head []byte) string {
+	for _, sig := range magicSignatures {
+		if len(head) >= sig.offset+len(sig.magic) && bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return sig.ext
+		}
+	}
+	// EBML 容器：Matroska 和 WebM 按 DocType 区分
+	if bytes.HasPrefix(head, []byte("\x1A\x45\xDF\xA3")) && bytes.Contains(head, []byte("matroska")) {
+		return ".mkv"
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if genericMimeTypes[contentType] {
+		return ""
+	}
+	return extensionForMimeType(contentType)
+}
+
+// commonMimeExtensions 常见 MIME 类型的扩展名，优先于系统 MIME 数据库
+// （Alpine 环境可能缺少 /etc/mime.types，系统数据库中一个类型也可能对应多个扩展名）
+var commonMimeExtensions = map[string]string{
+	"video/mp4":                    ".mp4",
+	"video/mpeg":                   ".mpeg",
+	"video/webm":                   ".webm",
+	"video/x-matroska":             ".mkv",
+	"video/quicktime":              ".mov",
+	"video/x-msvideo":              ".avi",
+	"video/avi":                    ".avi",
+	"video/x-flv":                  ".flv",
+	"audio/mpeg":                   ".mp3",
+	"audio/mp4":                    ".m4a",
+	"audio/wav":                    ".wav",
+	"audio/wave":                   ".wav",
+	"audio/ogg":                    ".ogg",
+	"audio/flac":                   ".flac",
+	"application/ogg":              ".ogg",
+	"image/jpeg":                   ".jpg",
+	"image/png":                    ".png",
+	"image/gif":                    ".gif",
+	"image/webp":                   ".webp",
+	"image/bmp":                    ".bmp",
+	"image/svg+xml":                ".svg",
+	"application/pdf":              ".pdf",
+	"application/zip":              ".zip",
+	"application/x-gzip":           ".gz",
+	"application/gzip":             ".gz",
+	"application/x-rar-compressed": ".rar",
+	"application/vnd.rar":          ".rar",
+	"application/x-7z-compressed":  ".7z",
+	"application/x-bittorrent":     ".torrent",
+	"application/epub+zip":         ".epub",
+	"application/json":             ".json",
+	"text/plain":                   ".txt",
+	"text/html":                    ".html",
+}
+
+// extensionForMimeType 返回 MIME 类型对应的扩展名（含点），未知时返回空字符串
+func extensionForMimeType(mimeType string) string {
+	if ext, ok := commonMimeExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// urlBasename 返回 URL 路径的最后一级（已解码），没有时返回空字符串
+func urlBasename(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
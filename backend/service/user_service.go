@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix/mynest/backend/model"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUserNotFound  = errors.New("用户不存在")
+	ErrUsernameTaken = errors.New("用户名已存在")
+	ErrInvalidRole   = errors.New("无效的角色，可选 admin、member、readonly")
+	ErrLastAdmin     = errors.New("至少需要保留一个管理员")
+)
+
+// UserInput 创建或更新用户的参数，更新时为空的字段保持不变
+type UserInput struct {
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+	Role             string `json:"role"`
+	DisableTwoFactor bool   `json:"disable_two_factor"` // 关闭用户的两步验证（用户丢失验证器和恢复码时由管理员重置）
+}
+
+// UserService 管理用户账号：管理员可以查看和管理所有任务、用户和系统配置，
+// 普通成员只能提交和管理自己的任务，只读用户只能查看任务
+type UserService struct {
+	db          *gorm.DB
+	authService *AuthService
+}
+
+func NewUserService(db *gorm.DB, authService *AuthService) *UserService {
+	return &UserService{db: db, authService: authService}
+}
+
+// ValidRole 是否为有效的角色
+func ValidRole(role string) bool {
+	switch role {
+	case model.RoleAdmin, model.RoleMember, model.RoleReadOnly:
+		return true
+	}
+	return false
+}
+
+// ownedBy 按所有者过滤（任务、API Token），ownerID 为 0 时不限制
+func ownedBy(db *gorm.DB, ownerID uint) *gorm.DB {
+	if ownerID == 0 {
+		return db
+	}
+	return db.Where("owner_id = ?", ownerID)
+}
+
+// ListUsers 列出所有用户
+func (s *UserService) ListUsers(ctx context.Context) ([]model.User, error) {
+	var users []model.User
+	if err := s.db.Order("id ASC").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// CreateUser 创建用户，未指定角色时为 member
+func (s *UserService) CreateUser(ctx context.Context, input UserInput) (*model.User, error) {
+	input.Username = strings.TrimSpace(input.Username)
+	if input.Username == "" {
+		return nil, fmt.Errorf("用户名不能为空")
+	}
+	if len(input.Password) < 6 {
+		return nil, fmt.Errorf("密码至少需要 6 位")
+	}
+	if input.Role == "" {
+		input.Role = model.RoleMember
+	}
+	if !ValidRole(input.Role) {
+		return nil, ErrInvalidRole
+	}
+
+	var count int64
+	if err := s.db.Model(&model.User{}).Where("username = ?", input.Username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrUsernameTaken
+	}
+
+	hashedPassword, err := s.authService.HashPassword(input.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	user := &model.User{
+		Username:     input.Username,
+		PasswordHash: hashedPassword,
+		Role:         input.Role,
+	}
+	if err := s.db.Create(user).Error; err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	return user, nil
+}
+
+// UpdateUser 修改用户名、密码、角色或关闭两步验证，不能取消最后一个管理员的管理员角色
+func (s *UserService) UpdateUser(ctx context.Context, id uint, input UserInput) (*model.User, error) {
+	user, err := s.getUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	if username := strings.TrimSpace(input.Username); username != "" && username != user.Username {
+		var count int64
+		if err := s.db.Model(&model.User{}).Where("username = ? AND id <> ?", username, id).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, ErrUsernameTaken
+		}
+		updates["username"] = username
+	}
+	if input.Password != "" {
+		if len(input.Password) < 6 {
+			return nil, fmt.Errorf("密码至少需要 6 位")
+		}
+		hashedPassword, err := s.authService.HashPassword(input.Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %w", err)
+		}
+		updates["password_hash"] = hashedPassword
+	}
+	if input.Role != "" && input.Role != user.Role {
+		if !ValidRole(input.Role) {
+			return nil, ErrInvalidRole
+		}
+		if user.IsAdmin() {
+			if err := s.ensureOtherAdmin(id); err != nil {
+				return nil, err
+			}
+		}
+		updates["role"] = input.Role
+	}
+	if input.DisableTwoFactor && user.TOTPEnabled {
+		for column, value := range twoFactorResetUpdates() {
+			updates[column] = value
+		}
+	}
+
+	if len(updates) > 0 {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(user).Updates(updates).Error; err != nil {
+				return err
+			}
+			// 管理员重置密码后，该用户的所有会话需要重新登录
+			if _, ok := updates["password_hash"]; ok {
+				return revokeSessions(tx, id, 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// DeleteUser 删除用户及其 API Token 和会话，用户的任务保留（之后只有管理员可见）
+func (s *UserService) DeleteUser(ctx context.Context, id uint) error {
+	user, err := s.getUser(id)
+	if err != nil {
+		return err
+	}
+	if user.IsAdmin() {
+		if err := s.ensureOtherAdmin(id); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("owner_id = ?", id).Delete(&model.APIToken{}).Error; err != nil {
+			return err
+		}
+		if err := revokeSessions(tx, id, 0); err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	})
+}
+
+func (s *UserService) getUser(id uint) (*model.User, error) {
+	var user model.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ensureOtherAdmin 除 id 以外还有其他管理员
+func (s *UserService) ensureOtherAdmin(id uint) error {
+	var count int64
+	if err := s.db.Model(&model.User{}).Where("role = ? AND id <> ?", model.RoleAdmin, id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 // MyNest Chrome Extension - Background Script
 
+import { getCookieHeader } from './cookies'
+
 interface Config {
   apiUrl: string
   apiToken: string
@@ -42,7 +44,7 @@ chrome.contextMenus.onClicked.addListener((info, tab) => {
     // 智能识别：优先下载媒体资源（图片/视频/音频），否则下载链接
     const url = info.srcUrl || info.linkUrl
     if (url) {
-      handleDownload(url)
+      handleDownload(url, info.pageUrl)
     }
   } else if (info.menuItemId === 'sniff-page-media') {
     // 嗅探页面媒体资源
@@ -57,7 +59,7 @@ chrome.contextMenus.onClicked.addListener((info, tab) => {
 
       if (urls.length > 0) {
         // 如果找到多个 URL，下载第一个
-        handleDownload(urls[0])
+        handleDownload(urls[0], info.pageUrl)
 
         if (urls.length > 1) {
           showNotification(
@@ -69,7 +71,7 @@ chrome.contextMenus.onClicked.addListener((info, tab) => {
       } else {
         // 尝试将整个文本作为 URL
         if (isValidUrl(selectedText)) {
-          handleDownload(selectedText)
+          handleDownload(selectedText, info.pageUrl)
         } else {
           showNotification(
             '未找到有效链接',
@@ -105,7 +107,8 @@ function extractUrls(text: string): string[] {
 }
 
 // 处理下载请求
-async function handleDownload(url: string): Promise<void> {
+// referer 为所在页面地址，部分站点（如抖音、B 站）会校验 Referer 和 User-Agent
+async function handleDownload(url: string, referer?: string): Promise<void> {
   try {
     // 验证 URL
     if (!url || !isValidUrl(url)) {
@@ -121,7 +124,8 @@ async function handleDownload(url: string): Promise<void> {
       return
     }
 
-    // 调用 MyNest API
+    // 调用 MyNest API，带上浏览器中该链接的 Cookie
+    const cookies = await getCookieHeader(url)
     const response = await fetch(`${config.apiUrl}/api/v1/download`, {
       method: 'POST',
       headers: {
@@ -131,7 +135,10 @@ async function handleDownload(url: string): Promise<void> {
       body: JSON.stringify({
         url: url,
         plugin_name: 'chrome-extension',
-        category: config.defaultCategory || 'browser'
+        category: config.defaultCategory || 'browser',
+        referer: referer,
+        user_agent: navigator.userAgent,
+        cookies: cookies
       })
     })
 
@@ -0,0 +1,12 @@
+// 读取浏览器中目标地址的 Cookie，拼成 Cookie 请求头格式（a=1; b=2）
+// 需要登录的下载链接（网盘、论坛附件等）由 MyNest 带上这些 Cookie 下载
+export async function getCookieHeader(url: string): Promise<string | undefined> {
+  try {
+    const cookies = await chrome.cookies.getAll({ url })
+    if (cookies.length === 0) return undefined
+    return cookies.map((cookie) => `${cookie.name}=${cookie.value}`).join('; ')
+  } catch (error) {
+    console.error('Failed to read cookies:', error)
+    return undefined
+  }
+}
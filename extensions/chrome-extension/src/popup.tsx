@@ -2,6 +2,7 @@ import React, { useEffect, useState } from 'react'
 import { createRoot } from 'react-dom/client'
 import './popup.css'
 import packageJson from '../package.json'
+import { getCookieHeader } from './cookies'
 
 interface Config {
   apiUrl: string
@@ -188,6 +189,12 @@ const Popup: React.FC = () => {
     })
   }
 
+  // 获取当前标签页地址，作为嗅探资源下载的 Referer
+  const getActiveTabUrl = () =>
+    new Promise<string | undefined>((resolve) => {
+      chrome.tabs.query({ active: true, currentWindow: true }, (tabs) => resolve(tabs[0]?.url))
+    })
+
   const handleSniffedResourceDownload = async (url: string) => {
     if (!config.apiUrl || !config.apiToken) {
       if (confirm('请先配置 API 地址和 Token，是否现在配置？')) {
@@ -198,6 +205,8 @@ const Popup: React.FC = () => {
 
     try {
       const baseUrl = config.apiUrl.trim().replace(/\/$/, '')
+      const referer = await getActiveTabUrl()
+      const cookies = await getCookieHeader(url)
       const response = await fetch(`${baseUrl}/api/v1/download`, {
         method: 'POST',
         headers: {
@@ -207,7 +216,10 @@ const Popup: React.FC = () => {
         body: JSON.stringify({
           url: url,
           plugin_name: 'chrome-extension',
-          category: config.defaultCategory || 'browser'
+          category: config.defaultCategory || 'browser',
+          referer: referer,
+          user_agent: navigator.userAgent,
+          cookies: cookies
         })
       })
 
@@ -384,6 +396,7 @@ const Popup: React.FC = () => {
 
     try {
       const baseUrl = config.apiUrl.trim().replace(/\/$/, '')
+      const cookies = url.startsWith('magnet:') ? undefined : await getCookieHeader(url)
       const response = await fetch(`${baseUrl}/api/v1/download`, {
         method: 'POST',
         headers: {
@@ -393,7 +406,8 @@ const Popup: React.FC = () => {
         body: JSON.stringify({
           url: url,
           plugin_name: 'chrome-extension',
-          category: config.defaultCategory || 'browser'
+          category: config.defaultCategory || 'browser',
+          cookies: cookies
         })
       })
 
@@ -7,7 +7,7 @@ import SystemConfig from './pages/SystemConfig'
 import SystemLogs from './pages/SystemLogs'
 import TokensPage from './pages/TokensPage'
 import LoginPage from './pages/LoginPage'
-import { authApi, User } from './lib/api'
+import { authApi, clearAuthTokens, User } from './lib/api'
 import { LogOut, Menu } from 'lucide-react'
 import { Button } from './components/ui/button'
 import { Sheet, SheetContent, SheetTrigger } from './components/ui/sheet'
@@ -160,7 +160,7 @@ function App() {
       setUser(response.data.user)
     } catch (error) {
       console.error('Auth check failed:', error)
-      localStorage.removeItem('auth_token')
+      clearAuthTokens()
     } finally {
       setLoading(false)
     }
@@ -170,8 +170,13 @@ function App() {
     checkAuth()
   }, [checkAuth])
 
-  const handleLogout = () => {
-    localStorage.removeItem('auth_token')
+  const handleLogout = async () => {
+    try {
+      await authApi.logout()
+    } catch (error) {
+      console.error('Logout failed:', error)
+    }
+    clearAuthTokens()
     setUser(null)
     window.location.href = '/login'
   }
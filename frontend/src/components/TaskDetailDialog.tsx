@@ -93,7 +93,9 @@ export default function TaskDetailDialog({
       downloading: 'bg-blue-100 text-blue-800',
       completed: 'bg-green-100 text-green-800',
       failed: 'bg-red-100 text-red-800',
+      corrupt: 'bg-red-100 text-red-800',
       paused: 'bg-gray-100 text-gray-800',
+      waiting_for_space: 'bg-orange-100 text-orange-800',
     }
     return colors[status] || 'bg-gray-100 text-gray-800'
   }
@@ -117,6 +119,8 @@ export default function TaskDetailDialog({
                 {task.status === 'downloading' ? '下载中' :
                  task.status === 'completed' ? '已归巢' :
                  task.status === 'failed' ? '失败' :
+                 task.status === 'corrupt' ? '校验失败' :
+                 task.status === 'waiting_for_space' ? '等待空间' :
                  task.status === 'paused' ? '已暂停' : '等待中'}
               </Badge>
             </div>
@@ -259,7 +263,7 @@ export default function TaskDetailDialog({
               继续下载
             </Button>
           )}
-          {task.status === 'failed' && (
+          {(task.status === 'failed' || task.status === 'corrupt') && (
             <Button
               onClick={() => {
                 onRetry(task.id)
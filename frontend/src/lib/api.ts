@@ -18,13 +18,58 @@ api.interceptors.request.use(
   }
 )
 
-// 响应拦截器：处理 401 错误
+// 保存登录或刷新后得到的令牌
+export const saveAuthTokens = (token: string, refreshToken?: string) => {
+  localStorage.setItem('auth_token', token)
+  if (refreshToken) {
+    localStorage.setItem('refresh_token', refreshToken)
+  }
+}
+
+export const clearAuthTokens = () => {
+  localStorage.removeItem('auth_token')
+  localStorage.removeItem('refresh_token')
+}
+
+// 同时有多个请求 401 时只刷新一次，刷新令牌每次使用后都会轮换
+let refreshing: Promise<string> | null = null
+
+const refreshAccessToken = () => {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem('refresh_token')
+    refreshing = (
+      refreshToken
+        ? axios
+            .post<{ token: string; refresh_token: string }>('/api/v1/auth/refresh', {
+              refresh_token: refreshToken,
+            })
+            .then((response) => {
+              saveAuthTokens(response.data.token, response.data.refresh_token)
+              return response.data.token
+            })
+        : Promise.reject(new Error('no refresh token'))
+    ).finally(() => {
+      refreshing = null
+    })
+  }
+  return refreshing
+}
+
+// 响应拦截器：访问令牌过期时用刷新令牌换新的并重试，刷新失败时跳转登录页
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
-    if (error.response?.status === 401) {
-      localStorage.removeItem('auth_token')
-      window.location.href = '/login'
+  async (error) => {
+    const config = error.config
+    if (error.response?.status === 401 && config && !config._retried && !config.url?.startsWith('/auth/login')) {
+      config._retried = true
+      try {
+        const token = await refreshAccessToken()
+        config.headers.Authorization = `Bearer ${token}`
+        return api(config)
+      } catch {
+        clearAuthTokens()
+        window.location.href = '/login'
+      }
     }
     return Promise.reject(error)
   }
@@ -118,9 +163,16 @@ export const pluginsApi = {
 export interface APIToken {
   id: number
   name: string
-  token: string
+  prefix: string
+  token?: string // 完整 Token，只在创建时返回
   description?: string
   enabled: boolean
+  owner_id?: number
+  scopes: string[]
+  expires_at?: string
+  categories?: string[]
+  path_template?: string
+  allowed_ips?: string[]
   last_used_at?: string
   created_at: string
   updated_at: string
@@ -146,16 +198,59 @@ export const tokensApi = {
 export interface User {
   id: number
   username: string
+  role: 'admin' | 'member' | 'readonly'
   is_admin: boolean
+  totp_enabled?: boolean
+}
+
+export interface Session {
+  id: number
+  user_id: number
+  user_agent: string
+  ip: string
+  last_seen_at: string
+  expires_at: string
+  created_at: string
+}
+
+export interface LoginResponse {
+  success: boolean
+  message?: string
+  token?: string
+  refresh_token?: string
+  expires_in?: number
+  two_factor_required?: boolean
+  challenge_token?: string
 }
 
 export const authApi = {
+  // 开启两步验证的用户返回 two_factor_required 和 challenge_token，需要再调用 loginTwoFactor
   login: (username: string, password: string) =>
-    api.post<{ success: boolean; message: string; token: string }>('/auth/login', {
+    api.post<LoginResponse>('/auth/login', {
       username,
       password,
     }),
+  loginTwoFactor: (challengeToken: string, code: string) =>
+    api.post<LoginResponse>('/auth/login/2fa', {
+      challenge_token: challengeToken,
+      code,
+    }),
+  logout: () => api.post<{ success: boolean; message: string }>('/auth/logout'),
+  logoutAll: () => api.post<{ success: boolean; message: string }>('/auth/logout-all'),
+  sessions: () =>
+    api.get<{ success: boolean; sessions: Session[]; current_session_id: number }>('/auth/sessions'),
+  revokeSession: (id: number) => api.delete<{ success: boolean; message: string }>(`/auth/sessions/${id}`),
   me: () => api.get<{ success: boolean; user: User }>('/auth/me'),
+  twoFactorStatus: () =>
+    api.get<{ success: boolean; two_factor: { enabled: boolean; recovery_codes_left: number } }>('/auth/2fa'),
+  setupTwoFactor: () =>
+    api.post<{ success: boolean; secret: string; otpauth_url: string }>('/auth/2fa/setup'),
+  enableTwoFactor: (code: string) =>
+    api.post<{ success: boolean; message: string; recovery_codes: string[] }>('/auth/2fa/enable', { code }),
+  disableTwoFactor: (password: string, code: string) =>
+    api.post<{ success: boolean; message: string }>('/auth/2fa/disable', { password, code }),
+  regenerateRecoveryCodes: (password: string, code: string) =>
+    api.post<{ success: boolean; message: string; recovery_codes: string[] }>('/auth/2fa/recovery-codes', { password, code }),
   changePassword: (oldPassword: string, newPassword: string) =>
     api.post<{ success: boolean; message: string }>('/auth/change-password', {
       old_password: oldPassword,
@@ -5,7 +5,7 @@ import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/com
 import { Input } from '@/components/ui/input'
 import { Label } from '@/components/ui/label'
 import { Button } from '@/components/ui/button'
-import { authApi } from '@/lib/api'
+import { authApi, saveAuthTokens, clearAuthTokens } from '@/lib/api'
 
 export default function LoginPage() {
   const navigate = useNavigate()
@@ -15,6 +15,9 @@ export default function LoginPage() {
     username: 'admin', // 默认填充 admin
     password: '',
   })
+  // 开启两步验证时，密码验证通过后输入验证码
+  const [challengeToken, setChallengeToken] = useState('')
+  const [code, setCode] = useState('')
 
   // 检查是否已登录
   useEffect(() => {
@@ -27,7 +30,7 @@ export default function LoginPage() {
           navigate('/', { replace: true })
         } catch (error) {
           // Token 无效，清除并继续显示登录页
-          localStorage.removeItem('auth_token')
+          clearAuthTokens()
         }
       }
       setChecking(false)
@@ -58,9 +61,12 @@ export default function LoginPage() {
     try {
       const response = await authApi.login(username, password)
 
-      if (response.data.success) {
+      if (response.data.success && response.data.two_factor_required && response.data.challenge_token) {
+        setChallengeToken(response.data.challenge_token)
+        setCode('')
+      } else if (response.data.success && response.data.token) {
         // 保存 token
-        localStorage.setItem('auth_token', response.data.token)
+        saveAuthTokens(response.data.token, response.data.refresh_token)
         toast.success('登录成功')
 
         // 跳转到首页
@@ -77,6 +83,38 @@ export default function LoginPage() {
     }
   }
 
+  const handleTwoFactorSubmit = async (e: React.FormEvent) => {
+    e.preventDefault()
+
+    if (!code.trim()) {
+      toast.error('请输入验证码')
+      return
+    }
+
+    setLoading(true)
+    try {
+      const response = await authApi.loginTwoFactor(challengeToken, code.trim())
+
+      if (response.data.success && response.data.token) {
+        saveAuthTokens(response.data.token, response.data.refresh_token)
+        toast.success('登录成功')
+        navigate('/')
+      } else {
+        toast.error('登录失败')
+      }
+    } catch (error: any) {
+      console.error('Two-factor login error:', error)
+      const errorMsg = error.response?.data?.error || '验证失败，请重试'
+      toast.error(errorMsg)
+      // 两步验证超时，需要重新输入密码
+      if (error.response?.status === 401 && errorMsg.includes('过期')) {
+        setChallengeToken('')
+      }
+    } finally {
+      setLoading(false)
+    }
+  }
+
   // 正在检查登录状态时显示加载
   if (checking) {
     return (
@@ -102,43 +140,79 @@ export default function LoginPage() {
             </CardDescription>
           </CardHeader>
           <CardContent>
-            <form onSubmit={handleSubmit} className="space-y-4">
-              <div className="space-y-2">
-                <Label htmlFor="username">用户名</Label>
-                <Input
-                  id="username"
-                  name="username"
-                  type="text"
-                  placeholder="admin"
-                  value={form.username}
-                  onChange={(e) => setForm({ ...form, username: e.target.value })}
+            {challengeToken ? (
+              <form onSubmit={handleTwoFactorSubmit} className="space-y-4">
+                <div className="space-y-2">
+                  <Label htmlFor="code">两步验证码</Label>
+                  <Input
+                    id="code"
+                    name="code"
+                    type="text"
+                    placeholder="验证器应用中的 6 位验证码或恢复码"
+                    value={code}
+                    onChange={(e) => setCode(e.target.value)}
+                    disabled={loading}
+                    autoComplete="one-time-code"
+                    autoFocus
+                  />
+                </div>
+
+                <Button
+                  type="submit"
+                  className="w-full"
+                  disabled={loading}
+                >
+                  {loading ? '验证中...' : '验证'}
+                </Button>
+                <Button
+                  type="button"
+                  variant="ghost"
+                  className="w-full"
                   disabled={loading}
-                  autoComplete="username"
-                />
-              </div>
-
-              <div className="space-y-2">
-                <Label htmlFor="password">密码</Label>
-                <Input
-                  id="password"
-                  name="password"
-                  type="password"
-                  placeholder="请输入密码"
-                  value={form.password}
-                  onChange={(e) => setForm({ ...form, password: e.target.value })}
+                  onClick={() => setChallengeToken('')}
+                >
+                  返回
+                </Button>
+              </form>
+            ) : (
+              <form onSubmit={handleSubmit} className="space-y-4">
+                <div className="space-y-2">
+                  <Label htmlFor="username">用户名</Label>
+                  <Input
+                    id="username"
+                    name="username"
+                    type="text"
+                    placeholder="admin"
+                    value={form.username}
+                    onChange={(e) => setForm({ ...form, username: e.target.value })}
+                    disabled={loading}
+                    autoComplete="username"
+                  />
+                </div>
+
+                <div className="space-y-2">
+                  <Label htmlFor="password">密码</Label>
+                  <Input
+                    id="password"
+                    name="password"
+                    type="password"
+                    placeholder="请输入密码"
+                    value={form.password}
+                    onChange={(e) => setForm({ ...form, password: e.target.value })}
+                    disabled={loading}
+                    autoComplete="current-password"
+                  />
+                </div>
+
+                <Button
+                  type="submit"
+                  className="w-full"
                   disabled={loading}
-                  autoComplete="current-password"
-                />
-              </div>
-
-              <Button
-                type="submit"
-                className="w-full"
-                disabled={loading}
-              >
-                {loading ? '登录中...' : '登录'}
-              </Button>
-            </form>
+                >
+                  {loading ? '登录中...' : '登录'}
+                </Button>
+              </form>
+            )}
 
             <div className="mt-6 text-sm text-muted-foreground text-center">
               <p className="mb-1">💡 首次启动时</p>
@@ -48,11 +48,15 @@ export default function TasksPage() {
 
   // 状态选项
   const statusOptions: Option[] = [
+    { value: 'queued', label: '排队中' },
     { value: 'pending', label: '等待中' },
     { value: 'downloading', label: '下载中' },
     { value: 'completed', label: '已归巢' },
     { value: 'failed', label: '失败' },
+    { value: 'corrupt', label: '校验失败' },
     { value: 'paused', label: '已暂停' },
+    { value: 'awaiting_selection', label: '待选择文件' },
+    { value: 'waiting_for_space', label: '等待空间' },
   ]
 
   // 来源插件选项
@@ -93,10 +97,10 @@ export default function TasksPage() {
     try {
       // 根据当前 tab 设置状态过滤
       const tabFilters = activeTab === 'in-progress'
-        ? ['pending', 'downloading', 'paused']
+        ? ['queued', 'pending', 'downloading', 'paused', 'awaiting_selection', 'waiting_for_space']
         : activeTab === 'completed'
         ? ['completed']
-        : ['failed']
+        : ['failed', 'corrupt']
 
       const params = {
         page: currentPage,
@@ -331,13 +335,18 @@ export default function TasksPage() {
       downloading: 'default',
       completed: 'default',
       failed: 'destructive',
+      corrupt: 'destructive',
     }
 
     const labels: Record<string, string> = {
+      queued: '排队中',
       pending: '等待中',
       downloading: '下载中',
       completed: '已归巢',
       failed: '失败',
+      corrupt: '校验失败',
+      awaiting_selection: '待选择文件',
+      waiting_for_space: '等待空间',
     }
 
     return (
@@ -8,7 +8,7 @@ import { Label } from '@/components/ui/label'
 import { Dialog, DialogContent, DialogDescription, DialogHeader, DialogTitle, DialogTrigger } from '@/components/ui/dialog'
 import { Switch } from '@/components/ui/switch'
 import { tokensApi, APIToken } from '@/lib/api'
-import { Plus, Copy, Trash2, Eye, EyeOff, Edit } from 'lucide-react'
+import { Plus, Copy, Trash2, Edit } from 'lucide-react'
 import { confirm } from '@/lib/confirm'
 import { copyToClipboard } from '@/lib/utils'
 
@@ -18,7 +18,8 @@ export default function TokensPage() {
   const [createDialogOpen, setCreateDialogOpen] = useState(false)
   const [editDialogOpen, setEditDialogOpen] = useState(false)
   const [selectedToken, setSelectedToken] = useState<APIToken | null>(null)
-  const [showTokens, setShowTokens] = useState<Record<number, boolean>>({})
+  // 新创建的 Token 明文，服务端只保存哈希，刷新页面后无法再次查看
+  const [newSecrets, setNewSecrets] = useState<Record<number, string>>({})
 
   // 创建表单
   const [createForm, setCreateForm] = useState({
@@ -59,9 +60,11 @@ export default function TokensPage() {
       const response = await tokensApi.create(createForm.name, createForm.description)
       toast.success('✅ Token 创建成功！')
 
-      // 显示新创建的 token
+      // 显示新创建的 token，只有这一次
       const newToken = response.data.token
-      setShowTokens({ ...showTokens, [newToken.id]: true })
+      if (newToken.token) {
+        setNewSecrets({ ...newSecrets, [newToken.id]: newToken.token })
+      }
 
       setCreateDialogOpen(false)
       setCreateForm({ name: '', description: '' })
@@ -138,20 +141,12 @@ export default function TokensPage() {
     }
   }
 
-  const toggleTokenVisibility = (id: number) => {
-    setShowTokens({
-      ...showTokens,
-      [id]: !showTokens[id],
-    })
-  }
-
   const formatDate = (dateString: string) => {
     return new Date(dateString).toLocaleString('zh-CN')
   }
 
-  const maskToken = (token: string) => {
-    if (token.length <= 12) return '••••••••'
-    return `${token.substring(0, 8)}${'•'.repeat(token.length - 12)}${token.substring(token.length - 4)}`
+  const maskToken = (prefix: string) => {
+    return `${prefix}${'•'.repeat(24)}`
   }
 
   if (loading) {
@@ -278,32 +273,23 @@ export default function TokensPage() {
 
                   <div className="bg-muted rounded-md p-3 space-y-2">
                     <div className="flex items-center justify-between">
-                      <code className="text-sm font-mono">
-                        {showTokens[token.id] ? token.token : maskToken(token.token)}
+                      <code className="text-sm font-mono break-all">
+                        {newSecrets[token.id] ?? maskToken(token.prefix)}
                       </code>
-                      <div className="flex gap-1">
-                        <Button
-                          size="sm"
-                          variant="ghost"
-                          onClick={() => toggleTokenVisibility(token.id)}
-                        >
-                          {showTokens[token.id] ? (
-                            <EyeOff className="w-4 h-4" />
-                          ) : (
-                            <Eye className="w-4 h-4" />
-                          )}
-                        </Button>
+                      {newSecrets[token.id] && (
                         <Button
                           size="sm"
                           variant="ghost"
-                          onClick={() => handleCopyToken(token.token)}
+                          onClick={() => handleCopyToken(newSecrets[token.id])}
                         >
                           <Copy className="w-4 h-4" />
                         </Button>
-                      </div>
+                      )}
                     </div>
                     <p className="text-xs text-muted-foreground">
-                      ⚠️ 请妥善保管此 Token，不要分享给他人
+                      {newSecrets[token.id]
+                        ? '⚠️ Token 只显示这一次，请立即复制并妥善保管，离开页面后无法再次查看'
+                        : '⚠️ 服务端只保存 Token 的哈希，无法再次查看完整 Token；遗失后请删除并重新创建'}
                     </p>
                   </div>
                 </div>
@@ -17,13 +17,82 @@ const (
 	TaskStatusCompleted   TaskStatus = "completed"
 	TaskStatusFailed      TaskStatus = "failed"
 	TaskStatusPaused      TaskStatus = "paused"
+	// TaskStatusQueued 在 MyNest 队列中等待调度，尚未提交给下载引擎
+	TaskStatusQueued TaskStatus = "queued"
+	// TaskStatusAwaitingSelection BT 元数据已就绪，等待选择要下载的文件
+	TaskStatusAwaitingSelection TaskStatus = "awaiting_selection"
+	// TaskStatusCorrupt 下载完成但文件校验值与期望不符
+	TaskStatusCorrupt TaskStatus = "corrupt"
+	// TaskStatusWaitingForSpace 磁盘剩余空间或存储配额不足，空间足够后重新排队
+	TaskStatusWaitingForSpace TaskStatus = "waiting_for_space"
 )
 
 type DownloadRequest struct {
-	URL        string `json:"url" binding:"required"`
-	Filename   string `json:"filename"`
-	PluginName string `json:"plugin_name"`
-	Category   string `json:"category"`
+	URL           string            `json:"url" binding:"required"`
+	Filename      string            `json:"filename"`
+	PluginName    string            `json:"plugin_name"`
+	Category      string            `json:"category"`
+	FileSelection *FileSelection    `json:"file_selection,omitempty"` // BT/magnet 文件选择，为空时下载全部文件
+	Queue         string            `json:"queue"`                    // 队列名称，为空时使用 default 队列
+	Priority      int               `json:"priority"`                 // 队列内优先级，数值越大越先放行
+	StartAt       *time.Time        `json:"start_at,omitempty"`       // 最早开始时间（RFC3339）
+	At            string            `json:"at,omitempty"`             // 开始时间，按服务器本地时间解析（23:30、2006-01-02T15:04 或 RFC3339），优先于 start_at
+	Window        string            `json:"window,omitempty"`         // 下载时间窗口，如 01:00-07:00（服务器本地时间）
+	OnDuplicate   string            `json:"on_duplicate,omitempty"`   // 重复任务策略 reject/link/allow，为空时使用系统配置
+	Checksum      string            `json:"checksum,omitempty"`       // 期望的校验值，如 sha256=<hex>，支持 md5/sha1/sha256
+	ChecksumURL   string            `json:"checksum_url,omitempty"`   // 校验文件地址（如 SHA256SUMS），按文件名查找校验值
+	Metadata      map[string]string `json:"metadata,omitempty"`       // 插件提供的元数据，如 tg_chat，可在路径模板中使用
+	User          string            `json:"-"`                        // 提交任务的用户或 API Token 名称，由接口层填充
+	OwnerID       uint              `json:"-"`                        // 提交任务的用户 ID（使用 API Token 时为 Token 的所有者），由接口层填充
+	PathTemplate  string            `json:"-"`                        // API Token 限定的路径模板，优先于下载规则和系统配置
+	DownloadOptions
+}
+
+// DownloadOptions 单个任务的请求选项，随任务保存并在重试时复用，未设置的字段使用默认值
+type DownloadOptions struct {
+	Headers        map[string]string `json:"headers,omitempty"`
+	Cookies        string            `json:"cookies,omitempty"` // Cookie 请求头格式，如 a=1; b=2
+	Referer        string            `json:"referer,omitempty"`
+	UserAgent      string            `json:"user_agent,omitempty"`
+	Proxy          string            `json:"proxy,omitempty"`           // 如 http://127.0.0.1:7890
+	MaxConnections int               `json:"max_connections,omitempty"` // 每个服务器的最大连接数（1-16）
+	Split          int               `json:"split,omitempty"`           // 分段数
+}
+
+// IsZero 判断是否未设置任何选项
+func (o DownloadOptions) IsZero() bool {
+	return len(o.Headers) == 0 && o.Cookies == "" && o.Referer == "" && o.UserAgent == "" &&
+		o.Proxy == "" && o.MaxConnections == 0 && o.Split == 0
+}
+
+// FileSelection BT/magnet 文件选择规则
+// Manual 为 true 时元数据就绪后进入 awaiting_selection 等待手动选择，否则按规则自动选择
+type FileSelection struct {
+	Manual           bool     `json:"manual,omitempty"`
+	LargestVideoOnly bool     `json:"largest_video_only,omitempty"` // 只下载最大的视频文件
+	Exclude          []string `json:"exclude,omitempty"`            // 通配符（如 *.txt）或路径关键字（如 sample），不区分大小写
+}
+
+// UploadRequest 上传种子/metalink 文件时的表单字段，文件本身在 file 字段中
+type UploadRequest struct {
+	Filename   string `form:"filename"`
+	PluginName string `form:"plugin_name"`
+	Category   string `form:"category"`
+	// FileSelection JSON 格式的 FileSelection，仅对种子有效
+	FileSelection string    `form:"file_selection"`
+	Queue         string    `form:"queue"`
+	Priority      int       `form:"priority"`
+	StartAt       time.Time `form:"start_at" time_format:"2006-01-02T15:04:05Z07:00"`
+	At            string    `form:"at"` // 同 DownloadRequest.At
+	Window        string    `form:"window"`
+	OnDuplicate   string    `form:"on_duplicate"`
+	// Metadata JSON 格式的插件元数据，如 {"tg_chat": "..."}
+	Metadata string `form:"metadata"`
+	// Options JSON 格式的 DownloadOptions（headers、cookies、referer 等），用于种子的 Web 种子和 metalink 中的 HTTP 地址
+	Options      string `form:"options"`
+	User         string `form:"-"`
+	OwnerID      uint   `form:"-"`
+	PathTemplate string `form:"-"`
 }
 
 type DownloadTask struct {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 )
 
@@ -18,6 +19,68 @@ type TelegramDownloadRequest struct {
 
 	// Category 下载分类，用于文件组织
 	Category string `json:"category"`
+
+	// At 定时开始时间（23:30、2006-01-02T15:04 或 RFC3339），由核心服务按服务器本地时间解析，为空时立即开始
+	At string `json:"at,omitempty"`
+
+	// Window 每日下载时间窗口，如 "01:00-07:00"
+	Window string `json:"window,omitempty"`
+
+	// Metadata 消息来源信息（tg_chat、tg_sender 等），可在路径模板中使用
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// DownloadSchedule 从消息中解析出的定时下载设置
+type DownloadSchedule struct {
+	// At 定时开始时间，原样交给核心服务解析，与时间窗口使用同一时区
+	At string
+
+	// Window 每日下载时间窗口
+	Window string
+}
+
+// SubmitResult 核心服务对提交请求的响应
+type SubmitResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	Task    struct {
+		ID uint `json:"id"`
+	} `json:"task"`
+
+	// DuplicateOf 与之重复的已有任务 ID，为 0 表示没有重复
+	DuplicateOf uint `json:"duplicate_of"`
+}
+
+// Linked 是否直接复用了已有任务（未创建新任务）
+func (r *SubmitResult) Linked() bool {
+	return r.DuplicateOf != 0 && r.Task.ID == r.DuplicateOf
+}
+
+// describe 返回提交成功后回复给用户的消息
+func (r *SubmitResult) describe() string {
+	switch {
+	case r.Linked():
+		return fmt.Sprintf("♻️ 已存在相同任务 #%d，未重复添加", r.DuplicateOf)
+	case r.DuplicateOf != 0:
+		return fmt.Sprintf("✅ 已添加到下载队列（与任务 #%d 重复）", r.DuplicateOf)
+	}
+	return "✅ 已添加到下载队列"
+}
+
+// readSubmitResult 解析核心服务的响应，非 200 时返回服务端的错误信息
+func readSubmitResult(resp *http.Response) (*SubmitResult, error) {
+	var result SubmitResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if result.Error != "" {
+			return nil, fmt.Errorf("%s", result.Error)
+		}
+		return nil, fmt.Errorf("download service returned status %d", resp.StatusCode)
+	}
+	return &result, nil
 }
 
 // DownloadClient 下载客户端
@@ -42,34 +105,85 @@ func NewDownloadClient(coreAPIURL string) *DownloadClient {
 //   - url: 要下载的文件 URL
 //   - pluginName: 插件名称
 //   - category: 下载分类
-// 返回: 如果提交成功返回 nil，否则返回错误
-func (c *DownloadClient) SubmitDownload(url, pluginName, category string) error {
+//   - schedule: 定时下载设置
+//   - metadata: 消息来源信息
+// 返回: 核心服务的响应，提交失败时返回错误
+func (c *DownloadClient) SubmitDownload(url, pluginName, category string, schedule DownloadSchedule, metadata map[string]string) (*SubmitResult, error) {
 	// 构造下载请求
 	req := TelegramDownloadRequest{
 		URL:        url,
 		PluginName: pluginName,
 		Category:   category,
+		At:         schedule.At,
+		Window:     schedule.Window,
+		Metadata:   metadata,
 	}
 
 	// 序列化请求为 JSON
 	jsonData, err := json.Marshal(req)
 	if err != nil {
-		return fmt.Errorf("failed to marshal download request: %w", err)
+		return nil, fmt.Errorf("failed to marshal download request: %w", err)
 	}
 
 	// 发送 HTTP POST 请求到核心服务
 	resp, err := http.Post(c.coreAPIURL+"/download", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to send download request: %w", err)
+		return nil, fmt.Errorf("failed to send download request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// 检查响应状态码
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download service returned status %d", resp.StatusCode)
+	// 检查响应状态码，重复任务被拒绝时返回服务端的说明
+	return readSubmitResult(resp)
+}
+
+// SubmitFile 上传种子/metalink 文件到核心服务
+// 参数:
+//   - filename: 文件名，核心服务根据文件内容判断文件类型
+//   - data: 文件内容
+//   - pluginName: 插件名称
+//   - category: 下载分类
+//   - schedule: 定时下载设置
+//   - metadata: 消息来源信息
+// 返回: 核心服务的响应，提交失败时返回错误
+func (c *DownloadClient) SubmitFile(filename string, data []byte, pluginName, category string, schedule DownloadSchedule, metadata map[string]string) (*SubmitResult, error) {
+	// 构造 multipart 表单
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("plugin_name", pluginName)
+	writer.WriteField("category", category)
+	if schedule.At != "" {
+		writer.WriteField("at", schedule.At)
+	}
+	if schedule.Window != "" {
+		writer.WriteField("window", schedule.Window)
+	}
+	if len(metadata) > 0 {
+		encoded, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+		writer.WriteField("metadata", string(encoded))
+	}
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form file: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write form file: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close multipart writer: %w", err)
 	}
 
-	return nil
+	// 发送 HTTP POST 请求到核心服务
+	resp, err := http.Post(c.coreAPIURL+"/download/file", writer.FormDataContentType(), &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return readSubmitResult(resp)
 }
 
 // 全局下载客户端实例（向后兼容旧代码）
@@ -77,12 +191,20 @@ var globalDownloadClient *DownloadClient
 
 // submitTelegramDownload 向后兼容的下载提交函数
 // 这个函数保持与原有代码的兼容性
-func submitTelegramDownload(coreAPI, url string) error {
+func submitTelegramDownload(coreAPI, url string, schedule DownloadSchedule, metadata map[string]string) (*SubmitResult, error) {
 	// 如果全局客户端未初始化，创建一个
 	if globalDownloadClient == nil {
 		globalDownloadClient = NewDownloadClient(coreAPI)
 	}
 
 	// 提交下载任务，使用固定的插件名称和分类
-	return globalDownloadClient.SubmitDownload(url, "telegram-bot", "telegram")
-}
\ No newline at end of file
+	return globalDownloadClient.SubmitDownload(url, "telegram-bot", "telegram", schedule, metadata)
+}
+// submitTelegramFile 上传种子/metalink 文件，使用与链接下载相同的插件名称和分类
+func submitTelegramFile(coreAPI, filename string, data []byte, schedule DownloadSchedule, metadata map[string]string) (*SubmitResult, error) {
+	if globalDownloadClient == nil {
+		globalDownloadClient = NewDownloadClient(coreAPI)
+	}
+
+	return globalDownloadClient.SubmitFile(filename, data, "telegram-bot", "telegram", schedule, metadata)
+}
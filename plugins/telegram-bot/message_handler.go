@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -57,6 +62,17 @@ func (h *MessageHandler) HandleMessage(update tgbotapi.Update) {
 		return
 	}
 
+	// 解析 at=/window= 定时参数
+	schedule := parseDownloadSchedule(update.Message.Text + " " + update.Message.Caption)
+
+	metadata := messageMetadata(update.Message)
+
+	// 种子/metalink 文档直接上传到核心服务
+	if doc := update.Message.Document; doc != nil && isSourceDocument(doc.FileName) {
+		h.handleSourceDocument(update.Message.Chat.ID, doc, schedule, metadata)
+		return
+	}
+
 	// 提取消息中的所有可下载链接
 	urls := h.extractAllURLs(update.Message)
 
@@ -71,14 +87,143 @@ func (h *MessageHandler) HandleMessage(update tgbotapi.Update) {
 
 	// 逐个提交下载请求
 	for _, url := range urls {
-		if err := submitTelegramDownload(h.config.CoreAPI, url); err != nil {
+		if result, err := submitTelegramDownload(h.config.CoreAPI, url, schedule, metadata); err != nil {
 			// 下载提交失败，通知用户具体错误
 			h.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("❌ 下载失败: %v", err)))
 		} else {
-			// 下载提交成功
-			h.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "✅ 已添加到下载队列"))
+			// 下载提交成功，重复任务会提示已有任务
+			h.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, result.describe()+schedule.describe()))
+		}
+	}
+}
+
+// messageMetadata 消息来源信息，核心服务的路径模板中可用 {tg_chat}、{tg_sender} 等变量
+// 私聊没有标题时使用对方的用户名
+func messageMetadata(msg *tgbotapi.Message) map[string]string {
+	metadata := map[string]string{
+		"tg_chat_id": strconv.FormatInt(msg.Chat.ID, 10),
+	}
+
+	chat := msg.Chat.Title
+	if chat == "" {
+		chat = msg.Chat.UserName
+	}
+	if chat != "" {
+		metadata["tg_chat"] = chat
+	}
+
+	if msg.From != nil {
+		sender := msg.From.UserName
+		if sender == "" {
+			sender = strings.TrimSpace(msg.From.FirstName + " " + msg.From.LastName)
+		}
+		if sender != "" {
+			metadata["tg_sender"] = sender
+		}
+	}
+	return metadata
+}
+
+// maxSourceDocumentSize 种子/metalink 文档的大小上限，与核心服务一致
+const maxSourceDocumentSize = 10 << 20
+
+// isSourceDocument 判断文档是否为种子或 metalink 文件
+func isSourceDocument(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".torrent", ".metalink", ".meta4":
+		return true
+	}
+	return false
+}
+
+// handleSourceDocument 下载 Telegram 中的种子/metalink 文档并上传到核心服务
+func (h *MessageHandler) handleSourceDocument(chatID int64, doc *tgbotapi.Document, schedule DownloadSchedule, metadata map[string]string) {
+	log.Printf("Found source document: %s, file ID: %s, size: %d bytes", doc.FileName, doc.FileID, doc.FileSize)
+
+	if doc.FileSize > maxSourceDocumentSize {
+		h.bot.Send(tgbotapi.NewMessage(chatID, "❌ 文件过大"))
+		return
+	}
+
+	data, err := h.downloadTelegramFile(doc.FileID)
+	if err != nil {
+		log.Printf("Failed to download document %s: %v", doc.FileName, err)
+		h.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ 获取文件失败: %v", err)))
+		return
+	}
+
+	result, err := submitTelegramFile(h.config.CoreAPI, doc.FileName, data, schedule, metadata)
+	if err != nil {
+		h.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ 下载失败: %v", err)))
+		return
+	}
+
+	h.bot.Send(tgbotapi.NewMessage(chatID, result.describe()+schedule.describe()))
+}
+
+// 定时参数的格式，不符合格式的 at=/window= 视为普通文本（如链接说明中的 at=home），不影响提交
+var (
+	startAtPattern = regexp.MustCompile(`^(\d{1,2}:\d{2}|\d{4}-\d{2}-\d{2}T\d{2}:\d{2}(:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2}))?)$`)
+	windowPattern  = regexp.MustCompile(`^\d{1,2}:\d{2}-\d{1,2}:\d{2}$`)
+)
+
+// parseDownloadSchedule 从消息文本中解析定时参数
+// 支持 at=23:30（今天该时刻，已过则为明天）、at=2024-06-01T23:30、at=<RFC3339> 以及 window=01:00-07:00
+// 开始时间和时间窗口都由核心服务按服务器本地时间解析
+func parseDownloadSchedule(text string) DownloadSchedule {
+	var schedule DownloadSchedule
+	for _, field := range strings.Fields(text) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "at":
+			if startAtPattern.MatchString(value) {
+				schedule.At = value
+			}
+		case "window":
+			if windowPattern.MatchString(value) {
+				schedule.Window = value
+			}
 		}
 	}
+	return schedule
+}
+
+// describe 返回附加在回复消息后的定时说明
+func (s DownloadSchedule) describe() string {
+	var parts []string
+	if s.At != "" {
+		parts = append(parts, "开始时间 "+s.At)
+	}
+	if s.Window != "" {
+		parts = append(parts, "时间窗口 "+s.Window)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "（" + strings.Join(parts, "，") + "）"
+}
+
+// downloadTelegramFile 通过 Bot API 下载文件内容
+func (h *MessageHandler) downloadTelegramFile(fileID string) ([]byte, error) {
+	file, err := h.bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	resp, err := http.Get(file.Link(h.config.BotToken))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("telegram returned status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxSourceDocumentSize))
 }
 
 // logMessageDebugInfo 记录消息调试信息